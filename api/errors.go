@@ -31,8 +31,10 @@ var (
 	ErrIDTokenNotFound      = newErrorMessage(http.StatusForbidden, 4301, "no id_token field in oauth2 token")
 	ErrInvalidState         = newErrorMessage(http.StatusForbidden, 4302, "invalid state parameter")
 	ErrFailedVerification   = newErrorMessage(http.StatusForbidden, 4303, "failed to verify ID Token")
+	ErrPermissionDenied     = newErrorMessage(http.StatusForbidden, 4304, "permission denied")
 	ErrResourceNotFound     = newErrorMessage(http.StatusNotFound, 4401, "requested resource not found")
 	ErrResourceAlreadyExist = newErrorMessage(http.StatusConflict, 4501, "resource you requested already exist")
+	ErrTooManyRequests      = newErrorMessage(http.StatusTooManyRequests, 4601, "too many requests")
 
 	ErrInternal              = newErrorMessage(http.StatusInternalServerError, 5001, "internal error")
 	ErrUnknown               = newErrorMessage(http.StatusInternalServerError, 5002, "unknown error")
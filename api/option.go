@@ -3,8 +3,24 @@ package api
 type ListOptions struct {
 	KindSelector string `json:"kindSelector" form:"kindSelector"`
 	TypeSelector string `json:"typeSelector" form:"typeSelector"`
+	// Days is the look-ahead window of the selectors which forecast the future
+	Days int `json:"days" form:"days"`
+	// Granularity is the bucket size of time series, day or month
+	Granularity string `json:"granularity" form:"granularity"`
+	// Currency is the currency the amounts are reported in
+	Currency string `json:"currency" form:"currency"`
+	// AsOf is a range expression, the users are listed as they were on
+	// its last day
+	AsOf string `json:"as_of" form:"as_of"`
 }
 
 type GetOptions struct {
 	KindSelector string `json:"kindSelector" form:"kindSelector"`
+	// Start and End are the range expressions of the first and the last day
+	// of the bills, such as 2006-01-02 or this_month, the last 90 days are
+	// returned when they're empty
+	Start string `json:"start" form:"start"`
+	End   string `json:"end" form:"end"`
+	// Granularity is the bucket size of the bills, day, week or month
+	Granularity string `json:"granularity" form:"granularity"`
 }
@@ -1,8 +1,21 @@
 package api
 
+import (
+	"time"
+)
+
 type ListResult struct {
 	List []interface{} `json:"list"`
 	P    Page          `json:"page"`
+	// Previous is the series of the range compared against, only for the
+	// time series requested with a comparison range
+	Previous []interface{} `json:"previous,omitempty"`
+}
+
+type CountResult struct {
+	Total int64 `json:"total"`
+	// AsOf is the day counted, empty for today
+	AsOf *time.Time `json:"as_of,omitempty"`
 }
 
 type Page struct {
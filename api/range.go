@@ -1,5 +1,53 @@
 package api
 
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The grammar of the range expressions, the days, weeks and so on are the
+// ones of the location of the now the expression is parsed against:
+//
+//	all                                     the whole history, Start is zero
+//	today, yesterday
+//	wtd, mtd, qtd, ytd                      the period to date
+//	last_<n><h|d|w|m|q|y>                   e.g. last_7d, from n units ago to now
+//	this_<day|week|month|quarter|year>      the current period
+//	previous_<day|week|month|quarter|year>  the period before the current one
+//	2006, 2006-Q1, 2006-01, 2006-W02        a year, quarter, month or ISO week
+//	2006-01-02                              a day
+//	2006-01-02T15:04[:05][Z07:00]           an instant, only useful as a bound
+//	<expr>..<expr>                          from the start of the first to the
+//	                                        end of the second, both inclusive
+//
+// A comparison is "<expr> vs <expr>", or "<expr> vs previous_period" for
+// the same length right before it and "<expr> vs previous_year" for the
+// same range a year earlier.
+const (
+	RangeOfAll           = "all"
+	RangeSeparator       = ".."
+	ComparisonSeparator  = " vs "
+	ComparisonOfPeriod   = "previous_period"
+	ComparisonOfLastYear = "previous_year"
+)
+
+var (
+	// the ranges of the dashboards before the grammar was introduced
+	legacyRanges = map[string]string{
+		"month":        "last_1m",
+		"three months": "last_3m",
+		"six months":   "last_6m",
+		"year":         "last_1y",
+	}
+	instantLayouts = []string{
+		time.RFC3339Nano,
+		"2006-01-02T15:04:05",
+		"2006-01-02T15:04",
+	}
+)
+
 type Range struct {
 	Start string `json:"start" form:"start"`
 	End   string `json:"end" form:"end"`
@@ -8,3 +56,234 @@ type Range struct {
 type Ranges struct {
 	Range Range `json:"range" form:"range"`
 }
+
+// Interval is the half-open interval [Start, End) of a parsed range.
+type Interval struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+func (i Interval) Duration() time.Duration {
+	return i.End.Sub(i.Start)
+}
+
+// Comparison is a range along with the one it is compared against.
+type Comparison struct {
+	Current  Interval `json:"current"`
+	Previous Interval `json:"previous"`
+}
+
+// Parse returns the interval from the start of Start to the end of End, one
+// of which may be empty to use the other one for both.
+func (r Range) Parse(now time.Time) (Interval, error) {
+	start, end := strings.TrimSpace(r.Start), strings.TrimSpace(r.End)
+	switch {
+	case start == "" && end == "":
+		return Interval{}, ErrParseRange.WithMessage("the range is missing")
+	case start == "":
+		start = end
+	case end == "":
+		end = start
+	}
+	return ParseRange(start+RangeSeparator+end, now)
+}
+
+// ParseRange parses the range expression relative to now, an empty
+// expression is an error as well.
+func ParseRange(expr string, now time.Time) (Interval, error) {
+	expr = strings.ToLower(strings.TrimSpace(expr))
+	if alias, ok := legacyRanges[expr]; ok {
+		expr = alias
+	}
+	if expr == RangeOfAll {
+		return Interval{End: now}, nil
+	}
+	var (
+		interval Interval
+		err      error
+	)
+	if from, to, ok := strings.Cut(expr, RangeSeparator); ok {
+		var first, last Interval
+		if first, err = parseBound(from, now); err != nil {
+			return Interval{}, err
+		}
+		if last, err = parseBound(to, now); err != nil {
+			return Interval{}, err
+		}
+		interval = Interval{Start: first.Start, End: last.End}
+	} else if interval, err = parseBound(expr, now); err != nil {
+		return Interval{}, err
+	}
+	if !interval.Start.Before(interval.End) {
+		return Interval{}, ErrParseRange.WithMessage(fmt.Sprintf("the range %s is empty", expr))
+	}
+	return interval, nil
+}
+
+// ParseComparison parses a range expression followed by the one it is
+// compared against.
+func ParseComparison(expr string, now time.Time) (Comparison, error) {
+	current, previous, ok := strings.Cut(strings.ToLower(expr), ComparisonSeparator)
+	if !ok {
+		return Comparison{}, ErrParseRange.WithMessage(fmt.Sprintf("%s is not a comparison, the format is <range> vs <range>", expr))
+	}
+	interval, err := ParseRange(current, now)
+	if err != nil {
+		return Comparison{}, err
+	}
+	cmp := Comparison{Current: interval}
+	switch previous = strings.TrimSpace(previous); previous {
+	case ComparisonOfPeriod:
+		cmp.Previous = Interval{Start: interval.Start.Add(-interval.Duration()), End: interval.Start}
+	case ComparisonOfLastYear:
+		cmp.Previous = Interval{Start: interval.Start.AddDate(-1, 0, 0), End: interval.End.AddDate(-1, 0, 0)}
+	default:
+		if cmp.Previous, err = ParseRange(previous, now); err != nil {
+			return Comparison{}, err
+		}
+	}
+	return cmp, nil
+}
+
+// parseBound parses an expression without the range separator.
+func parseBound(expr string, now time.Time) (Interval, error) {
+	expr = strings.TrimSpace(expr)
+	loc := now.Location()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	switch expr {
+	case "today":
+		return periodOf(today, "day", 0), nil
+	case "yesterday":
+		return periodOf(today, "day", -1), nil
+	case "wtd", "mtd", "qtd", "ytd":
+		period := map[string]string{"wtd": "week", "mtd": "month", "qtd": "quarter", "ytd": "year"}[expr]
+		return Interval{Start: periodOf(today, period, 0).Start, End: now}, nil
+	}
+	if n, unit, ok := parseLast(expr); ok {
+		if unit == 'h' {
+			return Interval{Start: now.Add(-time.Duration(n) * time.Hour), End: now}, nil
+		}
+		return Interval{Start: shift(today, unit, -n), End: now}, nil
+	}
+	if period := strings.TrimPrefix(expr, "this_"); period != expr && isPeriod(period) {
+		return periodOf(today, period, 0), nil
+	}
+	if period := strings.TrimPrefix(expr, "previous_"); period != expr && isPeriod(period) {
+		return periodOf(today, period, -1), nil
+	}
+	if interval, ok := parseAbsolute(expr, loc); ok {
+		return interval, nil
+	}
+	for _, layout := range instantLayouts {
+		if t, err := time.ParseInLocation(layout, strings.ToUpper(expr), loc); err == nil {
+			return Interval{Start: t, End: t}, nil
+		}
+	}
+	return Interval{}, ErrParseRange.WithMessage(fmt.Sprintf("unknown range %s", expr))
+}
+
+// parseLast parses last_<n><unit>.
+func parseLast(expr string) (int, byte, bool) {
+	rest := strings.TrimPrefix(expr, "last_")
+	if rest == expr || len(rest) < 2 {
+		return 0, 0, false
+	}
+	unit := rest[len(rest)-1]
+	if !strings.ContainsRune("hdwmqy", rune(unit)) {
+		return 0, 0, false
+	}
+	n, err := strconv.Atoi(rest[:len(rest)-1])
+	if err != nil || n <= 0 {
+		return 0, 0, false
+	}
+	return n, unit, true
+}
+
+// parseAbsolute parses a year, quarter, month, ISO week or day.
+func parseAbsolute(expr string, loc *time.Location) (Interval, bool) {
+	if t, err := time.ParseInLocation("2006-01-02", expr, loc); err == nil {
+		return periodOf(t, "day", 0), true
+	}
+	if t, err := time.ParseInLocation("2006-01", expr, loc); err == nil {
+		return periodOf(t, "month", 0), true
+	}
+	if len(expr) == 4 {
+		if t, err := time.ParseInLocation("2006", expr, loc); err == nil {
+			return periodOf(t, "year", 0), true
+		}
+	}
+	year, rest, ok := strings.Cut(expr, "-")
+	if !ok || len(year) != 4 || len(rest) < 2 {
+		return Interval{}, false
+	}
+	y, err := strconv.Atoi(year)
+	if err != nil {
+		return Interval{}, false
+	}
+	n, err := strconv.Atoi(rest[1:])
+	if err != nil {
+		return Interval{}, false
+	}
+	switch rest[0] {
+	case 'q':
+		if n < 1 || n > 4 {
+			return Interval{}, false
+		}
+		return periodOf(time.Date(y, time.Month(3*n-2), 1, 0, 0, 0, 0, loc), "quarter", 0), true
+	case 'w':
+		// the first ISO week is the one with the 4th of January
+		jan4 := time.Date(y, time.January, 4, 0, 0, 0, 0, loc)
+		monday := jan4.AddDate(0, 0, -int((jan4.Weekday()+6)%7)+7*(n-1))
+		if wy, wn := monday.ISOWeek(); wy != y || wn != n {
+			return Interval{}, false
+		}
+		return periodOf(monday, "week", 0), true
+	}
+	return Interval{}, false
+}
+
+func isPeriod(period string) bool {
+	switch period {
+	case "day", "week", "month", "quarter", "year":
+		return true
+	}
+	return false
+}
+
+// periodOf returns the day, week, month, quarter or year of the day, moved
+// by offset periods.
+func periodOf(day time.Time, period string, offset int) Interval {
+	var start time.Time
+	unit := period[0]
+	switch period {
+	case "day":
+		start = day
+	case "week":
+		start = day.AddDate(0, 0, -int((day.Weekday()+6)%7))
+	case "month":
+		start = time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, day.Location())
+	case "quarter":
+		start = time.Date(day.Year(), day.Month()-(day.Month()-1)%3, 1, 0, 0, 0, 0, day.Location())
+	case "year":
+		start = time.Date(day.Year(), time.January, 1, 0, 0, 0, 0, day.Location())
+	}
+	start = shift(start, unit, offset)
+	return Interval{Start: start, End: shift(start, unit, 1)}
+}
+
+// shift moves t by n days, weeks, months, quarters or years.
+func shift(t time.Time, unit byte, n int) time.Time {
+	switch unit {
+	case 'd':
+		return t.AddDate(0, 0, n)
+	case 'w':
+		return t.AddDate(0, 0, 7*n)
+	case 'm':
+		return t.AddDate(0, n, 0)
+	case 'q':
+		return t.AddDate(0, 3*n, 0)
+	case 'y':
+		return t.AddDate(n, 0, 0)
+	}
+	return t
+}
@@ -0,0 +1,60 @@
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRange(t *testing.T) {
+	// Wednesday, May 15, 2024
+	now := time.Date(2024, 5, 15, 10, 30, 0, 0, time.UTC)
+	day := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	}
+	cases := []struct {
+		expr       string
+		start, end time.Time
+	}{
+		{expr: "today", start: day(2024, 5, 15), end: day(2024, 5, 16)},
+		{expr: "yesterday", start: day(2024, 5, 14), end: day(2024, 5, 15)},
+		{expr: "last_7d", start: day(2024, 5, 8), end: now},
+		{expr: "last_24h", start: now.Add(-24 * time.Hour), end: now},
+		{expr: "this_week", start: day(2024, 5, 13), end: day(2024, 5, 20)},
+		{expr: "this_month", start: day(2024, 5, 1), end: day(2024, 6, 1)},
+		{expr: "previous_quarter", start: day(2024, 1, 1), end: day(2024, 4, 1)},
+		{expr: "previous_year", start: day(2023, 1, 1), end: day(2024, 1, 1)},
+		{expr: "ytd", start: day(2024, 1, 1), end: now},
+		{expr: "2024-03-01", start: day(2024, 3, 1), end: day(2024, 3, 2)},
+		{expr: "2024-02", start: day(2024, 2, 1), end: day(2024, 3, 1)},
+		{expr: "2023-Q4", start: day(2023, 10, 1), end: day(2024, 1, 1)},
+		{expr: "2021-W01", start: day(2021, 1, 4), end: day(2021, 1, 11)},
+		{expr: "2020-W53", start: day(2020, 12, 28), end: day(2021, 1, 4)},
+		{expr: "2024-03-01..2024-03-10", start: day(2024, 3, 1), end: day(2024, 3, 11)},
+		{expr: "2024-03-01T08:00:00Z..2024-03-01T20:00:00Z", start: day(2024, 3, 1).Add(8 * time.Hour), end: day(2024, 3, 1).Add(20 * time.Hour)},
+	}
+	for _, c := range cases {
+		rg, err := ParseRange(c.expr, now)
+		if err != nil {
+			t.Errorf("ParseRange(%q) = %v", c.expr, err)
+			continue
+		}
+		if !rg.Start.Equal(c.start) || !rg.End.Equal(c.end) {
+			t.Errorf("ParseRange(%q) = [%v, %v), want [%v, %v)", c.expr, rg.Start, rg.End, c.start, c.end)
+		}
+	}
+
+	cmp, err := ParseComparison("this_month vs previous_year", now)
+	if err != nil {
+		t.Fatalf("ParseComparison() = %v", err)
+	}
+	if !cmp.Previous.Start.Equal(day(2023, 5, 1)) || !cmp.Previous.End.Equal(day(2023, 6, 1)) {
+		t.Errorf("ParseComparison().Previous = %+v", cmp.Previous)
+	}
+	cmp, err = ParseComparison("last_7d vs previous_period", now)
+	if err != nil {
+		t.Fatalf("ParseComparison() = %v", err)
+	}
+	if !cmp.Previous.End.Equal(day(2024, 5, 8)) || cmp.Previous.Duration() != cmp.Current.Duration() {
+		t.Errorf("ParseComparison().Previous = %+v", cmp.Previous)
+	}
+}
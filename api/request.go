@@ -15,3 +15,25 @@ func NewRequest() Request {
 		},
 	}
 }
+
+type APIKeyRequest struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+	// ExpiresIn is a duration like 720h, the key never expires when empty
+	ExpiresIn string `json:"expires_in"`
+}
+
+type DataSubjectRequest struct {
+	OID   string `json:"oid"`
+	Email string `json:"email"`
+	// Mode of an erasure, delete or anonymize
+	Mode string `json:"mode"`
+}
+
+type ReconciliationRequest struct {
+	// Mode is sample or full, sample when empty
+	Mode       string `json:"mode"`
+	SampleSize int64  `json:"sample_size"`
+	// Repair refreshes the inconsistent stat users and deletes the orphans
+	Repair bool `json:"repair"`
+}
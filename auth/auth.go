@@ -0,0 +1,170 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/jyjiangkai/stat/constant"
+	"github.com/jyjiangkai/stat/log"
+)
+
+type Role string
+
+const (
+	RoleOfAdmin     Role = "admin"
+	RoleOfAnalyst   Role = "analyst"
+	RoleOfMarketing Role = "marketing"
+	RoleOfSupport   Role = "support"
+)
+
+type Permission string
+
+const (
+	PermissionOfUsersRead     Permission = "users:read"
+	PermissionOfStatementRead Permission = "statements:read"
+	PermissionOfActionsRead   Permission = "actions:read"
+	PermissionOfDownload      Permission = "download:read"
+	PermissionOfAnalyticsRead Permission = "analytics:read"
+	PermissionOfRevenueRead   Permission = "revenue:read"
+	PermissionOfAlarmsRead    Permission = "alarms:read"
+	PermissionOfAlarmsWrite   Permission = "alarms:write"
+	PermissionOfKeysManage    Permission = "keys:manage"
+	PermissionOfAuditRead     Permission = "audit:read"
+	PermissionOfGDPRManage    Permission = "gdpr:manage"
+)
+
+const (
+	MethodOfAPIKey    = "api_key"
+	MethodOfBearer    = "bearer"
+	MethodOfBootstrap = "bootstrap"
+	MethodOfNone      = "none"
+)
+
+var (
+	ErrAuthDisabled = errors.New("the authentication is disabled, set auth.insecure to run without it")
+
+	cfg  Config
+	once sync.Once
+
+	// the admin role is granted every permission
+	rolePermissions = map[Role][]Permission{
+		RoleOfAnalyst: {
+			PermissionOfUsersRead,
+			PermissionOfStatementRead,
+			PermissionOfActionsRead,
+			PermissionOfAnalyticsRead,
+			PermissionOfRevenueRead,
+			PermissionOfAlarmsRead,
+			PermissionOfAlarmsWrite,
+		},
+		RoleOfMarketing: {
+			PermissionOfUsersRead,
+			PermissionOfActionsRead,
+			PermissionOfAnalyticsRead,
+		},
+		RoleOfSupport: {
+			PermissionOfUsersRead,
+			PermissionOfStatementRead,
+			PermissionOfActionsRead,
+			PermissionOfDownload,
+			PermissionOfAlarmsRead,
+		},
+	}
+)
+
+type Config struct {
+	// Enable turns authentication on, the service refuses to start with it
+	// off unless Insecure is set
+	Enable bool `yaml:"enable"`
+	// Insecure allows running without authentication, every request is
+	// then treated as coming from an anonymous admin. It's meant for local
+	// development only.
+	Insecure bool `yaml:"insecure"`
+	// BootstrapKey is an admin key accepted besides the keys in MongoDB, it
+	// is used to create the first keys
+	BootstrapKey string     `yaml:"bootstrap_key"`
+	OIDC         OIDCConfig `yaml:"oidc"`
+}
+
+func Init(ctx context.Context, c Config) error {
+	var err error
+	once.Do(func() {
+		if !c.Enable && !c.Insecure {
+			err = ErrAuthDisabled
+			return
+		}
+		cfg = c
+		if cfg.OIDC.RolesClaim == "" {
+			cfg.OIDC.RolesClaim = DefaultRolesClaim
+		}
+		if !cfg.Enable {
+			log.Warn(ctx).Msg("the authentication is disabled, every request is served as an anonymous admin")
+		}
+		log.Info(ctx).Str("issuer", cfg.OIDC.Issuer).Msgf("the authentication has been %s\n", authSwitchStatus(c.Enable))
+	})
+	return err
+}
+
+func Enabled() bool {
+	return cfg.Enable
+}
+
+func BootstrapKey() string {
+	return cfg.BootstrapKey
+}
+
+func ValidRole(role Role) bool {
+	if role == RoleOfAdmin {
+		return true
+	}
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// Principal is the caller of a request.
+type Principal struct {
+	ID     string `json:"id" bson:"id"`
+	Name   string `json:"name" bson:"name"`
+	Role   Role   `json:"role" bson:"role"`
+	Method string `json:"method" bson:"method"`
+}
+
+func (p *Principal) Can(permission Permission) bool {
+	if p.Role == RoleOfAdmin {
+		return true
+	}
+	for _, perm := range rolePermissions[p.Role] {
+		if perm == permission {
+			return true
+		}
+	}
+	return false
+}
+
+func Anonymous() *Principal {
+	return &Principal{
+		ID:     "anonymous",
+		Name:   "anonymous",
+		Role:   RoleOfAdmin,
+		Method: MethodOfNone,
+	}
+}
+
+// GetPrincipal returns the caller set by the auth middleware, nil is
+// returned for the routines out of a request.
+func GetPrincipal(ctx context.Context) *Principal {
+	val := ctx.Value(constant.ContextPrincipal)
+	if val == nil {
+		return nil
+	}
+	p, _ := val.(*Principal)
+	return p
+}
+
+func authSwitchStatus(enable bool) string {
+	if enable {
+		return "enabled"
+	}
+	return "disabled"
+}
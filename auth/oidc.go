@@ -0,0 +1,253 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/resty.v1"
+
+	"github.com/jyjiangkai/stat/utils"
+)
+
+const (
+	DefaultRolesClaim = "roles"
+
+	jwksRefreshInterval = time.Hour
+	clockSkew           = time.Minute
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid bearer token")
+
+	verifier = &jwksVerifier{
+		keys: make(map[string]*rsa.PublicKey),
+	}
+)
+
+type OIDCConfig struct {
+	// Issuer is checked against the iss claim, the signing keys are
+	// discovered from its openid configuration unless JWKSURL is set
+	Issuer   string `yaml:"issuer"`
+	Audience string `yaml:"audience"`
+	JWKSURL  string `yaml:"jwks_url"`
+	// RolesClaim is the claim carrying the roles of the caller, a string or
+	// a list of strings
+	RolesClaim string `yaml:"roles_claim"`
+}
+
+type claims map[string]interface{}
+
+func (c claims) string(name string) string {
+	val, _ := c[name].(string)
+	return val
+}
+
+func (c claims) strings(name string) []string {
+	switch val := c[name].(type) {
+	case string:
+		return strings.Fields(val)
+	case []interface{}:
+		list := make([]string, 0, len(val))
+		for _, item := range val {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+func (c claims) time(name string) (time.Time, bool) {
+	val, ok := c[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(val), 0), true
+}
+
+// VerifyBearer verifies the RS256 signed JWT issued by the configured OIDC
+// provider and returns the caller it stands for.
+func VerifyBearer(token string) (*Principal, error) {
+	if cfg.OIDC.Issuer == "" && cfg.OIDC.JWKSURL == "" {
+		return nil, fmt.Errorf("%w: no oidc provider configured", ErrInvalidToken)
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("%w: unsupported algorithm %s", ErrInvalidToken, header.Alg)
+	}
+	key, err := verifier.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, fmt.Errorf("%w: bad signature", ErrInvalidToken)
+	}
+
+	c := claims{}
+	if err = decodeSegment(parts[1], &c); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if exp, ok := c.time("exp"); !ok || now.After(exp.Add(clockSkew)) {
+		return nil, fmt.Errorf("%w: expired", ErrInvalidToken)
+	}
+	if nbf, ok := c.time("nbf"); ok && now.Add(clockSkew).Before(nbf) {
+		return nil, fmt.Errorf("%w: not valid yet", ErrInvalidToken)
+	}
+	if cfg.OIDC.Issuer != "" && c.string("iss") != cfg.OIDC.Issuer {
+		return nil, fmt.Errorf("%w: unexpected issuer", ErrInvalidToken)
+	}
+	if cfg.OIDC.Audience != "" && !utils.Contains(c.strings("aud"), cfg.OIDC.Audience) {
+		return nil, fmt.Errorf("%w: unexpected audience", ErrInvalidToken)
+	}
+	role, ok := highestRole(c.strings(cfg.OIDC.RolesClaim))
+	if !ok {
+		return nil, fmt.Errorf("%w: no known role in claim %s", ErrInvalidToken, cfg.OIDC.RolesClaim)
+	}
+	name := c.string("email")
+	if name == "" {
+		name = c.string("sub")
+	}
+	return &Principal{
+		ID:     c.string("sub"),
+		Name:   name,
+		Role:   role,
+		Method: MethodOfBearer,
+	}, nil
+}
+
+// highestRole picks the most privileged known role, so a caller in several
+// groups is not limited by the weakest of them.
+func highestRole(roles []string) (Role, bool) {
+	order := []Role{RoleOfAdmin, RoleOfAnalyst, RoleOfSupport, RoleOfMarketing}
+	for _, role := range order {
+		if utils.Contains(roles, string(role)) {
+			return role, true
+		}
+	}
+	return "", false
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return ErrInvalidToken
+	}
+	if err = json.Unmarshal(data, v); err != nil {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// jwksVerifier caches the signing keys of the provider, they are fetched
+// again when a token is signed by an unknown key or the cache is stale.
+type jwksVerifier struct {
+	mutex       sync.Mutex
+	keys        map[string]*rsa.PublicKey
+	fetchedAt   time.Time
+	attemptedAt time.Time
+}
+
+func (v *jwksVerifier) key(kid string) (*rsa.PublicKey, error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	key, ok := v.keys[kid]
+	if ok && time.Since(v.fetchedAt) < jwksRefreshInterval {
+		return key, nil
+	}
+	// don't hammer the provider with tokens signed by unknown keys
+	if !ok && time.Since(v.attemptedAt) < time.Minute {
+		return nil, fmt.Errorf("%w: unknown key %s", ErrInvalidToken, kid)
+	}
+	v.attemptedAt = time.Now()
+	if err := v.refresh(); err != nil {
+		if ok {
+			return key, nil
+		}
+		return nil, err
+	}
+	if key, ok = v.keys[kid]; !ok {
+		return nil, fmt.Errorf("%w: unknown key %s", ErrInvalidToken, kid)
+	}
+	return key, nil
+}
+
+func (v *jwksVerifier) refresh() error {
+	client := resty.New().SetTimeout(10 * time.Second)
+	url := cfg.OIDC.JWKSURL
+	if url == "" {
+		discovery := struct {
+			JWKSURI string `json:"jwks_uri"`
+		}{}
+		resp, err := client.R().SetResult(&discovery).Get(strings.TrimSuffix(cfg.OIDC.Issuer, "/") + "/.well-known/openid-configuration")
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode() != http.StatusOK || discovery.JWKSURI == "" {
+			return fmt.Errorf("failed to discover the jwks of %s: %s", cfg.OIDC.Issuer, resp.Status())
+		}
+		url = discovery.JWKSURI
+	}
+	jwks := struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}{}
+	resp, err := client.R().SetResult(&jwks).Get(url)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return fmt.Errorf("failed to fetch the jwks %s: %s", url, resp.Status())
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, jwk := range jwks.Keys {
+		if jwk.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	v.keys = keys
+	v.fetchedAt = time.Now()
+	return nil
+}
@@ -0,0 +1,237 @@
+package cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/jyjiangkai/stat/log"
+)
+
+const (
+	DefaultSize = 1024
+	DefaultTTL  = 6 * time.Hour
+
+	// markerKey is the id of the document recording the last invalidation
+	// of the shared cache, the other replicas poll it to purge their memory
+	markerKey    = "_invalidated"
+	pollInterval = time.Minute
+	writeTimeout = 5 * time.Second
+)
+
+var (
+	cfg   Config
+	ttl   = DefaultTTL
+	lru   = NewLRU(DefaultSize)
+	coll  *mongo.Collection
+	once  sync.Once
+	mutex sync.RWMutex
+	// invalidatedAt is when the cache was invalidated last, the shared
+	// entries created before it are stale
+	invalidatedAt time.Time
+)
+
+type Config struct {
+	Enable bool `yaml:"enable"`
+	// Size is the number of responses kept in memory
+	Size int `yaml:"size"`
+	// TTL is a duration like 6h
+	TTL string `yaml:"ttl"`
+	// Shared keeps the responses in MongoDB too so the replicas share them
+	Shared bool `yaml:"shared"`
+}
+
+// Entry is a rendered response.
+type Entry struct {
+	Key         string    `bson:"_id"`
+	Body        []byte    `bson:"body"`
+	ContentType string    `bson:"content_type"`
+	ETag        string    `bson:"etag"`
+	CreatedAt   time.Time `bson:"created_at"`
+	ExpiresAt   time.Time `bson:"expires_at"`
+	// Value is the response the body is rendered from, it's only kept in
+	// memory and is nil for the entries loaded from the shared cache
+	Value any `bson:"-"`
+}
+
+// Init sets the cache up, the shared responses are kept in shared when it
+// is enabled.
+func Init(ctx context.Context, c Config, shared *mongo.Collection) error {
+	var err error
+	once.Do(func() {
+		cfg = c
+		if c.TTL != "" {
+			ttl, err = time.ParseDuration(c.TTL)
+			if err != nil || ttl <= 0 {
+				err = fmt.Errorf("invalid cache ttl %s", c.TTL)
+				return
+			}
+		}
+		if c.Size > 0 {
+			lru = NewLRU(c.Size)
+		}
+		if c.Enable && c.Shared {
+			coll = shared
+			_, err = coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys:    bson.D{{"expires_at", 1}},
+				Options: options.Index().SetExpireAfterSeconds(0),
+			})
+			if err != nil {
+				err = fmt.Errorf("failed to create the ttl index of the shared cache: %w", err)
+				return
+			}
+			go poll(ctx)
+		}
+		log.Info(ctx).Int("size", lru.size).Str("ttl", ttl.String()).Bool("shared", coll != nil).
+			Msgf("the response cache has been %s\n", switchStatus(c.Enable))
+	})
+	return err
+}
+
+func Enabled() bool {
+	return cfg.Enable
+}
+
+// Key hashes the parts of a normalized request into a cache key.
+func Key(parts ...string) string {
+	h := sha256.New()
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ETag returns a strong entity tag of the body.
+func ETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// Get looks the key up in memory, and in the shared cache when it is
+// enabled.
+func Get(ctx context.Context, key string) (*Entry, bool) {
+	if !Enabled() {
+		return nil, false
+	}
+	now := time.Now()
+	if entry, ok := lru.Get(key, now); ok {
+		return entry, true
+	}
+	if coll == nil {
+		return nil, false
+	}
+	entry := &Entry{}
+	query := bson.M{
+		"_id": key,
+		"expires_at": bson.M{
+			"$gt": now,
+		},
+	}
+	if err := coll.FindOne(ctx, query).Decode(entry); err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.Warn(ctx).Err(err).Msg("failed to get the shared cache")
+		}
+		return nil, false
+	}
+	mutex.RLock()
+	stale := entry.CreatedAt.Before(invalidatedAt)
+	mutex.RUnlock()
+	if stale {
+		return nil, false
+	}
+	lru.Add(entry)
+	return entry, true
+}
+
+// Set caches the entry for the configured TTL.
+func Set(ctx context.Context, entry *Entry) {
+	if !Enabled() {
+		return
+	}
+	entry.CreatedAt = time.Now()
+	entry.ExpiresAt = entry.CreatedAt.Add(ttl)
+	lru.Add(entry)
+	if coll == nil {
+		return
+	}
+	wctx, cancel := context.WithTimeout(context.Background(), writeTimeout)
+	defer cancel()
+	_, err := coll.ReplaceOne(wctx, bson.M{"_id": entry.Key}, entry, options.Replace().SetUpsert(true))
+	if err != nil {
+		log.Warn(ctx).Err(err).Msg("failed to set the shared cache")
+	}
+}
+
+// Invalidate drops every cached response, it is called when the data the
+// responses are computed from has been refreshed.
+func Invalidate(ctx context.Context, reason string) {
+	if !Enabled() {
+		return
+	}
+	now := time.Now()
+	mutex.Lock()
+	invalidatedAt = now
+	mutex.Unlock()
+	lru.Purge()
+	if coll != nil {
+		_, err := coll.DeleteMany(ctx, bson.M{"_id": bson.M{"$ne": markerKey}})
+		if err != nil {
+			log.Warn(ctx).Err(err).Msg("failed to purge the shared cache")
+		}
+		marker := bson.M{
+			"_id":        markerKey,
+			"created_at": now,
+			// the marker must outlive the ttl index
+			"expires_at": time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC),
+		}
+		_, err = coll.ReplaceOne(ctx, bson.M{"_id": markerKey}, marker, options.Replace().SetUpsert(true))
+		if err != nil {
+			log.Warn(ctx).Err(err).Msg("failed to mark the invalidation of the shared cache")
+		}
+	}
+	log.Info(ctx).Str("reason", reason).Msg("the response cache has been invalidated")
+}
+
+// poll purges the memory when another replica invalidated the shared cache.
+func poll(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			marker := &Entry{}
+			if err := coll.FindOne(ctx, bson.M{"_id": markerKey}).Decode(marker); err != nil {
+				if err != mongo.ErrNoDocuments {
+					log.Warn(ctx).Err(err).Msg("failed to get the invalidation of the shared cache")
+				}
+				continue
+			}
+			mutex.Lock()
+			stale := marker.CreatedAt.After(invalidatedAt)
+			if stale {
+				invalidatedAt = marker.CreatedAt
+			}
+			mutex.Unlock()
+			if stale {
+				lru.Purge()
+			}
+		}
+	}
+}
+
+func switchStatus(enable bool) string {
+	if enable {
+		return "enabled"
+	}
+	return "disabled"
+}
@@ -0,0 +1,81 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// LRU is a size bounded cache of entries, the least recently used entry is
+// evicted first and the expired ones are dropped on access.
+type LRU struct {
+	mutex sync.Mutex
+	size  int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+func NewLRU(size int) *LRU {
+	return &LRU{
+		size:  size,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+func (l *LRU) Get(key string, now time.Time) (*Entry, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	elem, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*Entry)
+	if !now.Before(entry.ExpiresAt) {
+		l.ll.Remove(elem)
+		delete(l.items, key)
+		return nil, false
+	}
+	l.ll.MoveToFront(elem)
+	return entry, true
+}
+
+func (l *LRU) Add(entry *Entry) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if elem, ok := l.items[entry.Key]; ok {
+		elem.Value = entry
+		l.ll.MoveToFront(elem)
+		return
+	}
+	l.items[entry.Key] = l.ll.PushFront(entry)
+	for l.ll.Len() > l.size {
+		oldest := l.ll.Back()
+		l.ll.Remove(oldest)
+		delete(l.items, oldest.Value.(*Entry).Key)
+	}
+}
+
+func (l *LRU) Remove(keys ...string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, key := range keys {
+		if elem, ok := l.items[key]; ok {
+			l.ll.Remove(elem)
+			delete(l.items, key)
+		}
+	}
+}
+
+func (l *LRU) Purge() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.ll.Init()
+	l.items = make(map[string]*list.Element)
+}
+
+func (l *LRU) Len() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.ll.Len()
+}
@@ -4,20 +4,30 @@ import (
 	"fmt"
 	"io"
 	"os"
+	// the timezones are loaded without the database of the system
+	_ "time/tzdata"
 
 	"github.com/gin-contrib/logger"
 	"github.com/gin-contrib/requestid"
 	"github.com/gin-gonic/gin"
 	"gopkg.in/yaml.v3"
 
+	"github.com/jyjiangkai/stat/auth"
+	"github.com/jyjiangkai/stat/cache"
 	"github.com/jyjiangkai/stat/config"
 	"github.com/jyjiangkai/stat/controller"
+	"github.com/jyjiangkai/stat/cost"
+	"github.com/jyjiangkai/stat/currency"
 	"github.com/jyjiangkai/stat/db"
 	"github.com/jyjiangkai/stat/internal/services"
 	"github.com/jyjiangkai/stat/log"
 	"github.com/jyjiangkai/stat/mailchimp"
 	"github.com/jyjiangkai/stat/monitor"
+	"github.com/jyjiangkai/stat/pdf"
+	"github.com/jyjiangkai/stat/privacy"
+	"github.com/jyjiangkai/stat/ratelimit"
 	"github.com/jyjiangkai/stat/router"
+	"github.com/jyjiangkai/stat/timezone"
 	"github.com/jyjiangkai/stat/utils"
 )
 
@@ -27,6 +37,15 @@ type Config struct {
 	Monitor   monitor.Config   `yaml:"monitor"`
 	MailChimp mailchimp.Config `yaml:"mailchimp"`
 	S3        config.S3        `yaml:"s3"`
+	Audit     config.Audit     `yaml:"audit"`
+	Currency  currency.Config  `yaml:"currency"`
+	Cost      cost.Config      `yaml:"cost"`
+	Auth      auth.Config      `yaml:"auth"`
+	Privacy   privacy.Config   `yaml:"privacy"`
+	RateLimit ratelimit.Config `yaml:"rate_limit"`
+	Cache     cache.Config     `yaml:"cache"`
+	Timezone  timezone.Config  `yaml:"timezone"`
+	PDF       pdf.Config       `yaml:"pdf"`
 }
 
 var (
@@ -63,6 +82,31 @@ func main() {
 
 	monitor.Init(ctx, cfg.Monitor)
 	mailchimp.Init(ctx, cfg.MailChimp)
+	if err = timezone.Init(ctx, cfg.Timezone); err != nil {
+		panic(fmt.Sprintf("failed to initialize timezone: %s", err))
+	}
+	if err = currency.Init(ctx, cfg.Currency); err != nil {
+		panic(fmt.Sprintf("failed to initialize currency: %s", err))
+	}
+	if err = cost.Init(ctx, cfg.Cost); err != nil {
+		panic(fmt.Sprintf("failed to initialize cost: %s", err))
+	}
+	if err = pdf.Init(ctx, cfg.PDF); err != nil {
+		panic(fmt.Sprintf("failed to initialize pdf fonts: %s", err))
+	}
+	if err = auth.Init(ctx, cfg.Auth); err != nil {
+		panic(fmt.Sprintf("failed to initialize authentication: %s", err))
+	}
+	if err = privacy.Init(ctx, cfg.Privacy); err != nil {
+		panic(fmt.Sprintf("failed to initialize privacy policies: %s", err))
+	}
+	if err = ratelimit.Init(ctx, cfg.RateLimit); err != nil {
+		panic(fmt.Sprintf("failed to initialize rate limiting: %s", err))
+	}
+	sharedCache := cli.Database(services.DatabaseOfUserStatistics).Collection("response_cache")
+	if err = cache.Init(ctx, cfg.Cache, sharedCache); err != nil {
+		panic(fmt.Sprintf("failed to initialize response cache: %s", err))
+	}
 
 	lg := logger.SetLogger(
 		logger.WithLogger(log.CustomLogger),
@@ -74,9 +118,32 @@ func main() {
 		requestid.New(),
 	)
 
+	apiKeyService := services.NewAPIKeyService(cli)
+	if err = apiKeyService.Start(); err != nil {
+		panic("failed to start api key service: " + err.Error())
+	}
+
+	auditService := services.NewAuditService(cli, cfg.Audit)
+	if err = auditService.Start(); err != nil {
+		panic("failed to start audit service: " + err.Error())
+	}
+
 	e := eng.Group("/v1")
 	e.Use(
 		lg,
+		router.Audit(auditService),
+		router.Authenticate(apiKeyService),
+		router.Timezone(),
+		router.Cache(),
+		router.RateLimit(),
+	)
+	router.RegisterAuditRouter(
+		e.Group("/audit"),
+		controller.NewAuditController(auditService),
+	)
+	router.RegisterKeysRouter(
+		e.Group("/keys"),
+		controller.NewAPIKeyController(apiKeyService),
 	)
 
 	userService := services.NewUserService(cli)
@@ -103,6 +170,51 @@ func main() {
 		controller.NewActionController(actionService),
 	)
 
+	anomalyService := services.NewAnomalyService(cli)
+	if err = anomalyService.Start(); err != nil {
+		panic("failed to start anomaly service: " + err.Error())
+	}
+	router.RegisterAnomaliesRouter(
+		e.Group("/anomalies"),
+		controller.NewAnomalyController(anomalyService),
+	)
+
+	revenueService := services.NewRevenueService(cli)
+	if err = revenueService.Start(); err != nil {
+		panic("failed to start revenue service: " + err.Error())
+	}
+	router.RegisterRevenueRouter(
+		e.Group("/revenue"),
+		controller.NewRevenueController(revenueService),
+	)
+
+	marginService := services.NewMarginService(cli)
+	if err = marginService.Start(); err != nil {
+		panic("failed to start margin service: " + err.Error())
+	}
+	router.RegisterMarginsRouter(
+		e.Group("/margins"),
+		controller.NewMarginController(marginService),
+	)
+
+	gdprService := services.NewGDPRService(cli)
+	if err = gdprService.Start(); err != nil {
+		panic("failed to start gdpr service: " + err.Error())
+	}
+	router.RegisterGDPRRouter(
+		e.Group("/gdpr"),
+		controller.NewGDPRController(gdprService),
+	)
+
+	planService := services.NewPlanService(cli)
+	if err = planService.Start(); err != nil {
+		panic("failed to start plan service: " + err.Error())
+	}
+	router.RegisterPlansRouter(
+		e.Group("/plans"),
+		controller.NewPlanController(planService),
+	)
+
 	statService := services.NewStatService(cli)
 	if err = statService.Start(); err != nil {
 		panic("failed to start stat service: " + err.Error())
@@ -113,16 +225,62 @@ func main() {
 		panic("failed to start track service: " + err.Error())
 	}
 
-	alarmService := services.NewAlarmService(cli)
+	alarmService := services.NewAlarmService(cli, anomalyService)
 	if err = alarmService.Start(); err != nil {
 		panic("failed to start alarm service: " + err.Error())
 	}
+	router.RegisterAlarmsRouter(
+		e.Group("/alarms"),
+		controller.NewAlarmController(alarmService),
+	)
+
+	churnService := services.NewChurnService(cli)
+	if err = churnService.Start(); err != nil {
+		panic("failed to start churn service: " + err.Error())
+	}
+
+	renewalService := services.NewRenewalService(cli)
+	if err = renewalService.Start(); err != nil {
+		panic("failed to start renewal service: " + err.Error())
+	}
+	router.RegisterRenewalsRouter(
+		e.Group("/renewals"),
+		controller.NewRenewalController(renewalService),
+	)
 
 	cohortService := services.NewCohortService(cli)
 	if err = cohortService.Start(); err != nil {
 		panic("failed to start cohort service: " + err.Error())
 	}
 
+	growthService := services.NewGrowthService(cli)
+	if err = growthService.Start(); err != nil {
+		panic("failed to start growth service: " + err.Error())
+	}
+	router.RegisterGrowthRouter(
+		e.Group("/growth"),
+		controller.NewGrowthController(growthService),
+	)
+
+	activationService := services.NewActivationService(cli)
+	if err = activationService.Start(); err != nil {
+		panic("failed to start activation service: " + err.Error())
+	}
+	router.RegisterActivationRouter(
+		e.Group("/activation"),
+		controller.NewActivationController(activationService),
+	)
+
+	reconciliationService := services.NewReconciliationService(cli, statService)
+	if err = reconciliationService.Start(); err != nil {
+		panic("failed to start reconciliation service: " + err.Error())
+	}
+	statService.AfterUserStat(reconciliationService.Scheduled)
+	router.RegisterReconciliationsRouter(
+		e.Group("/reconciliations"),
+		controller.NewReconciliationController(reconciliationService),
+	)
+
 	go func() {
 		if err = eng.Run(fmt.Sprintf("0.0.0.0:%d", cfg.Port)); err != nil {
 			panic(fmt.Sprintf("failed to start HTTP server: %s", err))
@@ -136,5 +294,8 @@ func main() {
 	if err = userService.Stop(); err != nil {
 		log.Warn(ctx).Err(err).Msg("error when stop UserService")
 	}
+	if err = auditService.Stop(); err != nil {
+		log.Warn(ctx).Err(err).Msg("error when stop AuditService")
+	}
 	log.Info(ctx).Msg("the Vanus Stat Server has been shutdown gracefully")
 }
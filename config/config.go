@@ -4,3 +4,8 @@ type S3 struct {
 	AWSAccessKeyID     string `yaml:"aws_access_key_id"`
 	AWSSecretAccessKey string `yaml:"aws_secret_access_key"`
 }
+
+type Audit struct {
+	// RetentionDays is how long the audit logs are kept
+	RetentionDays int `yaml:"retention_days"`
+}
@@ -1,7 +1,10 @@
 package constant
 
 const (
-	ContextUserID = "ctx_user_id"
+	ContextUserID    = "ctx_user_id"
+	ContextPrincipal = "ctx_principal"
+	ContextResponse  = "ctx_response"
+	ContextTimezone  = "ctx_timezone"
 
 	HTTPSSchema = "https://"
 	HTTPSchema  = "http://"
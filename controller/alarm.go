@@ -0,0 +1,85 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jyjiangkai/stat/api"
+	"github.com/jyjiangkai/stat/internal/services"
+)
+
+const (
+	ParamOfAlarmID  = "id"
+	QueryOfState    = "state"
+	QueryOfDuration = "duration"
+)
+
+type AlarmController struct {
+	svc *services.AlarmService
+}
+
+func NewAlarmController(handler *services.AlarmService) *AlarmController {
+	return &AlarmController{
+		svc: handler,
+	}
+}
+
+func (ac *AlarmController) List(ctx *gin.Context) (any, error) {
+	pg := api.Page{}
+	if err := ctx.BindQuery(&pg); err != nil {
+		return nil, api.ErrParsePaging
+	}
+	state, _ := ctx.GetQuery(QueryOfState)
+	result, err := ac.svc.List(ctx, pg, state)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (ac *AlarmController) Get(ctx *gin.Context) (any, error) {
+	result, err := ac.svc.Get(ctx, ctx.Param(ParamOfAlarmID))
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (ac *AlarmController) Acknowledge(ctx *gin.Context) (any, error) {
+	result, err := ac.svc.Acknowledge(ctx, ctx.Param(ParamOfAlarmID))
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (ac *AlarmController) Silence(ctx *gin.Context) (any, error) {
+	val, ok := ctx.GetQuery(QueryOfDuration)
+	if !ok {
+		return nil, api.ErrInvalidMissingParameter.WithMessage("missing duration parameter")
+	}
+	duration, err := time.ParseDuration(val)
+	if err != nil {
+		return nil, api.ErrInvalidParameter.WithError(err)
+	}
+	result, err := ac.svc.Silence(ctx, ctx.Param(ParamOfAlarmID), duration)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
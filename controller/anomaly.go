@@ -0,0 +1,49 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"github.com/jyjiangkai/stat/api"
+	"github.com/jyjiangkai/stat/internal/services"
+)
+
+const (
+	QueryOfMetric = "metric"
+)
+
+type AnomalyController struct {
+	svc *services.AnomalyService
+}
+
+func NewAnomalyController(handler *services.AnomalyService) *AnomalyController {
+	return &AnomalyController{
+		svc: handler,
+	}
+}
+
+func (ac *AnomalyController) List(ctx *gin.Context) (any, error) {
+	pg := api.Page{}
+	if err := ctx.BindQuery(&pg); err != nil {
+		return nil, api.ErrParsePaging
+	}
+	metric, _ := ctx.GetQuery(QueryOfMetric)
+	result, err := ac.svc.List(ctx, pg, metric)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
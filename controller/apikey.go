@@ -0,0 +1,81 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jyjiangkai/stat/api"
+	"github.com/jyjiangkai/stat/internal/services"
+	"github.com/jyjiangkai/stat/log"
+)
+
+const (
+	ParamOfAPIKeyID = "id"
+)
+
+type APIKeyController struct {
+	svc *services.APIKeyService
+}
+
+func NewAPIKeyController(handler *services.APIKeyService) *APIKeyController {
+	return &APIKeyController{
+		svc: handler,
+	}
+}
+
+func (ac *APIKeyController) Create(ctx *gin.Context) (any, error) {
+	req := api.APIKeyRequest{}
+	if err := ctx.BindJSON(&req); err != nil {
+		log.Error(ctx).Err(err).Msg("failed to parse api key request")
+		return nil, api.ErrParseBody.WithError(err)
+	}
+	var ttl time.Duration
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 {
+			return nil, api.ErrInvalidParameter.WithMessage("invalid expires_in: " + req.ExpiresIn)
+		}
+		ttl = d
+	}
+	result, err := ac.svc.Create(ctx, req.Name, req.Role, ttl)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (ac *APIKeyController) List(ctx *gin.Context) (any, error) {
+	pg := api.Page{}
+	if err := ctx.BindQuery(&pg); err != nil {
+		log.Error(ctx).Err(err).Msg("failed to parse page parameters")
+		return nil, api.ErrParsePaging
+	}
+	result, err := ac.svc.List(ctx, pg)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (ac *APIKeyController) Revoke(ctx *gin.Context) (any, error) {
+	result, err := ac.svc.Revoke(ctx, ctx.Param(ParamOfAPIKeyID))
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
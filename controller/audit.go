@@ -0,0 +1,55 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"github.com/jyjiangkai/stat/api"
+	"github.com/jyjiangkai/stat/internal/services"
+)
+
+const (
+	QueryOfPrincipal = "principal"
+	QueryOfRoute     = "route"
+	QueryOfOID       = "oid"
+)
+
+type AuditController struct {
+	svc *services.AuditService
+}
+
+func NewAuditController(handler *services.AuditService) *AuditController {
+	return &AuditController{
+		svc: handler,
+	}
+}
+
+func (ac *AuditController) List(ctx *gin.Context) (any, error) {
+	pg := api.Page{}
+	if err := ctx.BindQuery(&pg); err != nil {
+		return nil, api.ErrParsePaging
+	}
+	q := &services.AuditQuery{
+		Principal: ctx.Query(QueryOfPrincipal),
+		Route:     ctx.Query(QueryOfRoute),
+		OID:       ctx.Query(QueryOfOID),
+	}
+	result, err := ac.svc.List(ctx, pg, q)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
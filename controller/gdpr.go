@@ -0,0 +1,87 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"github.com/jyjiangkai/stat/api"
+	"github.com/jyjiangkai/stat/internal/services"
+	"github.com/jyjiangkai/stat/log"
+)
+
+const (
+	ParamOfRequestID = "id"
+)
+
+type GDPRController struct {
+	svc *services.GDPRService
+}
+
+func NewGDPRController(handler *services.GDPRService) *GDPRController {
+	return &GDPRController{
+		svc: handler,
+	}
+}
+
+func (gc *GDPRController) Export(ctx *gin.Context) (any, error) {
+	req := api.DataSubjectRequest{}
+	if err := ctx.BindJSON(&req); err != nil {
+		log.Error(ctx).Err(err).Msg("failed to parse data subject request")
+		return nil, api.ErrParseBody.WithError(err)
+	}
+	result, err := gc.svc.Export(ctx, req.OID, req.Email)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (gc *GDPRController) Erase(ctx *gin.Context) (any, error) {
+	req := api.DataSubjectRequest{}
+	if err := ctx.BindJSON(&req); err != nil {
+		log.Error(ctx).Err(err).Msg("failed to parse data subject request")
+		return nil, api.ErrParseBody.WithError(err)
+	}
+	result, err := gc.svc.Erase(ctx, req.OID, req.Email, req.Mode)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (gc *GDPRController) List(ctx *gin.Context) (any, error) {
+	pg := api.Page{}
+	if err := ctx.BindQuery(&pg); err != nil {
+		return nil, api.ErrParsePaging
+	}
+	typ, _ := ctx.GetQuery(QueryOfUserType)
+	opts := &api.ListOptions{
+		TypeSelector: typ,
+	}
+	result, err := gc.svc.List(ctx, pg, opts)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (gc *GDPRController) Get(ctx *gin.Context) (any, error) {
+	result, err := gc.svc.Get(ctx, ctx.Param(ParamOfRequestID))
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
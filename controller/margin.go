@@ -0,0 +1,85 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"github.com/jyjiangkai/stat/api"
+	"github.com/jyjiangkai/stat/internal/services"
+)
+
+type MarginController struct {
+	svc *services.MarginService
+}
+
+func NewMarginController(handler *services.MarginService) *MarginController {
+	return &MarginController{
+		svc: handler,
+	}
+}
+
+func (mc *MarginController) Users(ctx *gin.Context) (any, error) {
+	pg, opts, err := getMarginOptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result, err := mc.svc.Users(ctx, pg, opts)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (mc *MarginController) Apps(ctx *gin.Context) (any, error) {
+	pg, opts, err := getMarginOptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result, err := mc.svc.Apps(ctx, pg, opts)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (mc *MarginController) Plans(ctx *gin.Context) (any, error) {
+	pg, opts, err := getMarginOptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result, err := mc.svc.Plans(ctx, pg, opts)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func getMarginOptions(ctx *gin.Context) (api.Page, *api.ListOptions, error) {
+	pg := api.Page{}
+	if err := ctx.BindQuery(&pg); err != nil {
+		return pg, nil, api.ErrParsePaging
+	}
+	typ, _ := ctx.GetQuery(QueryOfUserType)
+	cur, err := getCurrency(ctx)
+	if err != nil {
+		return pg, nil, err
+	}
+	opts := &api.ListOptions{
+		TypeSelector: typ,
+		Currency:     cur,
+	}
+	return pg, opts, nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"github.com/jyjiangkai/stat/api"
+	"github.com/jyjiangkai/stat/internal/services"
+)
+
+type PlanController struct {
+	svc *services.PlanService
+}
+
+func NewPlanController(handler *services.PlanService) *PlanController {
+	return &PlanController{
+		svc: handler,
+	}
+}
+
+func (pc *PlanController) List(ctx *gin.Context) (any, error) {
+	pg, opts, err := getPlanOptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result, err := pc.svc.List(ctx, pg, opts)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (pc *PlanController) Matrix(ctx *gin.Context) (any, error) {
+	pg, opts, err := getPlanOptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result, err := pc.svc.Matrix(ctx, pg, opts)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (pc *PlanController) Counts(ctx *gin.Context) (any, error) {
+	pg, opts, err := getPlanOptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result, err := pc.svc.Counts(ctx, pg, opts)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func getPlanOptions(ctx *gin.Context) (api.Page, *api.ListOptions, error) {
+	pg := api.Page{}
+	if err := ctx.BindQuery(&pg); err != nil {
+		return pg, nil, api.ErrParsePaging
+	}
+	kind, _ := ctx.GetQuery(QueryOfUserKind)
+	typ, _ := ctx.GetQuery(QueryOfUserType)
+	granularity, _ := ctx.GetQuery(QueryOfGranularity)
+	opts := &api.ListOptions{
+		KindSelector: kind,
+		TypeSelector: typ,
+		Granularity:  granularity,
+	}
+	return pg, opts, nil
+}
@@ -0,0 +1,75 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"github.com/jyjiangkai/stat/api"
+	"github.com/jyjiangkai/stat/internal/services"
+	"github.com/jyjiangkai/stat/log"
+)
+
+const (
+	ParamOfReportID = "id"
+	QueryOfMode     = "mode"
+)
+
+type ReconciliationController struct {
+	svc *services.ReconciliationService
+}
+
+func NewReconciliationController(handler *services.ReconciliationService) *ReconciliationController {
+	return &ReconciliationController{
+		svc: handler,
+	}
+}
+
+func (rc *ReconciliationController) Run(ctx *gin.Context) (any, error) {
+	req := api.ReconciliationRequest{}
+	if err := ctx.BindJSON(&req); err != nil {
+		log.Error(ctx).Err(err).Msg("failed to parse reconciliation request")
+		return nil, api.ErrParseBody.WithError(err)
+	}
+	result, err := rc.svc.Run(ctx, req.Mode, req.SampleSize, req.Repair)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (rc *ReconciliationController) List(ctx *gin.Context) (any, error) {
+	pg := api.Page{}
+	if err := ctx.BindQuery(&pg); err != nil {
+		return nil, api.ErrParsePaging
+	}
+	mode, _ := ctx.GetQuery(QueryOfMode)
+	opts := &api.ListOptions{
+		TypeSelector: mode,
+	}
+	result, err := rc.svc.List(ctx, pg, opts)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (rc *ReconciliationController) Get(ctx *gin.Context) (any, error) {
+	result, err := rc.svc.Get(ctx, ctx.Param(ParamOfReportID))
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
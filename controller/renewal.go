@@ -0,0 +1,82 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"github.com/jyjiangkai/stat/api"
+	"github.com/jyjiangkai/stat/internal/services"
+	"github.com/jyjiangkai/stat/utils"
+)
+
+type RenewalController struct {
+	svc *services.RenewalService
+}
+
+func NewRenewalController(handler *services.RenewalService) *RenewalController {
+	return &RenewalController{
+		svc: handler,
+	}
+}
+
+func (rc *RenewalController) List(ctx *gin.Context) (any, error) {
+	pg := api.Page{}
+	if err := ctx.BindQuery(&pg); err != nil {
+		return nil, api.ErrParsePaging
+	}
+	opts, err := getRenewalOptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result, err := rc.svc.List(ctx, pg, opts)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (rc *RenewalController) Rates(ctx *gin.Context) (any, error) {
+	pg := api.Page{}
+	if err := ctx.BindQuery(&pg); err != nil {
+		return nil, api.ErrParsePaging
+	}
+	opts, err := getRenewalOptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result, err := rc.svc.Rates(ctx, pg, opts)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func getRenewalOptions(ctx *gin.Context) (*api.ListOptions, error) {
+	kind, _ := ctx.GetQuery(QueryOfUserKind)
+	renewalType, _ := ctx.GetQuery(QueryOfUserType)
+	opts := &api.ListOptions{
+		KindSelector: kind,
+		TypeSelector: renewalType,
+	}
+	if val, ok := ctx.GetQuery(QueryOfDays); ok {
+		days, err := utils.StrToInt(val)
+		if err != nil {
+			return nil, api.ErrInvalidParameter.WithError(err)
+		}
+		opts.Days = days
+	}
+	return opts, nil
+}
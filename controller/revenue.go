@@ -0,0 +1,106 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jyjiangkai/stat/api"
+	"github.com/jyjiangkai/stat/currency"
+	"github.com/jyjiangkai/stat/internal/services"
+)
+
+const (
+	QueryOfGranularity = "granularity"
+	QueryOfCurrency    = "currency"
+)
+
+type RevenueController struct {
+	svc *services.RevenueService
+}
+
+func NewRevenueController(handler *services.RevenueService) *RevenueController {
+	return &RevenueController{
+		svc: handler,
+	}
+}
+
+func (rc *RevenueController) MRR(ctx *gin.Context) (any, error) {
+	pg, opts, err := getRevenueOptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result, err := rc.svc.MRR(ctx, pg, opts)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (rc *RevenueController) Movements(ctx *gin.Context) (any, error) {
+	pg, opts, err := getRevenueOptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result, err := rc.svc.Movements(ctx, pg, opts)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (rc *RevenueController) Retention(ctx *gin.Context) (any, error) {
+	pg, opts, err := getRevenueOptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result, err := rc.svc.Retention(ctx, pg, opts)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func getRevenueOptions(ctx *gin.Context) (api.Page, *api.ListOptions, error) {
+	pg := api.Page{}
+	if err := ctx.BindQuery(&pg); err != nil {
+		return pg, nil, api.ErrParsePaging
+	}
+	kind, _ := ctx.GetQuery(QueryOfUserKind)
+	granularity, _ := ctx.GetQuery(QueryOfGranularity)
+	cur, err := getCurrency(ctx)
+	if err != nil {
+		return pg, nil, err
+	}
+	opts := &api.ListOptions{
+		KindSelector: kind,
+		Granularity:  granularity,
+		Currency:     cur,
+	}
+	return pg, opts, nil
+}
+
+func getCurrency(ctx *gin.Context) (string, error) {
+	val, ok := ctx.GetQuery(QueryOfCurrency)
+	if !ok || val == "" {
+		return "", nil
+	}
+	if !currency.Supported(val) {
+		return "", api.ErrUnsupportedCurrency.WithMessage(fmt.Sprintf("unsupported currency: %s", val))
+	}
+	return currency.Normalize(val), nil
+}
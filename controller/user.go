@@ -15,13 +15,19 @@
 package controller
 
 import (
+	"fmt"
+	"net/http"
+	"regexp"
 	"strings"
 
 	"github.com/gin-gonic/gin"
 
 	"github.com/jyjiangkai/stat/api"
+	"github.com/jyjiangkai/stat/constant"
 	"github.com/jyjiangkai/stat/internal/services"
 	"github.com/jyjiangkai/stat/log"
+	"github.com/jyjiangkai/stat/privacy"
+	"github.com/jyjiangkai/stat/utils"
 )
 
 const (
@@ -29,8 +35,16 @@ const (
 	QueryOfUserKind = "kind"
 	QueryOfUserType = "type"
 	QueryOfOperator = "operator"
+	QueryOfDays     = "days"
+	ParamOfMonth    = "month"
+	QueryOfFormat   = "format"
+	QueryOfStart    = "start"
+	QueryOfEnd      = "end"
+	QueryOfAsOf     = "as_of"
 )
 
+var unsafeFilenameChars = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
 type UserController struct {
 	svc *services.UserService
 }
@@ -57,10 +71,24 @@ func (uc *UserController) List(ctx *gin.Context) (any, error) {
 	}
 	kind, _ := ctx.GetQuery(QueryOfUserKind)
 	userType, _ := ctx.GetQuery(QueryOfUserType)
+	asOf, _ := ctx.GetQuery(QueryOfAsOf)
 	opts := &api.ListOptions{
 		KindSelector: kind,
 		TypeSelector: userType,
+		AsOf:         asOf,
+	}
+	if val, ok := ctx.GetQuery(QueryOfDays); ok {
+		days, err := utils.StrToInt(val)
+		if err != nil {
+			return nil, api.ErrInvalidParameter.WithError(err)
+		}
+		opts.Days = days
+	}
+	cur, err := getCurrency(ctx)
+	if err != nil {
+		return nil, err
 	}
+	opts.Currency = cur
 	result, err := uc.svc.List(ctx, pg, req, opts)
 	if err != nil {
 		return nil, err
@@ -68,10 +96,39 @@ func (uc *UserController) List(ctx *gin.Context) (any, error) {
 	return result, nil
 }
 
+func (uc *UserController) Count(ctx *gin.Context) (any, error) {
+	req := api.NewRequest()
+	if err := ctx.Bind(&req); err != nil {
+		log.Error(ctx).Err(err).Msg("failed to parse filting parameters")
+		if !strings.Contains(err.Error(), "EOF") {
+			return nil, api.ErrParseFilting.WithError(err)
+		}
+	}
+	kind, _ := ctx.GetQuery(QueryOfUserKind)
+	userType, _ := ctx.GetQuery(QueryOfUserType)
+	asOf, _ := ctx.GetQuery(QueryOfAsOf)
+	opts := &api.ListOptions{
+		KindSelector: kind,
+		TypeSelector: userType,
+		AsOf:         asOf,
+	}
+	result, err := uc.svc.Count(ctx, req, opts)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
 func (uc *UserController) Get(ctx *gin.Context) (any, error) {
 	kind, _ := ctx.GetQuery(QueryOfUserKind)
+	start, _ := ctx.GetQuery(QueryOfStart)
+	end, _ := ctx.GetQuery(QueryOfEnd)
+	granularity, _ := ctx.GetQuery(QueryOfGranularity)
 	opts := &api.GetOptions{
 		KindSelector: kind,
+		Start:        start,
+		End:          end,
+		Granularity:  granularity,
 	}
 	result, err := uc.svc.Get(ctx, ctx.Param(ParamOfUserOID), opts)
 	if err != nil {
@@ -79,3 +136,30 @@ func (uc *UserController) Get(ctx *gin.Context) (any, error) {
 	}
 	return result, nil
 }
+
+// Statement writes the monthly statement of the user as HTML, or as a PDF
+// attachment when format is pdf.
+func (uc *UserController) Statement(ctx *gin.Context) {
+	oid := ctx.Param(ParamOfUserOID)
+	month := ctx.Param(ParamOfMonth)
+	format, _ := ctx.GetQuery(QueryOfFormat)
+	statement, err := uc.svc.Statement(ctx, oid, month)
+	if err != nil {
+		log.Info(ctx).Err(err).Str("path", ctx.Request.URL.Path).Msg("request has error")
+		api.ResponseWithError(ctx, err)
+		return
+	}
+	privacy.Apply(ctx, statement)
+	ctx.Set(constant.ContextResponse, statement)
+	contentType, data, err := uc.svc.Render(statement, format)
+	if err != nil {
+		log.Info(ctx).Err(err).Str("path", ctx.Request.URL.Path).Msg("request has error")
+		api.ResponseWithError(ctx, err)
+		return
+	}
+	if format == services.StatementFormatOfPDF {
+		filename := fmt.Sprintf("statement-%s-%s.pdf", unsafeFilenameChars.ReplaceAllString(oid, "_"), month)
+		ctx.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	}
+	ctx.Data(http.StatusOK, contentType, data)
+}
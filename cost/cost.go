@@ -0,0 +1,138 @@
+package cost
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jyjiangkai/stat/currency"
+	"github.com/jyjiangkai/stat/log"
+	"github.com/jyjiangkai/stat/utils"
+)
+
+const (
+	ModelOfChatGPT35 = "chatgpt_3_5"
+	ModelOfChatGPT4  = "chatgpt_4"
+
+	DefaultUnit = 1000
+	dateLayout  = "2006-01-02"
+)
+
+var (
+	ErrUnknownPrice = errors.New("no unit price of the model")
+
+	// Models are the models which must all have a unit price
+	Models = []string{
+		ModelOfChatGPT35,
+		ModelOfChatGPT4,
+	}
+
+	cfg    Config
+	prices = make(map[string]utils.DatedValues)
+	mutex  sync.RWMutex
+	once   sync.Once
+)
+
+type Config struct {
+	// Currency is the currency the unit prices are quoted in, the reporting
+	// currency by default
+	Currency string `yaml:"currency"`
+	// Unit is the number of tokens a unit price is charged for
+	Unit   uint64  `yaml:"unit"`
+	Prices []Price `yaml:"prices"`
+}
+
+// Price means every Unit tokens of Model cost Price since Date.
+type Price struct {
+	Date  string  `yaml:"date"`
+	Model string  `yaml:"model"`
+	Price float64 `yaml:"price"`
+}
+
+func Init(ctx context.Context, c Config) error {
+	var err error
+	once.Do(func() {
+		cfg = c
+		if cfg.Unit == 0 {
+			cfg.Unit = DefaultUnit
+		}
+		if cfg.Currency != "" {
+			cfg.Currency = currency.Normalize(cfg.Currency)
+		}
+		for _, price := range c.Prices {
+			if err = add(price); err != nil {
+				return
+			}
+		}
+		if len(c.Prices) == 0 {
+			log.Warn(ctx).Msg("no unit price is configured, the margin analytics are unavailable")
+		} else if err = validate(); err != nil {
+			return
+		}
+		log.Info(ctx).Str("currency", Currency()).Int("prices", len(c.Prices)).Msg("the unit price table has been loaded")
+	})
+	return err
+}
+
+func Currency() string {
+	if cfg.Currency == "" {
+		return currency.ReportingCurrency()
+	}
+	return cfg.Currency
+}
+
+// Of returns the cost of the tokens of the model consumed at the given time
+// in the currency of the unit prices, the earliest price is used for the
+// time before it.
+func Of(model string, tokens uint64, at time.Time) (float64, error) {
+	if tokens == 0 {
+		return 0, nil
+	}
+	price, err := lookup(model, at)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", err, model)
+	}
+	unit := cfg.Unit
+	if unit == 0 {
+		unit = DefaultUnit
+	}
+	return float64(tokens) / float64(unit) * price, nil
+}
+
+func add(price Price) error {
+	since, err := time.Parse(dateLayout, price.Date)
+	if err != nil {
+		return fmt.Errorf("invalid unit price date %s: %w", price.Date, err)
+	}
+	if price.Price < 0 {
+		return fmt.Errorf("invalid unit price %f of %s", price.Price, price.Model)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	prices[price.Model] = prices[price.Model].Set(since, price.Price)
+	return nil
+}
+
+// validate makes sure every model has a unit price.
+func validate() error {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	for _, model := range Models {
+		if len(prices[model]) == 0 {
+			return fmt.Errorf("%w: %s", ErrUnknownPrice, model)
+		}
+	}
+	return nil
+}
+
+func lookup(model string, at time.Time) (float64, error) {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	price, ok := prices[model].At(at)
+	if !ok {
+		return 0, ErrUnknownPrice
+	}
+	return price, nil
+}
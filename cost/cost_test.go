@@ -0,0 +1,71 @@
+package cost
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/jyjiangkai/stat/utils"
+)
+
+func TestOf(t *testing.T) {
+	prices = make(map[string]utils.DatedValues)
+	cfg = Config{Unit: 1000}
+	defer func() {
+		prices = make(map[string]utils.DatedValues)
+		cfg = Config{}
+	}()
+	for _, price := range []Price{
+		{Date: "2023-06-01", Model: ModelOfChatGPT35, Price: 0.002},
+		{Date: "2023-01-01", Model: ModelOfChatGPT35, Price: 0.004},
+		// replaces the price of the same date
+		{Date: "2023-06-01", Model: ModelOfChatGPT35, Price: 0.0015},
+		{Date: "2023-01-01", Model: ModelOfChatGPT4, Price: 0.06},
+	} {
+		if err := add(price); err != nil {
+			t.Fatalf("add(%+v) error = %v", price, err)
+		}
+	}
+	if err := add(Price{Date: "2023-06", Model: ModelOfChatGPT4, Price: 0.03}); err == nil {
+		t.Errorf("add() of an invalid date succeeded")
+	}
+	if err := validate(); err != nil {
+		t.Errorf("validate() error = %v", err)
+	}
+
+	day := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	}
+	cases := []struct {
+		name   string
+		model  string
+		tokens uint64
+		at     time.Time
+		want   float64
+		err    error
+	}{
+		{name: "before the earliest price", model: ModelOfChatGPT35, tokens: 10000, at: day(2022, 12, 1), want: 0.04},
+		{name: "effective price", model: ModelOfChatGPT35, tokens: 10000, at: day(2023, 5, 31), want: 0.04},
+		{name: "replaced price", model: ModelOfChatGPT35, tokens: 10000, at: day(2023, 6, 1), want: 0.015},
+		{name: "other model", model: ModelOfChatGPT4, tokens: 500, at: day(2023, 7, 1), want: 0.03},
+		{name: "no tokens", model: "unknown", tokens: 0, at: day(2023, 7, 1), want: 0},
+		{name: "unknown model", model: "unknown", tokens: 1, at: day(2023, 7, 1), err: ErrUnknownPrice},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := Of(c.model, c.tokens, c.at)
+			if !errors.Is(err, c.err) {
+				t.Fatalf("Of() error = %v, want %v", err, c.err)
+			}
+			if math.Abs(got-c.want) > 1e-9 {
+				t.Errorf("Of() = %v, want %v", got, c.want)
+			}
+		})
+	}
+
+	delete(prices, ModelOfChatGPT4)
+	if err := validate(); !errors.Is(err, ErrUnknownPrice) {
+		t.Errorf("validate() error = %v, want %v", err, ErrUnknownPrice)
+	}
+}
@@ -0,0 +1,220 @@
+package currency
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jyjiangkai/stat/log"
+	"github.com/jyjiangkai/stat/utils"
+)
+
+const (
+	USD = "USD"
+	CNY = "CNY"
+
+	DefaultReportingCurrency = USD
+	dateLayout               = "2006-01-02"
+)
+
+var (
+	ErrUnknownRate = errors.New("no exchange rate between the currencies")
+
+	cfg   Config
+	table = newRateTable()
+	once  sync.Once
+)
+
+type Config struct {
+	// Reporting is the currency every amount is converted to when the
+	// request does not ask for a specific one
+	Reporting string `yaml:"reporting"`
+	// RatesFile is a CSV file of date,from,to,rate lines
+	RatesFile string `yaml:"rates_file"`
+	Rates     []Rate `yaml:"rates"`
+}
+
+// Rate means one unit of From is worth Rate units of To since Date.
+type Rate struct {
+	Date string  `yaml:"date"`
+	From string  `yaml:"from"`
+	To   string  `yaml:"to"`
+	Rate float64 `yaml:"rate"`
+}
+
+func Init(ctx context.Context, c Config) error {
+	var err error
+	once.Do(func() {
+		cfg = c
+		if cfg.Reporting == "" {
+			cfg.Reporting = DefaultReportingCurrency
+		}
+		cfg.Reporting = Normalize(cfg.Reporting)
+		rates := c.Rates
+		if c.RatesFile != "" {
+			var loaded []Rate
+			loaded, err = LoadRates(c.RatesFile)
+			if err != nil {
+				return
+			}
+			rates = append(rates, loaded...)
+		}
+		for _, rate := range rates {
+			if err = table.add(rate); err != nil {
+				return
+			}
+		}
+		log.Info(ctx).Str("reporting", cfg.Reporting).Int("rates", len(rates)).Msg("the exchange rate table has been loaded")
+	})
+	return err
+}
+
+// LoadRates reads a CSV file of date,from,to,rate lines, a header line
+// starting with date is skipped.
+func LoadRates(file string) ([]Rate, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = 4
+	reader.TrimLeadingSpace = true
+	rates := make([]Rate, 0)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if strings.EqualFold(record[0], "date") {
+			continue
+		}
+		value, err := strconv.ParseFloat(record[3], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exchange rate %s: %w", record[3], err)
+		}
+		rates = append(rates, Rate{
+			Date: record[0],
+			From: record[1],
+			To:   record[2],
+			Rate: value,
+		})
+	}
+	return rates, nil
+}
+
+func ReportingCurrency() string {
+	if cfg.Reporting == "" {
+		return DefaultReportingCurrency
+	}
+	return cfg.Reporting
+}
+
+func Normalize(currency string) string {
+	return strings.ToUpper(strings.TrimSpace(currency))
+}
+
+// Supported reports whether amounts can be converted to the currency, which
+// is the case when there is a rate from the reporting currency to it.
+func Supported(currency string) bool {
+	currency = Normalize(currency)
+	reporting := ReportingCurrency()
+	return currency == reporting || table.has(reporting, currency)
+}
+
+// Convert converts the amount from one currency to another with the rate
+// effective at the given time, the earliest rate is used for the time
+// before it. Currencies without a rate between them are converted through
+// the reporting currency.
+func Convert(amount float64, from, to string, at time.Time) (float64, error) {
+	from, to = Normalize(from), Normalize(to)
+	if from == to || amount == 0 {
+		return amount, nil
+	}
+	rate, err := table.lookup(from, to, at)
+	if err == ErrUnknownRate {
+		rate, err = table.cross(from, to, ReportingCurrency(), at)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s to %s", err, from, to)
+	}
+	return amount * rate, nil
+}
+
+type rateTable struct {
+	mutex sync.RWMutex
+	pairs map[string]utils.DatedValues
+}
+
+func newRateTable() *rateTable {
+	return &rateTable{
+		pairs: make(map[string]utils.DatedValues),
+	}
+}
+
+func pairKey(from, to string) string {
+	return from + "/" + to
+}
+
+func (rt *rateTable) add(rate Rate) error {
+	since, err := time.Parse(dateLayout, rate.Date)
+	if err != nil {
+		return fmt.Errorf("invalid exchange rate date %s: %w", rate.Date, err)
+	}
+	if rate.Rate <= 0 {
+		return fmt.Errorf("invalid exchange rate %f of %s", rate.Rate, rate.Date)
+	}
+	from, to := Normalize(rate.From), Normalize(rate.To)
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+	key := pairKey(from, to)
+	rt.pairs[key] = rt.pairs[key].Set(since, rate.Rate)
+	// the reverse direction is derived unless it is configured explicitly
+	reverse := pairKey(to, from)
+	if !rt.pairs[reverse].Has(since) {
+		rt.pairs[reverse] = rt.pairs[reverse].Set(since, 1/rate.Rate)
+	}
+	return nil
+}
+
+func (rt *rateTable) lookup(from, to string, at time.Time) (float64, error) {
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+	rate, ok := rt.pairs[pairKey(from, to)].At(at)
+	if !ok {
+		return 0, ErrUnknownRate
+	}
+	return rate, nil
+}
+
+// cross returns the rate from one currency to another through the given one.
+func (rt *rateTable) cross(from, to, through string, at time.Time) (float64, error) {
+	if from == through || to == through {
+		return 0, ErrUnknownRate
+	}
+	first, err := rt.lookup(from, through, at)
+	if err != nil {
+		return 0, err
+	}
+	second, err := rt.lookup(through, to, at)
+	if err != nil {
+		return 0, err
+	}
+	return first * second, nil
+}
+
+func (rt *rateTable) has(from, to string) bool {
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+	return len(rt.pairs[pairKey(from, to)]) != 0
+}
@@ -0,0 +1,73 @@
+package currency
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func newTestTable(t *testing.T, rates ...Rate) *rateTable {
+	rt := newRateTable()
+	for _, rate := range rates {
+		if err := rt.add(rate); err != nil {
+			t.Fatalf("add(%+v) error = %v", rate, err)
+		}
+	}
+	return rt
+}
+
+func TestConvert(t *testing.T) {
+	table = newTestTable(t,
+		Rate{Date: "2023-01-01", From: "usd", To: "cny", Rate: 7},
+		Rate{Date: "2023-06-01", From: "USD", To: "CNY", Rate: 8},
+		// configured explicitly, not derived from USD/CNY
+		Rate{Date: "2023-06-01", From: "CNY", To: "USD", Rate: 0.2},
+		Rate{Date: "2023-01-01", From: "EUR", To: "USD", Rate: 1.25},
+		// there is no rate between USD and JPY
+		Rate{Date: "2023-01-01", From: "JPY", To: "CNY", Rate: 0.05},
+	)
+	cfg = Config{Reporting: USD}
+	defer func() {
+		table = newRateTable()
+		cfg = Config{}
+	}()
+	day := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	}
+	cases := []struct {
+		name     string
+		amount   float64
+		from, to string
+		at       time.Time
+		want     float64
+		err      error
+	}{
+		{name: "same currency", amount: 10, from: "usd", to: "USD", at: day(2023, 3, 1), want: 10},
+		{name: "before the earliest rate", amount: 10, from: USD, to: CNY, at: day(2022, 3, 1), want: 70},
+		{name: "effective rate", amount: 10, from: USD, to: CNY, at: day(2023, 5, 31), want: 70},
+		{name: "a rate is effective on its day", amount: 10, from: USD, to: CNY, at: day(2023, 6, 1), want: 80},
+		{name: "derived reverse rate", amount: 70, from: CNY, to: USD, at: day(2023, 3, 1), want: 10},
+		{name: "configured reverse rate", amount: 10, from: CNY, to: USD, at: day(2023, 7, 1), want: 2},
+		{name: "through the reporting currency", amount: 10, from: "EUR", to: CNY, at: day(2023, 7, 1), want: 100},
+		{name: "no rate", amount: 10, from: "JPY", to: USD, at: day(2023, 7, 1), err: ErrUnknownRate},
+		{name: "no amount", amount: 0, from: "JPY", to: USD, at: day(2023, 7, 1), want: 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := Convert(c.amount, c.from, c.to, c.at)
+			if !errors.Is(err, c.err) {
+				t.Fatalf("Convert() error = %v, want %v", err, c.err)
+			}
+			if math.Abs(got-c.want) > 1e-9 {
+				t.Errorf("Convert() = %v, want %v", got, c.want)
+			}
+		})
+	}
+
+	for currency, want := range map[string]bool{"usd": true, CNY: true, "EUR": true, "JPY": false, "GBP": false} {
+		if got := Supported(currency); got != want {
+			t.Errorf("Supported(%s) = %v, want %v", currency, got, want)
+		}
+	}
+}
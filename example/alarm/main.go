@@ -41,7 +41,7 @@ func main() {
 	monitor.Init(ctx, monitorCfg)
 
 	now := time.Now()
-	svc := services.NewAlarmService(cli)
+	svc := services.NewAlarmService(cli, services.NewAnomalyService(cli))
 	if err := svc.AlarmOfUsage(ctx, now); err != nil {
 		log.Error(ctx).Err(err).Msg("failed to execute alarm service")
 		return
@@ -7,6 +7,7 @@ require (
 	github.com/gin-contrib/logger v0.2.6
 	github.com/gin-contrib/requestid v0.0.6
 	github.com/gin-gonic/gin v1.9.1
+	github.com/go-pdf/fpdf v0.8.0
 	github.com/rs/zerolog v1.30.0
 	go.mongodb.org/mongo-driver v1.12.1
 	gopkg.in/resty.v1 v1.12.0
@@ -0,0 +1,553 @@
+package repository
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/jyjiangkai/stat/models"
+	"github.com/jyjiangkai/stat/models/cloud"
+)
+
+// The in-memory repositories keep the documents they were seeded with in
+// slices, they are used where a database isn't at hand, such as the tests.
+
+type MemoryUserRepository struct {
+	mutex sync.RWMutex
+	users []*cloud.User
+}
+
+func NewMemoryUserRepository(users ...*cloud.User) *MemoryUserRepository {
+	return &MemoryUserRepository{
+		users: users,
+	}
+}
+
+func (r *MemoryUserRepository) Add(users ...*cloud.User) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.users = append(r.users, users...)
+}
+
+func (r *MemoryUserRepository) Count(_ context.Context) (int64, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return int64(len(r.users)), nil
+}
+
+func (r *MemoryUserRepository) CountCreated(_ context.Context, start, end time.Time) (int64, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	var count int64
+	for _, user := range r.users {
+		if within(user.CreatedAt, start, end) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (r *MemoryUserRepository) Range(_ context.Context, skip, limit int64, fn func(*cloud.User) error) error {
+	r.mutex.RLock()
+	users := make([]*cloud.User, len(r.users))
+	copy(users, r.users)
+	r.mutex.RUnlock()
+	sort.SliceStable(users, func(i, j int) bool {
+		return users[i].CreatedAt.Before(users[j].CreatedAt)
+	})
+	lo, hi := bounds(len(users), skip, limit)
+	for _, user := range users[lo:hi] {
+		if err := fn(user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type MemoryActionRepository struct {
+	mutex   sync.RWMutex
+	actions []*models.Action
+}
+
+func NewMemoryActionRepository(actions ...*models.Action) *MemoryActionRepository {
+	return &MemoryActionRepository{
+		actions: actions,
+	}
+}
+
+func (r *MemoryActionRepository) Add(actions ...*models.Action) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.actions = append(r.actions, actions...)
+}
+
+func (r *MemoryActionRepository) Exists(_ context.Context, oid, action string, since time.Time) (bool, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, a := range r.actions {
+		if a.OID != oid || a.Time.Before(since) {
+			continue
+		}
+		if action == "" || a.Action == action {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+type MemoryBillRepository struct {
+	mutex sync.RWMutex
+	bills []*cloud.Bill
+}
+
+func NewMemoryBillRepository(bills ...*cloud.Bill) *MemoryBillRepository {
+	return &MemoryBillRepository{
+		bills: bills,
+	}
+}
+
+func (r *MemoryBillRepository) Add(bills ...*cloud.Bill) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.bills = append(r.bills, bills...)
+}
+
+func (r *MemoryBillRepository) UsageByCollectedAt(_ context.Context, from, to time.Time) (map[time.Time]uint64, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	usages := make(map[time.Time]uint64)
+	for _, bill := range r.bills {
+		if !bill.CollectedAt.Before(from) && bill.CollectedAt.Before(to) {
+			usages[bill.CollectedAt] += bill.DeliveredNum
+		}
+	}
+	return usages, nil
+}
+
+func (r *MemoryBillRepository) UserUsage(_ context.Context, oid string, from, to time.Time) (*UsageFacet, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	facet := newUsageFacet(from, to)
+	for _, bill := range r.bills {
+		if bill.UserID == oid {
+			facet.add(bill.ConnectionID, bill.CollectedAt, bill.DeliveredNum)
+		}
+	}
+	return facet.build(), nil
+}
+
+type MemoryAIBillRepository struct {
+	mutex sync.RWMutex
+	bills []*cloud.AIBill
+}
+
+func NewMemoryAIBillRepository(bills ...*cloud.AIBill) *MemoryAIBillRepository {
+	return &MemoryAIBillRepository{
+		bills: bills,
+	}
+}
+
+func (r *MemoryAIBillRepository) Add(bills ...*cloud.AIBill) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.bills = append(r.bills, bills...)
+}
+
+func (r *MemoryAIBillRepository) UsageByCollectedAt(_ context.Context, from, to time.Time) (map[time.Time]uint64, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	usages := make(map[time.Time]uint64)
+	for _, bill := range r.bills {
+		if !bill.CollectedAt.Before(from) && bill.CollectedAt.Before(to) {
+			usages[bill.CollectedAt] += usageOfAIBill(bill)
+		}
+	}
+	return usages, nil
+}
+
+func (r *MemoryAIBillRepository) UserUsage(_ context.Context, oid string, from, to time.Time) (*UsageFacet, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	facet := newUsageFacet(from, to)
+	for _, bill := range r.bills {
+		if bill.UserID == oid {
+			facet.add(bill.AppID, bill.CollectedAt, usageOfAIBill(bill))
+		}
+	}
+	return facet.build(), nil
+}
+
+func (r *MemoryAIBillRepository) UserTotal(_ context.Context, oid string, until time.Time) (uint64, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	total := uint64(0)
+	for _, bill := range r.bills {
+		if bill.UserID == oid && !bill.CollectedAt.After(until) {
+			total += usageOfAIBill(bill)
+		}
+	}
+	return total, nil
+}
+
+// usageOfAIBill is the same as aiUsage.
+func usageOfAIBill(bill *cloud.AIBill) uint64 {
+	if bill.Usage == nil {
+		return 0
+	}
+	return bill.Usage.ChatGPT35 + bill.Usage.ChatGPT4*20
+}
+
+type MemoryPaymentRepository struct {
+	mutex    sync.RWMutex
+	payments []*models.Payment
+}
+
+func NewMemoryPaymentRepository(payments ...*models.Payment) *MemoryPaymentRepository {
+	return &MemoryPaymentRepository{
+		payments: payments,
+	}
+}
+
+func (r *MemoryPaymentRepository) Add(payments ...*models.Payment) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.payments = append(r.payments, payments...)
+}
+
+func (r *MemoryPaymentRepository) Latest(_ context.Context, oid, kind string) (*models.Payment, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	var latest *models.Payment
+	for _, payment := range r.payments {
+		if payment.CreatedBy != oid || payment.Kind != kind {
+			continue
+		}
+		if latest == nil || payment.CreatedAt.After(latest.CreatedAt) {
+			latest = payment
+		}
+	}
+	return latest, nil
+}
+
+func (r *MemoryPaymentRepository) List(_ context.Context, oid string, start, end time.Time) ([]*models.Payment, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	payments := make([]*models.Payment, 0)
+	for _, payment := range r.payments {
+		if payment.CreatedBy == oid && !payment.CreatedAt.Before(start) && payment.CreatedAt.Before(end) {
+			payments = append(payments, payment)
+		}
+	}
+	sort.SliceStable(payments, func(i, j int) bool {
+		return payments[i].CreatedAt.Before(payments[j].CreatedAt)
+	})
+	return payments, nil
+}
+
+func (r *MemoryPaymentRepository) ExistsSince(_ context.Context, oid string, since time.Time) (bool, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, payment := range r.payments {
+		if payment.CreatedBy == oid && !payment.CreatedAt.Before(since) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *MemoryPaymentRepository) FirstPaid(_ context.Context, kind string) (map[string]time.Time, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	first := make(map[string]time.Time)
+	for _, payment := range r.payments {
+		if !isPaid(payment, kind) {
+			continue
+		}
+		if at, ok := first[payment.CreatedBy]; !ok || payment.CreatedAt.Before(at) {
+			first[payment.CreatedBy] = payment.CreatedAt
+		}
+	}
+	return first, nil
+}
+
+func (r *MemoryPaymentRepository) Paid(_ context.Context, kind string, start, end time.Time) ([]*models.Payment, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	payments := make([]*models.Payment, 0)
+	for _, payment := range r.payments {
+		if isPaid(payment, kind) && !payment.CreatedAt.Before(start) && payment.CreatedAt.Before(end) {
+			payments = append(payments, payment)
+		}
+	}
+	sort.SliceStable(payments, func(i, j int) bool {
+		return payments[i].CreatedAt.Before(payments[j].CreatedAt)
+	})
+	return payments, nil
+}
+
+func (r *MemoryPaymentRepository) FirstWithin(_ context.Context, oid, kind string, after, until time.Time) (*models.Payment, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	var first *models.Payment
+	for _, payment := range r.payments {
+		if payment.CreatedBy != oid || payment.Kind != kind || payment.Currency == "" {
+			continue
+		}
+		if !payment.CreatedAt.After(after) || payment.CreatedAt.After(until) {
+			continue
+		}
+		if first == nil || payment.CreatedAt.Before(first.CreatedAt) {
+			first = payment
+		}
+	}
+	return first, nil
+}
+
+// isPaid reports whether the payment was actually paid for the kind of plan,
+// any kind when it is empty.
+func isPaid(payment *models.Payment, kind string) bool {
+	if kind != "" && payment.Kind != kind {
+		return false
+	}
+	return payment.Currency != "" && payment.Amount != nil && payment.Amount.Payable > 0
+}
+
+type MemoryQuotaRepository struct {
+	mutex  sync.RWMutex
+	quotas []*cloud.UserQuota
+}
+
+func NewMemoryQuotaRepository(quotas ...*cloud.UserQuota) *MemoryQuotaRepository {
+	return &MemoryQuotaRepository{
+		quotas: quotas,
+	}
+}
+
+func (r *MemoryQuotaRepository) Add(quotas ...*cloud.UserQuota) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.quotas = append(r.quotas, quotas...)
+}
+
+func (r *MemoryQuotaRepository) Active(_ context.Context, oid, kind string, at time.Time) (*cloud.UserQuota, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, quota := range r.quotas {
+		if quota.CreatedBy != oid || quota.Plan == nil || quota.Plan.Kind != kind {
+			continue
+		}
+		if quota.PeriodOfValidity != nil && within(at, quota.PeriodOfValidity.Start, quota.PeriodOfValidity.End) {
+			return quota, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *MemoryQuotaRepository) EndWithin(_ context.Context, after, until time.Time) ([]*cloud.UserQuota, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	quotas := make([]*cloud.UserQuota, 0)
+	for _, quota := range r.quotas {
+		if quota.Plan == nil || quota.PeriodOfValidity == nil {
+			continue
+		}
+		if end := quota.PeriodOfValidity.End; end.After(after) && !end.After(until) {
+			quotas = append(quotas, quota)
+		}
+	}
+	return quotas, nil
+}
+
+func (r *MemoryQuotaRepository) StartWithin(_ context.Context, oid, kind string, after, until time.Time) ([]*cloud.UserQuota, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	quotas := make([]*cloud.UserQuota, 0)
+	for _, quota := range r.quotas {
+		if quota.CreatedBy != oid || quota.Plan == nil || quota.Plan.Kind != kind || quota.PeriodOfValidity == nil {
+			continue
+		}
+		if start := quota.PeriodOfValidity.Start; start.After(after) && !start.After(until) {
+			quotas = append(quotas, quota)
+		}
+	}
+	sort.SliceStable(quotas, func(i, j int) bool {
+		return quotas[i].PeriodOfValidity.Start.Before(quotas[j].PeriodOfValidity.Start)
+	})
+	return quotas, nil
+}
+
+func (r *MemoryQuotaRepository) ValidAfter(_ context.Context, oids []string, since time.Time) ([]*cloud.UserQuota, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	users := make(map[string]struct{}, len(oids))
+	for _, oid := range oids {
+		users[oid] = struct{}{}
+	}
+	quotas := make([]*cloud.UserQuota, 0)
+	for _, quota := range r.quotas {
+		if _, ok := users[quota.CreatedBy]; !ok || quota.PeriodOfValidity == nil {
+			continue
+		}
+		if quota.PeriodOfValidity.End.After(since) {
+			quotas = append(quotas, quota)
+		}
+	}
+	return quotas, nil
+}
+
+type MemoryAppRepository struct {
+	mutex sync.RWMutex
+	apps  []*cloud.App
+}
+
+func NewMemoryAppRepository(apps ...*cloud.App) *MemoryAppRepository {
+	return &MemoryAppRepository{
+		apps: apps,
+	}
+}
+
+func (r *MemoryAppRepository) Add(apps ...*cloud.App) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.apps = append(r.apps, apps...)
+}
+
+func (r *MemoryAppRepository) ListByUser(_ context.Context, oid string) ([]*cloud.App, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	apps := make([]*cloud.App, 0)
+	for _, app := range r.apps {
+		if app.CreatedBy == oid {
+			apps = append(apps, app)
+		}
+	}
+	return apps, nil
+}
+
+func (r *MemoryAppRepository) GetMany(_ context.Context, ids []primitive.ObjectID) ([]*cloud.App, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	wanted := make(map[primitive.ObjectID]bool, len(ids))
+	for _, id := range ids {
+		wanted[id] = true
+	}
+	apps := make([]*cloud.App, 0)
+	for _, app := range r.apps {
+		if wanted[app.ID] {
+			apps = append(apps, app)
+		}
+	}
+	return apps, nil
+}
+
+func (r *MemoryAppRepository) UpdatedSince(_ context.Context, since time.Time) ([]primitive.ObjectID, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	ids := make([]primitive.ObjectID, 0)
+	for _, app := range r.apps {
+		if !app.UpdatedAt.Before(since) {
+			ids = append(ids, app.ID)
+		}
+	}
+	return ids, nil
+}
+
+type MemoryConnectionRepository struct {
+	mutex       sync.RWMutex
+	connections []*cloud.Connection
+}
+
+func NewMemoryConnectionRepository(connections ...*cloud.Connection) *MemoryConnectionRepository {
+	return &MemoryConnectionRepository{
+		connections: connections,
+	}
+}
+
+func (r *MemoryConnectionRepository) Add(connections ...*cloud.Connection) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.connections = append(r.connections, connections...)
+}
+
+func (r *MemoryConnectionRepository) ListByUser(_ context.Context, oid string) ([]*cloud.Connection, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	connections := make([]*cloud.Connection, 0)
+	for _, connection := range r.connections {
+		if connection.CreatedBy == oid {
+			connections = append(connections, connection)
+		}
+	}
+	return connections, nil
+}
+
+// usageFacet builds a UsageFacet the way userUsage aggregates it.
+type usageFacet struct {
+	from   time.Time
+	to     time.Time
+	totals map[primitive.ObjectID]uint64
+	bills  map[GroupUsage]uint64
+}
+
+func newUsageFacet(from, to time.Time) *usageFacet {
+	return &usageFacet{
+		from:   from,
+		to:     to,
+		totals: make(map[primitive.ObjectID]uint64),
+		bills:  make(map[GroupUsage]uint64),
+	}
+}
+
+func (f *usageFacet) add(group primitive.ObjectID, date time.Time, usage uint64) {
+	f.totals[group] += usage
+	if !date.Before(f.from) && date.Before(f.to) {
+		f.bills[GroupUsage{ID: group, Date: date}] += usage
+	}
+}
+
+func (f *usageFacet) build() *UsageFacet {
+	facet := &UsageFacet{
+		Totals: make([]*GroupUsage, 0, len(f.totals)),
+		Bills:  make([]*GroupUsage, 0, len(f.bills)),
+	}
+	for group, usage := range f.totals {
+		facet.Totals = append(facet.Totals, &GroupUsage{ID: group, Usage: usage})
+	}
+	for key, usage := range f.bills {
+		facet.Bills = append(facet.Bills, &GroupUsage{ID: key.ID, Date: key.Date, Usage: usage})
+	}
+	sortGroupUsages(facet.Totals)
+	sortGroupUsages(facet.Bills)
+	return facet
+}
+
+func sortGroupUsages(usages []*GroupUsage) {
+	sort.Slice(usages, func(i, j int) bool {
+		if usages[i].ID != usages[j].ID {
+			return usages[i].ID.Hex() < usages[j].ID.Hex()
+		}
+		return usages[i].Date.Before(usages[j].Date)
+	})
+}
+
+// within reports whether t is within [start, end].
+func within(t, start, end time.Time) bool {
+	return !t.Before(start) && !t.After(end)
+}
+
+// bounds returns the bounds of the page of a list of n elements which skips
+// skip of them and takes limit of them, a zero limit takes the rest.
+func bounds(n int, skip, limit int64) (int, int) {
+	lo := int(skip)
+	if lo > n {
+		lo = n
+	}
+	hi := n
+	if limit > 0 && lo+int(limit) < n {
+		hi = lo + int(limit)
+	}
+	return lo, hi
+}
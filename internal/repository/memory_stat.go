@@ -0,0 +1,271 @@
+package repository
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/jyjiangkai/stat/models"
+)
+
+type MemoryUserStatRepository struct {
+	mutex sync.RWMutex
+	users []*models.User
+}
+
+func NewMemoryUserStatRepository(users ...*models.User) *MemoryUserStatRepository {
+	return &MemoryUserStatRepository{
+		users: users,
+	}
+}
+
+func (r *MemoryUserStatRepository) Add(users ...*models.User) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.users = append(r.users, users...)
+}
+
+func (r *MemoryUserStatRepository) Get(_ context.Context, oid string) (*models.User, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, user := range r.users {
+		if user.OID == oid {
+			return user, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *MemoryUserStatRepository) CreatedBetween(_ context.Context, start, end time.Time) ([]*models.User, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	users := make([]*models.User, 0)
+	for _, user := range r.users {
+		if within(user.CreatedAt, start, end) {
+			users = append(users, user)
+		}
+	}
+	return users, nil
+}
+
+type MemoryDailyStatRepository struct {
+	mutex sync.RWMutex
+	stats []*models.DailyStatsOfUserNumber
+}
+
+func NewMemoryDailyStatRepository(stats ...*models.DailyStatsOfUserNumber) *MemoryDailyStatRepository {
+	return &MemoryDailyStatRepository{
+		stats: stats,
+	}
+}
+
+func (r *MemoryDailyStatRepository) Add(stats ...*models.DailyStatsOfUserNumber) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.stats = append(r.stats, stats...)
+}
+
+func (r *MemoryDailyStatRepository) UserNumbers(_ context.Context, start, end time.Time) ([]*models.DailyStatsOfUserNumber, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	stats := make([]*models.DailyStatsOfUserNumber, 0)
+	for _, stat := range r.stats {
+		if stat.Tag == "user_number" && within(stat.Date, start, end) {
+			stats = append(stats, stat)
+		}
+	}
+	return stats, nil
+}
+
+type MemoryCohortRepository struct {
+	mutex    sync.RWMutex
+	analyses []*models.WeeklyCohortAnalysis
+}
+
+func NewMemoryCohortRepository(analyses ...*models.WeeklyCohortAnalysis) *MemoryCohortRepository {
+	return &MemoryCohortRepository{
+		analyses: analyses,
+	}
+}
+
+func (r *MemoryCohortRepository) GetByAlias(_ context.Context, alias string) (*models.WeeklyCohortAnalysis, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, analysis := range r.analyses {
+		if analysis.Week != nil && analysis.Week.Alias == alias {
+			return analysis, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *MemoryCohortRepository) Save(_ context.Context, analysis *models.WeeklyCohortAnalysis) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for idx := range r.analyses {
+		if r.analyses[idx].ID == analysis.ID {
+			r.analyses[idx] = analysis
+			return nil
+		}
+	}
+	r.analyses = append(r.analyses, analysis)
+	return nil
+}
+
+type MemoryAlarmRepository struct {
+	mutex  sync.RWMutex
+	alarms []*models.Alarm
+}
+
+func NewMemoryAlarmRepository(alarms ...*models.Alarm) *MemoryAlarmRepository {
+	return &MemoryAlarmRepository{
+		alarms: alarms,
+	}
+}
+
+func (r *MemoryAlarmRepository) Get(_ context.Context, id primitive.ObjectID) (*models.Alarm, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, alarm := range r.alarms {
+		if alarm.ID == id {
+			return alarm, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *MemoryAlarmRepository) GetActive(_ context.Context, key string) (*models.Alarm, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, alarm := range r.alarms {
+		if alarm.Key == key && alarm.State != models.AlarmStateOfResolved {
+			return alarm, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *MemoryAlarmRepository) ListActive(_ context.Context) ([]*models.Alarm, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	alarms := make([]*models.Alarm, 0)
+	for _, alarm := range r.alarms {
+		if alarm.State != models.AlarmStateOfResolved {
+			alarms = append(alarms, alarm)
+		}
+	}
+	return alarms, nil
+}
+
+func (r *MemoryAlarmRepository) Save(_ context.Context, alarm *models.Alarm) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for idx := range r.alarms {
+		if r.alarms[idx].ID == alarm.ID {
+			r.alarms[idx] = alarm
+			return nil
+		}
+	}
+	r.alarms = append(r.alarms, alarm)
+	return nil
+}
+
+func (r *MemoryAlarmRepository) Count(_ context.Context, query AlarmQuery) (int64, error) {
+	return int64(len(r.match(query))), nil
+}
+
+func (r *MemoryAlarmRepository) List(_ context.Context, query AlarmQuery, pg Page) ([]*models.Alarm, error) {
+	alarms := r.match(query)
+	sort.SliceStable(alarms, func(i, j int) bool {
+		if pg.Asc {
+			return alarms[i].LastSeen.Before(alarms[j].LastSeen)
+		}
+		return alarms[i].LastSeen.After(alarms[j].LastSeen)
+	})
+	lo, hi := bounds(len(alarms), pg.Skip, pg.Limit)
+	return alarms[lo:hi], nil
+}
+
+func (r *MemoryAlarmRepository) match(query AlarmQuery) []*models.Alarm {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	alarms := make([]*models.Alarm, 0)
+	for _, alarm := range r.alarms {
+		if alarm.LastSeen.Before(query.SeenSince) || !query.SeenUntil.IsZero() && !alarm.LastSeen.Before(query.SeenUntil) {
+			continue
+		}
+		if query.State == "" || alarm.State == query.State {
+			alarms = append(alarms, alarm)
+		}
+	}
+	return alarms
+}
+
+type MemoryAnomalyRepository struct {
+	mutex     sync.RWMutex
+	anomalies []*models.Anomaly
+}
+
+func NewMemoryAnomalyRepository(anomalies ...*models.Anomaly) *MemoryAnomalyRepository {
+	return &MemoryAnomalyRepository{
+		anomalies: anomalies,
+	}
+}
+
+func (r *MemoryAnomalyRepository) GetByDate(_ context.Context, date time.Time, metric string) (*models.Anomaly, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, anomaly := range r.anomalies {
+		if anomaly.Date.Equal(date) && anomaly.Metric == metric {
+			return anomaly, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *MemoryAnomalyRepository) Save(_ context.Context, anomaly *models.Anomaly) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for idx := range r.anomalies {
+		if r.anomalies[idx].ID == anomaly.ID {
+			r.anomalies[idx] = anomaly
+			return nil
+		}
+	}
+	r.anomalies = append(r.anomalies, anomaly)
+	return nil
+}
+
+func (r *MemoryAnomalyRepository) Count(_ context.Context, query AnomalyQuery) (int64, error) {
+	return int64(len(r.match(query))), nil
+}
+
+func (r *MemoryAnomalyRepository) List(_ context.Context, query AnomalyQuery, pg Page) ([]*models.Anomaly, error) {
+	anomalies := r.match(query)
+	sort.SliceStable(anomalies, func(i, j int) bool {
+		if pg.Asc {
+			return anomalies[i].Date.Before(anomalies[j].Date)
+		}
+		return anomalies[i].Date.After(anomalies[j].Date)
+	})
+	lo, hi := bounds(len(anomalies), pg.Skip, pg.Limit)
+	return anomalies[lo:hi], nil
+}
+
+func (r *MemoryAnomalyRepository) match(query AnomalyQuery) []*models.Anomaly {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	anomalies := make([]*models.Anomaly, 0)
+	for _, anomaly := range r.anomalies {
+		if anomaly.Date.Before(query.Since) || !query.Until.IsZero() && !anomaly.Date.Before(query.Until) {
+			continue
+		}
+		if query.Metric == "" || anomaly.Metric == query.Metric {
+			anomalies = append(anomalies, anomaly)
+		}
+	}
+	return anomalies
+}
@@ -0,0 +1,612 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/jyjiangkai/stat/models"
+	"github.com/jyjiangkai/stat/models/cloud"
+)
+
+// aiUsage is the usage of an AI bill, where a ChatGPT-4 token counts as 20
+// ChatGPT-3.5 ones.
+var aiUsage = bson.D{
+	{"$add", []interface{}{
+		"$usage.chatgpt_3_5",
+		bson.M{"$multiply": []interface{}{"$usage.chatgpt_4", 20}},
+	}},
+}
+
+type MongoUserRepository struct {
+	coll *mongo.Collection
+}
+
+func NewMongoUserRepository(coll *mongo.Collection) *MongoUserRepository {
+	return &MongoUserRepository{
+		coll: coll,
+	}
+}
+
+func (r *MongoUserRepository) Count(ctx context.Context) (int64, error) {
+	return r.coll.CountDocuments(ctx, bson.M{})
+}
+
+func (r *MongoUserRepository) CountCreated(ctx context.Context, start, end time.Time) (int64, error) {
+	query := bson.M{
+		"created_at": bson.M{
+			"$gte": start,
+			"$lte": end,
+		},
+	}
+	return r.coll.CountDocuments(ctx, query)
+}
+
+func (r *MongoUserRepository) Range(ctx context.Context, skip, limit int64, fn func(*cloud.User) error) error {
+	opt := options.FindOptions{
+		Limit: &limit,
+		Skip:  &skip,
+		Sort:  bson.M{"created_at": 1},
+	}
+	cursor, err := r.coll.Find(ctx, bson.M{}, &opt)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = cursor.Close(ctx)
+	}()
+	for cursor.Next(ctx) {
+		user := &cloud.User{}
+		if err = cursor.Decode(user); err != nil {
+			return err
+		}
+		if err = fn(user); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+type MongoActionRepository struct {
+	coll *mongo.Collection
+}
+
+func NewMongoActionRepository(coll *mongo.Collection) *MongoActionRepository {
+	return &MongoActionRepository{
+		coll: coll,
+	}
+}
+
+func (r *MongoActionRepository) Exists(ctx context.Context, oid, action string, since time.Time) (bool, error) {
+	// the time of the actions is stored as an RFC 3339 string
+	query := bson.M{
+		"usersub": oid,
+		"time": bson.M{
+			"$gte": since.Format(time.RFC3339),
+		},
+	}
+	if action != "" {
+		query["action"] = action
+	}
+	return exists(ctx, r.coll, query)
+}
+
+type MongoBillRepository struct {
+	coll *mongo.Collection
+}
+
+func NewMongoBillRepository(coll *mongo.Collection) *MongoBillRepository {
+	return &MongoBillRepository{
+		coll: coll,
+	}
+}
+
+func (r *MongoBillRepository) UsageByCollectedAt(ctx context.Context, from, to time.Time) (map[time.Time]uint64, error) {
+	return usageByCollectedAt(ctx, r.coll, "$delivered_num", from, to)
+}
+
+func (r *MongoBillRepository) UserUsage(ctx context.Context, oid string, from, to time.Time) (*UsageFacet, error) {
+	return userUsage(ctx, r.coll, oid, "connection_id", "$delivered_num", from, to)
+}
+
+type MongoAIBillRepository struct {
+	coll *mongo.Collection
+}
+
+func NewMongoAIBillRepository(coll *mongo.Collection) *MongoAIBillRepository {
+	return &MongoAIBillRepository{
+		coll: coll,
+	}
+}
+
+func (r *MongoAIBillRepository) UsageByCollectedAt(ctx context.Context, from, to time.Time) (map[time.Time]uint64, error) {
+	return usageByCollectedAt(ctx, r.coll, aiUsage, from, to)
+}
+
+func (r *MongoAIBillRepository) UserUsage(ctx context.Context, oid string, from, to time.Time) (*UsageFacet, error) {
+	return userUsage(ctx, r.coll, oid, "app_id", aiUsage, from, to)
+}
+
+func (r *MongoAIBillRepository) UserTotal(ctx context.Context, oid string, until time.Time) (uint64, error) {
+	pipeline := mongo.Pipeline{
+		{
+			{"$match", bson.M{
+				"user_id": oid,
+				"collected_at": bson.M{
+					"$lte": until,
+				},
+			}},
+		},
+		{
+			{"$group", bson.D{
+				{"_id", nil},
+				{"usage", bson.D{
+					{"$sum", aiUsage},
+				}},
+			}},
+		},
+	}
+	cursor, err := r.coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = cursor.Close(ctx)
+	}()
+	var group struct {
+		Usage uint64 `bson:"usage"`
+	}
+	if cursor.Next(ctx) {
+		if err = cursor.Decode(&group); err != nil {
+			return 0, err
+		}
+	}
+	return group.Usage, cursor.Err()
+}
+
+type MongoPaymentRepository struct {
+	coll *mongo.Collection
+}
+
+func NewMongoPaymentRepository(coll *mongo.Collection) *MongoPaymentRepository {
+	return &MongoPaymentRepository{
+		coll: coll,
+	}
+}
+
+func (r *MongoPaymentRepository) Latest(ctx context.Context, oid, kind string) (*models.Payment, error) {
+	query := bson.M{
+		"created_by": oid,
+		"kind":       kind,
+	}
+	opt := options.FindOneOptions{
+		Sort: bson.M{"created_at": -1},
+	}
+	payment := models.NewPayment()
+	if found, err := findOne(ctx, r.coll, query, &opt, payment); !found {
+		return nil, err
+	}
+	return payment, nil
+}
+
+func (r *MongoPaymentRepository) List(ctx context.Context, oid string, start, end time.Time) ([]*models.Payment, error) {
+	query := bson.M{
+		"created_by": oid,
+		"created_at": bson.M{
+			"$gte": start,
+			"$lt":  end,
+		},
+	}
+	return r.find(ctx, query)
+}
+
+func (r *MongoPaymentRepository) ExistsSince(ctx context.Context, oid string, since time.Time) (bool, error) {
+	query := bson.M{
+		"created_by": oid,
+		"created_at": bson.M{
+			"$gte": since,
+		},
+	}
+	return exists(ctx, r.coll, query)
+}
+
+// paidQuery matches the payments actually paid for the kind of plan, any
+// kind when it is empty.
+func paidQuery(kind string) bson.M {
+	query := bson.M{
+		"currency":       bson.M{"$ne": ""},
+		"amount.payable": bson.M{"$gt": 0},
+	}
+	if kind != "" {
+		query["kind"] = kind
+	}
+	return query
+}
+
+func (r *MongoPaymentRepository) FirstPaid(ctx context.Context, kind string) (map[string]time.Time, error) {
+	pipeline := mongo.Pipeline{
+		{
+			{"$match", paidQuery(kind)},
+		},
+		{
+			{"$group", bson.D{
+				{"_id", "$created_by"},
+				{"first", bson.M{"$min": "$created_at"}},
+			}},
+		},
+	}
+	cursor, err := r.coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = cursor.Close(ctx)
+	}()
+	first := make(map[string]time.Time)
+	for cursor.Next(ctx) {
+		var group struct {
+			User  string    `bson:"_id"`
+			First time.Time `bson:"first"`
+		}
+		if err = cursor.Decode(&group); err != nil {
+			return nil, err
+		}
+		first[group.User] = group.First
+	}
+	return first, cursor.Err()
+}
+
+func (r *MongoPaymentRepository) Paid(ctx context.Context, kind string, start, end time.Time) ([]*models.Payment, error) {
+	query := paidQuery(kind)
+	query["created_at"] = bson.M{
+		"$gte": start,
+		"$lt":  end,
+	}
+	return r.find(ctx, query)
+}
+
+func (r *MongoPaymentRepository) FirstWithin(ctx context.Context, oid, kind string, after, until time.Time) (*models.Payment, error) {
+	query := bson.M{
+		"created_by": oid,
+		"kind":       kind,
+		"currency":   bson.M{"$ne": ""},
+		"created_at": bson.M{
+			"$gt":  after,
+			"$lte": until,
+		},
+	}
+	opt := options.FindOneOptions{
+		Sort: bson.M{"created_at": 1},
+	}
+	payment := models.NewPayment()
+	if found, err := findOne(ctx, r.coll, query, &opt, payment); !found {
+		return nil, err
+	}
+	return payment, nil
+}
+
+// find returns the payments matched in the order of their creation.
+func (r *MongoPaymentRepository) find(ctx context.Context, query bson.M) ([]*models.Payment, error) {
+	opt := options.FindOptions{
+		Sort: bson.M{"created_at": 1},
+	}
+	cursor, err := r.coll.Find(ctx, query, &opt)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = cursor.Close(ctx)
+	}()
+	payments := make([]*models.Payment, 0)
+	for cursor.Next(ctx) {
+		payment := models.NewPayment()
+		if err = cursor.Decode(payment); err != nil {
+			return nil, err
+		}
+		payments = append(payments, payment)
+	}
+	return payments, cursor.Err()
+}
+
+type MongoQuotaRepository struct {
+	coll *mongo.Collection
+}
+
+func NewMongoQuotaRepository(coll *mongo.Collection) *MongoQuotaRepository {
+	return &MongoQuotaRepository{
+		coll: coll,
+	}
+}
+
+func (r *MongoQuotaRepository) Active(ctx context.Context, oid, kind string, at time.Time) (*cloud.UserQuota, error) {
+	query := bson.M{
+		"created_by": oid,
+		"plan.kind":  kind,
+		"period_of_validity.start": bson.M{
+			"$lte": at,
+		},
+		"period_of_validity.end": bson.M{
+			"$gte": at,
+		},
+	}
+	quota := &cloud.UserQuota{}
+	if found, err := findOne(ctx, r.coll, query, nil, quota); !found {
+		return nil, err
+	}
+	return quota, nil
+}
+
+func (r *MongoQuotaRepository) EndWithin(ctx context.Context, after, until time.Time) ([]*cloud.UserQuota, error) {
+	query := bson.M{
+		"plan.type": bson.M{"$ne": nil},
+		"period_of_validity.end": bson.M{
+			"$gt":  after,
+			"$lte": until,
+		},
+	}
+	quotas := make([]*cloud.UserQuota, 0)
+	if err := findAll(ctx, r.coll, query, nil, &quotas); err != nil {
+		return nil, err
+	}
+	return quotas, nil
+}
+
+func (r *MongoQuotaRepository) StartWithin(ctx context.Context, oid, kind string, after, until time.Time) ([]*cloud.UserQuota, error) {
+	query := bson.M{
+		"created_by": oid,
+		"plan.kind":  kind,
+		"period_of_validity.start": bson.M{
+			"$gt":  after,
+			"$lte": until,
+		},
+	}
+	opt := options.FindOptions{
+		Sort: bson.M{"period_of_validity.start": 1},
+	}
+	quotas := make([]*cloud.UserQuota, 0)
+	if err := findAll(ctx, r.coll, query, &opt, &quotas); err != nil {
+		return nil, err
+	}
+	return quotas, nil
+}
+
+func (r *MongoQuotaRepository) ValidAfter(ctx context.Context, oids []string, since time.Time) ([]*cloud.UserQuota, error) {
+	query := bson.M{
+		"created_by":             bson.M{"$in": oids},
+		"period_of_validity.end": bson.M{"$gt": since},
+	}
+	quotas := make([]*cloud.UserQuota, 0)
+	if err := findAll(ctx, r.coll, query, nil, &quotas); err != nil {
+		return nil, err
+	}
+	return quotas, nil
+}
+
+type MongoAppRepository struct {
+	coll *mongo.Collection
+}
+
+func NewMongoAppRepository(coll *mongo.Collection) *MongoAppRepository {
+	return &MongoAppRepository{
+		coll: coll,
+	}
+}
+
+func (r *MongoAppRepository) ListByUser(ctx context.Context, oid string) ([]*cloud.App, error) {
+	apps := make([]*cloud.App, 0)
+	if err := findAll(ctx, r.coll, bson.M{"created_by": oid}, nil, &apps); err != nil {
+		return nil, err
+	}
+	return apps, nil
+}
+
+func (r *MongoAppRepository) GetMany(ctx context.Context, ids []primitive.ObjectID) ([]*cloud.App, error) {
+	apps := make([]*cloud.App, 0)
+	if len(ids) == 0 {
+		return apps, nil
+	}
+	query := bson.M{
+		"_id": bson.M{
+			"$in": ids,
+		},
+	}
+	if err := findAll(ctx, r.coll, query, nil, &apps); err != nil {
+		return nil, err
+	}
+	return apps, nil
+}
+
+func (r *MongoAppRepository) UpdatedSince(ctx context.Context, since time.Time) ([]primitive.ObjectID, error) {
+	query := bson.M{
+		"updated_at": bson.M{
+			"$gte": since,
+		},
+	}
+	opt := options.FindOptions{
+		Projection: bson.M{"_id": 1},
+	}
+	apps := make([]*cloud.App, 0)
+	if err := findAll(ctx, r.coll, query, &opt, &apps); err != nil {
+		return nil, err
+	}
+	ids := make([]primitive.ObjectID, 0, len(apps))
+	for _, app := range apps {
+		ids = append(ids, app.ID)
+	}
+	return ids, nil
+}
+
+type MongoConnectionRepository struct {
+	coll *mongo.Collection
+}
+
+func NewMongoConnectionRepository(coll *mongo.Collection) *MongoConnectionRepository {
+	return &MongoConnectionRepository{
+		coll: coll,
+	}
+}
+
+func (r *MongoConnectionRepository) ListByUser(ctx context.Context, oid string) ([]*cloud.Connection, error) {
+	connections := make([]*cloud.Connection, 0)
+	if err := findAll(ctx, r.coll, bson.M{"created_by": oid}, nil, &connections); err != nil {
+		return nil, err
+	}
+	return connections, nil
+}
+
+func usageByCollectedAt(ctx context.Context, coll *mongo.Collection, usage interface{}, from, to time.Time) (map[time.Time]uint64, error) {
+	pipeline := mongo.Pipeline{
+		{
+			{"$match", bson.M{
+				"collected_at": bson.M{
+					"$gte": from,
+					"$lt":  to,
+				},
+			}},
+		},
+		{
+			{"$group", bson.D{
+				{"_id", "$collected_at"},
+				{"usage", bson.D{
+					{"$sum", usage},
+				}},
+			}},
+		},
+	}
+	cursor, err := coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = cursor.Close(ctx)
+	}()
+	usages := make(map[time.Time]uint64)
+	for cursor.Next(ctx) {
+		var group struct {
+			Date  time.Time `bson:"_id"`
+			Usage uint64    `bson:"usage"`
+		}
+		if err = cursor.Decode(&group); err != nil {
+			return nil, err
+		}
+		usages[group.Date] += group.Usage
+	}
+	return usages, cursor.Err()
+}
+
+// userUsage aggregates the bills of the user grouped by the group field in
+// a single pipeline, the bills collected within [from, to) are grouped by
+// the collection time too.
+func userUsage(ctx context.Context, coll *mongo.Collection, oid, group string, usage interface{}, from, to time.Time) (*UsageFacet, error) {
+	pipeline := mongo.Pipeline{
+		{
+			{"$match", bson.D{
+				{"user_id", oid},
+			}},
+		},
+		{
+			{"$facet", bson.D{
+				{"totals", bson.A{
+					bson.D{
+						{"$group", bson.D{
+							{"_id", "$" + group},
+							{"usage", bson.D{{"$sum", usage}}},
+						}},
+					},
+					bson.D{
+						{"$project", bson.D{
+							{"_id", 0},
+							{"group", "$_id"},
+							{"usage", 1},
+						}},
+					},
+				}},
+				{"bills", bson.A{
+					bson.D{
+						{"$match", bson.D{
+							{"collected_at", bson.D{
+								{"$gte", from},
+								{"$lt", to},
+							}},
+						}},
+					},
+					bson.D{
+						{"$group", bson.D{
+							{"_id", bson.D{
+								{"group", "$" + group},
+								{"date", "$collected_at"},
+							}},
+							{"usage", bson.D{{"$sum", usage}}},
+						}},
+					},
+					bson.D{
+						{"$project", bson.D{
+							{"_id", 0},
+							{"group", "$_id.group"},
+							{"date", "$_id.date"},
+							{"usage", 1},
+						}},
+					},
+				}},
+			}},
+		},
+	}
+	cursor, err := coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = cursor.Close(ctx)
+	}()
+	facet := &UsageFacet{}
+	if cursor.Next(ctx) {
+		if err = cursor.Decode(facet); err != nil {
+			return nil, err
+		}
+	}
+	return facet, cursor.Err()
+}
+
+// findOne decodes the document matched into doc, found is false when there
+// is no document.
+func findOne(ctx context.Context, coll *mongo.Collection, query interface{}, opt *options.FindOneOptions, doc interface{}) (bool, error) {
+	opts := make([]*options.FindOneOptions, 0)
+	if opt != nil {
+		opts = append(opts, opt)
+	}
+	if err := coll.FindOne(ctx, query, opts...).Decode(doc); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// findAll decodes the documents matched into docs, a pointer to a slice.
+func findAll(ctx context.Context, coll *mongo.Collection, query interface{}, opt *options.FindOptions, docs interface{}) error {
+	opts := make([]*options.FindOptions, 0)
+	if opt != nil {
+		opts = append(opts, opt)
+	}
+	cursor, err := coll.Find(ctx, query, opts...)
+	if err != nil {
+		return err
+	}
+	return cursor.All(ctx, docs)
+}
+
+func exists(ctx context.Context, coll *mongo.Collection, query interface{}) (bool, error) {
+	err := coll.FindOne(ctx, query, options.FindOne().SetProjection(bson.M{"_id": 1})).Err()
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
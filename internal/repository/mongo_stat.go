@@ -0,0 +1,238 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/jyjiangkai/stat/models"
+	"github.com/jyjiangkai/stat/utils"
+)
+
+type MongoUserStatRepository struct {
+	coll *mongo.Collection
+}
+
+func NewMongoUserStatRepository(coll *mongo.Collection) *MongoUserStatRepository {
+	return &MongoUserStatRepository{
+		coll: coll,
+	}
+}
+
+func (r *MongoUserStatRepository) Get(ctx context.Context, oid string) (*models.User, error) {
+	user := &models.User{}
+	if found, err := findOne(ctx, r.coll, bson.M{"oidc_id": oid}, nil, user); !found {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (r *MongoUserStatRepository) CreatedBetween(ctx context.Context, start, end time.Time) ([]*models.User, error) {
+	query := bson.M{
+		"created_at": bson.M{
+			"$gte": start,
+			"$lte": end,
+		},
+	}
+	users := make([]*models.User, 0)
+	if err := findAll(ctx, r.coll, query, nil, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+type MongoDailyStatRepository struct {
+	coll *mongo.Collection
+}
+
+func NewMongoDailyStatRepository(coll *mongo.Collection) *MongoDailyStatRepository {
+	return &MongoDailyStatRepository{
+		coll: coll,
+	}
+}
+
+func (r *MongoDailyStatRepository) UserNumbers(ctx context.Context, start, end time.Time) ([]*models.DailyStatsOfUserNumber, error) {
+	query := bson.M{
+		"date": bson.M{
+			"$gte": start,
+			"$lte": end,
+		},
+		"tag": "user_number",
+	}
+	stats := make([]*models.DailyStatsOfUserNumber, 0)
+	if err := findAll(ctx, r.coll, query, nil, &stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+type MongoCohortRepository struct {
+	coll *mongo.Collection
+}
+
+func NewMongoCohortRepository(coll *mongo.Collection) *MongoCohortRepository {
+	return &MongoCohortRepository{
+		coll: coll,
+	}
+}
+
+func (r *MongoCohortRepository) GetByAlias(ctx context.Context, alias string) (*models.WeeklyCohortAnalysis, error) {
+	analysis := &models.WeeklyCohortAnalysis{}
+	if found, err := findOne(ctx, r.coll, bson.M{"week.alias": alias}, nil, analysis); !found {
+		return nil, err
+	}
+	return analysis, nil
+}
+
+func (r *MongoCohortRepository) Save(ctx context.Context, analysis *models.WeeklyCohortAnalysis) error {
+	return replace(ctx, r.coll, analysis.ID, analysis)
+}
+
+type MongoAlarmRepository struct {
+	coll *mongo.Collection
+}
+
+func NewMongoAlarmRepository(coll *mongo.Collection) *MongoAlarmRepository {
+	return &MongoAlarmRepository{
+		coll: coll,
+	}
+}
+
+func (r *MongoAlarmRepository) Get(ctx context.Context, id primitive.ObjectID) (*models.Alarm, error) {
+	alarm := &models.Alarm{}
+	if found, err := findOne(ctx, r.coll, bson.M{"_id": id}, nil, alarm); !found {
+		return nil, err
+	}
+	return alarm, nil
+}
+
+func (r *MongoAlarmRepository) GetActive(ctx context.Context, key string) (*models.Alarm, error) {
+	query := bson.M{
+		"key":   key,
+		"state": bson.M{"$ne": models.AlarmStateOfResolved},
+	}
+	alarm := &models.Alarm{}
+	if found, err := findOne(ctx, r.coll, query, nil, alarm); !found {
+		return nil, err
+	}
+	return alarm, nil
+}
+
+func (r *MongoAlarmRepository) ListActive(ctx context.Context) ([]*models.Alarm, error) {
+	query := bson.M{
+		"state": bson.M{"$ne": models.AlarmStateOfResolved},
+	}
+	alarms := make([]*models.Alarm, 0)
+	if err := findAll(ctx, r.coll, query, nil, &alarms); err != nil {
+		return nil, err
+	}
+	return alarms, nil
+}
+
+func (r *MongoAlarmRepository) Save(ctx context.Context, alarm *models.Alarm) error {
+	return replace(ctx, r.coll, alarm.ID, alarm)
+}
+
+func (r *MongoAlarmRepository) Count(ctx context.Context, query AlarmQuery) (int64, error) {
+	return r.coll.CountDocuments(ctx, alarmFilter(query))
+}
+
+func (r *MongoAlarmRepository) List(ctx context.Context, query AlarmQuery, pg Page) ([]*models.Alarm, error) {
+	alarms := make([]*models.Alarm, 0)
+	if err := findAll(ctx, r.coll, alarmFilter(query), pageOptions(pg, "last_seen"), &alarms); err != nil {
+		return nil, err
+	}
+	return alarms, nil
+}
+
+func alarmFilter(query AlarmQuery) bson.M {
+	filter := bson.M{
+		"last_seen": bson.M{
+			"$gte": query.SeenSince,
+		},
+	}
+	if !query.SeenUntil.IsZero() {
+		filter["last_seen"].(bson.M)["$lt"] = query.SeenUntil
+	}
+	if query.State != "" {
+		filter["state"] = query.State
+	}
+	return filter
+}
+
+type MongoAnomalyRepository struct {
+	coll *mongo.Collection
+}
+
+func NewMongoAnomalyRepository(coll *mongo.Collection) *MongoAnomalyRepository {
+	return &MongoAnomalyRepository{
+		coll: coll,
+	}
+}
+
+func (r *MongoAnomalyRepository) GetByDate(ctx context.Context, date time.Time, metric string) (*models.Anomaly, error) {
+	query := bson.M{
+		"date":   date,
+		"metric": metric,
+	}
+	anomaly := &models.Anomaly{}
+	if found, err := findOne(ctx, r.coll, query, nil, anomaly); !found {
+		return nil, err
+	}
+	return anomaly, nil
+}
+
+func (r *MongoAnomalyRepository) Save(ctx context.Context, anomaly *models.Anomaly) error {
+	return replace(ctx, r.coll, anomaly.ID, anomaly)
+}
+
+func (r *MongoAnomalyRepository) Count(ctx context.Context, query AnomalyQuery) (int64, error) {
+	return r.coll.CountDocuments(ctx, anomalyFilter(query))
+}
+
+func (r *MongoAnomalyRepository) List(ctx context.Context, query AnomalyQuery, pg Page) ([]*models.Anomaly, error) {
+	anomalies := make([]*models.Anomaly, 0)
+	if err := findAll(ctx, r.coll, anomalyFilter(query), pageOptions(pg, "date"), &anomalies); err != nil {
+		return nil, err
+	}
+	return anomalies, nil
+}
+
+func anomalyFilter(query AnomalyQuery) bson.M {
+	filter := bson.M{
+		"date": bson.M{
+			"$gte": query.Since,
+		},
+	}
+	if !query.Until.IsZero() {
+		filter["date"].(bson.M)["$lt"] = query.Until
+	}
+	if query.Metric != "" {
+		filter["metric"] = query.Metric
+	}
+	return filter
+}
+
+func pageOptions(pg Page, sortBy string) *options.FindOptions {
+	direction := -1
+	if pg.Asc {
+		direction = 1
+	}
+	return &options.FindOptions{
+		Limit: &pg.Limit,
+		Skip:  &pg.Skip,
+		Sort:  bson.M{sortBy: direction},
+	}
+}
+
+func replace(ctx context.Context, coll *mongo.Collection, id primitive.ObjectID, doc interface{}) error {
+	opts := &options.ReplaceOptions{
+		Upsert: utils.PtrBool(true),
+	}
+	_, err := coll.ReplaceOne(ctx, bson.M{"_id": id}, doc, opts)
+	return err
+}
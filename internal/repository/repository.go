@@ -0,0 +1,210 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/jyjiangkai/stat/models"
+	"github.com/jyjiangkai/stat/models/cloud"
+)
+
+// The repositories hide how the services read and write the collections, the
+// lookups returning a single document return nil when it doesn't exist.
+// They cover the reads the scheduled jobs share and the tests fake, the
+// paged lists and the aggregations behind a single dashboard endpoint stay
+// in the services which own them.
+
+// UserRepository is the users of the cloud.
+type UserRepository interface {
+	Count(ctx context.Context) (int64, error)
+	// CountCreated counts the users created within [start, end]
+	CountCreated(ctx context.Context, start, end time.Time) (int64, error)
+	// Range calls fn with limit users from skip in the order of their
+	// creation one by one, it stops at the first error fn returns
+	Range(ctx context.Context, skip, limit int64, fn func(*cloud.User) error) error
+}
+
+// ActionRepository is the actions tracked from the websites.
+type ActionRepository interface {
+	// Exists reports whether the user did the action since the given time,
+	// any action counts when it is empty
+	Exists(ctx context.Context, oid, action string, since time.Time) (bool, error)
+}
+
+// BillRepository is the daily bills of the Connect connections.
+type BillRepository interface {
+	// UsageByCollectedAt sums the delivered events of the bills collected
+	// within [from, to) per collection time
+	UsageByCollectedAt(ctx context.Context, from, to time.Time) (map[time.Time]uint64, error)
+	// UserUsage sums the delivered events of the user per connection
+	UserUsage(ctx context.Context, oid string, from, to time.Time) (*UsageFacet, error)
+}
+
+// AIBillRepository is the bills of the AI apps.
+type AIBillRepository interface {
+	// UsageByCollectedAt sums the usage of the bills collected within
+	// [from, to) per collection time
+	UsageByCollectedAt(ctx context.Context, from, to time.Time) (map[time.Time]uint64, error)
+	// UserUsage sums the usage of the user per app
+	UserUsage(ctx context.Context, oid string, from, to time.Time) (*UsageFacet, error)
+	// UserTotal sums the usage of the bills of the user collected up to until
+	UserTotal(ctx context.Context, oid string, until time.Time) (uint64, error)
+}
+
+// PaymentRepository is the payments of the users.
+type PaymentRepository interface {
+	// Latest returns the latest payment of the user for the kind of plan
+	Latest(ctx context.Context, oid, kind string) (*models.Payment, error)
+	// List returns the payments of the user created within [start, end)
+	// in the order of their creation
+	List(ctx context.Context, oid string, start, end time.Time) ([]*models.Payment, error)
+	// ExistsSince reports whether the user paid since the given time
+	ExistsSince(ctx context.Context, oid string, since time.Time) (bool, error)
+	// FirstPaid returns the time of the first paid payment of every user for
+	// the kind of plan, any kind when it is empty
+	FirstPaid(ctx context.Context, kind string) (map[string]time.Time, error)
+	// Paid returns the paid payments for the kind of plan created within
+	// [start, end) in the order of their creation, any kind when it is empty
+	Paid(ctx context.Context, kind string, start, end time.Time) ([]*models.Payment, error)
+	// FirstWithin returns the first payment in a currency of the user for
+	// the kind of plan created within (after, until]
+	FirstWithin(ctx context.Context, oid, kind string, after, until time.Time) (*models.Payment, error)
+}
+
+// QuotaRepository is the quotas granted by the plans of the users.
+type QuotaRepository interface {
+	// Active returns the quota of the user for the kind of plan valid at
+	Active(ctx context.Context, oid, kind string, at time.Time) (*cloud.UserQuota, error)
+	// EndWithin returns the quotas with a plan type which end within
+	// (after, until]
+	EndWithin(ctx context.Context, after, until time.Time) ([]*cloud.UserQuota, error)
+	// StartWithin returns the quotas of the user for the kind of plan which
+	// start within (after, until] in the order of their start
+	StartWithin(ctx context.Context, oid, kind string, after, until time.Time) ([]*cloud.UserQuota, error)
+	// ValidAfter returns the quotas of the users which end after since
+	ValidAfter(ctx context.Context, oids []string, since time.Time) ([]*cloud.UserQuota, error)
+}
+
+// AppRepository is the AI apps.
+type AppRepository interface {
+	ListByUser(ctx context.Context, oid string) ([]*cloud.App, error)
+	// GetMany returns the apps of the ids, the deleted ones are left out
+	GetMany(ctx context.Context, ids []primitive.ObjectID) ([]*cloud.App, error)
+	// UpdatedSince returns the ids of the apps updated since the given time
+	UpdatedSince(ctx context.Context, since time.Time) ([]primitive.ObjectID, error)
+}
+
+// ConnectionRepository is the Connect connections.
+type ConnectionRepository interface {
+	ListByUser(ctx context.Context, oid string) ([]*cloud.Connection, error)
+}
+
+// UserStatRepository is the user_stats collection.
+type UserStatRepository interface {
+	Get(ctx context.Context, oid string) (*models.User, error)
+	// CreatedBetween returns the users created within [start, end]
+	CreatedBetween(ctx context.Context, start, end time.Time) ([]*models.User, error)
+}
+
+// DailyStatRepository is the daily_stats collection.
+type DailyStatRepository interface {
+	// UserNumbers returns the daily user numbers within [start, end]
+	UserNumbers(ctx context.Context, start, end time.Time) ([]*models.DailyStatsOfUserNumber, error)
+}
+
+// CohortRepository is the weekly_cohort collection.
+type CohortRepository interface {
+	GetByAlias(ctx context.Context, alias string) (*models.WeeklyCohortAnalysis, error)
+	Save(ctx context.Context, analysis *models.WeeklyCohortAnalysis) error
+}
+
+// AlarmRepository is the alarms collection.
+type AlarmRepository interface {
+	Get(ctx context.Context, id primitive.ObjectID) (*models.Alarm, error)
+	// GetActive returns the alarm of the key which isn't resolved yet
+	GetActive(ctx context.Context, key string) (*models.Alarm, error)
+	ListActive(ctx context.Context) ([]*models.Alarm, error)
+	Save(ctx context.Context, alarm *models.Alarm) error
+	Count(ctx context.Context, query AlarmQuery) (int64, error)
+	// List returns a page of the alarms sorted by the time they were seen last
+	List(ctx context.Context, query AlarmQuery, pg Page) ([]*models.Alarm, error)
+}
+
+// AnomalyRepository is the anomalies collection.
+type AnomalyRepository interface {
+	GetByDate(ctx context.Context, date time.Time, metric string) (*models.Anomaly, error)
+	Save(ctx context.Context, anomaly *models.Anomaly) error
+	Count(ctx context.Context, query AnomalyQuery) (int64, error)
+	// List returns a page of the anomalies sorted by their date
+	List(ctx context.Context, query AnomalyQuery, pg Page) ([]*models.Anomaly, error)
+}
+
+// Page selects a page of a list.
+type Page struct {
+	Skip  int64
+	Limit int64
+	Asc   bool
+}
+
+type AlarmQuery struct {
+	// SeenSince and SeenUntil select the alarms seen last within the range,
+	// the end is exclusive and a zero one is unbounded
+	SeenSince time.Time
+	SeenUntil time.Time
+	State     string
+}
+
+type AnomalyQuery struct {
+	// Since and Until select the anomalies of the days within the range, the
+	// end is exclusive and a zero one is unbounded
+	Since  time.Time
+	Until  time.Time
+	Metric string
+}
+
+// UsageFacet is the usage of a user per app or connection, in total and per
+// collection time within the range asked for.
+type UsageFacet struct {
+	Totals []*GroupUsage `bson:"totals"`
+	Bills  []*GroupUsage `bson:"bills"`
+}
+
+// GroupUsage is the usage of an app or a connection, Date is the collection
+// time, which is zero for the totals.
+type GroupUsage struct {
+	ID    primitive.ObjectID `bson:"group"`
+	Date  time.Time          `bson:"date"`
+	Usage uint64             `bson:"usage"`
+}
+
+var (
+	_ UserRepository       = (*MongoUserRepository)(nil)
+	_ ActionRepository     = (*MongoActionRepository)(nil)
+	_ BillRepository       = (*MongoBillRepository)(nil)
+	_ AIBillRepository     = (*MongoAIBillRepository)(nil)
+	_ PaymentRepository    = (*MongoPaymentRepository)(nil)
+	_ QuotaRepository      = (*MongoQuotaRepository)(nil)
+	_ AppRepository        = (*MongoAppRepository)(nil)
+	_ ConnectionRepository = (*MongoConnectionRepository)(nil)
+	_ UserStatRepository   = (*MongoUserStatRepository)(nil)
+	_ DailyStatRepository  = (*MongoDailyStatRepository)(nil)
+	_ CohortRepository     = (*MongoCohortRepository)(nil)
+	_ AlarmRepository      = (*MongoAlarmRepository)(nil)
+	_ AnomalyRepository    = (*MongoAnomalyRepository)(nil)
+
+	_ UserRepository       = (*MemoryUserRepository)(nil)
+	_ ActionRepository     = (*MemoryActionRepository)(nil)
+	_ BillRepository       = (*MemoryBillRepository)(nil)
+	_ AIBillRepository     = (*MemoryAIBillRepository)(nil)
+	_ PaymentRepository    = (*MemoryPaymentRepository)(nil)
+	_ QuotaRepository      = (*MemoryQuotaRepository)(nil)
+	_ AppRepository        = (*MemoryAppRepository)(nil)
+	_ ConnectionRepository = (*MemoryConnectionRepository)(nil)
+	_ UserStatRepository   = (*MemoryUserStatRepository)(nil)
+	_ DailyStatRepository  = (*MemoryDailyStatRepository)(nil)
+	_ CohortRepository     = (*MemoryCohortRepository)(nil)
+	_ AlarmRepository      = (*MemoryAlarmRepository)(nil)
+	_ AnomalyRepository    = (*MemoryAnomalyRepository)(nil)
+)
@@ -4,7 +4,6 @@ import (
 	"context"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -14,10 +13,13 @@ import (
 
 	"github.com/jyjiangkai/stat/api"
 	"github.com/jyjiangkai/stat/db"
+	"github.com/jyjiangkai/stat/internal/repository"
 	"github.com/jyjiangkai/stat/log"
 	"github.com/jyjiangkai/stat/mailchimp"
 	"github.com/jyjiangkai/stat/models"
 	"github.com/jyjiangkai/stat/models/cloud"
+	"github.com/jyjiangkai/stat/timezone"
+	"github.com/jyjiangkai/stat/utils"
 )
 
 const (
@@ -34,14 +36,15 @@ const (
 type ActionService struct {
 	cli            *mongo.Client
 	userColl       *mongo.Collection
-	appColl        *mongo.Collection
+	apps           repository.AppRepository
 	connectionColl *mongo.Collection
 	chatColl       *mongo.Collection
 	statColl       *mongo.Collection
 	dailyStatColl  *mongo.Collection
 	actionColl     *mongo.Collection
 	trackColl      *mongo.Collection
-	appCache       sync.Map
+	appCache       *lookupCache
+	appsCheckedAt  time.Time
 	closeC         chan struct{}
 }
 
@@ -49,13 +52,15 @@ func NewActionService(cli *mongo.Client) *ActionService {
 	return &ActionService{
 		cli:            cli,
 		userColl:       cli.Database(db.GetDatabaseName()).Collection("users"),
-		appColl:        cli.Database(db.GetDatabaseName()).Collection("ai_app"),
+		apps:           repository.NewMongoAppRepository(cli.Database(db.GetDatabaseName()).Collection("ai_app")),
 		connectionColl: cli.Database(db.GetDatabaseName()).Collection("connections"),
 		chatColl:       cli.Database(db.GetDatabaseName()).Collection("ai_chat_history"),
 		statColl:       cli.Database(DatabaseOfUserStatistics).Collection("user_stats"),
 		dailyStatColl:  cli.Database(DatabaseOfUserStatistics).Collection("daily_stats"),
 		actionColl:     cli.Database(DatabaseOfUserAnalytics).Collection("user_actions"),
 		trackColl:      cli.Database(DatabaseOfUserAnalytics).Collection("user_tracks"),
+		appCache:       newLookupCache(LookupCacheSize, LookupCacheTTL),
+		appsCheckedAt:  time.Now(),
 		closeC:         make(chan struct{}),
 	}
 }
@@ -76,6 +81,10 @@ func (as *ActionService) Start() error {
 				if err != nil {
 					log.Error(ctx).Err(err).Msgf("failed to update time format at %+v", time.Now())
 				}
+				err = as.invalidateUpdatedApps(ctx)
+				if err != nil {
+					log.Error(ctx).Err(err).Msgf("failed to invalidate updated apps at %+v", time.Now())
+				}
 			}
 		}
 	}()
@@ -139,7 +148,7 @@ func (as *ActionService) weeklyViewPriceUserTracking(ctx context.Context, now ti
 			User:  user.OID,
 			Tag:   ActionTypeOfRedirectChangePlan,
 			Count: counts[user.OID],
-			Time:  time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC),
+			Time:  utils.ToBillTimeForAI(now, timezone.Reporting()),
 		}
 		_, err := as.trackColl.InsertOne(ctx, track)
 		if err != nil {
@@ -290,35 +299,11 @@ func (as *ActionService) list(ctx context.Context, pg api.Page, filters api.Filt
 		if err = cursor.Decode(action); err != nil {
 			return nil, db.HandleDBError(err)
 		}
-		if action.Payload.AppID != "" {
-			if app, ok := as.appCache.Load(action.Payload.AppID); ok {
-				action.App = app.(*models.ActionApp)
-			} else {
-				id, _ := primitive.ObjectIDFromHex(action.Payload.AppID)
-				result := as.appColl.FindOne(ctx, bson.M{"_id": id})
-				if result.Err() != nil {
-					return nil, db.HandleDBError(result.Err())
-				}
-				app := &cloud.App{}
-				if err := result.Decode(app); err != nil {
-					return nil, db.HandleDBError(err)
-				}
-				actionApp := &models.ActionApp{
-					Name:     app.Name,
-					Type:     app.Type,
-					Model:    app.Model,
-					Status:   string(app.Status),
-					Greeting: app.Greeting,
-					Prompt:   app.Prompt,
-				}
-				action.App = actionApp
-				as.appCache.Store(action.Payload.AppID, actionApp)
-			}
-		} else {
-			action.App = models.NewActionApp()
-		}
 		list = append(list, action)
 	}
+	if err = as.fillActionApps(ctx, list); err != nil {
+		return nil, err
+	}
 	return &api.ListResult{
 		List: list,
 		P:    pg,
@@ -326,6 +311,7 @@ func (as *ActionService) list(ctx context.Context, pg api.Page, filters api.Filt
 }
 
 func (as *ActionService) listConnectionTemplateCreatedNumber(ctx context.Context, pg api.Page, opts *api.ListOptions) (*api.ListResult, error) {
+	loc := timezone.Of(ctx)
 	pipeline := mongo.Pipeline{
 		{
 			{"$match", bson.D{
@@ -335,7 +321,7 @@ func (as *ActionService) listConnectionTemplateCreatedNumber(ctx context.Context
 		{
 			{"$project", bson.D{
 				{"date", bson.D{
-					{"$dateToString", bson.M{"format": "%Y-%m-%d", "date": "$created_at"}},
+					{"$dateToString", bson.M{"format": "%Y-%m-%d", "date": "$created_at", "timezone": loc.String()}},
 				}},
 			}},
 		},
@@ -382,8 +368,8 @@ func (as *ActionService) listConnectionTemplateCreatedNumber(ctx context.Context
 		results[cg.Date] = cg
 	}
 	list := make([]interface{}, 0)
-	now := time.Now()
-	date := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, -1, 0)
+	now := time.Now().In(loc)
+	date := utils.ToBillTimeForAI(now, loc).AddDate(0, -1, 0)
 	for {
 		timeStr := date.Format(layout)
 		if cg, ok := results[timeStr]; ok {
@@ -426,14 +412,14 @@ func (as *ActionService) listConnectionTemplateCreated(ctx context.Context, pg a
 		}, nil
 	}
 
-	date, err := time.Parse("2006-01-02", pg.Range)
+	rg, err := GetRange(ctx, pg.Range)
 	if err != nil {
 		return nil, err
 	}
 	query := addActionFilter(ctx, filters)
 	query["created_at"] = bson.M{
-		"$gte": date,
-		"$lte": date.AddDate(0, 0, 1),
+		"$gte": rg.Start,
+		"$lt":  rg.End,
 	}
 	if pg.Tag == "" || pg.Tag == "all" {
 		query["template_id"] = bson.M{"$exists": true}
@@ -601,11 +587,16 @@ func (as *ActionService) listDailyActionNumber(ctx context.Context, pg api.Page,
 }
 
 func (as *ActionService) conversionOfShopifyLandingPage(ctx context.Context, pg api.Page, opts *api.ListOptions) (*api.ListResult, error) {
+	rg, err := GetRange(ctx, pg.Range)
+	if err != nil {
+		return nil, err
+	}
 	query := bson.M{
 		"date": bson.M{
-			"$gte": GetStartAt(ctx, pg.Range),
-			// "$lte": end,
+			"$gte": rg.Start,
+			"$lt":  rg.End,
 		},
+		"timezone": timezone.Query(timezone.Reporting()),
 		"tag": bson.M{
 			"$regex": UserActionOfShopifyLandingPage,
 		},
@@ -657,11 +648,16 @@ func (as *ActionService) conversionOfShopifyLandingPage(ctx context.Context, pg
 }
 
 func (as *ActionService) conversionOfGithubLandingPage(ctx context.Context, pg api.Page, opts *api.ListOptions) (*api.ListResult, error) {
+	rg, err := GetRange(ctx, pg.Range)
+	if err != nil {
+		return nil, err
+	}
 	query := bson.M{
 		"date": bson.M{
-			"$gte": GetStartAt(ctx, pg.Range),
-			// "$lte": end,
+			"$gte": rg.Start,
+			"$lt":  rg.End,
 		},
+		"timezone": timezone.Query(timezone.Reporting()),
 		"tag": bson.M{
 			"$regex": UserActionOfGithubLandingPage,
 		},
@@ -713,11 +709,16 @@ func (as *ActionService) conversionOfGithubLandingPage(ctx context.Context, pg a
 }
 
 func (as *ActionService) conversionOfAWSCampaignsPage(ctx context.Context, pg api.Page, opts *api.ListOptions) (*api.ListResult, error) {
+	rg, err := GetRange(ctx, pg.Range)
+	if err != nil {
+		return nil, err
+	}
 	query := bson.M{
 		"date": bson.M{
-			"$gte": GetStartAt(ctx, pg.Range),
-			// "$lte": end,
+			"$gte": rg.Start,
+			"$lt":  rg.End,
 		},
+		"timezone": timezone.Query(timezone.Reporting()),
 		"tag": bson.M{
 			"$regex": UserActionOfAWSCampaignsPage,
 		},
@@ -769,12 +770,17 @@ func (as *ActionService) conversionOfAWSCampaignsPage(ctx context.Context, pg ap
 }
 
 func (as *ActionService) actionOfLandingPage(ctx context.Context, pg api.Page, opts *api.ListOptions) (*api.ListResult, error) {
+	rg, err := GetRange(ctx, pg.Range)
+	if err != nil {
+		return nil, err
+	}
 	query := bson.M{
 		"date": bson.M{
-			"$gte": GetStartAt(ctx, pg.Range),
-			// "$lte": end,
+			"$gte": rg.Start,
+			"$lt":  rg.End,
 		},
-		"tag": pg.Tag,
+		"timezone": timezone.Query(timezone.Reporting()),
+		"tag":      pg.Tag,
 	}
 	opt := options.FindOptions{
 		Sort: bson.M{"date": 1},
@@ -963,41 +969,94 @@ func (as *ActionService) get(ctx context.Context, pg api.Page, filters api.Filte
 		if err = cursor.Decode(action); err != nil {
 			return nil, db.HandleDBError(err)
 		}
-		if action.Payload.AppID != "" {
-			if app, ok := as.appCache.Load(action.Payload.AppID); ok {
-				action.App = app.(*models.ActionApp)
-			} else {
-				id, _ := primitive.ObjectIDFromHex(action.Payload.AppID)
-				result := as.appColl.FindOne(ctx, bson.M{"_id": id})
-				if result.Err() != nil {
-					return nil, db.HandleDBError(result.Err())
-				}
-				app := &cloud.App{}
-				if err := result.Decode(app); err != nil {
-					return nil, db.HandleDBError(err)
-				}
-				actionApp := &models.ActionApp{
-					Name:     app.Name,
-					Type:     app.Type,
-					Model:    app.Model,
-					Status:   string(app.Status),
-					Greeting: app.Greeting,
-					Prompt:   app.Prompt,
-				}
-				action.App = actionApp
-				as.appCache.Store(action.Payload.AppID, actionApp)
-			}
-		} else {
-			action.App = models.NewActionApp()
-		}
 		list = append(list, action)
 	}
+	if err = as.fillActionApps(ctx, list); err != nil {
+		return nil, err
+	}
 	return &api.ListResult{
 		List: list,
 		P:    pg,
 	}, nil
 }
 
+// fillActionApps sets the app of the actions, the apps missing from the
+// cache are fetched with a single query.
+func (as *ActionService) fillActionApps(ctx context.Context, list []interface{}) error {
+	apps := make(map[string]*models.ActionApp)
+	missing := make([]primitive.ObjectID, 0)
+	for _, item := range list {
+		action := item.(*models.Action)
+		id := action.Payload.AppID
+		if id == "" {
+			continue
+		}
+		if _, ok := apps[id]; ok {
+			continue
+		}
+		if app, ok := as.appCache.Get(id); ok {
+			apps[id] = app.(*models.ActionApp)
+			continue
+		}
+		oid, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			apps[id] = models.NewActionApp()
+			continue
+		}
+		apps[id] = nil
+		missing = append(missing, oid)
+	}
+	if len(missing) > 0 {
+		found, err := as.apps.GetMany(ctx, missing)
+		if err != nil {
+			return db.HandleDBError(err)
+		}
+		for _, app := range found {
+			actionApp := &models.ActionApp{
+				Name:     app.Name,
+				Type:     app.Type,
+				Model:    app.Model,
+				Status:   string(app.Status),
+				Greeting: app.Greeting,
+				Prompt:   app.Prompt,
+			}
+			apps[app.ID.Hex()] = actionApp
+			as.appCache.Add(app.ID.Hex(), actionApp)
+		}
+		// the deleted apps are cached too, so they aren't looked up again
+		for _, oid := range missing {
+			if apps[oid.Hex()] == nil {
+				apps[oid.Hex()] = models.NewActionApp()
+				as.appCache.Add(oid.Hex(), apps[oid.Hex()])
+			}
+		}
+	}
+	for _, item := range list {
+		action := item.(*models.Action)
+		if app, ok := apps[action.Payload.AppID]; ok {
+			action.App = app
+		} else {
+			action.App = models.NewActionApp()
+		}
+	}
+	return nil
+}
+
+// invalidateUpdatedApps drops the apps updated since the last check from
+// the cache, so a renamed app shows up at once rather than after the ttl.
+func (as *ActionService) invalidateUpdatedApps(ctx context.Context) error {
+	now := time.Now()
+	ids, err := as.apps.UpdatedSince(ctx, as.appsCheckedAt)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		as.appCache.Remove(id.Hex())
+	}
+	as.appsCheckedAt = now
+	return nil
+}
+
 func (as *ActionService) UpdateTime(ctx context.Context) error {
 	// err := as.UpdateActionTime(ctx)
 	// if err != nil {
@@ -0,0 +1,310 @@
+package services
+
+import (
+	"context"
+	"math"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/jyjiangkai/stat/api"
+	"github.com/jyjiangkai/stat/db"
+	"github.com/jyjiangkai/stat/models"
+	"github.com/jyjiangkai/stat/timezone"
+	"github.com/jyjiangkai/stat/utils"
+)
+
+const (
+	activationRefOfNone = "none"
+)
+
+var (
+	// actionTime converts the time of an action to a date, it's an RFC 3339
+	// string or a legacy epoch in nanoseconds or milliseconds like
+	// "1690000000000", the ones which can't be converted are null
+	actionTime = bson.M{
+		"$cond": bson.A{
+			bson.M{"$regexMatch": bson.M{"input": "$time", "regex": "^[0-9]+$"}},
+			bson.M{"$toDate": bson.M{"$cond": bson.A{
+				bson.M{"$gt": bson.A{bson.M{"$strLenCP": "$time"}, 13}},
+				bson.M{"$toLong": bson.M{"$divide": bson.A{bson.M{"$toLong": "$time"}, int64(time.Millisecond)}}},
+				bson.M{"$toLong": "$time"},
+			}}},
+			bson.M{"$dateFromString": bson.M{"dateString": "$time", "onError": nil, "onNull": nil}},
+		},
+	}
+)
+
+// getActivation finds the first time the user reached every milestone, the
+// milestones of the stored activation are reached already and kept as they
+// are, so a fully activated user costs no query.
+func (ss *StatService) getActivation(ctx context.Context, oid string, stored *models.Activation) (*models.Activation, error) {
+	activation := &models.Activation{}
+	if stored != nil {
+		*activation = *stored
+	}
+	var err error
+	if activation.FirstLogin == nil {
+		if activation.FirstLogin, err = ss.getFirstLogin(ctx, oid); err != nil {
+			return nil, err
+		}
+	}
+	if activation.FirstDelivery == nil {
+		delivered, err := firstTime(ctx, ss.billColl, bson.M{"user_id": oid, "delivered_num": bson.M{"$gt": 0}}, "collected_at")
+		if err != nil {
+			return nil, err
+		}
+		// the bills are collected the day after the delivery
+		if delivered != nil {
+			at := delivered.AddDate(0, 0, -1)
+			activation.FirstDelivery = &at
+		}
+	}
+	firsts := []struct {
+		at    **time.Time
+		coll  *mongo.Collection
+		query bson.M
+		field string
+	}{
+		{&activation.FirstApp, ss.aiAppColl, bson.M{"created_by": oid}, "created_at"},
+		{&activation.FirstUpload, ss.aiUploadColl, bson.M{"created_by": oid}, "created_at"},
+		{&activation.FirstConnection, ss.connectionColl, bson.M{"created_by": oid}, "created_at"},
+		{&activation.FirstPayment, ss.paymentColl, bson.M{"created_by": oid, "currency": bson.M{"$ne": ""}}, "created_at"},
+	}
+	for _, first := range firsts {
+		if *first.at != nil {
+			continue
+		}
+		if *first.at, err = firstTime(ctx, first.coll, first.query, first.field); err != nil {
+			return nil, err
+		}
+	}
+	return activation, nil
+}
+
+// getStoredActivation returns the activation of the stat user, nil when the
+// user has no stat user yet.
+func (ss *StatService) getStoredActivation(ctx context.Context, oid string) (*models.Activation, error) {
+	opt := options.FindOneOptions{
+		Projection: bson.M{"activation": 1},
+	}
+	user := &models.User{}
+	err := ss.userStatColl.FindOne(ctx, bson.M{"oidc_id": oid}, &opt).Decode(user)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return user.Activation, nil
+}
+
+// getFirstLogin returns the time of the first action of the user, there are
+// no login actions so any action counts. The times are compared as dates as
+// the legacy epoch strings sort before the RFC 3339 ones.
+func (ss *StatService) getFirstLogin(ctx context.Context, oid string) (*time.Time, error) {
+	pipeline := mongo.Pipeline{
+		{
+			{"$match", bson.M{"usersub": oid}},
+		},
+		{
+			{"$group", bson.D{
+				{"_id", nil},
+				{"first", bson.M{"$min": actionTime}},
+			}},
+		},
+	}
+	cursor, err := ss.actionColl.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = cursor.Close(ctx)
+	}()
+	var group struct {
+		First *time.Time `bson:"first"`
+	}
+	if cursor.Next(ctx) {
+		if err = cursor.Decode(&group); err != nil {
+			return nil, err
+		}
+	}
+	return group.First, cursor.Err()
+}
+
+// firstTime returns the earliest time field of the documents matching the
+// query, nil when there are none.
+func firstTime(ctx context.Context, coll *mongo.Collection, query bson.M, field string) (*time.Time, error) {
+	opt := options.FindOneOptions{
+		Sort:       bson.M{field: 1},
+		Projection: bson.M{field: 1},
+	}
+	var doc bson.M
+	err := coll.FindOne(ctx, query, &opt).Decode(&doc)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, err
+	}
+	value, ok := doc[field].(primitive.DateTime)
+	if !ok {
+		return nil, nil
+	}
+	at := value.Time()
+	return &at, nil
+}
+
+type ActivationService struct {
+	cli          *mongo.Client
+	userStatColl *mongo.Collection
+	closeC       chan struct{}
+}
+
+func NewActivationService(cli *mongo.Client) *ActivationService {
+	return &ActivationService{
+		cli:          cli,
+		userStatColl: cli.Database(DatabaseOfUserStatistics).Collection("user_stats"),
+		closeC:       make(chan struct{}),
+	}
+}
+
+func (as *ActivationService) Start() error {
+	return nil
+}
+
+func (as *ActivationService) Stop() error {
+	return nil
+}
+
+// Report returns the activation rates and the time to every milestone of
+// the users who signed up within the range, grouped by the week they signed
+// up in or by where they were referred from.
+func (as *ActivationService) Report(ctx context.Context, expr, groupBy string) (*models.ActivationReport, error) {
+	switch groupBy {
+	case "":
+		groupBy = models.ActivationGroupByCohort
+	case models.ActivationGroupByCohort, models.ActivationGroupByRef:
+	default:
+		return nil, api.ErrInvalidParameter.WithMessage("unsupported group_by " + groupBy)
+	}
+	rg, err := GetRange(ctx, expr)
+	if err != nil {
+		return nil, err
+	}
+	loc := timezone.Of(ctx)
+	query := bson.M{
+		"created_at": bson.M{
+			"$gte": rg.Start,
+			"$lt":  rg.End,
+		},
+	}
+	opt := options.FindOptions{
+		Projection: bson.M{
+			"oidc_id":    1,
+			"created_at": 1,
+			"ref":        1,
+			"ref_host":   1,
+			"activation": 1,
+		},
+	}
+	cursor, err := as.userStatColl.Find(ctx, query, &opt)
+	if err != nil {
+		return nil, db.HandleDBError(err)
+	}
+	defer func() {
+		_ = cursor.Close(ctx)
+	}()
+	users := make(map[string][]*models.User)
+	all := make([]*models.User, 0)
+	for cursor.Next(ctx) {
+		user := &models.User{}
+		if err = cursor.Decode(user); err != nil {
+			return nil, db.HandleDBError(err)
+		}
+		key := activationRefOf(user)
+		if groupBy == models.ActivationGroupByCohort {
+			key = TimeToWeek(user.CreatedAt.In(loc)).Start.Format(detailDateLayout)
+		}
+		users[key] = append(users[key], user)
+		all = append(all, user)
+	}
+	if err = cursor.Err(); err != nil {
+		return nil, db.HandleDBError(err)
+	}
+
+	keys := make([]string, 0, len(users))
+	for key := range users {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	report := &models.ActivationReport{
+		GroupBy:  groupBy,
+		Timezone: loc.String(),
+		Groups:   make([]*models.ActivationGroup, 0, len(keys)),
+		Total:    activationGroupOf("all", all),
+	}
+	for _, key := range keys {
+		report.Groups = append(report.Groups, activationGroupOf(key, users[key]))
+	}
+	return report, nil
+}
+
+func activationRefOf(user *models.User) string {
+	if user.Ref != "" {
+		return user.Ref
+	}
+	if user.RefHost != "" {
+		return user.RefHost
+	}
+	return activationRefOfNone
+}
+
+// activationGroupOf computes the share of the users who reached every
+// milestone and the percentiles of the hours it took them since sign up.
+func activationGroupOf(key string, users []*models.User) *models.ActivationGroup {
+	group := &models.ActivationGroup{
+		Key:        key,
+		Users:      int64(len(users)),
+		Milestones: make([]*models.ActivationMilestone, 0, len(models.Milestones)),
+	}
+	for _, milestone := range models.Milestones {
+		hours := make([]float64, 0)
+		for _, user := range users {
+			at := user.Activation.Of(milestone)
+			if at == nil {
+				continue
+			}
+			hours = append(hours, math.Max(at.Sub(user.CreatedAt).Hours(), 0))
+		}
+		sort.Float64s(hours)
+		stat := &models.ActivationMilestone{
+			Milestone: milestone,
+			Reached:   int64(len(hours)),
+			P25:       utils.KeepTwoDecimalPlaces(percentile(hours, 0.25)),
+			P50:       utils.KeepTwoDecimalPlaces(percentile(hours, 0.5)),
+			P75:       utils.KeepTwoDecimalPlaces(percentile(hours, 0.75)),
+			P90:       utils.KeepTwoDecimalPlaces(percentile(hours, 0.9)),
+		}
+		if group.Users > 0 {
+			stat.Rate = utils.KeepTwoDecimalPlaces(float64(stat.Reached) / float64(group.Users) * 100)
+		}
+		group.Milestones = append(group.Milestones, stat)
+	}
+	return group
+}
+
+// percentile interpolates the p-th percentile of the sorted values.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := p * float64(len(sorted)-1)
+	lo := int(math.Floor(rank))
+	hi := int(math.Ceil(rank))
+	return sorted[lo] + (sorted[hi]-sorted[lo])*(rank-float64(lo))
+}
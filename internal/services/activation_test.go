@@ -0,0 +1,60 @@
+package services
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/jyjiangkai/stat/models"
+)
+
+func TestActivationGroupOf(t *testing.T) {
+	signup := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	after := func(hours int) *time.Time {
+		at := signup.Add(time.Duration(hours) * time.Hour)
+		return &at
+	}
+	users := []*models.User{
+		{Activation: &models.Activation{FirstLogin: after(0), FirstApp: after(1)}},
+		{Activation: &models.Activation{FirstLogin: after(2), FirstApp: after(3)}},
+		{Activation: &models.Activation{FirstLogin: after(4), FirstPayment: after(48)}},
+		// the stat users refreshed before the activation was computed
+		{},
+	}
+	for _, user := range users {
+		user.CreatedAt = signup
+	}
+	// a login before the sign up counts as right at it
+	users[0].Activation.FirstLogin = after(-1)
+
+	group := activationGroupOf("2024-04-29", users)
+	if group.Key != "2024-04-29" || group.Users != 4 || len(group.Milestones) != len(models.Milestones) {
+		t.Fatalf("activationGroupOf() = %+v", group)
+	}
+	want := map[string]models.ActivationMilestone{
+		models.MilestoneOfFirstLogin:   {Reached: 3, Rate: 75, P25: 1, P50: 2, P75: 3, P90: 3.6},
+		models.MilestoneOfFirstApp:     {Reached: 2, Rate: 50, P25: 1.5, P50: 2, P75: 2.5, P90: 2.8},
+		models.MilestoneOfFirstPayment: {Reached: 1, Rate: 25, P25: 48, P50: 48, P75: 48, P90: 48},
+		models.MilestoneOfFirstUpload:  {},
+	}
+	for _, got := range group.Milestones {
+		w, ok := want[got.Milestone]
+		if !ok {
+			continue
+		}
+		w.Milestone = got.Milestone
+		for _, v := range []struct{ got, want float64 }{
+			{float64(got.Reached), float64(w.Reached)},
+			{got.Rate, w.Rate},
+			{got.P25, w.P25},
+			{got.P50, w.P50},
+			{got.P75, w.P75},
+			{got.P90, w.P90},
+		} {
+			if math.Abs(v.got-v.want) > 1e-9 {
+				t.Errorf("milestone %s = %+v, want %+v", got.Milestone, *got, w)
+				break
+			}
+		}
+	}
+}
@@ -2,20 +2,20 @@ package services
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"time"
 
-	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 
+	"github.com/jyjiangkai/stat/api"
 	"github.com/jyjiangkai/stat/db"
+	"github.com/jyjiangkai/stat/internal/repository"
 	"github.com/jyjiangkai/stat/log"
+	"github.com/jyjiangkai/stat/models"
+	"github.com/jyjiangkai/stat/models/cloud"
 	"github.com/jyjiangkai/stat/monitor"
-)
-
-const (
-	UsageAlarmThreshold = 30 // trigger an alarm when usage decreases by 30% or more
+	"github.com/jyjiangkai/stat/utils"
 )
 
 type AlarmService struct {
@@ -25,10 +25,12 @@ type AlarmService struct {
 	quotaColl      *mongo.Collection
 	billColl       *mongo.Collection
 	aiBillColl     *mongo.Collection
+	alarms         repository.AlarmRepository
+	anomaly        *AnomalyService
 	closeC         chan struct{}
 }
 
-func NewAlarmService(cli *mongo.Client) *AlarmService {
+func NewAlarmService(cli *mongo.Client, anomaly *AnomalyService) *AlarmService {
 	return &AlarmService{
 		mgoCli:         cli,
 		connectionColl: cli.Database(db.GetDatabaseName()).Collection("connections"),
@@ -36,6 +38,8 @@ func NewAlarmService(cli *mongo.Client) *AlarmService {
 		quotaColl:      cli.Database(db.GetDatabaseName()).Collection("quotas"),
 		billColl:       cli.Database(db.GetDatabaseName()).Collection("bills"),
 		aiBillColl:     cli.Database(db.GetDatabaseName()).Collection("ai_bills"),
+		alarms:         repository.NewMongoAlarmRepository(cli.Database(DatabaseOfUserStatistics).Collection("alarms")),
+		anomaly:        anomaly,
 		closeC:         make(chan struct{}),
 	}
 }
@@ -71,163 +75,267 @@ func (as *AlarmService) Stop() error {
 }
 
 func (as *AlarmService) AlarmOfUsage(ctx context.Context, now time.Time) error {
-	err := as.AlarmOfConnectUsage(ctx, now)
+	detection, err := as.anomaly.DetectAnomalies(ctx, now)
 	if err != nil {
-		log.Error(ctx).Err(err).Msg("failed to alarm of connect usage")
+		log.Error(ctx).Err(err).Msg("failed to detect anomalies")
+		return err
 	}
-	err = as.AlarmOfAIUsage(ctx, now)
+	anomalies := make(map[string]*models.Anomaly)
+	for _, anomaly := range detection.Anomalies {
+		key := alarmKeyOfAnomaly(anomaly.Metric, anomaly.Direction)
+		anomalies[key] = anomaly
+		if err = as.fire(ctx, now, key, anomaly); err != nil {
+			log.Error(ctx).Err(err).Str("key", key).Msg("failed to fire alarm")
+			return err
+		}
+	}
+	// the alarms of metrics which were judged and are no longer anomalous are recovered
+	active, err := as.getActiveAlarms(ctx)
 	if err != nil {
-		log.Error(ctx).Err(err).Msg("failed to alarm of ai usage")
+		return err
+	}
+	for _, alarm := range active {
+		if _, ok := anomalies[alarm.Key]; ok || !utils.Contains(detection.Metrics, alarm.Metric) {
+			continue
+		}
+		if err = as.resolve(ctx, now, alarm); err != nil {
+			log.Error(ctx).Err(err).Str("key", alarm.Key).Msg("failed to resolve alarm")
+			return err
+		}
 	}
 	return nil
 }
 
-func (as *AlarmService) AlarmOfConnectUsage(ctx context.Context, now time.Time) error {
-	latest := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
-	before := latest.Add(-24 * time.Hour)
-	pipeline := mongo.Pipeline{
-		{
-			{"$match", bson.D{
-				{"collected_at", bson.M{"$in": []interface{}{latest, before}}},
-			}},
-		},
-		{
-			{"$group", bson.D{
-				{"_id", "$collected_at"},
-				{"usage", bson.D{
-					{"$sum", "$delivered_num"},
-				}},
-			}},
-		},
-		{
-			{"$sort", bson.D{
-				{"_id", -1},
-			}},
-		},
-	}
-	type usageGroup struct {
-		Date  time.Time `bson:"_id"`
-		Usage uint64    `bson:"usage"`
-	}
-	cursor, err := as.billColl.Aggregate(ctx, pipeline)
+func alarmKeyOfAnomaly(metric, direction string) string {
+	return fmt.Sprintf("anomaly:%s:%s", metric, direction)
+}
+
+func (as *AlarmService) fire(ctx context.Context, now time.Time, key string, anomaly *models.Anomaly) error {
+	message := AnomalyMessage(anomaly)
+	alarm, err := as.getActiveAlarm(ctx, key)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			log.Warn(ctx).Msg("no documents")
-		}
-		log.Error(ctx).Err(err).Msg("aggregate error")
 		return err
 	}
-	defer cursor.Close(ctx)
-	usage := make([]usageGroup, 0)
-	for cursor.Next(ctx) {
-		var usageGroup usageGroup
-		if err = cursor.Decode(&usageGroup); err != nil {
+	if alarm == nil {
+		if anomaly.Confidence < AnomalyAlarmConfidence {
+			log.Info(ctx).Str("metric", anomaly.Metric).Float64("confidence", anomaly.Confidence).Msg("anomaly has not reached the alarm confidence, no need alarm")
+			return nil
+		}
+		if err = monitor.SendAlarm(ctx, message); err != nil {
+			return err
+		}
+		alarm = &models.Alarm{
+			Base:      cloud.NewBase(ctx),
+			Key:       key,
+			Metric:    anomaly.Metric,
+			Direction: anomaly.Direction,
+			Message:   message,
+			FirstSeen: now,
+			LastSeen:  now,
+			History:   make([]*models.AlarmEvent, 0),
+		}
+		alarm.AddEvent(&models.AlarmEvent{
+			Time:     now,
+			State:    models.AlarmStateOfFiring,
+			Operator: utils.GetUserID(ctx),
+			Message:  message,
+			Notified: true,
+		})
+		return as.saveAlarm(ctx, alarm)
+	}
+
+	// the alarm is still firing, only notify again once a silence has expired
+	alarm.LastSeen = now
+	alarm.Message = message
+	if alarm.State == models.AlarmStateOfSilenced && !alarm.IsSilenced(now) {
+		if err = monitor.SendAlarm(ctx, message); err != nil {
 			return err
 		}
-		usage = append(usage, usageGroup)
+		alarm.SilencedUntil = nil
+		alarm.AddEvent(&models.AlarmEvent{
+			Time:     now,
+			State:    models.AlarmStateOfFiring,
+			Operator: utils.GetUserID(ctx),
+			Message:  message,
+			Notified: true,
+		})
+	} else {
+		log.Info(ctx).Str("key", key).Str("state", alarm.State).Msg("alarm is already active, no need alarm")
 	}
-	if len(usage) != 2 {
-		log.Error(ctx).Msgf("usage group len is %d\n", len(usage))
+	return as.saveAlarm(ctx, alarm)
+}
+
+func (as *AlarmService) resolve(ctx context.Context, now time.Time, alarm *models.Alarm) error {
+	message := fmt.Sprintf("[RESOLVED] the %s has recovered, the alarm lasted since %s", alarm.Metric, alarm.FirstSeen.Format("2006-01-02"))
+	if err := monitor.SendAlarm(ctx, message); err != nil {
 		return err
 	}
-	if usage[0].Usage >= usage[1].Usage {
-		log.Info(ctx).Msg("increased usage, no need for alarm")
-		return nil
+	alarm.ResolvedAt = &now
+	alarm.SilencedUntil = nil
+	alarm.AddEvent(&models.AlarmEvent{
+		Time:     now,
+		State:    models.AlarmStateOfResolved,
+		Operator: utils.GetUserID(ctx),
+		Message:  message,
+		Notified: true,
+	})
+	return as.saveAlarm(ctx, alarm)
+}
+
+func (as *AlarmService) getActiveAlarm(ctx context.Context, key string) (*models.Alarm, error) {
+	alarm, err := as.alarms.GetActive(ctx, key)
+	if err != nil {
+		return nil, db.HandleDBError(err)
 	}
-	decrease, needAlarm := ExceedingTheUsageAlarmThreshold(usage[0].Usage, usage[1].Usage)
-	if needAlarm {
-		err = monitor.SendAlarm(ctx, fmt.Sprintf("On %s %dth, the usage of connect was %d, decrease of %0.2f%% compared to the previous day", now.Month().String(), now.Day(), usage[0].Usage, decrease))
-		if err != nil {
-			return err
-		}
+	return alarm, nil
+}
+
+func (as *AlarmService) getActiveAlarms(ctx context.Context) ([]*models.Alarm, error) {
+	alarms, err := as.alarms.ListActive(ctx)
+	if err != nil {
+		return nil, db.HandleDBError(err)
+	}
+	return alarms, nil
+}
+
+func (as *AlarmService) saveAlarm(ctx context.Context, alarm *models.Alarm) error {
+	if err := as.alarms.Save(ctx, alarm); err != nil {
+		log.Error(ctx).Err(err).Str("key", alarm.Key).Msg("failed to save alarm")
+		return err
 	}
 	return nil
 }
 
-func (as *AlarmService) AlarmOfAIUsage(ctx context.Context, now time.Time) error {
-	date := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
-	latestUsage, err := as.getAIDailyUsage(ctx, date)
+func (as *AlarmService) Get(ctx context.Context, id string) (*models.Alarm, error) {
+	objID, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
-		return err
+		return nil, api.ErrInvalidID
 	}
-	beforeUsage, err := as.getAIDailyUsage(ctx, date.Add(-24*time.Hour))
+	alarm, err := as.alarms.Get(ctx, objID)
 	if err != nil {
-		return err
+		return nil, db.HandleDBError(err)
 	}
-	if latestUsage >= beforeUsage {
-		log.Info(ctx).Msg("increased usage, no need alarm")
-		return nil
+	if alarm == nil {
+		return nil, api.ErrResourceNotFound
 	}
-	decrease, needAlarm := ExceedingTheUsageAlarmThreshold(latestUsage, beforeUsage)
-	if needAlarm {
-		err = monitor.SendAlarm(ctx, fmt.Sprintf("On %s %dth, the usage of ai was %d, decrease of %0.2f%% compared to the previous day", now.Month().String(), now.Day(), latestUsage, decrease))
-		if err != nil {
-			return err
-		}
-	} else {
-		log.Info(ctx).Msg("decrease usage has not reached the alarm threshold, no need alarm")
+	return alarm, nil
+}
+
+// Acknowledge stops the notifications of an active alarm until it recovers.
+func (as *AlarmService) Acknowledge(ctx context.Context, id string) (*models.Alarm, error) {
+	alarm, err := as.Get(ctx, id)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	if alarm.State == models.AlarmStateOfResolved {
+		return nil, api.ErrInvalidResourceStatus.WithMessage("alarm has been resolved")
+	}
+	now := time.Now()
+	alarm.AcknowledgedBy = utils.GetUserID(ctx)
+	alarm.AcknowledgedAt = &now
+	alarm.SilencedUntil = nil
+	alarm.AddEvent(&models.AlarmEvent{
+		Time:     now,
+		State:    models.AlarmStateOfAcknowledged,
+		Operator: utils.GetUserID(ctx),
+	})
+	if err = as.saveAlarm(ctx, alarm); err != nil {
+		return nil, err
+	}
+	return alarm, nil
 }
 
-func (as *AlarmService) getAIDailyUsage(ctx context.Context, date time.Time) (uint64, error) {
-	pipeline := mongo.Pipeline{
-		{
-			{"$match", bson.M{
-				"collected_at": bson.M{
-					"$gt":  date.Add(-24 * time.Hour),
-					"$lte": date,
-				},
-			}},
-		},
-		{
-			{"$group", bson.D{
-				{"_id", bson.M{
-					"$dateToString": bson.M{
-						"format": date.Format("2006-01-02T"),
-						"date":   "$collected_at",
-					},
-				}},
-				{"usage", bson.D{
-					{"$sum", bson.D{
-						{"$add", []interface{}{
-							"$usage.chatgpt_3_5",
-							bson.M{"$multiply": []interface{}{"$usage.chatgpt_4", 20}},
-						}},
-					}},
-				}},
-			}},
-		},
-	}
-	type usageGroup struct {
-		Date  string `bson:"_id"`
-		Usage uint64 `bson:"usage"`
-	}
-	cursor, err := as.aiBillColl.Aggregate(ctx, pipeline)
+// Silence stops the notifications of an active alarm for the given duration,
+// the alarm notifies again if it is still firing after the silence expires.
+func (as *AlarmService) Silence(ctx context.Context, id string, duration time.Duration) (*models.Alarm, error) {
+	if duration <= 0 {
+		return nil, api.ErrInvalidParameter.WithMessage("silence duration must be positive")
+	}
+	alarm, err := as.Get(ctx, id)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			log.Warn(ctx).Msg("no documents")
-		}
-		log.Error(ctx).Err(err).Msg("aggregate error")
-		return 0, err
-	}
-	defer cursor.Close(ctx)
-	for cursor.Next(ctx) {
-		var usageGroup usageGroup
-		if err = cursor.Decode(&usageGroup); err != nil {
-			return 0, err
-		}
-		return usageGroup.Usage, nil
+		return nil, err
+	}
+	if alarm.State == models.AlarmStateOfResolved {
+		return nil, api.ErrInvalidResourceStatus.WithMessage("alarm has been resolved")
+	}
+	now := time.Now()
+	until := now.Add(duration)
+	alarm.SilencedBy = utils.GetUserID(ctx)
+	alarm.SilencedUntil = &until
+	alarm.AddEvent(&models.AlarmEvent{
+		Time:     now,
+		State:    models.AlarmStateOfSilenced,
+		Operator: utils.GetUserID(ctx),
+		Message:  fmt.Sprintf("silenced until %s", until.Format(time.RFC3339)),
+	})
+	if err = as.saveAlarm(ctx, alarm); err != nil {
+		return nil, err
 	}
-	return 0, errors.New("no usage group")
+	return alarm, nil
 }
 
-func ExceedingTheUsageAlarmThreshold(latest, before uint64) (float64, bool) {
-	new := float64(latest)
-	old := float64(before)
-	decrease := (old - new) / old * 100
-	if decrease > UsageAlarmThreshold {
-		return decrease, true
+func (as *AlarmService) List(ctx context.Context, pg api.Page, state string) (*api.ListResult, error) {
+	var (
+		skip  = pg.PageNumber * pg.PageSize
+		limit = pg.PageSize
+	)
+
+	if skip < 0 {
+		skip = 0
+	}
+
+	rg, err := GetRange(ctx, pg.Range)
+	if err != nil {
+		return nil, err
+	}
+	query := repository.AlarmQuery{
+		SeenSince: rg.Start,
+		SeenUntil: rg.End,
+		State:     state,
+	}
+	cnt, err := as.alarms.Count(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if cnt == 0 {
+		return &api.ListResult{
+			List: []interface{}{},
+			P:    pg,
+		}, nil
+	}
+	if cnt <= skip {
+		return nil, api.ErrPageArgumentsTooLarge
+	}
+
+	pg.Total = cnt
+	alarms, err := as.alarms.List(ctx, query, repository.Page{
+		Skip:  skip,
+		Limit: limit,
+		Asc:   pg.Direction == "asc",
+	})
+	if err != nil {
+		return nil, db.HandleDBError(err)
+	}
+	list := make([]interface{}, 0, len(alarms))
+	for _, alarm := range alarms {
+		list = append(list, alarm)
+	}
+	return &api.ListResult{
+		List: list,
+		P:    pg,
+	}, nil
+}
+
+func AnomalyMessage(anomaly *models.Anomaly) string {
+	change := 0.0
+	if anomaly.Expected > 0 {
+		change = (anomaly.Value - anomaly.Expected) / anomaly.Expected * 100
+	}
+	relation := "above"
+	if anomaly.Direction == AnomalyDirectionOfDrop {
+		relation = "below"
+		change = -change
 	}
-	return 0, false
+	return fmt.Sprintf("On %s %dth, the %s was %.0f, %0.2f%% %s the expected %.0f of the same weekday (confidence %0.2f%%)",
+		anomaly.Date.Month().String(), anomaly.Date.Day(), anomaly.Metric, anomaly.Value, change, relation, anomaly.Expected, anomaly.Confidence*100)
 }
@@ -0,0 +1,107 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/jyjiangkai/stat/internal/repository"
+	"github.com/jyjiangkai/stat/models"
+	"github.com/jyjiangkai/stat/models/cloud"
+)
+
+func aiBill(at time.Time, usage uint64) *cloud.AIBill {
+	return &cloud.AIBill{
+		ID:          primitive.NewObjectID(),
+		UserID:      "user",
+		CollectedAt: at,
+		AppID:       primitive.NewObjectID(),
+		Usage: &cloud.Usage{
+			ChatGPT35: usage,
+		},
+	}
+}
+
+func newTestAlarmService(aiBills *repository.MemoryAIBillRepository) (*AlarmService, *repository.MemoryAlarmRepository, *repository.MemoryAnomalyRepository) {
+	alarms := repository.NewMemoryAlarmRepository()
+	anomalies := repository.NewMemoryAnomalyRepository()
+	as := &AlarmService{
+		alarms: alarms,
+		anomaly: &AnomalyService{
+			bills:      repository.NewMemoryBillRepository(),
+			aiBills:    aiBills,
+			dailyStats: repository.NewMemoryDailyStatRepository(),
+			anomalies:  anomalies,
+		},
+	}
+	return as, alarms, anomalies
+}
+
+func TestAlarmOfUsage(t *testing.T) {
+	ctx := context.Background()
+	date := time.Date(2023, 9, 20, 0, 0, 0, 0, time.UTC)
+	aiBills := repository.NewMemoryAIBillRepository()
+	for week := 1; week <= AnomalyHistoryWeeks; week++ {
+		aiBills.Add(aiBill(date.AddDate(0, 0, -7*week).Add(10*time.Hour), 1000))
+	}
+	aiBills.Add(aiBill(date.Add(10*time.Hour), 6000), aiBill(date.Add(14*time.Hour), 4000))
+	as, alarms, anomalies := newTestAlarmService(aiBills)
+
+	now := date.AddDate(0, 0, 1).Add(2 * time.Hour)
+	if err := as.AlarmOfUsage(ctx, now); err != nil {
+		t.Fatalf("AlarmOfUsage() error = %v", err)
+	}
+	anomaly, _ := anomalies.GetByDate(ctx, date, MetricOfAIUsage)
+	if anomaly == nil {
+		t.Fatalf("no anomaly of %s was saved", MetricOfAIUsage)
+	}
+	if anomaly.Value != 10000 || anomaly.Expected != 1000 || anomaly.Direction != AnomalyDirectionOfSpike {
+		t.Errorf("anomaly = %+v, want a spike of 10000 over 1000", anomaly)
+	}
+	key := alarmKeyOfAnomaly(MetricOfAIUsage, AnomalyDirectionOfSpike)
+	alarm, _ := alarms.GetActive(ctx, key)
+	if alarm == nil {
+		t.Fatalf("alarm %s isn't firing", key)
+	}
+	if alarm.State != models.AlarmStateOfFiring || alarm.NotificationCount != 1 {
+		t.Errorf("alarm = %+v, want firing with one notification", alarm)
+	}
+
+	// detecting the same day again keeps a single alarm without notifying again
+	if err := as.AlarmOfUsage(ctx, now.Add(time.Hour)); err != nil {
+		t.Fatalf("AlarmOfUsage() error = %v", err)
+	}
+	active, _ := alarms.ListActive(ctx)
+	if len(active) != 1 || active[0].NotificationCount != 1 || !active[0].LastSeen.Equal(now.Add(time.Hour)) {
+		t.Errorf("active alarms = %+v, want the same alarm seen again", active)
+	}
+
+	// the usage is back to normal a week later
+	next := date.AddDate(0, 0, 7)
+	aiBills.Add(aiBill(next.Add(10*time.Hour), 1000))
+	if err := as.AlarmOfUsage(ctx, next.AddDate(0, 0, 1).Add(2*time.Hour)); err != nil {
+		t.Fatalf("AlarmOfUsage() error = %v", err)
+	}
+	if alarm, _ = alarms.GetActive(ctx, key); alarm != nil {
+		t.Errorf("alarm %s is still active: %+v", key, alarm)
+	}
+	resolved, _ := alarms.Get(ctx, active[0].ID)
+	if resolved == nil || resolved.State != models.AlarmStateOfResolved || resolved.ResolvedAt == nil {
+		t.Errorf("alarm = %+v, want resolved", resolved)
+	}
+}
+
+func TestAlarmOfUsageWithoutHistory(t *testing.T) {
+	ctx := context.Background()
+	date := time.Date(2023, 9, 20, 0, 0, 0, 0, time.UTC)
+	aiBills := repository.NewMemoryAIBillRepository(aiBill(date.Add(10*time.Hour), 10000))
+	as, alarms, _ := newTestAlarmService(aiBills)
+	if err := as.AlarmOfUsage(ctx, date.AddDate(0, 0, 1)); err != nil {
+		t.Fatalf("AlarmOfUsage() error = %v", err)
+	}
+	if active, _ := alarms.ListActive(ctx); len(active) != 0 {
+		t.Errorf("active alarms = %+v, want none without enough history", active)
+	}
+}
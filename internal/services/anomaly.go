@@ -0,0 +1,365 @@
+package services
+
+import (
+	"context"
+	"math"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/jyjiangkai/stat/api"
+	"github.com/jyjiangkai/stat/db"
+	"github.com/jyjiangkai/stat/internal/repository"
+	"github.com/jyjiangkai/stat/log"
+	"github.com/jyjiangkai/stat/models"
+	"github.com/jyjiangkai/stat/models/cloud"
+	"github.com/jyjiangkai/stat/timezone"
+	"github.com/jyjiangkai/stat/utils"
+)
+
+const (
+	MetricOfAIUsage            = "ai_usage"
+	MetricOfConnectUsage       = "connect_usage"
+	MetricOfRegisterUserNumber = "register_user_number"
+	MetricOfLoginUserNumber    = "login_user_number"
+
+	AnomalyDirectionOfSpike = "spike"
+	AnomalyDirectionOfDrop  = "drop"
+
+	AnomalyHistoryWeeks     = 8    // number of same-weekday samples used as the seasonal baseline
+	AnomalyMinHistory       = 4    // minimum number of samples required before a day can be judged
+	AnomalyScoreThreshold   = 3.0  // robust z-score beyond which a day is flagged
+	AnomalyAlarmConfidence  = 0.99 // minimum confidence for an anomaly to be notified
+	anomalyMinRelativeSigma = 0.05 // lower bound of sigma relative to the expected value
+)
+
+var (
+	AnomalyMetrics = []string{
+		MetricOfAIUsage,
+		MetricOfConnectUsage,
+		MetricOfRegisterUserNumber,
+		MetricOfLoginUserNumber,
+	}
+)
+
+// AnomalyDetection is the outcome of one detection run, Metrics holds the
+// metrics that had enough data to be judged on Date.
+type AnomalyDetection struct {
+	Date      time.Time
+	Metrics   []string
+	Anomalies []*models.Anomaly
+}
+
+type AnomalyService struct {
+	cli        *mongo.Client
+	bills      repository.BillRepository
+	aiBills    repository.AIBillRepository
+	dailyStats repository.DailyStatRepository
+	anomalies  repository.AnomalyRepository
+	closeC     chan struct{}
+}
+
+func NewAnomalyService(cli *mongo.Client) *AnomalyService {
+	return &AnomalyService{
+		cli:        cli,
+		bills:      repository.NewMongoBillRepository(cli.Database(db.GetDatabaseName()).Collection("bills")),
+		aiBills:    repository.NewMongoAIBillRepository(cli.Database(db.GetDatabaseName()).Collection("ai_bills")),
+		dailyStats: repository.NewMongoDailyStatRepository(cli.Database(DatabaseOfUserStatistics).Collection("daily_stats")),
+		anomalies:  repository.NewMongoAnomalyRepository(cli.Database(DatabaseOfUserStatistics).Collection("anomalies")),
+		closeC:     make(chan struct{}),
+	}
+}
+
+func (as *AnomalyService) Start() error {
+	return nil
+}
+
+func (as *AnomalyService) Stop() error {
+	return nil
+}
+
+// DetectAnomalies checks the last complete day of every metric against its
+// same-weekday history and stores the days that were flagged, the days are
+// the days of the reporting timezone.
+func (as *AnomalyService) DetectAnomalies(ctx context.Context, now time.Time) (*AnomalyDetection, error) {
+	loc := timezone.Reporting()
+	date := utils.ToBillTimeForAI(now, loc).AddDate(0, 0, -1)
+	start := date.AddDate(0, 0, -7*AnomalyHistoryWeeks)
+	detection := &AnomalyDetection{
+		Date:      date,
+		Metrics:   make([]string, 0),
+		Anomalies: make([]*models.Anomaly, 0),
+	}
+	for _, metric := range AnomalyMetrics {
+		series, err := as.getDailySeries(ctx, metric, start, date)
+		if err != nil {
+			log.Error(ctx).Err(err).Str("metric", metric).Msg("failed to get daily series")
+			return nil, err
+		}
+		value, history, ok := seasonalSamples(metric, date, series)
+		if !ok {
+			log.Warn(ctx).Str("metric", metric).Any("date", date).Msg("not enough data, skip anomaly detection")
+			continue
+		}
+		detection.Metrics = append(detection.Metrics, metric)
+		anomaly, ok := as.detect(ctx, metric, date, value, history)
+		if !ok {
+			continue
+		}
+		if err = as.saveAnomaly(ctx, anomaly); err != nil {
+			return nil, err
+		}
+		detection.Anomalies = append(detection.Anomalies, anomaly)
+	}
+	log.Info(ctx).Int("anomalies", len(detection.Anomalies)).Any("date", date).Msg("finish anomaly detection")
+	return detection, nil
+}
+
+// seasonalSamples returns the value of date and the values of the same
+// weekday in the previous weeks, ordered from oldest to newest.
+func seasonalSamples(metric string, date time.Time, series map[time.Time]float64) (float64, []float64, bool) {
+	value, ok := series[date]
+	if !ok {
+		if metric == MetricOfRegisterUserNumber || metric == MetricOfLoginUserNumber {
+			// daily stat is not ready yet
+			return 0, nil, false
+		}
+		// no bill was collected at all, which is exactly what a usage drop looks like
+		value = 0
+	}
+	history := make([]float64, 0, AnomalyHistoryWeeks)
+	for week := AnomalyHistoryWeeks; week >= 1; week-- {
+		if v, ok := series[date.AddDate(0, 0, -7*week)]; ok {
+			history = append(history, v)
+		}
+	}
+	if len(history) < AnomalyMinHistory {
+		return 0, nil, false
+	}
+	return value, history, true
+}
+
+func (as *AnomalyService) detect(ctx context.Context, metric string, date time.Time, value float64, history []float64) (*models.Anomaly, bool) {
+	result, ok := detectAnomaly(history, value)
+	if !ok {
+		return nil, false
+	}
+	anomaly := &models.Anomaly{
+		Base:       cloud.NewBase(ctx),
+		Date:       date,
+		Timezone:   date.Location().String(),
+		Metric:     metric,
+		Value:      value,
+		Expected:   result.expected,
+		Lower:      result.lower,
+		Upper:      result.upper,
+		Score:      result.score,
+		Confidence: result.confidence,
+		Direction:  result.direction,
+		Samples:    len(history),
+	}
+	return anomaly, true
+}
+
+type anomalyResult struct {
+	expected   float64
+	lower      float64
+	upper      float64
+	score      float64
+	confidence float64
+	direction  string
+}
+
+// detectAnomaly fits a robust (Theil-Sen) trend line over the same-weekday
+// history, which is ordered from oldest to newest, and scores the value
+// against the median absolute deviation of the residuals.
+func detectAnomaly(history []float64, value float64) (*anomalyResult, bool) {
+	n := len(history)
+	if n < AnomalyMinHistory {
+		return nil, false
+	}
+	slopes := make([]float64, 0, n*(n-1)/2)
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			slopes = append(slopes, (history[j]-history[i])/float64(j-i))
+		}
+	}
+	slope := median(slopes)
+	intercepts := make([]float64, n)
+	for i := range history {
+		intercepts[i] = history[i] - slope*float64(i)
+	}
+	intercept := median(intercepts)
+
+	residuals := make([]float64, n)
+	for i := range history {
+		residuals[i] = history[i] - (intercept + slope*float64(i))
+	}
+	center := median(residuals)
+	deviations := make([]float64, n)
+	for i := range residuals {
+		deviations[i] = math.Abs(residuals[i] - center)
+	}
+
+	expected := math.Max(intercept+slope*float64(n), 0)
+	sigma := 1.4826 * median(deviations)
+	sigma = math.Max(sigma, math.Max(anomalyMinRelativeSigma*expected, 1))
+
+	score := (value - expected) / sigma
+	if math.Abs(score) < AnomalyScoreThreshold {
+		return nil, false
+	}
+	result := &anomalyResult{
+		expected:   utils.KeepTwoDecimalPlaces(expected),
+		lower:      utils.KeepTwoDecimalPlaces(math.Max(expected-AnomalyScoreThreshold*sigma, 0)),
+		upper:      utils.KeepTwoDecimalPlaces(expected + AnomalyScoreThreshold*sigma),
+		score:      utils.KeepTwoDecimalPlaces(score),
+		confidence: math.Erf(math.Abs(score) / math.Sqrt2),
+		direction:  AnomalyDirectionOfSpike,
+	}
+	if score < 0 {
+		result.direction = AnomalyDirectionOfDrop
+	}
+	return result, true
+}
+
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := make([]float64, len(values))
+	copy(sorted, values)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+func (as *AnomalyService) getDailySeries(ctx context.Context, metric string, start, end time.Time) (map[time.Time]float64, error) {
+	switch metric {
+	case MetricOfAIUsage:
+		return as.getAIDailySeries(ctx, start, end)
+	case MetricOfConnectUsage:
+		return as.getConnectDailySeries(ctx, start, end)
+	case MetricOfRegisterUserNumber, MetricOfLoginUserNumber:
+		return as.getUserNumberDailySeries(ctx, metric, start, end)
+	}
+	return map[time.Time]float64{}, nil
+}
+
+func (as *AnomalyService) getAIDailySeries(ctx context.Context, start, end time.Time) (map[time.Time]float64, error) {
+	usages, err := as.aiBills.UsageByCollectedAt(ctx, start, end.AddDate(0, 0, 1))
+	if err != nil {
+		log.Error(ctx).Err(err).Msg("aggregate error")
+		return nil, err
+	}
+	series := make(map[time.Time]float64)
+	for collectedAt, usage := range usages {
+		series[utils.ToBillTimeForAI(collectedAt, start.Location())] += float64(usage)
+	}
+	return series, nil
+}
+
+func (as *AnomalyService) getConnectDailySeries(ctx context.Context, start, end time.Time) (map[time.Time]float64, error) {
+	// connect bills are collected at midnight UTC for the previous UTC day
+	usages, err := as.bills.UsageByCollectedAt(ctx, utcDay(start).AddDate(0, 0, 1), utcDay(end).AddDate(0, 0, 2))
+	if err != nil {
+		log.Error(ctx).Err(err).Msg("aggregate error")
+		return nil, err
+	}
+	series := make(map[time.Time]float64)
+	for collectedAt, usage := range usages {
+		day := utils.ToBillTimeForConnect(collectedAt)
+		date := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, start.Location())
+		series[date] += float64(usage)
+	}
+	return series, nil
+}
+
+func (as *AnomalyService) getUserNumberDailySeries(ctx context.Context, metric string, start, end time.Time) (map[time.Time]float64, error) {
+	stats, err := as.dailyStats.UserNumbers(ctx, start, end)
+	if err != nil {
+		return nil, err
+	}
+	series := make(map[time.Time]float64)
+	for _, daily := range stats {
+		date := daily.Date.In(start.Location())
+		if metric == MetricOfRegisterUserNumber {
+			series[date] = float64(daily.RegisterUserNumber)
+		} else {
+			series[date] = float64(daily.LoginUserNumber)
+		}
+	}
+	return series, nil
+}
+
+func (as *AnomalyService) saveAnomaly(ctx context.Context, anomaly *models.Anomaly) error {
+	existing, err := as.anomalies.GetByDate(ctx, anomaly.Date, anomaly.Metric)
+	if err != nil {
+		return db.HandleDBError(err)
+	}
+	if existing != nil {
+		anomaly.Base = existing.Base
+		anomaly.UpdatedAt = time.Now()
+	}
+	if err = as.anomalies.Save(ctx, anomaly); err != nil {
+		log.Error(ctx).Err(err).Str("metric", anomaly.Metric).Msg("failed to save anomaly")
+		return err
+	}
+	return nil
+}
+
+func (as *AnomalyService) List(ctx context.Context, pg api.Page, metric string) (*api.ListResult, error) {
+	var (
+		skip  = pg.PageNumber * pg.PageSize
+		limit = pg.PageSize
+	)
+
+	if skip < 0 {
+		skip = 0
+	}
+
+	rg, err := GetRange(ctx, pg.Range)
+	if err != nil {
+		return nil, err
+	}
+	query := repository.AnomalyQuery{
+		Since:  rg.Start,
+		Until:  rg.End,
+		Metric: metric,
+	}
+	cnt, err := as.anomalies.Count(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if cnt == 0 {
+		return &api.ListResult{
+			List: []interface{}{},
+			P:    pg,
+		}, nil
+	}
+	if cnt <= skip {
+		return nil, api.ErrPageArgumentsTooLarge
+	}
+
+	pg.Total = cnt
+	anomalies, err := as.anomalies.List(ctx, query, repository.Page{
+		Skip:  skip,
+		Limit: limit,
+		Asc:   pg.Direction == "asc",
+	})
+	if err != nil {
+		return nil, db.HandleDBError(err)
+	}
+	list := make([]interface{}, 0, len(anomalies))
+	for _, anomaly := range anomalies {
+		list = append(list, anomaly)
+	}
+	return &api.ListResult{
+		List: list,
+		P:    pg,
+	}, nil
+}
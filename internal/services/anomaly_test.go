@@ -0,0 +1,98 @@
+package services
+
+import (
+	"testing"
+)
+
+func TestDetectAnomaly(t *testing.T) {
+	flat := []float64{1000, 1000, 1000, 1000, 1000, 1000, 1000, 1000}
+	cases := []struct {
+		name    string
+		history []float64
+		value   float64
+		want    *anomalyResult
+	}{
+		{
+			name:    "not enough history",
+			history: []float64{1000, 1000, 1000},
+			value:   10000,
+		},
+		{
+			name:    "expected value",
+			history: flat,
+			value:   1000,
+		},
+		{
+			name:    "spike over a flat history",
+			history: flat,
+			value:   10000,
+			want: &anomalyResult{
+				expected:  1000,
+				lower:     850,
+				upper:     1150,
+				score:     180,
+				direction: AnomalyDirectionOfSpike,
+			},
+		},
+		{
+			name:    "value on the trend",
+			history: []float64{100, 200, 300, 400, 500, 600, 700, 800},
+			value:   900,
+		},
+		{
+			name:    "drop against the trend",
+			history: []float64{100, 200, 300, 400, 500, 600, 700, 800},
+			value:   100,
+			want: &anomalyResult{
+				expected:  900,
+				lower:     765,
+				upper:     1035,
+				score:     -17.78,
+				direction: AnomalyDirectionOfDrop,
+			},
+		},
+		{
+			name:    "an outlier in the history doesn't move the baseline",
+			history: []float64{1000, 1000, 1000, 5000, 1000, 1000, 1000, 1000},
+			value:   1000,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, ok := detectAnomaly(c.history, c.value)
+			if c.want == nil {
+				if ok {
+					t.Fatalf("detectAnomaly() = %+v, want no anomaly", got)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("detectAnomaly() found no anomaly, want %+v", c.want)
+			}
+			if got.confidence < AnomalyAlarmConfidence {
+				t.Errorf("detectAnomaly().confidence = %v, want >= %v", got.confidence, AnomalyAlarmConfidence)
+			}
+			got.confidence = 0
+			if *got != *c.want {
+				t.Errorf("detectAnomaly() = %+v, want %+v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestMedian(t *testing.T) {
+	cases := []struct {
+		values []float64
+		want   float64
+	}{
+		{values: nil, want: 0},
+		{values: []float64{3}, want: 3},
+		{values: []float64{5, 1, 3}, want: 3},
+		{values: []float64{4, 1, 3, 2}, want: 2.5},
+	}
+	for _, c := range cases {
+		if got := median(c.values); got != c.want {
+			t.Errorf("median(%v) = %v, want %v", c.values, got, c.want)
+		}
+	}
+}
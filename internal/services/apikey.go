@@ -0,0 +1,209 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/jyjiangkai/stat/api"
+	"github.com/jyjiangkai/stat/auth"
+	"github.com/jyjiangkai/stat/db"
+	"github.com/jyjiangkai/stat/log"
+	"github.com/jyjiangkai/stat/models"
+	"github.com/jyjiangkai/stat/models/cloud"
+	"github.com/jyjiangkai/stat/utils"
+)
+
+const (
+	APIKeyPrefix = "vst_"
+
+	apiKeyPrefixLength = 8
+	// last_used_at is written at most once per interval for a key
+	apiKeyTouchInterval = time.Minute
+)
+
+type APIKeyService struct {
+	cli        *mongo.Client
+	apiKeyColl *mongo.Collection
+	closeC     chan struct{}
+}
+
+func NewAPIKeyService(cli *mongo.Client) *APIKeyService {
+	return &APIKeyService{
+		cli:        cli,
+		apiKeyColl: cli.Database(DatabaseOfUserStatistics).Collection("api_keys"),
+		closeC:     make(chan struct{}),
+	}
+}
+
+func (as *APIKeyService) Start() error {
+	return nil
+}
+
+func (as *APIKeyService) Stop() error {
+	return nil
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create generates a key of the role, the plain key is only returned here.
+func (as *APIKeyService) Create(ctx context.Context, name string, role string, ttl time.Duration) (*models.CreatedAPIKey, error) {
+	if name == "" {
+		return nil, api.ErrInvalidMissingParameter.WithMessage("name is required")
+	}
+	if !auth.ValidRole(auth.Role(role)) {
+		return nil, api.ErrInvalidParameter.WithMessage(fmt.Sprintf("unknown role: %s", role))
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, api.ErrInternal.WithError(err)
+	}
+	plain := APIKeyPrefix + hex.EncodeToString(secret)
+	key := &models.APIKey{
+		Base:   cloud.NewBase(ctx),
+		Name:   name,
+		Role:   role,
+		Prefix: plain[:len(APIKeyPrefix)+apiKeyPrefixLength],
+		Hash:   hashAPIKey(plain),
+	}
+	if ttl > 0 {
+		expiresAt := time.Now().Add(ttl)
+		key.ExpiresAt = &expiresAt
+	}
+	if _, err := as.apiKeyColl.InsertOne(ctx, key); err != nil {
+		return nil, db.HandleDBError(err)
+	}
+	log.Info(ctx).Str("id", key.ID.Hex()).Str("role", role).Str("operator", utils.GetUserID(ctx)).Msg("api key created")
+	return &models.CreatedAPIKey{
+		APIKey: key,
+		Key:    plain,
+	}, nil
+}
+
+func (as *APIKeyService) List(ctx context.Context, pg api.Page) (*api.ListResult, error) {
+	var (
+		skip  = pg.PageNumber * pg.PageSize
+		limit = pg.PageSize
+		sort  = bson.M{"created_at": -1}
+	)
+
+	if skip < 0 {
+		skip = 0
+	}
+
+	query := bson.M{}
+	cnt, err := as.apiKeyColl.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if cnt == 0 {
+		return &api.ListResult{
+			List: []interface{}{},
+			P:    pg,
+		}, nil
+	}
+	if cnt <= skip {
+		return nil, api.ErrPageArgumentsTooLarge
+	}
+
+	pg.Total = cnt
+	if pg.Direction == "asc" {
+		sort = bson.M{"created_at": 1}
+	}
+	opt := options.FindOptions{
+		Limit: &limit,
+		Skip:  &skip,
+		Sort:  sort,
+	}
+	cursor, err := as.apiKeyColl.Find(ctx, query, &opt)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = cursor.Close(ctx)
+	}()
+
+	list := make([]interface{}, 0)
+	for cursor.Next(ctx) {
+		key := &models.APIKey{}
+		if err = cursor.Decode(key); err != nil {
+			return nil, db.HandleDBError(err)
+		}
+		list = append(list, key)
+	}
+	return &api.ListResult{
+		List: list,
+		P:    pg,
+	}, nil
+}
+
+func (as *APIKeyService) Revoke(ctx context.Context, id string) (*models.APIKey, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, api.ErrInvalidID.WithError(err)
+	}
+	key := &models.APIKey{}
+	if err = as.apiKeyColl.FindOne(ctx, bson.M{"_id": oid}).Decode(key); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, api.ErrResourceNotFound.WithMessage(fmt.Sprintf("api key %s not found", id))
+		}
+		return nil, db.HandleDBError(err)
+	}
+	if key.RevokedAt != nil {
+		return key, nil
+	}
+	now := time.Now()
+	key.RevokedAt = &now
+	key.RevokedBy = utils.GetUserID(ctx)
+	key.UpdatedAt = now
+	key.UpdatedBy = key.RevokedBy
+	if _, err = as.apiKeyColl.ReplaceOne(ctx, bson.M{"_id": oid}, key); err != nil {
+		return nil, db.HandleDBError(err)
+	}
+	log.Info(ctx).Str("id", id).Str("operator", key.RevokedBy).Msg("api key revoked")
+	return key, nil
+}
+
+// Authenticate returns the caller owning the plain key, nil is returned
+// for an unknown, expired or revoked key.
+func (as *APIKeyService) Authenticate(ctx context.Context, plain string) (*auth.Principal, error) {
+	if !strings.HasPrefix(plain, APIKeyPrefix) {
+		return nil, nil
+	}
+	key := &models.APIKey{}
+	err := as.apiKeyColl.FindOne(ctx, bson.M{"hash": hashAPIKey(plain)}).Decode(key)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, db.HandleDBError(err)
+	}
+	now := time.Now()
+	if !key.Active(now) {
+		return nil, nil
+	}
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) > apiKeyTouchInterval {
+		_, err = as.apiKeyColl.UpdateOne(ctx, bson.M{"_id": key.ID}, bson.M{"$set": bson.M{"last_used_at": now}})
+		if err != nil {
+			log.Warn(ctx).Err(err).Str("id", key.ID.Hex()).Msg("failed to update the last used time of api key")
+		}
+	}
+	return &auth.Principal{
+		ID:     "apikey:" + key.ID.Hex(),
+		Name:   key.Name,
+		Role:   auth.Role(key.Role),
+		Method: auth.MethodOfAPIKey,
+	}, nil
+}
@@ -0,0 +1,237 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/jyjiangkai/stat/api"
+	"github.com/jyjiangkai/stat/config"
+	"github.com/jyjiangkai/stat/db"
+	"github.com/jyjiangkai/stat/log"
+	"github.com/jyjiangkai/stat/models"
+)
+
+const (
+	DefaultAuditRetentionDays = 365
+	// AuditExportPageSize is the page size from which a list request is
+	// regarded as a bulk export
+	AuditExportPageSize = 100
+
+	auditWriteTimeout  = 5 * time.Second
+	auditQueueSize     = 4096
+	auditBatchSize     = 100
+	auditFlushInterval = time.Second
+)
+
+type AuditService struct {
+	cli       *mongo.Client
+	auditColl *mongo.Collection
+	retention time.Duration
+	entries   chan *models.AuditLog
+	closeC    chan struct{}
+	doneC     chan struct{}
+}
+
+func NewAuditService(cli *mongo.Client, cfg config.Audit) *AuditService {
+	days := cfg.RetentionDays
+	if days <= 0 {
+		days = DefaultAuditRetentionDays
+	}
+	return &AuditService{
+		cli:       cli,
+		auditColl: cli.Database(DatabaseOfUserStatistics).Collection("audit_logs"),
+		retention: time.Duration(days) * 24 * time.Hour,
+		entries:   make(chan *models.AuditLog, auditQueueSize),
+		closeC:    make(chan struct{}),
+		doneC:     make(chan struct{}),
+	}
+}
+
+func (as *AuditService) Start() error {
+	ctx := context.Background()
+	go as.runWriter(ctx)
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		defer log.Warn(ctx).Err(nil).Msg("audit retention routine exit")
+		for {
+			select {
+			case <-as.closeC:
+				log.Info(ctx).Msg("audit service stopped.")
+				return
+			case <-ticker.C:
+				now := time.Now()
+				if now.Hour() == 5 {
+					log.Info(ctx).Msgf("start purging audit logs at: %+v\n", now)
+					if err := as.Purge(ctx, now); err != nil {
+						log.Error(ctx).Err(err).Msgf("purge audit logs failed at %+v\n", time.Now())
+					}
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop flushes the queued entries.
+func (as *AuditService) Stop() error {
+	close(as.closeC)
+	select {
+	case <-as.doneC:
+	case <-time.After(auditWriteTimeout):
+		log.Warn(context.Background()).Int("queued", len(as.entries)).Msg("timeout to flush audit logs")
+	}
+	return nil
+}
+
+// Record queues the entry to be written in batches off the request path,
+// the entry is written in place when the queue is full so none is dropped.
+func (as *AuditService) Record(entry *models.AuditLog) {
+	select {
+	case as.entries <- entry:
+	default:
+		as.write([]interface{}{entry})
+	}
+}
+
+func (as *AuditService) runWriter(ctx context.Context) {
+	defer close(as.doneC)
+	ticker := time.NewTicker(auditFlushInterval)
+	defer ticker.Stop()
+	batch := make([]interface{}, 0, auditBatchSize)
+	flush := func() {
+		if len(batch) != 0 {
+			as.write(batch)
+			batch = make([]interface{}, 0, auditBatchSize)
+		}
+	}
+	for {
+		select {
+		case entry := <-as.entries:
+			batch = append(batch, entry)
+			if len(batch) >= auditBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-as.closeC:
+			for {
+				select {
+				case entry := <-as.entries:
+					batch = append(batch, entry)
+				default:
+					flush()
+					log.Info(ctx).Msg("audit writer stopped.")
+					return
+				}
+			}
+		}
+	}
+}
+
+// write inserts the entries, it is detached from the requests so a client
+// going away doesn't lose the records.
+func (as *AuditService) write(entries []interface{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), auditWriteTimeout)
+	defer cancel()
+	opts := options.InsertMany().SetOrdered(false)
+	if _, err := as.auditColl.InsertMany(ctx, entries, opts); err != nil {
+		log.Error(ctx).Err(err).Int("entries", len(entries)).Msg("failed to record audit logs")
+	}
+}
+
+// Purge deletes the entries older than the retention period, which is the
+// only way an entry is ever removed.
+func (as *AuditService) Purge(ctx context.Context, now time.Time) error {
+	result, err := as.auditColl.DeleteMany(ctx, bson.M{"time": bson.M{"$lt": now.Add(-as.retention)}})
+	if err != nil {
+		return db.HandleDBError(err)
+	}
+	log.Info(ctx).Int64("deleted", result.DeletedCount).Msgf("finish purging audit logs at: %+v\n", time.Now())
+	return nil
+}
+
+type AuditQuery struct {
+	Principal string
+	Route     string
+	OID       string
+}
+
+func (as *AuditService) List(ctx context.Context, pg api.Page, q *AuditQuery) (*api.ListResult, error) {
+	var (
+		skip  = pg.PageNumber * pg.PageSize
+		limit = pg.PageSize
+		sort  = bson.M{"time": -1}
+	)
+
+	if skip < 0 {
+		skip = 0
+	}
+
+	rg, err := GetRange(ctx, pg.Range)
+	if err != nil {
+		return nil, err
+	}
+	query := bson.M{
+		"time": bson.M{
+			"$gte": rg.Start,
+			"$lt":  rg.End,
+		},
+	}
+	if q.Principal != "" {
+		query["principal"] = q.Principal
+	}
+	if q.Route != "" {
+		query["route"] = q.Route
+	}
+	if q.OID != "" {
+		query["viewed_users"] = q.OID
+	}
+	cnt, err := as.auditColl.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if cnt == 0 {
+		return &api.ListResult{
+			List: []interface{}{},
+			P:    pg,
+		}, nil
+	}
+	if cnt <= skip {
+		return nil, api.ErrPageArgumentsTooLarge
+	}
+
+	pg.Total = cnt
+	if pg.Direction == "asc" {
+		sort = bson.M{"time": 1}
+	}
+	opt := options.FindOptions{
+		Limit: &limit,
+		Skip:  &skip,
+		Sort:  sort,
+	}
+	cursor, err := as.auditColl.Find(ctx, query, &opt)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = cursor.Close(ctx)
+	}()
+
+	list := make([]interface{}, 0)
+	for cursor.Next(ctx) {
+		entry := &models.AuditLog{}
+		if err = cursor.Decode(entry); err != nil {
+			return nil, db.HandleDBError(err)
+		}
+		list = append(list, entry)
+	}
+	return &api.ListResult{
+		List: list,
+		P:    pg,
+	}, nil
+}
@@ -6,10 +6,13 @@ import (
 
 	"github.com/jyjiangkai/stat/models"
 	"github.com/jyjiangkai/stat/models/cloud"
+	"github.com/jyjiangkai/stat/timezone"
 	"github.com/jyjiangkai/stat/utils"
 	"go.mongodb.org/mongo-driver/bson"
 )
 
+// getBills sums the bills collected up to now, which is what the stat user is
+// stamped with, so the reconciliation recomputes the same totals.
 func (ss *StatService) getBills(ctx context.Context, oid string, now time.Time) (*models.Bills, error) {
 	aiBill, err := ss.getAIBill(ctx, oid, now)
 	if err != nil {
@@ -26,7 +29,7 @@ func (ss *StatService) getBills(ctx context.Context, oid string, now time.Time)
 }
 
 func (ss *StatService) getConnectBill(ctx context.Context, oid string, now time.Time) (*models.ConnectBills, error) {
-	bills, err := ss.getConnectBills(ctx, oid)
+	bills, err := ss.getConnectBills(ctx, oid, now)
 	if err != nil {
 		return nil, err
 	}
@@ -62,14 +65,15 @@ func (ss *StatService) getConnectBill(ctx context.Context, oid string, now time.
 }
 
 func (ss *StatService) getAIBill(ctx context.Context, oid string, now time.Time) (*models.AIBills, error) {
-	bills, err := ss.getAIBills(ctx, oid)
+	bills, err := ss.getAIBills(ctx, oid, now)
 	if err != nil {
 		return nil, err
 	}
+	loc := timezone.Reporting()
 	stat := models.NewAIBill()
 	for idx := range bills {
 		credit := bills[idx].Usage.ChatGPT35 + 20*bills[idx].Usage.ChatGPT4
-		billTime := utils.ToBillTimeForAI(bills[idx].CollectedAt)
+		billTime := utils.ToBillTimeForAI(bills[idx].CollectedAt, loc)
 		if _, ok := stat.Items[billTime]; ok {
 			stat.Items[billTime] += credit
 		} else {
@@ -83,20 +87,19 @@ func (ss *StatService) getAIBill(ctx context.Context, oid string, now time.Time)
 		}
 		stat.Total += credit
 	}
-	yesterday := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).Add(-24 * time.Hour)
+	yesterday := utils.ToBillTimeForAI(now, loc).AddDate(0, 0, -1)
 	if value, ok := stat.Items[yesterday]; ok {
 		stat.Yesterday = value
 	}
 	return stat, nil
 }
 
-func (ss *StatService) getAIBills(ctx context.Context, oid string) ([]*cloud.AIBill, error) {
+func (ss *StatService) getAIBills(ctx context.Context, oid string, until time.Time) ([]*cloud.AIBill, error) {
 	query := bson.M{
 		"user_id": oid,
-		// "collected_at": bson.M{
-		// 	"$gte": start,
-		// 	"$lte": end,
-		// },
+		"collected_at": bson.M{
+			"$lte": until,
+		},
 	}
 	cursor, err := ss.aiBillColl.Find(ctx, query)
 	if err != nil {
@@ -117,13 +120,12 @@ func (ss *StatService) getAIBills(ctx context.Context, oid string) ([]*cloud.AIB
 	return bills, nil
 }
 
-func (ss *StatService) getConnectBills(ctx context.Context, oid string) ([]*cloud.Bill, error) {
+func (ss *StatService) getConnectBills(ctx context.Context, oid string, until time.Time) ([]*cloud.Bill, error) {
 	query := bson.M{
 		"user_id": oid,
-		// "collected_at": bson.M{
-		// 	"$gte": start,
-		// 	"$lte": end,
-		// },
+		"collected_at": bson.M{
+			"$lte": until,
+		},
 	}
 	cursor, err := ss.billColl.Find(ctx, query)
 	if err != nil {
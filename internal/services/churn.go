@@ -0,0 +1,476 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/jyjiangkai/stat/api"
+	"github.com/jyjiangkai/stat/db"
+	"github.com/jyjiangkai/stat/log"
+	"github.com/jyjiangkai/stat/models"
+	"github.com/jyjiangkai/stat/models/cloud"
+	"github.com/jyjiangkai/stat/monitor"
+	"github.com/jyjiangkai/stat/timezone"
+	"github.com/jyjiangkai/stat/utils"
+)
+
+const (
+	ChurnBaselineDays  = 28 // days before the recent window used as the user's own baseline
+	ChurnRecentDays    = 7  // days of the recent window
+	ChurnDropThreshold = 50 // flag a user when the recent usage decreases by 50% or more
+	ChurnLowDays       = 5  // days of the recent window which must be below the threshold
+	ChurnMinBaseline   = 1  // ignore users whose baseline daily usage is lower than this
+)
+
+type ChurnService struct {
+	cli           *mongo.Client
+	billColl      *mongo.Collection
+	aiBillColl    *mongo.Collection
+	userStatColl  *mongo.Collection
+	churnRiskColl *mongo.Collection
+	closeC        chan struct{}
+}
+
+func NewChurnService(cli *mongo.Client) *ChurnService {
+	return &ChurnService{
+		cli:           cli,
+		billColl:      cli.Database(db.GetDatabaseName()).Collection("bills"),
+		aiBillColl:    cli.Database(db.GetDatabaseName()).Collection("ai_bills"),
+		userStatColl:  cli.Database(DatabaseOfUserStatistics).Collection("user_stats"),
+		churnRiskColl: cli.Database(DatabaseOfUserStatistics).Collection("churn_risks"),
+		closeC:        make(chan struct{}),
+	}
+}
+
+func (cs *ChurnService) Start() error {
+	ctx := context.Background()
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		defer log.Warn(ctx).Err(nil).Msg("churn risk routine exit")
+		for {
+			select {
+			case <-cs.closeC:
+				log.Info(ctx).Msg("churn service stopped.")
+				return
+			case <-ticker.C:
+				now := time.Now()
+				if now.Hour() == 3 {
+					log.Info(ctx).Msgf("start churn risk detection at: %+v\n", now)
+					err := cs.DetectChurnRisk(ctx, now)
+					if err != nil {
+						log.Error(ctx).Err(err).Msgf("churn risk detection failed at %+v\n", time.Now())
+					}
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func (cs *ChurnService) Stop() error {
+	return nil
+}
+
+// DetectChurnRisk compares the recent daily usage of every premium user with
+// the user's own baseline, stores the users with a sustained drop as the
+// churn risk list of the day and notifies the newly found ones.
+func (cs *ChurnService) DetectChurnRisk(ctx context.Context, now time.Time) error {
+	today := utils.ToBillTimeForAI(now, timezone.Reporting())
+	users, err := cs.getPremiumUsers(ctx)
+	if err != nil {
+		return err
+	}
+	aiUsers := make([]string, 0)
+	connectUsers := make([]string, 0)
+	for _, user := range users {
+		if user.Class.AI != nil && user.Class.AI.Premium {
+			aiUsers = append(aiUsers, user.OID)
+		}
+		if user.Class.Connect != nil && user.Class.Connect.Premium {
+			connectUsers = append(connectUsers, user.OID)
+		}
+	}
+	aiUsages, err := cs.getAIDailyUsages(ctx, aiUsers, today)
+	if err != nil {
+		return err
+	}
+	connectUsages, err := cs.getConnectDailyUsages(ctx, connectUsers, today)
+	if err != nil {
+		return err
+	}
+
+	risks := make([]interface{}, 0)
+	for _, user := range users {
+		risk := &models.ChurnRisk{
+			Base:        cloud.NewBase(ctx),
+			Date:        today,
+			Timezone:    today.Location().String(),
+			OID:         user.OID,
+			Email:       user.Email,
+			CompanyName: user.CompanyName,
+			Class:       user.Class,
+			Reasons:     make([]string, 0),
+		}
+		if user.Class.AI != nil && user.Class.AI.Premium {
+			if drop, reason, ok := detectUsageDrop(aiUsages[user.OID], user.CreatedAt, today); ok {
+				risk.AI = drop
+				risk.Reasons = append(risk.Reasons, "ai "+reason)
+			}
+		}
+		if user.Class.Connect != nil && user.Class.Connect.Premium {
+			if drop, reason, ok := detectUsageDrop(connectUsages[user.OID], user.CreatedAt, today); ok {
+				risk.Connect = drop
+				risk.Reasons = append(risk.Reasons, "connect "+reason)
+			}
+		}
+		if len(risk.Reasons) != 0 {
+			risks = append(risks, risk)
+		}
+	}
+
+	previous, err := cs.getChurnRiskUsers(ctx, today.AddDate(0, 0, -1))
+	if err != nil {
+		return err
+	}
+	// rerunning the detection of the same day replaces the previous result
+	if _, err = cs.churnRiskColl.DeleteMany(ctx, bson.M{"date": today}); err != nil {
+		return db.HandleDBError(err)
+	}
+	if len(risks) != 0 {
+		if _, err = cs.churnRiskColl.InsertMany(ctx, risks); err != nil {
+			log.Error(ctx).Err(err).Msg("failed to insert churn risks")
+			return db.HandleDBError(err)
+		}
+	}
+
+	lines := make([]string, 0)
+	for idx := range risks {
+		risk := risks[idx].(*models.ChurnRisk)
+		if _, ok := previous[risk.OID]; ok {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s(%s): %s", risk.Email, risk.OID, strings.Join(risk.Reasons, "; ")))
+	}
+	log.Info(ctx).Int("risks", len(risks)).Int("new", len(lines)).Msgf("finish churn risk detection at: %+v\n", time.Now())
+	if len(lines) == 0 {
+		return nil
+	}
+	message := fmt.Sprintf("On %s %dth, %d premium users are at churn risk:\n%s", today.Month().String(), today.Day(), len(lines), strings.Join(lines, "\n"))
+	return monitor.SendAlarm(ctx, message)
+}
+
+// detectUsageDrop judges the daily usages of the recent window, the days
+// before today, against the daily average of the baseline window. The
+// baseline of a user who signed up within the window is averaged over the
+// days since the sign up.
+func detectUsageDrop(usages map[time.Time]uint64, createdAt, today time.Time) (*models.UsageDrop, string, bool) {
+	recentStart := today.AddDate(0, 0, -ChurnRecentDays)
+	baselineStart := recentStart.AddDate(0, 0, -ChurnBaselineDays)
+	baselineDays := ChurnBaselineDays
+	if created := utils.ToBillTimeForAI(createdAt, today.Location()); created.After(baselineStart) {
+		baselineDays = int(recentStart.Sub(created).Hours()+12) / 24
+	}
+	if baselineDays <= 0 {
+		return nil, "", false
+	}
+	var baseline, recent uint64
+	for date, usage := range usages {
+		if !date.Before(baselineStart) && date.Before(recentStart) {
+			baseline += usage
+		} else if !date.Before(recentStart) && date.Before(today) {
+			recent += usage
+		}
+	}
+	drop := &models.UsageDrop{
+		Baseline: float64(baseline) / float64(baselineDays),
+		Recent:   float64(recent) / ChurnRecentDays,
+	}
+	if drop.Baseline < ChurnMinBaseline {
+		return nil, "", false
+	}
+	threshold := drop.Baseline * (100 - ChurnDropThreshold) / 100
+	for date := recentStart; date.Before(today); date = date.AddDate(0, 0, 1) {
+		if float64(usages[date]) < threshold {
+			drop.LowDays++
+		}
+	}
+	drop.Decrease = utils.KeepTwoDecimalPlaces((drop.Baseline - drop.Recent) / drop.Baseline * 100)
+	drop.Baseline = utils.KeepTwoDecimalPlaces(drop.Baseline)
+	drop.Recent = utils.KeepTwoDecimalPlaces(drop.Recent)
+	if drop.Decrease < ChurnDropThreshold || drop.LowDays < ChurnLowDays {
+		return nil, "", false
+	}
+	if recent == 0 {
+		return drop, fmt.Sprintf("usage stopped in the last %d days, daily usage was %.2f before", ChurnRecentDays, drop.Baseline), true
+	}
+	return drop, fmt.Sprintf("daily usage decreased by %0.2f%% from %.2f to %.2f, %d of the last %d days were low",
+		drop.Decrease, drop.Baseline, drop.Recent, drop.LowDays, ChurnRecentDays), true
+}
+
+func (cs *ChurnService) getPremiumUsers(ctx context.Context) ([]*models.User, error) {
+	query := bson.M{
+		"$or": []bson.M{
+			{"class.ai.premium": true},
+			{"class.connect.premium": true},
+		},
+	}
+	opt := options.FindOptions{
+		Projection: bson.M{
+			"bills":  0,
+			"cohort": 0,
+		},
+	}
+	cursor, err := cs.userStatColl.Find(ctx, query, &opt)
+	if err != nil {
+		return nil, db.HandleDBError(err)
+	}
+	defer func() {
+		_ = cursor.Close(ctx)
+	}()
+	users := make([]*models.User, 0)
+	for cursor.Next(ctx) {
+		user := &models.User{}
+		if err = cursor.Decode(user); err != nil {
+			return nil, db.HandleDBError(err)
+		}
+		if user.Class == nil {
+			continue
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+func (cs *ChurnService) getAIDailyUsages(ctx context.Context, users []string, today time.Time) (map[string]map[time.Time]uint64, error) {
+	usages := make(map[string]map[time.Time]uint64)
+	if len(users) == 0 {
+		return usages, nil
+	}
+	pipeline := mongo.Pipeline{
+		{
+			{"$match", bson.M{
+				"user_id": bson.M{"$in": users},
+				"collected_at": bson.M{
+					"$gte": today.AddDate(0, 0, -ChurnRecentDays-ChurnBaselineDays),
+					"$lt":  today,
+				},
+			}},
+		},
+		{
+			{"$group", bson.D{
+				{"_id", bson.M{
+					"user_id": "$user_id",
+					"date": bson.M{
+						"$dateToString": bson.M{
+							"format":   "%Y-%m-%d",
+							"date":     "$collected_at",
+							"timezone": today.Location().String(),
+						},
+					},
+				}},
+				{"usage", bson.D{
+					{"$sum", bson.D{
+						{"$add", []interface{}{
+							"$usage.chatgpt_3_5",
+							bson.M{"$multiply": []interface{}{"$usage.chatgpt_4", 20}},
+						}},
+					}},
+				}},
+			}},
+		},
+	}
+	type usageGroup struct {
+		ID struct {
+			UserID string `bson:"user_id"`
+			Date   string `bson:"date"`
+		} `bson:"_id"`
+		Usage uint64 `bson:"usage"`
+	}
+	cursor, err := cs.aiBillColl.Aggregate(ctx, pipeline)
+	if err != nil {
+		log.Error(ctx).Err(err).Msg("aggregate error")
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var ug usageGroup
+		if err = cursor.Decode(&ug); err != nil {
+			return nil, err
+		}
+		date, err := time.ParseInLocation("2006-01-02", ug.ID.Date, today.Location())
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := usages[ug.ID.UserID]; !ok {
+			usages[ug.ID.UserID] = make(map[time.Time]uint64)
+		}
+		usages[ug.ID.UserID][date] += ug.Usage
+	}
+	return usages, nil
+}
+
+func (cs *ChurnService) getConnectDailyUsages(ctx context.Context, users []string, today time.Time) (map[string]map[time.Time]uint64, error) {
+	usages := make(map[string]map[time.Time]uint64)
+	if len(users) == 0 {
+		return usages, nil
+	}
+	// connect bills are collected at UTC midnight for the previous UTC day
+	end := utcDay(today)
+	pipeline := mongo.Pipeline{
+		{
+			{"$match", bson.M{
+				"user_id": bson.M{"$in": users},
+				"collected_at": bson.M{
+					"$gt":  end.AddDate(0, 0, -ChurnRecentDays-ChurnBaselineDays),
+					"$lte": end,
+				},
+			}},
+		},
+		{
+			{"$group", bson.D{
+				{"_id", bson.M{
+					"user_id":      "$user_id",
+					"collected_at": "$collected_at",
+				}},
+				{"usage", bson.D{
+					{"$sum", "$delivered_num"},
+				}},
+			}},
+		},
+	}
+	type usageGroup struct {
+		ID struct {
+			UserID      string    `bson:"user_id"`
+			CollectedAt time.Time `bson:"collected_at"`
+		} `bson:"_id"`
+		Usage uint64 `bson:"usage"`
+	}
+	cursor, err := cs.billColl.Aggregate(ctx, pipeline)
+	if err != nil {
+		log.Error(ctx).Err(err).Msg("aggregate error")
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var ug usageGroup
+		if err = cursor.Decode(&ug); err != nil {
+			return nil, err
+		}
+		day := utils.ToBillTimeForConnect(ug.ID.CollectedAt)
+		date := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, today.Location())
+		if _, ok := usages[ug.ID.UserID]; !ok {
+			usages[ug.ID.UserID] = make(map[time.Time]uint64)
+		}
+		usages[ug.ID.UserID][date] += ug.Usage
+	}
+	return usages, nil
+}
+
+func (cs *ChurnService) getChurnRiskUsers(ctx context.Context, date time.Time) (map[string]struct{}, error) {
+	opt := options.FindOptions{
+		Projection: bson.M{"oidc_id": 1},
+	}
+	cursor, err := cs.churnRiskColl.Find(ctx, bson.M{"date": date}, &opt)
+	if err != nil {
+		return nil, db.HandleDBError(err)
+	}
+	defer func() {
+		_ = cursor.Close(ctx)
+	}()
+	users := make(map[string]struct{})
+	for cursor.Next(ctx) {
+		risk := &models.ChurnRisk{}
+		if err = cursor.Decode(risk); err != nil {
+			return nil, db.HandleDBError(err)
+		}
+		users[risk.OID] = struct{}{}
+	}
+	return users, nil
+}
+
+// List returns the latest churn risk list, KindSelector narrows it down to
+// the users whose ai or connect usage dropped.
+func (cs *ChurnService) List(ctx context.Context, pg api.Page, opts *api.ListOptions) (*api.ListResult, error) {
+	var (
+		skip              = pg.PageNumber * pg.PageSize
+		limit             = pg.PageSize
+		sort  interface{} = bson.D{{"ai.decrease", -1}, {"connect.decrease", -1}}
+	)
+
+	if skip < 0 {
+		skip = 0
+	}
+
+	latest := &models.ChurnRisk{}
+	opt := options.FindOneOptions{
+		Sort: bson.M{"date": -1},
+	}
+	err := cs.churnRiskColl.FindOne(ctx, bson.M{}, &opt).Decode(latest)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return &api.ListResult{
+				List: []interface{}{},
+				P:    pg,
+			}, nil
+		}
+		return nil, db.HandleDBError(err)
+	}
+
+	query := bson.M{
+		"date": latest.Date,
+	}
+	if opts.KindSelector == "ai" {
+		query["ai"] = bson.M{"$exists": true}
+		sort = bson.M{"ai.decrease": -1}
+	} else if opts.KindSelector == "connect" {
+		query["connect"] = bson.M{"$exists": true}
+		sort = bson.M{"connect.decrease": -1}
+	}
+	cnt, err := cs.churnRiskColl.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if cnt == 0 {
+		return &api.ListResult{
+			List: []interface{}{},
+			P:    pg,
+		}, nil
+	}
+	if cnt <= skip {
+		return nil, api.ErrPageArgumentsTooLarge
+	}
+
+	pg.Total = cnt
+	findOpt := options.FindOptions{
+		Limit: &limit,
+		Skip:  &skip,
+		Sort:  sort,
+	}
+	cursor, err := cs.churnRiskColl.Find(ctx, query, &findOpt)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = cursor.Close(ctx)
+	}()
+
+	list := make([]interface{}, 0)
+	for cursor.Next(ctx) {
+		risk := &models.ChurnRisk{}
+		if err = cursor.Decode(risk); err != nil {
+			return nil, db.HandleDBError(err)
+		}
+		list = append(list, risk)
+	}
+	return &api.ListResult{
+		List: list,
+		P:    pg,
+	}, nil
+}
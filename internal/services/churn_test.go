@@ -0,0 +1,67 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDetectUsageDrop(t *testing.T) {
+	today := time.Date(2024, 5, 29, 0, 0, 0, 0, time.UTC)
+	daily := func(from time.Time, days int, usage uint64) map[time.Time]uint64 {
+		usages := make(map[time.Time]uint64)
+		for day := 0; day < days; day++ {
+			usages[from.AddDate(0, 0, day)] = usage
+		}
+		return usages
+	}
+	longAgo := today.AddDate(-1, 0, 0)
+	recentStart := today.AddDate(0, 0, -ChurnRecentDays)
+	cases := []struct {
+		name      string
+		usages    map[time.Time]uint64
+		createdAt time.Time
+		drop      bool
+		baseline  float64
+	}{
+		{
+			name:      "steady usage",
+			usages:    daily(today.AddDate(0, 0, -ChurnRecentDays-ChurnBaselineDays), ChurnRecentDays+ChurnBaselineDays, 100),
+			createdAt: longAgo,
+		},
+		{
+			name:      "usage stopped",
+			usages:    daily(today.AddDate(0, 0, -ChurnRecentDays-ChurnBaselineDays), ChurnBaselineDays, 100),
+			createdAt: longAgo,
+			drop:      true,
+			baseline:  100,
+		},
+		{
+			name:      "a young user with steady usage isn't diluted",
+			usages:    daily(recentStart.AddDate(0, 0, -7), 14, 100),
+			createdAt: recentStart.AddDate(0, 0, -7).Add(9 * time.Hour),
+		},
+		{
+			name:      "a young user whose usage stopped",
+			usages:    daily(recentStart.AddDate(0, 0, -7), 7, 100),
+			createdAt: recentStart.AddDate(0, 0, -7).Add(9 * time.Hour),
+			drop:      true,
+			baseline:  100,
+		},
+		{
+			name:      "signed up within the recent window",
+			usages:    daily(recentStart.AddDate(0, 0, 1), 1, 100),
+			createdAt: recentStart.AddDate(0, 0, 1),
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			drop, reason, ok := detectUsageDrop(c.usages, c.createdAt, today)
+			if ok != c.drop {
+				t.Fatalf("detectUsageDrop() = %+v, %q, %v, want %v", drop, reason, ok, c.drop)
+			}
+			if ok && drop.Baseline != c.baseline {
+				t.Errorf("detectUsageDrop().Baseline = %v, want %v", drop.Baseline, c.baseline)
+			}
+		})
+	}
+}
@@ -7,10 +7,6 @@ import (
 	"github.com/jyjiangkai/stat/db"
 	"github.com/jyjiangkai/stat/log"
 	"github.com/jyjiangkai/stat/models"
-	"github.com/jyjiangkai/stat/models/cloud"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 func (ss *StatService) getClass(ctx context.Context, oid string, now time.Time) (*models.Class, error) {
@@ -29,33 +25,20 @@ func (ss *StatService) getClass(ctx context.Context, oid string, now time.Time)
 }
 
 func (ss *StatService) getLevel(ctx context.Context, oid string, kind string, now time.Time) (*models.Level, error) {
-	query := bson.M{
-		"created_by": oid,
-		"plan.kind":  kind,
-		"period_of_validity.start": bson.M{
-			"$lte": now,
-		},
-		"period_of_validity.end": bson.M{
-			"$gte": now,
-		},
-	}
-	result := ss.quotaColl.FindOne(ctx, query)
-	if result.Err() != nil {
-		if result.Err() == mongo.ErrNoDocuments {
-			return &models.Level{
-				Premium: false,
-				Plan: &models.Plan{
-					Type:  "Free",
-					Level: 1,
-				},
-			}, nil
-		}
-	}
-	userQuota := &cloud.UserQuota{}
-	if err := result.Decode(userQuota); err != nil {
-		log.Error(ctx).Err(err).Msg("failed to decode user quota")
+	userQuota, err := ss.quotas.Active(ctx, oid, kind, now)
+	if err != nil {
+		log.Error(ctx).Err(err).Msg("failed to get user quota")
 		return nil, db.HandleDBError(err)
 	}
+	if userQuota == nil {
+		return &models.Level{
+			Premium: false,
+			Plan: &models.Plan{
+				Type:  "Free",
+				Level: 1,
+			},
+		}, nil
+	}
 
 	payment, err := ss.getPayment(ctx, oid, kind)
 	if err != nil {
@@ -78,23 +61,12 @@ func (ss *StatService) getLevel(ctx context.Context, oid string, kind string, no
 }
 
 func (ss *StatService) getPayment(ctx context.Context, oid string, kind string) (*models.Payment, error) {
-	query := bson.M{
-		"created_by": oid,
-		"kind":       kind,
-	}
-	opt := options.FindOneOptions{
-		Sort: bson.M{"created_at": -1},
-	}
-	result := ss.paymentColl.FindOne(ctx, query, &opt)
-	if result.Err() != nil {
-		if result.Err() == mongo.ErrNoDocuments {
-			return models.NewPayment(), nil
-		}
+	payment, err := ss.payments.Latest(ctx, oid, kind)
+	if err != nil {
+		return nil, err
 	}
-	payment := &models.Payment{}
-	if err := result.Decode(payment); err != nil {
-		log.Error(ctx).Err(err).Msg("failed to decode payment")
-		return nil, db.HandleDBError(err)
+	if payment == nil {
+		return models.NewPayment(), nil
 	}
 	return payment, nil
 }
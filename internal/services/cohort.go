@@ -11,12 +11,13 @@ import (
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 
+	"github.com/jyjiangkai/stat/cache"
+	"github.com/jyjiangkai/stat/internal/repository"
 	"github.com/jyjiangkai/stat/log"
 	"github.com/jyjiangkai/stat/models"
 	"github.com/jyjiangkai/stat/models/cloud"
-	"github.com/jyjiangkai/stat/utils"
+	"github.com/jyjiangkai/stat/timezone"
 )
 
 var (
@@ -24,19 +25,19 @@ var (
 )
 
 type CohortService struct {
-	mgoCli     *mongo.Client
-	statColl   *mongo.Collection
-	cohortColl *mongo.Collection
-	wg         sync.WaitGroup
-	closeC     chan struct{}
+	mgoCli    *mongo.Client
+	userStats repository.UserStatRepository
+	cohorts   repository.CohortRepository
+	wg        sync.WaitGroup
+	closeC    chan struct{}
 }
 
 func NewCohortService(cli *mongo.Client) *CohortService {
 	return &CohortService{
-		mgoCli:     cli,
-		statColl:   cli.Database(DatabaseOfUserStatistics).Collection("user_stats"),
-		cohortColl: cli.Database(DatabaseOfUserStatistics).Collection("weekly_cohort"),
-		closeC:     make(chan struct{}),
+		mgoCli:    cli,
+		userStats: repository.NewMongoUserStatRepository(cli.Database(DatabaseOfUserStatistics).Collection("user_stats")),
+		cohorts:   repository.NewMongoCohortRepository(cli.Database(DatabaseOfUserStatistics).Collection("weekly_cohort")),
+		closeC:    make(chan struct{}),
 	}
 }
 
@@ -74,7 +75,7 @@ func (cs *CohortService) Stop() error {
 
 func (cs *CohortService) WeeklyCohortAnalysis(ctx context.Context, now time.Time) error {
 	goroutines := 0
-	week := TimeToWeek(StartAt)
+	week := TimeToWeek(StartAt.In(timezone.Reporting()))
 	for {
 		cs.wg.Add(1)
 		goroutines += 1
@@ -89,38 +90,35 @@ func (cs *CohortService) WeeklyCohortAnalysis(ctx context.Context, now time.Time
 	log.Info(ctx).Msg("starting weekly cohort analysis, please wait...")
 	cs.wg.Wait()
 	log.Info(ctx).Msgf("finished all weekly cohort analysis, spent %f seconds, updated %d weekly cohort analysis data\n", time.Since(now).Seconds(), goroutines)
+	cache.Invalidate(ctx, "weekly cohort analysis finished")
 	return nil
 }
 
 func (cs *CohortService) updateOrInsertWeeklyCohortAnalysis(ctx context.Context, week *models.Week) {
 	defer cs.wg.Done()
 	aiRetentions, ctRetentions, cnt, err := cs.getWeeklyRetentions(ctx, week)
-	if err != nil && err != mongo.ErrNoDocuments {
+	if err != nil {
 		log.Error(ctx).Err(err).Str("week", week.Alias).Msg("failed to get weekly retentions")
 		return
 	}
-	weeklyCohortAnalysis, exist, err := cs.getWeeklyCohortAnalysisFromAlias(ctx, week.Alias)
+	weeklyCohortAnalysis, err := cs.cohorts.GetByAlias(ctx, week.Alias)
 	if err != nil {
-		log.Error(ctx).Err(err).Str("week", week.Alias).Msg("failed to weekly cohort analysis")
+		log.Error(ctx).Err(err).Str("week", week.Alias).Msg("failed to get weekly cohort analysis")
 		return
 	}
-	if exist {
+	if weeklyCohortAnalysis != nil {
 		weeklyCohortAnalysis.UpdatedAt = time.Now()
 	} else {
-		weeklyCohortAnalysis.Base = cloud.NewBase(ctx)
+		weeklyCohortAnalysis = &models.WeeklyCohortAnalysis{
+			Base: cloud.NewBase(ctx),
+		}
 	}
 	weeklyCohortAnalysis.Week = week
 	weeklyCohortAnalysis.TotalUsers = cnt
 	weeklyCohortAnalysis.AIRetention = aiRetentions
 	weeklyCohortAnalysis.CTRetention = ctRetentions
-	query := bson.M{
-		"_id": weeklyCohortAnalysis.ID,
-	}
-	opts := &options.ReplaceOptions{
-		Upsert: utils.PtrBool(true),
-	}
-	_, err = cs.cohortColl.ReplaceOne(ctx, query, weeklyCohortAnalysis, opts)
-	if err != nil {
+	weeklyCohortAnalysis.Timezone = week.Start.Location().String()
+	if err = cs.cohorts.Save(ctx, weeklyCohortAnalysis); err != nil {
 		log.Error(ctx).Err(err).Str("week", week.Alias).Msg("failed to replace weekly cohort analysis")
 		return
 	}
@@ -132,25 +130,15 @@ func (cs *CohortService) getWeeklyRetentions(ctx context.Context, week *models.W
 	ctWeeklyActiveUsers := make(map[string]uint64)
 	aiRetentions := make(map[string]*models.WeeklyRetention)
 	ctRetentions := make(map[string]*models.WeeklyRetention)
-	query := bson.M{
-		"created_at": bson.M{
-			"$gte": week.Start,
-			"$lte": week.End,
-		},
-	}
-	cursor, err := cs.statColl.Find(ctx, query)
+	users, err := cs.userStats.CreatedBetween(ctx, week.Start, week.End)
 	if err != nil {
 		return aiRetentions, ctRetentions, 0, err
 	}
-	defer func() {
-		_ = cursor.Close(ctx)
-	}()
-	for cursor.Next(ctx) {
-		user := &models.User{}
-		if err = cursor.Decode(user); err != nil {
-			return nil, nil, 0, err
-		}
+	for _, user := range users {
 		totalUsers += 1
+		if user.Cohort == nil {
+			continue
+		}
 		for weekNum, retention := range user.Cohort.AI {
 			if _, ok := aiRetentions[weekNum]; ok {
 				aiRetentions[weekNum].Usage += retention.Usage
@@ -190,26 +178,6 @@ func (cs *CohortService) getWeeklyRetentions(ctx context.Context, week *models.W
 	return aiRetentions, ctRetentions, totalUsers, nil
 }
 
-func (cs *CohortService) getWeeklyCohortAnalysisFromAlias(ctx context.Context, alias string) (*models.WeeklyCohortAnalysis, bool, error) {
-	weeklyCohortAnalysis := &models.WeeklyCohortAnalysis{}
-	query := bson.M{
-		"week.alias": alias,
-	}
-	result := cs.cohortColl.FindOne(ctx, query)
-	if result.Err() != nil {
-		if result.Err() == mongo.ErrNoDocuments {
-			return weeklyCohortAnalysis, false, nil
-		}
-		log.Error(ctx).Err(result.Err()).Str("week", alias).Msg("failed to get weekly cohort analysis")
-		return nil, false, result.Err()
-	}
-	if err := result.Decode(weeklyCohortAnalysis); err != nil {
-		log.Error(ctx).Err(err).Str("week", alias).Msg("failed to weekly cohort analysis")
-		return nil, true, err
-	}
-	return weeklyCohortAnalysis, true, nil
-}
-
 // func (cas *CohortService) GetRetentions(ctx context.Context, week *models.Week, users []*models.User) ([]*models.Retention, error) {
 // 	query := bson.M{}
 // 	cnt, err := cas.statColl.CountDocuments(ctx, query)
@@ -282,15 +250,14 @@ func (cs *CohortService) getWeeklyCohortAnalysisFromAlias(ctx context.Context, a
 // 	return cohort, true, nil
 // }
 
+// TimeToWeek returns the week from Monday to Sunday that at is in, the days
+// are the ones of the timezone of at.
 func TimeToWeek(at time.Time) *models.Week {
-	// 获取当前时间所在的周一和周日的时间
-	weekday := at.Weekday()
-	startOffset := time.Duration((weekday + 6) % 7)
-	// endOffset := time.Duration((7 - weekday) % 7)
-
-	start := at.Add(-startOffset * 24 * time.Hour).Truncate(24 * time.Hour)
-	// end := at.Add(endOffset * 24 * time.Hour).Truncate(24 * time.Hour)
-	end := start.Add(TimeDurationOfWeek)
+	// 获取当前时间所在的周一和下周一的零点
+	loc := at.Location()
+	day := time.Date(at.Year(), at.Month(), at.Day(), 0, 0, 0, 0, loc)
+	start := day.AddDate(0, 0, -int((at.Weekday()+6)%7))
+	end := start.AddDate(0, 0, 7)
 
 	return &models.Week{
 		Number: 0,
@@ -311,12 +278,12 @@ func GetNextWeek(week *models.Week) *models.Week {
 		Number: week.Number + 1,
 		Alias:  alias,
 		Start:  week.End,
-		End:    week.End.Add(7 * 24 * time.Hour),
+		End:    week.End.AddDate(0, 0, 7),
 	}
 }
 
 func (ss *StatService) GetCohort(ctx context.Context, user *cloud.User) (*models.Cohort, error) {
-	week := TimeToWeek(user.CreatedAt)
+	week := TimeToWeek(user.CreatedAt.In(timezone.Reporting()))
 	aiRetention, err := ss.getAIRetention(ctx, user.OID, week)
 	if err != nil {
 		return nil, err
@@ -326,9 +293,10 @@ func (ss *StatService) GetCohort(ctx context.Context, user *cloud.User) (*models
 		return nil, err
 	}
 	return &models.Cohort{
-		Week:    week,
-		AI:      aiRetention,
-		Connect: ctRetention,
+		Week:     week,
+		AI:       aiRetention,
+		Connect:  ctRetention,
+		Timezone: week.Start.Location().String(),
 	}, nil
 }
 
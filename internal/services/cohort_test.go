@@ -0,0 +1,149 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/jyjiangkai/stat/internal/repository"
+	"github.com/jyjiangkai/stat/models"
+	"github.com/jyjiangkai/stat/models/cloud"
+)
+
+func TestTimeToWeek(t *testing.T) {
+	monday := time.Date(2023, 3, 13, 0, 0, 0, 0, time.UTC)
+	cases := []time.Time{
+		monday,
+		time.Date(2023, 3, 15, 15, 4, 5, 0, time.UTC),
+		time.Date(2023, 3, 19, 23, 59, 59, 0, time.UTC),
+	}
+	for _, at := range cases {
+		week := TimeToWeek(at)
+		if !week.Start.Equal(monday) {
+			t.Errorf("TimeToWeek(%v).Start = %v, want %v", at, week.Start, monday)
+		}
+		if !week.End.Equal(monday.AddDate(0, 0, 7)) {
+			t.Errorf("TimeToWeek(%v).End = %v, want %v", at, week.End, monday.AddDate(0, 0, 7))
+		}
+		if week.Alias != "March 13, 2023" {
+			t.Errorf("TimeToWeek(%v).Alias = %q, want %q", at, week.Alias, "March 13, 2023")
+		}
+	}
+
+	next := GetNextWeek(TimeToWeek(monday))
+	if next.Number != 1 || next.Alias != "March 20, 2023" || !next.Start.Equal(monday.AddDate(0, 0, 7)) {
+		t.Errorf("GetNextWeek() = %+v", next)
+	}
+
+	// Sunday 20:00 in UTC is already Monday in UTC+8
+	cst := time.FixedZone("CST", 8*60*60)
+	week := TimeToWeek(time.Date(2023, 3, 19, 20, 0, 0, 0, time.UTC).In(cst))
+	if want := time.Date(2023, 3, 20, 0, 0, 0, 0, cst); !week.Start.Equal(want) || week.Alias != "March 20, 2023" {
+		t.Errorf("TimeToWeek() in %s = %+v, want the week of %v", cst, week, want)
+	}
+}
+
+func newCohortUser(createdAt time.Time, ai, connect map[string]*models.Retention) *models.User {
+	return &models.User{
+		Base: cloud.Base{
+			ID:        primitive.NewObjectID(),
+			CreatedAt: createdAt,
+		},
+		Cohort: &models.Cohort{
+			Week:    TimeToWeek(createdAt),
+			AI:      ai,
+			Connect: connect,
+		},
+	}
+}
+
+func retention(week *models.Week, usage uint64) *models.Retention {
+	return &models.Retention{
+		Week:   week,
+		Active: usage > 0,
+		Usage:  usage,
+	}
+}
+
+func TestWeeklyCohortAnalysis(t *testing.T) {
+	ctx := context.Background()
+	week0 := TimeToWeek(StartAt)
+	week1 := GetNextWeek(week0)
+	at := week0.Start.Add(36 * time.Hour)
+
+	userStats := repository.NewMemoryUserStatRepository(
+		newCohortUser(at, map[string]*models.Retention{
+			"week 00": retention(week0, 100),
+			"week 01": retention(week1, 40),
+		}, map[string]*models.Retention{
+			"week 00": retention(week0, 7),
+			"week 01": retention(week1, 0),
+		}),
+		newCohortUser(at.Add(time.Hour), map[string]*models.Retention{
+			"week 00": retention(week0, 20),
+			"week 01": retention(week1, 0),
+		}, map[string]*models.Retention{}),
+		newCohortUser(at.Add(2*time.Hour), map[string]*models.Retention{
+			"week 00": retention(week0, 0),
+			"week 01": retention(week1, 0),
+		}, map[string]*models.Retention{}),
+		// created in the next week
+		newCohortUser(week1.Start.Add(time.Hour), map[string]*models.Retention{
+			"week 00": retention(week1, 5),
+		}, map[string]*models.Retention{}),
+	)
+	cohorts := repository.NewMemoryCohortRepository()
+	cs := &CohortService{
+		userStats: userStats,
+		cohorts:   cohorts,
+		closeC:    make(chan struct{}),
+	}
+
+	ai, connect, total, err := cs.getWeeklyRetentions(ctx, week0)
+	if err != nil {
+		t.Fatalf("getWeeklyRetentions() error = %v", err)
+	}
+	if total != 3 {
+		t.Errorf("total users = %d, want 3", total)
+	}
+	if ai["week 00"].Usage != 120 || ai["week 00"].Ratio != "66.67%" {
+		t.Errorf("ai week 00 = %+v, want usage 120 and ratio 66.67%%", ai["week 00"])
+	}
+	if ai["week 01"].Usage != 40 || ai["week 01"].Ratio != "33.33%" {
+		t.Errorf("ai week 01 = %+v, want usage 40 and ratio 33.33%%", ai["week 01"])
+	}
+	if connect["week 00"].Usage != 7 || connect["week 00"].Ratio != "33.33%" {
+		t.Errorf("connect week 00 = %+v, want usage 7 and ratio 33.33%%", connect["week 00"])
+	}
+	if connect["week 01"].Ratio != "" {
+		t.Errorf("connect week 01 ratio = %q, want empty without active users", connect["week 01"].Ratio)
+	}
+
+	now := week1.End.Add(time.Hour)
+	if err = cs.WeeklyCohortAnalysis(ctx, now); err != nil {
+		t.Fatalf("WeeklyCohortAnalysis() error = %v", err)
+	}
+	analysis, err := cohorts.GetByAlias(ctx, week0.Alias)
+	if err != nil || analysis == nil {
+		t.Fatalf("GetByAlias(%q) = %v, %v", week0.Alias, analysis, err)
+	}
+	if analysis.TotalUsers != 3 || analysis.AIRetention["week 00"].Usage != 120 {
+		t.Errorf("analysis of %s = %+v", week0.Alias, analysis)
+	}
+	next, err := cohorts.GetByAlias(ctx, week1.Alias)
+	if err != nil || next == nil || next.TotalUsers != 1 {
+		t.Fatalf("GetByAlias(%q) = %+v, %v", week1.Alias, next, err)
+	}
+
+	// a second run updates the analyses in place
+	id := analysis.ID
+	if err = cs.WeeklyCohortAnalysis(ctx, now); err != nil {
+		t.Fatalf("WeeklyCohortAnalysis() error = %v", err)
+	}
+	analysis, _ = cohorts.GetByAlias(ctx, week0.Alias)
+	if analysis.ID != id {
+		t.Errorf("analysis id = %s, want %s", analysis.ID.Hex(), id.Hex())
+	}
+}
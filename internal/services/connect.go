@@ -4,191 +4,171 @@ import (
 	"context"
 	"time"
 
-	"github.com/jyjiangkai/stat/constant"
+	"github.com/jyjiangkai/stat/db"
+	"github.com/jyjiangkai/stat/internal/repository"
 	"github.com/jyjiangkai/stat/log"
 	"github.com/jyjiangkai/stat/models"
 	"github.com/jyjiangkai/stat/models/cloud"
 	"github.com/jyjiangkai/stat/utils"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-func (us *UserService) getConnectDetail(ctx context.Context, oid string) (*models.UserConnectDetail, error) {
-	connections, err := us.getConnections(ctx, oid)
+func (us *UserService) getConnectDetail(ctx context.Context, oid string, rg *detailRange) (*models.UserConnectDetail, error) {
+	var (
+		connections []*cloud.Connection
+		facet       *repository.UsageFacet
+	)
+	// the bill of a day is collected at the beginning of the next UTC day, so
+	// the bills of the range are the ones of its calendar days in UTC
+	from := utcDay(rg.start).Add(24 * time.Hour)
+	to := utcDay(rg.end).Add(24 * time.Hour)
+	err := runConcurrently(
+		func() (err error) {
+			connections, err = us.connections.ListByUser(ctx, oid)
+			return err
+		},
+		func() (err error) {
+			facet, err = us.bills.UserUsage(ctx, oid, from, to)
+			return err
+		},
+	)
 	if err != nil {
 		return nil, err
 	}
-	cns := make([]*models.Connection, 0)
-	for idx := range connections {
-		c := connections[idx]
-		bills, usage, err := us.getConnectionBills(ctx, c.ID)
-		if err != nil {
-			return nil, err
+	ids := make([]primitive.ObjectID, 0, 2*len(connections))
+	for _, c := range connections {
+		ids = append(ids, c.SourceID, c.SinkID)
+	}
+	types, err := us.getConnectorTypes(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	totals := make(map[primitive.ObjectID]uint64)
+	total := uint64(0)
+	for _, t := range facet.Totals {
+		totals[t.ID] = t.Usage
+		total += t.Usage
+	}
+	connectionUsages := make(map[primitive.ObjectID]map[time.Time]uint64)
+	userUsages := make(map[time.Time]uint64)
+	for _, bill := range facet.Bills {
+		day := utils.ToBillTimeForConnect(bill.Date)
+		bucket := rg.bucketOf(time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, rg.loc))
+		if connectionUsages[bill.ID] == nil {
+			connectionUsages[bill.ID] = make(map[time.Time]uint64)
 		}
-		cn := &models.Connection{
+		connectionUsages[bill.ID][bucket] += bill.Usage
+		userUsages[bucket] += bill.Usage
+	}
+
+	cns := make([]*models.Connection, 0)
+	for _, c := range connections {
+		cns = append(cns, &models.Connection{
 			Base:          c.Base,
 			Name:          c.Name,
 			Status:        string(c.Status),
 			Description:   c.Description,
-			TotalUsage:    usage,
+			TotalUsage:    totals[c.ID],
 			EventbusID:    c.EventbusID,
 			Subscriptions: c.Subscriptions,
 			SourceID:      c.SourceID,
 			SinkID:        c.SinkID,
-			SourceType:    us.getConnectorType(ctx, c.SourceID),
-			SinkType:      us.getConnectorType(ctx, c.SinkID),
-			Bills:         bills,
-		}
-		cns = append(cns, cn)
-	}
-	// get user total bills
-	bills, usage, err := us.getUserBills(ctx, oid)
-	if err != nil {
-		return nil, err
+			SourceType:    types[c.SourceID],
+			SinkType:      types[c.SinkID],
+			Bills:         rg.format(connectionUsages[c.ID]),
+		})
 	}
 	result := &models.UserConnectDetail{
-		TotalUsage:  usage,
+		TotalUsage:  total,
 		Connections: cns,
-		Bills:       bills,
+		Bills:       rg.format(userUsages),
 	}
 	return result, nil
 }
 
-func (us *UserService) getConnections(ctx context.Context, oid string) ([]*cloud.Connection, error) {
+// utcDay returns the beginning of the calendar day of t in UTC.
+func utcDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// invalidateUpdatedConnectors drops the connectors updated since the last
+// check from the cache, so a renamed connector shows up at once rather than
+// after the ttl.
+func (us *UserService) invalidateUpdatedConnectors(ctx context.Context) error {
+	now := time.Now()
 	query := bson.M{
-		"created_by": oid,
+		"updated_at": bson.M{
+			"$gte": us.connectorsCheckedAt,
+		},
 	}
-	cursor, err := us.connectionColl.Find(ctx, query)
+	opts := options.Find().SetProjection(bson.M{"_id": 1})
+	cursor, err := us.connectorColl.Find(ctx, query, opts)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer func() {
 		_ = cursor.Close(ctx)
 	}()
-
-	connections := make([]*cloud.Connection, 0)
 	for cursor.Next(ctx) {
-		connection := &cloud.Connection{}
-		if err = cursor.Decode(connection); err != nil {
-			return nil, err
+		connector := &cloud.Connector{}
+		if err = cursor.Decode(connector); err != nil {
+			return err
 		}
-		connections = append(connections, connection)
+		us.connectors.Remove(connector.ID.Hex())
 	}
-	return connections, nil
+	us.connectorsCheckedAt = now
+	return nil
 }
 
-func (us *UserService) getConnectionBills(ctx context.Context, id primitive.ObjectID) ([]models.Bill, uint64, error) {
-	bills := make(map[time.Time]models.Bill, 0)
-	pipeline := mongo.Pipeline{
-		{
-			{"$match", bson.D{
-				{"connection_id", id},
-			}},
-		},
-		{
-			{"$group", bson.D{
-				{"_id", "$collected_at"},
-				{"usage", bson.D{
-					{"$sum", "$delivered_num"},
-				}},
-			}},
-		},
-	}
-	cursor, err := us.billColl.Aggregate(ctx, pipeline)
-	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			log.Warn(ctx).Err(err).Msg("find connect bills but no documents")
-			return []models.Bill{}, 0, nil
+// getConnectorTypes returns the display type of the connectors, the ones
+// missing from the cache are fetched with a single query.
+func (us *UserService) getConnectorTypes(ctx context.Context, ids []primitive.ObjectID) (map[primitive.ObjectID]string, error) {
+	types := make(map[primitive.ObjectID]string, len(ids))
+	missing := make([]primitive.ObjectID, 0)
+	for _, id := range ids {
+		if _, ok := types[id]; ok {
+			continue
 		}
-		return nil, 0, err
-	}
-	defer cursor.Close(ctx)
-	total := uint64(0)
-	for cursor.Next(ctx) {
-		var group models.Bill
-		if err = cursor.Decode(&group); err != nil {
-			return nil, 0, err
+		if typ, ok := us.connectors.Get(id.Hex()); ok {
+			types[id] = typ.(string)
+			continue
 		}
-		total += group.Usage
-		bills[utils.ToBillTimeForConnect(group.Date)] = group
+		types[id] = ""
+		missing = append(missing, id)
 	}
-	return toFormatBills(bills), total, nil
-}
-
-func (us *UserService) getUserBills(ctx context.Context, oid string) ([]models.Bill, uint64, error) {
-	bills := make(map[time.Time]models.Bill, 0)
-	pipeline := mongo.Pipeline{
-		{
-			{"$match", bson.D{
-				{"user_id", oid},
-			}},
-		},
-		{
-			{"$group", bson.D{
-				{"_id", "$collected_at"},
-				{"usage", bson.D{
-					{"$sum", "$delivered_num"},
-				}},
-			}},
+	if len(missing) == 0 {
+		return types, nil
+	}
+	query := bson.M{
+		"_id": bson.M{
+			"$in": missing,
 		},
 	}
-	cursor, err := us.billColl.Aggregate(ctx, pipeline)
+	cursor, err := us.connectorColl.Find(ctx, query)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			log.Warn(ctx).Err(err).Msg("find connect bills but no documents")
-			return []models.Bill{}, 0, nil
-		}
-		return nil, 0, err
+		return nil, db.HandleDBError(err)
 	}
-	defer cursor.Close(ctx)
-	total := uint64(0)
+	defer func() {
+		_ = cursor.Close(ctx)
+	}()
 	for cursor.Next(ctx) {
-		var group models.Bill
-		if err = cursor.Decode(&group); err != nil {
-			return nil, 0, err
+		connector := &cloud.Connector{}
+		if err = cursor.Decode(connector); err != nil {
+			log.Error(ctx).Err(err).Msg("failed to decode connector")
+			return nil, db.HandleDBError(err)
 		}
-		total += group.Usage
-		bills[utils.ToBillTimeForConnect(group.Date)] = group
-	}
-	return toFormatBills(bills), total, nil
-}
-
-func (us *UserService) getConnectorType(ctx context.Context, id primitive.ObjectID) string {
-	query := bson.M{
-		"_id": id,
-	}
-
-	result := us.connectorColl.FindOne(ctx, query)
-	if result.Err() != nil {
-		log.Error(ctx).Err(result.Err()).Any("id", id).Msg("failed to get connector")
-		return ""
-	}
-	connector := &cloud.Connector{}
-	if err := result.Decode(connector); err != nil {
-		log.Error(ctx).Err(err).Msg("failed to decode user quota")
-		return ""
-	}
-	if connector.DisplayType != "" {
-		return connector.DisplayType
-	}
-	return connector.Type
-}
-
-func toFormatBills(billMap map[time.Time]models.Bill) []models.Bill {
-	bills := make([]models.Bill, 0)
-	rt := time.Now().Add(-24 * time.Hour)
-	collectionTime := time.Date(rt.Year(), rt.Month(), rt.Day(), 0, 0, 0, 0, time.UTC)
-	for i := 0; i < constant.NumberOfHistogramSamples; i++ {
-		if bill, ok := billMap[collectionTime]; ok {
-			bills = append(bills, bill)
-		} else {
-			bills = append(bills, models.Bill{
-				Date:  collectionTime,
-				Usage: 0,
-			})
+		typ := connector.Type
+		if connector.DisplayType != "" {
+			typ = connector.DisplayType
 		}
-		collectionTime = collectionTime.Add(-24 * time.Hour)
+		types[connector.ID] = typ
+	}
+	// the deleted connectors are cached with an empty type
+	for _, id := range missing {
+		us.connectors.Add(id.Hex(), types[id])
 	}
-	return bills
+	return types, nil
 }
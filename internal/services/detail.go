@@ -0,0 +1,167 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/jyjiangkai/stat/api"
+	"github.com/jyjiangkai/stat/constant"
+	"github.com/jyjiangkai/stat/models"
+	"github.com/jyjiangkai/stat/utils"
+)
+
+const (
+	// MaxDetailBuckets bounds the number of bills of every series of the
+	// user detail, a longer range needs a coarser granularity
+	MaxDetailBuckets = 400
+	detailDateLayout = "2006-01-02"
+)
+
+// detailRange is the range of the bills of the user detail, the end is
+// exclusive, the days of it are the days of loc.
+type detailRange struct {
+	start       time.Time
+	end         time.Time
+	granularity string
+	loc         *time.Location
+}
+
+func newDetailRange(opts *api.GetOptions, loc *time.Location) (*detailRange, error) {
+	now := time.Now().In(loc)
+	rg := &detailRange{
+		end:         utils.ToBillTimeForAI(now, loc),
+		granularity: opts.Granularity,
+		loc:         loc,
+	}
+	rg.start = rg.end.AddDate(0, 0, -constant.NumberOfHistogramSamples)
+	if opts.Start != "" || opts.End != "" {
+		interval, err := api.Range{Start: opts.Start, End: opts.End}.Parse(now)
+		if err != nil {
+			return nil, err
+		}
+		// the buckets are whole days
+		rg.start = utils.ToBillTimeForAI(interval.Start, loc)
+		rg.end = utils.ToBillTimeForAI(interval.End.Add(-time.Nanosecond), loc).AddDate(0, 0, 1)
+	}
+	switch rg.granularity {
+	case "":
+		rg.granularity = GranularityOfDay
+	case GranularityOfDay, GranularityOfWeek, GranularityOfMonth:
+	default:
+		return nil, api.ErrInvalidParameter.WithMessage("unsupported granularity " + rg.granularity)
+	}
+	if n := len(rg.buckets()); n > MaxDetailBuckets {
+		return nil, api.ErrInvalidParameter.WithMessage(fmt.Sprintf(
+			"the range has %d buckets of %s, more than %d, use a coarser granularity", n, rg.granularity, MaxDetailBuckets))
+	}
+	return rg, nil
+}
+
+func (rg *detailRange) bucketOf(t time.Time) time.Time {
+	day := utils.ToBillTimeForAI(t, rg.loc)
+	switch rg.granularity {
+	case GranularityOfWeek:
+		return TimeToWeek(day).Start
+	case GranularityOfMonth:
+		return utils.GetMonthBeginTime(day)
+	}
+	return day
+}
+
+func (rg *detailRange) next(bucket time.Time) time.Time {
+	switch rg.granularity {
+	case GranularityOfWeek:
+		return bucket.AddDate(0, 0, 7)
+	case GranularityOfMonth:
+		return bucket.AddDate(0, 1, 0)
+	}
+	return bucket.AddDate(0, 0, 1)
+}
+
+func (rg *detailRange) buckets() []time.Time {
+	buckets := make([]time.Time, 0)
+	for bucket := rg.bucketOf(rg.start); bucket.Before(rg.end); bucket = rg.next(bucket) {
+		buckets = append(buckets, bucket)
+	}
+	return buckets
+}
+
+// format returns a bill for every bucket of the range, the latest first.
+func (rg *detailRange) format(usages map[time.Time]uint64) []models.Bill {
+	buckets := rg.buckets()
+	bills := make([]models.Bill, 0, len(buckets))
+	for i := len(buckets) - 1; i >= 0; i-- {
+		bills = append(bills, models.Bill{
+			Date:  buckets[i],
+			Usage: usages[buckets[i]],
+		})
+	}
+	return bills
+}
+
+// countByApp counts the documents of each app which aren't deleted.
+func countByApp(ctx context.Context, coll *mongo.Collection, ids []primitive.ObjectID) (map[primitive.ObjectID]int64, error) {
+	counts := make(map[primitive.ObjectID]int64)
+	if len(ids) == 0 {
+		return counts, nil
+	}
+	pipeline := mongo.Pipeline{
+		{
+			{"$match", bson.D{
+				{"app_id", bson.D{{"$in", ids}}},
+				{"status", bson.D{{"$ne", "deleted"}}},
+			}},
+		},
+		{
+			{"$group", bson.D{
+				{"_id", "$app_id"},
+				{"count", bson.D{{"$sum", 1}}},
+			}},
+		},
+	}
+	cursor, err := coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = cursor.Close(ctx)
+	}()
+	for cursor.Next(ctx) {
+		var group struct {
+			ID    primitive.ObjectID `bson:"_id"`
+			Count int64              `bson:"count"`
+		}
+		if err = cursor.Decode(&group); err != nil {
+			return nil, err
+		}
+		counts[group.ID] = group.Count
+	}
+	return counts, cursor.Err()
+}
+
+// runConcurrently runs the fns at the same time and returns the first error
+// in their order.
+func runConcurrently(fns ...func() error) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(fns))
+	for i := range fns {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = fns[i]()
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/jyjiangkai/stat/models"
+	"github.com/jyjiangkai/stat/models/cloud"
+	"github.com/jyjiangkai/stat/timezone"
+	"github.com/jyjiangkai/stat/utils"
+)
+
+const (
+	ForecastWindowDays  = 14  // days of recent usage the trend is fitted on
+	ForecastHorizonDays = 366 // never project further than this
+	DefaultForecastDays = 14  // default look-ahead window of the exhausting users list
+)
+
+var (
+	// the connect quota items which are consumed by delivered events
+	forecastConnectResources = []cloud.ResourceType{
+		cloud.ResourceNoticeEvents,
+		cloud.ResourceStreamingEvents,
+	}
+)
+
+func (ss *StatService) getForecasts(ctx context.Context, oid string, bills *models.Bills, now time.Time) ([]*models.Forecast, error) {
+	forecasts := make([]*models.Forecast, 0)
+	credits, err := ss.getActiveCredits(ctx, oid, now)
+	if err != nil {
+		return nil, err
+	}
+	if credits != nil && bills.AI != nil {
+		forecast := &models.Forecast{
+			Kind:      "ai",
+			Resource:  string(cloud.ResourceCredits),
+			Used:      credits.Used,
+			Total:     credits.Total,
+			PeriodEnd: credits.PeriodOfValidity.End,
+		}
+		forecast.DailyUsage, forecast.ExhaustedAt = projectExhaustion(bills.AI.Items, now, timezone.Reporting(), float64(credits.Total)-float64(credits.Used), credits.PeriodOfValidity.End)
+		forecasts = append(forecasts, forecast)
+	}
+
+	quota, err := ss.getActiveQuota(ctx, oid, "cloud", now)
+	if err != nil {
+		return nil, err
+	}
+	if quota != nil && quota.PeriodOfValidity != nil && bills.Connect != nil {
+		for _, item := range quota.QuotaItems {
+			if !utils.Contains(forecastConnectResources, item.Type) || item.Total <= 0 {
+				continue
+			}
+			forecast := &models.Forecast{
+				Kind:      "connect",
+				Resource:  string(item.Type),
+				Used:      item.Used,
+				Total:     item.Total,
+				PeriodEnd: quota.PeriodOfValidity.End,
+			}
+			forecast.DailyUsage, forecast.ExhaustedAt = projectExhaustion(bills.Connect.Items, now, time.UTC, float64(item.Total)-float64(item.Used), quota.PeriodOfValidity.End)
+			forecasts = append(forecasts, forecast)
+		}
+	}
+	return forecasts, nil
+}
+
+// projectExhaustion fits a least squares line on the daily usages of the
+// recent window and walks it forward day by day until the remaining amount
+// runs out or the period of validity ends, in which case nil is returned.
+// The items are keyed by the beginning of the days in loc.
+func projectExhaustion(items map[time.Time]uint64, now time.Time, loc *time.Location, remaining float64, end time.Time) (float64, *time.Time) {
+	today := utils.ToBillTimeForAI(now, loc)
+	if remaining <= 0 {
+		return 0, &today
+	}
+	var sumX, sumY, sumXY, sumXX float64
+	n := float64(ForecastWindowDays)
+	for i := 0; i < ForecastWindowDays; i++ {
+		x := float64(i)
+		y := float64(items[today.AddDate(0, 0, i-ForecastWindowDays)])
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumXX += x * x
+	}
+	slope := (n*sumXY - sumX*sumY) / (n*sumXX - sumX*sumX)
+	intercept := (sumY - slope*sumX) / n
+	rate := func(day int) float64 {
+		r := intercept + slope*float64(ForecastWindowDays+day)
+		if r < 0 {
+			return 0
+		}
+		return r
+	}
+
+	for day := 0; day < ForecastHorizonDays; day++ {
+		date := today.AddDate(0, 0, day)
+		if date.After(end) {
+			break
+		}
+		usage := rate(day)
+		if usage >= remaining {
+			at := date.Add(time.Duration(remaining / usage * float64(24*time.Hour)))
+			return rate(0), &at
+		}
+		remaining -= usage
+	}
+	return rate(0), nil
+}
+
+// getActiveCredits returns the credits of the current period, the monthly
+// credits of a paid plan take precedence over the free ones.
+func (ss *StatService) getActiveCredits(ctx context.Context, oid string, now time.Time) (*cloud.UserCredits, error) {
+	query := bson.M{
+		"user_id": oid,
+		"type": bson.M{
+			"$in": []cloud.CreditsType{cloud.MonthlyCredits, cloud.FreeUserCredits},
+		},
+		"period_of_validity.start": bson.M{
+			"$lte": now,
+		},
+		"period_of_validity.end": bson.M{
+			"$gte": now,
+		},
+	}
+	cursor, err := ss.creditColl.Find(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = cursor.Close(ctx)
+	}()
+
+	credits := make(cloud.UserCreditsList, 0)
+	for cursor.Next(ctx) {
+		credit := &cloud.UserCredits{}
+		if err = cursor.Decode(credit); err != nil {
+			return nil, err
+		}
+		if credit.PeriodOfValidity == nil {
+			continue
+		}
+		credits = append(credits, credit)
+	}
+	for _, credit := range credits {
+		if credit.Type == cloud.MonthlyCredits {
+			return credit, nil
+		}
+	}
+	if idx := credits.IndexFreeCredits(); idx >= 0 {
+		return credits[idx], nil
+	}
+	return nil, nil
+}
+
+func (ss *StatService) getActiveQuota(ctx context.Context, oid string, kind string, now time.Time) (*cloud.UserQuota, error) {
+	return ss.quotas.Active(ctx, oid, kind, now)
+}
@@ -0,0 +1,86 @@
+package services
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestProjectExhaustion(t *testing.T) {
+	now := time.Date(2024, 5, 15, 10, 0, 0, 0, time.UTC)
+	today := time.Date(2024, 5, 15, 0, 0, 0, 0, time.UTC)
+	window := func(usage func(day int) uint64) map[time.Time]uint64 {
+		items := make(map[time.Time]uint64)
+		for day := 0; day < ForecastWindowDays; day++ {
+			items[today.AddDate(0, 0, day-ForecastWindowDays)] = usage(day)
+		}
+		return items
+	}
+	flat := window(func(int) uint64 { return 100 })
+	growing := window(func(day int) uint64 { return uint64(10 * (day + 1)) })
+	at := func(d time.Duration) *time.Time {
+		t := today.Add(d)
+		return &t
+	}
+	cases := []struct {
+		name      string
+		items     map[time.Time]uint64
+		remaining float64
+		end       time.Time
+		rate      float64
+		exhausted *time.Time
+	}{
+		{
+			name:      "already exhausted",
+			items:     flat,
+			remaining: 0,
+			end:       today.AddDate(0, 1, 0),
+			exhausted: at(0),
+		},
+		{
+			name:      "flat usage",
+			items:     flat,
+			remaining: 250,
+			end:       today.AddDate(0, 1, 0),
+			rate:      100,
+			exhausted: at(60 * time.Hour),
+		},
+		{
+			name:      "the period ends first",
+			items:     flat,
+			remaining: 1000,
+			end:       today.AddDate(0, 0, 3),
+			rate:      100,
+		},
+		{
+			name:      "no usage",
+			items:     map[time.Time]uint64{},
+			remaining: 1000,
+			end:       today.AddDate(0, 1, 0),
+		},
+		{
+			name:      "growing usage",
+			items:     growing,
+			remaining: 150 + 160,
+			end:       today.AddDate(0, 1, 0),
+			rate:      150,
+			exhausted: at(48 * time.Hour),
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rate, exhausted := projectExhaustion(c.items, now, time.UTC, c.remaining, c.end)
+			if math.Abs(rate-c.rate) > 1e-6 {
+				t.Errorf("projectExhaustion() rate = %v, want %v", rate, c.rate)
+			}
+			switch {
+			case c.exhausted == nil && exhausted != nil:
+				t.Errorf("projectExhaustion() exhausted at %v, want nil", *exhausted)
+			case c.exhausted != nil && exhausted == nil:
+				t.Errorf("projectExhaustion() exhausted at nil, want %v", *c.exhausted)
+			case c.exhausted != nil && exhausted.Sub(*c.exhausted).Abs() > time.Second:
+				t.Errorf("projectExhaustion() exhausted at %v, want %v", *exhausted, *c.exhausted)
+			}
+		})
+	}
+}
@@ -0,0 +1,450 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/jyjiangkai/stat/api"
+	"github.com/jyjiangkai/stat/cache"
+	"github.com/jyjiangkai/stat/db"
+	"github.com/jyjiangkai/stat/log"
+	"github.com/jyjiangkai/stat/mailchimp"
+	"github.com/jyjiangkai/stat/models"
+	"github.com/jyjiangkai/stat/models/cloud"
+)
+
+const (
+	pseudonymPrefix = "anon-"
+)
+
+// subjectCollection is a collection of the stat service holding the data
+// of users, Field is where the OID is kept and Clear lists the PII fields
+// emptied on anonymization.
+type subjectCollection struct {
+	coll  *mongo.Collection
+	field string
+	clear []string
+}
+
+type GDPRService struct {
+	cli             *mongo.Client
+	userStatColl    *mongo.Collection
+	dataSubjectColl *mongo.Collection
+	auditColl       *mongo.Collection
+	reportColl      *mongo.Collection
+	collections     []*subjectCollection
+	closeC          chan struct{}
+}
+
+func NewGDPRService(cli *mongo.Client) *GDPRService {
+	stat := cli.Database(DatabaseOfUserStatistics)
+	analytics := cli.Database(DatabaseOfUserAnalytics)
+	return &GDPRService{
+		cli:             cli,
+		userStatColl:    stat.Collection("user_stats"),
+		dataSubjectColl: stat.Collection("data_subject_requests"),
+		auditColl:       stat.Collection("audit_logs"),
+		reportColl:      stat.Collection("reconciliation_reports"),
+		collections: []*subjectCollection{
+			{
+				coll:  stat.Collection("user_stats"),
+				field: "oidc_id",
+				clear: []string{"email", "phone", "given_name", "family_name", "nickname",
+					"company_name", "company_email", "country", "ref", "ref_host"},
+			},
+			{
+				coll:  stat.Collection("user_stat_history"),
+				field: "oidc_id",
+				clear: []string{"email", "phone", "given_name", "family_name", "nickname",
+					"company_name", "company_email", "country", "ref", "ref_host"},
+			},
+			{coll: stat.Collection("churn_risks"), field: "oidc_id", clear: []string{"email", "company_name"}},
+			{coll: stat.Collection("renewals"), field: "oidc_id"},
+			{coll: stat.Collection("plan_snapshots"), field: "oidc_id"},
+			{coll: stat.Collection("plan_transitions"), field: "oidc_id"},
+			{coll: analytics.Collection("user_tracks"), field: "user"},
+			{coll: analytics.Collection("user_actions"), field: "usersub", clear: []string{"user", "payload.message"}},
+		},
+		closeC: make(chan struct{}),
+	}
+}
+
+func (gs *GDPRService) Start() error {
+	return nil
+}
+
+func (gs *GDPRService) Stop() error {
+	return nil
+}
+
+// resolve finds the OID and email of the data subject from either of them.
+func (gs *GDPRService) resolve(ctx context.Context, oid, email string) (string, string, error) {
+	if oid == "" && email == "" {
+		return "", "", api.ErrInvalidMissingParameter.WithMessage("oid or email is required")
+	}
+	query := bson.M{"oidc_id": oid}
+	if oid == "" {
+		query = bson.M{"email": email}
+	}
+	user := &models.User{}
+	err := gs.userStatColl.FindOne(ctx, query).Decode(user)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			return "", "", db.HandleDBError(err)
+		}
+		if oid == "" {
+			return "", "", api.ErrResourceNotFound.WithMessage(fmt.Sprintf("no user with email %s", email))
+		}
+		return oid, email, nil
+	}
+	if email == "" {
+		email = user.Email
+	}
+	return user.OID, email, nil
+}
+
+// Export returns everything the stat service holds about the data subject.
+func (gs *GDPRService) Export(ctx context.Context, oid, email string) (*models.DataSubjectExport, error) {
+	oid, email, err := gs.resolve(ctx, oid, email)
+	if err != nil {
+		return nil, err
+	}
+	export := &models.DataSubjectExport{
+		OID:         oid,
+		Email:       email,
+		GeneratedAt: time.Now(),
+		Collections: make(map[string][]bson.M),
+	}
+	for _, sc := range gs.collections {
+		cursor, err := sc.coll.Find(ctx, bson.M{sc.field: oid})
+		if err != nil {
+			return nil, db.HandleDBError(err)
+		}
+		docs := make([]bson.M, 0)
+		if err = cursor.All(ctx, &docs); err != nil {
+			return nil, db.HandleDBError(err)
+		}
+		export.Collections[sc.coll.Database().Name()+"."+sc.coll.Name()] = docs
+	}
+	now := time.Now()
+	request := &models.DataSubjectRequest{
+		Base:        cloud.NewBase(ctx),
+		Type:        models.DataSubjectRequestOfExport,
+		OID:         oid,
+		Email:       email,
+		Status:      models.DataSubjectStatusOfCompleted,
+		CompletedAt: &now,
+	}
+	forgetEmail(request)
+	if _, err = gs.dataSubjectColl.InsertOne(ctx, request); err != nil {
+		return nil, db.HandleDBError(err)
+	}
+	return export, nil
+}
+
+// Erase creates an erasure request of the data subject and runs it in the
+// background, the returned request is polled for the completion report.
+func (gs *GDPRService) Erase(ctx context.Context, oid, email, mode string) (*models.DataSubjectRequest, error) {
+	if mode == "" {
+		mode = models.ErasureModeOfDelete
+	}
+	if mode != models.ErasureModeOfDelete && mode != models.ErasureModeOfAnonymize {
+		return nil, api.ErrInvalidParameter.WithMessage("unsupported erasure mode " + mode)
+	}
+	oid, email, err := gs.resolve(ctx, oid, email)
+	if err != nil {
+		return nil, err
+	}
+	request := &models.DataSubjectRequest{
+		Base:   cloud.NewBase(ctx),
+		Type:   models.DataSubjectRequestOfErasure,
+		Mode:   mode,
+		OID:    oid,
+		Email:  email,
+		Status: models.DataSubjectStatusOfPending,
+	}
+	if mode == models.ErasureModeOfAnonymize {
+		request.Pseudonym = pseudonymPrefix + primitive.NewObjectID().Hex()
+	}
+	if _, err = gs.dataSubjectColl.InsertOne(ctx, request); err != nil {
+		return nil, db.HandleDBError(err)
+	}
+	job := *request
+	go gs.runErasure(context.Background(), &job)
+	return request, nil
+}
+
+func (gs *GDPRService) runErasure(ctx context.Context, request *models.DataSubjectRequest) {
+	report := &models.ErasureReport{
+		Collections: make([]*models.CollectionErasure, 0, len(gs.collections)),
+		StartedAt:   time.Now(),
+	}
+	request.Status = models.DataSubjectStatusOfRunning
+	request.Report = report
+	gs.saveRequest(ctx, request)
+
+	failed := false
+	for _, sc := range gs.collections {
+		ce := gs.eraseCollection(ctx, sc, request)
+		if ce.Error != "" {
+			failed = true
+		}
+		report.Collections = append(report.Collections, ce)
+	}
+	// the logs are kept whatever the mode, a deleted subject gets a
+	// pseudonym which is used in all of them
+	pseudonym := request.Pseudonym
+	if pseudonym == "" {
+		pseudonym = pseudonymPrefix + primitive.NewObjectID().Hex()
+	}
+	for _, ce := range []*models.CollectionErasure{
+		gs.eraseAuditLogs(ctx, request, pseudonym),
+		gs.eraseReconciliationIssues(ctx, request, pseudonym),
+	} {
+		if ce.Error != "" {
+			failed = true
+		}
+		report.Collections = append(report.Collections, ce)
+	}
+
+	switch {
+	case request.Email == "" || !mailchimp.ValidateEmail(request.Email):
+		report.MailChimp = "skipped: no valid email"
+	case !mailchimp.Enabled():
+		report.MailChimp = "skipped: mailchimp is disabled"
+	default:
+		if err := mailchimp.RemoveMember(ctx, request.Email); err != nil {
+			failed = true
+			report.MailChimp = "failed: " + err.Error()
+		} else {
+			report.MailChimp = "removed"
+		}
+	}
+
+	now := time.Now()
+	report.FinishedAt = now
+	request.Status = models.DataSubjectStatusOfCompleted
+	if failed {
+		request.Status = models.DataSubjectStatusOfFailed
+		request.Error = "some of the data could not be erased, see the report"
+	}
+	request.CompletedAt = &now
+	forgetEmail(request)
+	gs.saveRequest(ctx, request)
+	// the cached pages may still show the erased user
+	cache.Invalidate(ctx, "data subject erased")
+	log.Info(ctx).Str("id", request.ID.Hex()).Str("status", request.Status).Msg("finish data subject erasure")
+}
+
+// forgetEmail replaces the email of a finished request with its digest, the
+// OID is kept as the daily jobs skip the erased users by it.
+func forgetEmail(request *models.DataSubjectRequest) {
+	if request.Email == "" {
+		return
+	}
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(request.Email))))
+	request.EmailDigest = hex.EncodeToString(sum[:])
+	request.Email = ""
+}
+
+// eraseAuditLogs replaces the OID of the data subject in the audit logs with
+// a pseudonym whatever the mode, the audit logs themselves are never deleted
+// before the retention period.
+func (gs *GDPRService) eraseAuditLogs(ctx context.Context, request *models.DataSubjectRequest, pseudonym string) *models.CollectionErasure {
+	ce := &models.CollectionErasure{
+		Database:   gs.auditColl.Database().Name(),
+		Collection: gs.auditColl.Name(),
+	}
+	filter := bson.M{
+		"$or": []bson.M{
+			{"viewed_users": request.OID},
+			{"path": bson.M{"$regex": regexp.QuoteMeta(request.OID)}},
+		},
+	}
+	update := mongo.Pipeline{
+		{
+			{"$set", bson.M{
+				"viewed_users": bson.M{
+					"$map": bson.M{
+						"input": bson.M{"$ifNull": []interface{}{"$viewed_users", bson.A{}}},
+						"in": bson.M{
+							"$cond": []interface{}{bson.M{"$eq": []interface{}{"$$this", request.OID}}, pseudonym, "$$this"},
+						},
+					},
+				},
+				"path": bson.M{
+					"$replaceAll": bson.M{"input": "$path", "find": request.OID, "replacement": pseudonym},
+				},
+			}},
+		},
+	}
+	result, err := gs.auditColl.UpdateMany(ctx, filter, update)
+	if err != nil {
+		ce.Error = err.Error()
+		return ce
+	}
+	ce.Matched, ce.Anonymized = result.MatchedCount, result.ModifiedCount
+	return ce
+}
+
+// eraseReconciliationIssues replaces the OID of the data subject in the
+// issues of the reconciliation reports with a pseudonym, the reports keep
+// their counters.
+func (gs *GDPRService) eraseReconciliationIssues(ctx context.Context, request *models.DataSubjectRequest, pseudonym string) *models.CollectionErasure {
+	ce := &models.CollectionErasure{
+		Database:   gs.reportColl.Database().Name(),
+		Collection: gs.reportColl.Name(),
+	}
+	filter := bson.M{"issues.oidc_id": request.OID}
+	update := bson.M{"$set": bson.M{"issues.$[issue].oidc_id": pseudonym}}
+	opts := options.Update().SetArrayFilters(options.ArrayFilters{
+		Filters: []interface{}{bson.M{"issue.oidc_id": request.OID}},
+	})
+	result, err := gs.reportColl.UpdateMany(ctx, filter, update, opts)
+	if err != nil {
+		ce.Error = err.Error()
+		return ce
+	}
+	ce.Matched, ce.Anonymized = result.MatchedCount, result.ModifiedCount
+	return ce
+}
+
+func (gs *GDPRService) eraseCollection(ctx context.Context, sc *subjectCollection, request *models.DataSubjectRequest) *models.CollectionErasure {
+	ce := &models.CollectionErasure{
+		Database:   sc.coll.Database().Name(),
+		Collection: sc.coll.Name(),
+	}
+	filter := bson.M{sc.field: request.OID}
+	if request.Mode == models.ErasureModeOfDelete {
+		result, err := sc.coll.DeleteMany(ctx, filter)
+		if err != nil {
+			ce.Error = err.Error()
+			return ce
+		}
+		ce.Matched, ce.Deleted = result.DeletedCount, result.DeletedCount
+		return ce
+	}
+	set := bson.M{sc.field: request.Pseudonym}
+	for _, field := range sc.clear {
+		set[field] = ""
+	}
+	result, err := sc.coll.UpdateMany(ctx, filter, bson.M{"$set": set})
+	if err != nil {
+		ce.Error = err.Error()
+		return ce
+	}
+	ce.Matched, ce.Anonymized = result.MatchedCount, result.ModifiedCount
+	return ce
+}
+
+func (gs *GDPRService) saveRequest(ctx context.Context, request *models.DataSubjectRequest) {
+	request.UpdatedAt = time.Now()
+	_, err := gs.dataSubjectColl.ReplaceOne(ctx, bson.M{"_id": request.ID}, request)
+	if err != nil {
+		log.Error(ctx).Err(err).Str("id", request.ID.Hex()).Msg("failed to save data subject request")
+	}
+}
+
+func (gs *GDPRService) Get(ctx context.Context, id string) (*models.DataSubjectRequest, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, api.ErrInvalidID.WithError(err)
+	}
+	request := &models.DataSubjectRequest{}
+	if err = gs.dataSubjectColl.FindOne(ctx, bson.M{"_id": oid}).Decode(request); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, api.ErrResourceNotFound.WithMessage(fmt.Sprintf("data subject request %s not found", id))
+		}
+		return nil, db.HandleDBError(err)
+	}
+	return request, nil
+}
+
+func (gs *GDPRService) List(ctx context.Context, pg api.Page, opts *api.ListOptions) (*api.ListResult, error) {
+	var (
+		skip  = pg.PageNumber * pg.PageSize
+		limit = pg.PageSize
+		sort  = bson.M{"created_at": -1}
+	)
+
+	if skip < 0 {
+		skip = 0
+	}
+
+	query := bson.M{}
+	if opts.TypeSelector != "" {
+		query["type"] = opts.TypeSelector
+	}
+	cnt, err := gs.dataSubjectColl.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if cnt == 0 {
+		return &api.ListResult{
+			List: []interface{}{},
+			P:    pg,
+		}, nil
+	}
+	if cnt <= skip {
+		return nil, api.ErrPageArgumentsTooLarge
+	}
+
+	pg.Total = cnt
+	if pg.Direction == "asc" {
+		sort = bson.M{"created_at": 1}
+	}
+	opt := options.FindOptions{
+		Limit: &limit,
+		Skip:  &skip,
+		Sort:  sort,
+	}
+	cursor, err := gs.dataSubjectColl.Find(ctx, query, &opt)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = cursor.Close(ctx)
+	}()
+
+	list := make([]interface{}, 0)
+	for cursor.Next(ctx) {
+		request := &models.DataSubjectRequest{}
+		if err = cursor.Decode(request); err != nil {
+			return nil, db.HandleDBError(err)
+		}
+		list = append(list, request)
+	}
+	return &api.ListResult{
+		List: list,
+		P:    pg,
+	}, nil
+}
+
+// erasedUsers returns the OIDs of every erasure request whatever its status,
+// the daily user stat skips them so an erased user doesn't come back.
+func erasedUsers(ctx context.Context, coll *mongo.Collection) (map[string]struct{}, error) {
+	query := bson.M{
+		"type": models.DataSubjectRequestOfErasure,
+	}
+	oids, err := coll.Distinct(ctx, "oidc_id", query)
+	if err != nil {
+		return nil, db.HandleDBError(err)
+	}
+	erased := make(map[string]struct{}, len(oids))
+	for _, oid := range oids {
+		if s, ok := oid.(string); ok {
+			erased[s] = struct{}{}
+		}
+	}
+	return erased, nil
+}
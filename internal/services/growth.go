@@ -0,0 +1,485 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/jyjiangkai/stat/api"
+	"github.com/jyjiangkai/stat/db"
+	"github.com/jyjiangkai/stat/log"
+	"github.com/jyjiangkai/stat/models"
+	"github.com/jyjiangkai/stat/timezone"
+	"github.com/jyjiangkai/stat/utils"
+)
+
+const (
+	growthTag        = "growth"
+	growthDateLayout = "2006-01-02"
+	// growthLookbackDays are the days accounted again in every run, as the
+	// bills of a day may be collected after it was accounted
+	growthLookbackDays = 7
+)
+
+type GrowthService struct {
+	cli             *mongo.Client
+	userColl        *mongo.Collection
+	billColl        *mongo.Collection
+	aiBillColl      *mongo.Collection
+	actionColl      *mongo.Collection
+	dailyStatColl   *mongo.Collection
+	dataSubjectColl *mongo.Collection
+	closeC          chan struct{}
+}
+
+func NewGrowthService(cli *mongo.Client) *GrowthService {
+	return &GrowthService{
+		cli:             cli,
+		userColl:        cli.Database(db.GetDatabaseName()).Collection("users"),
+		billColl:        cli.Database(db.GetDatabaseName()).Collection("bills"),
+		aiBillColl:      cli.Database(db.GetDatabaseName()).Collection("ai_bills"),
+		actionColl:      cli.Database(DatabaseOfUserAnalytics).Collection("user_actions"),
+		dailyStatColl:   cli.Database(DatabaseOfUserStatistics).Collection("daily_stats"),
+		dataSubjectColl: cli.Database(DatabaseOfUserStatistics).Collection("data_subject_requests"),
+		closeC:          make(chan struct{}),
+	}
+}
+
+func (gs *GrowthService) Start() error {
+	ctx := context.Background()
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		defer log.Warn(ctx).Err(nil).Msg("growth accounting routine exit")
+		for {
+			select {
+			case <-gs.closeC:
+				log.Info(ctx).Msg("growth service stopped.")
+				return
+			case <-ticker.C:
+				now := time.Now()
+				if now.Hour() == 2 {
+					log.Info(ctx).Msgf("start growth accounting at: %+v\n", now)
+					err := gs.Account(ctx, now)
+					if err != nil {
+						log.Error(ctx).Err(err).Msgf("growth accounting failed at %+v\n", time.Now())
+					}
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func (gs *GrowthService) Stop() error {
+	return nil
+}
+
+// Account computes the growth accounting of the complete days and weeks since
+// the last run in the reporting timezone and stores it in daily_stats, the
+// last growthLookbackDays are accounted again. The first run accounts every
+// one since StartAt.
+func (gs *GrowthService) Account(ctx context.Context, now time.Time) error {
+	loc := timezone.Reporting()
+	today := utils.ToBillTimeForAI(now, loc)
+	first := utils.ToBillTimeForAI(StartAt, loc)
+	from := first.AddDate(0, 0, 1)
+	last, err := gs.getLastAccounted(ctx, loc)
+	if err != nil {
+		return err
+	}
+	if last != nil && last.AddDate(0, 0, -growthLookbackDays).After(from) {
+		from = last.AddDate(0, 0, -growthLookbackDays)
+	}
+	// the first week which has a day since from
+	week := TimeToWeek(first).End
+	for !week.AddDate(0, 0, 7).After(from) {
+		week = week.AddDate(0, 0, 7)
+	}
+	since := from.AddDate(0, 0, -1)
+	if previous := week.AddDate(0, 0, -7); previous.Before(since) {
+		since = previous
+	}
+	activity, err := gs.getActivity(ctx, loc, since)
+	if err != nil {
+		return err
+	}
+	writes := make([]mongo.WriteModel, 0)
+	for day := from; day.Before(today); day = day.AddDate(0, 0, 1) {
+		growth := activity.account(day, day.AddDate(0, 0, 1), day.AddDate(0, 0, -1))
+		growth.Granularity = GranularityOfDay
+		writes = append(writes, gs.replaceGrowth(growth))
+	}
+	for ; !week.AddDate(0, 0, 7).After(today); week = week.AddDate(0, 0, 7) {
+		growth := activity.account(week, week.AddDate(0, 0, 7), week.AddDate(0, 0, -7))
+		growth.Granularity = GranularityOfWeek
+		writes = append(writes, gs.replaceGrowth(growth))
+	}
+	if err = bulkWrite(ctx, gs.dailyStatColl, writes); err != nil {
+		return err
+	}
+	log.Info(ctx).Int("periods", len(writes)).Int("users", len(activity.created)).Time("from", from).Msgf("finish growth accounting at: %+v\n", time.Now())
+	return nil
+}
+
+// getLastAccounted returns the last day accounted, nil when there is none.
+func (gs *GrowthService) getLastAccounted(ctx context.Context, loc *time.Location) (*time.Time, error) {
+	query := bson.M{
+		"tag":         growthTag,
+		"granularity": GranularityOfDay,
+		"timezone":    timezone.Query(loc),
+	}
+	opt := options.FindOneOptions{
+		Sort: bson.M{"date": -1},
+	}
+	growth := &models.DailyStatsOfGrowth{}
+	if err := gs.dailyStatColl.FindOne(ctx, query, &opt).Decode(growth); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, db.HandleDBError(err)
+	}
+	last := growth.Date.In(loc)
+	return &last, nil
+}
+
+func (gs *GrowthService) replaceGrowth(growth *models.DailyStatsOfGrowth) mongo.WriteModel {
+	return mongo.NewReplaceOneModel().
+		SetFilter(bson.M{
+			"date":        growth.Date,
+			"tag":         growthTag,
+			"granularity": growth.Granularity,
+			"timezone":    timezone.Query(growth.Date.Location()),
+		}).
+		SetReplacement(growth).
+		SetUpsert(true)
+}
+
+// List returns the growth accounting of the days or weeks within the range.
+func (gs *GrowthService) List(ctx context.Context, pg api.Page, granularity string) (*api.ListResult, error) {
+	switch granularity {
+	case "":
+		granularity = GranularityOfDay
+	case GranularityOfDay, GranularityOfWeek:
+	default:
+		return nil, api.ErrInvalidParameter.WithMessage("unsupported granularity " + granularity)
+	}
+	rg, previous, err := GetComparison(ctx, pg.Range)
+	if err != nil {
+		return nil, err
+	}
+	list, err := gs.find(ctx, rg, granularity)
+	if err != nil {
+		return nil, err
+	}
+	pg.Total = int64(len(list))
+	result := &api.ListResult{
+		List: list,
+		P:    pg,
+	}
+	if previous != nil {
+		if result.Previous, err = gs.find(ctx, *previous, granularity); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func (gs *GrowthService) find(ctx context.Context, rg api.Interval, granularity string) ([]interface{}, error) {
+	query := bson.M{
+		"date": bson.M{
+			"$gte": rg.Start,
+			"$lt":  rg.End,
+		},
+		"tag":         growthTag,
+		"granularity": granularity,
+		"timezone":    timezone.Query(timezone.Reporting()),
+	}
+	opt := options.FindOptions{
+		Sort: bson.M{"date": 1},
+	}
+	cursor, err := gs.dailyStatColl.Find(ctx, query, &opt)
+	if err != nil {
+		return nil, db.HandleDBError(err)
+	}
+	defer func() {
+		_ = cursor.Close(ctx)
+	}()
+	list := make([]interface{}, 0)
+	for cursor.Next(ctx) {
+		growth := &models.DailyStatsOfGrowth{}
+		if err = cursor.Decode(growth); err != nil {
+			return nil, db.HandleDBError(err)
+		}
+		list = append(list, growth)
+	}
+	return list, nil
+}
+
+// growthActivity is what the lifecycle of the users is derived from, the
+// days are the days of the reporting timezone.
+type growthActivity struct {
+	created map[string]time.Time
+	// the users who logged in or used AI or Connect on the day, by the
+	// date of the day
+	active map[string]map[string]struct{}
+	// the first day the user used AI or Connect
+	firstUsage map[string]time.Time
+}
+
+func newGrowthActivity() *growthActivity {
+	return &growthActivity{
+		created:    make(map[string]time.Time),
+		active:     make(map[string]map[string]struct{}),
+		firstUsage: make(map[string]time.Time),
+	}
+}
+
+func (ga *growthActivity) add(oid string, day time.Time, usage bool) {
+	if _, ok := ga.created[oid]; !ok {
+		return
+	}
+	date := day.Format(growthDateLayout)
+	users, ok := ga.active[date]
+	if !ok {
+		users = make(map[string]struct{})
+		ga.active[date] = users
+	}
+	users[oid] = struct{}{}
+	if first, ok := ga.firstUsage[oid]; usage && (!ok || day.Before(first)) {
+		ga.firstUsage[oid] = day
+	}
+}
+
+// activeWithin returns the users active on the days of [start, end).
+func (ga *growthActivity) activeWithin(start, end time.Time) map[string]struct{} {
+	users := make(map[string]struct{})
+	for day := start; day.Before(end); day = day.AddDate(0, 0, 1) {
+		for oid := range ga.active[day.Format(growthDateLayout)] {
+			users[oid] = struct{}{}
+		}
+	}
+	return users
+}
+
+// account classifies the users created before end in [start, end), the
+// previous period is [previous, start).
+func (ga *growthActivity) account(start, end, previous time.Time) *models.DailyStatsOfGrowth {
+	growth := &models.DailyStatsOfGrowth{
+		Date:     start,
+		Tag:      growthTag,
+		Timezone: start.Location().String(),
+	}
+	current := ga.activeWithin(start, end)
+	before := ga.activeWithin(previous, start)
+	for oid, created := range ga.created {
+		if !created.Before(end) {
+			continue
+		}
+		_, active := current[oid]
+		_, wasActive := before[oid]
+		// the sign up is an activity of its period
+		wasActive = wasActive || !created.Before(previous) && created.Before(start)
+		switch lifecycleOf(created, start, active, wasActive) {
+		case models.LifecycleOfNew:
+			growth.New++
+		case models.LifecycleOfRetained:
+			growth.Retained++
+		case models.LifecycleOfResurrected:
+			growth.Resurrected++
+		case models.LifecycleOfChurned:
+			growth.Churned++
+		case models.LifecycleOfDormant:
+			growth.Dormant++
+		}
+		if first, ok := ga.firstUsage[oid]; ok && !first.Before(start) && first.Before(end) {
+			growth.Activated++
+		}
+	}
+	growth.Active = growth.New + growth.Retained + growth.Resurrected
+	growth.Growth = growth.New + growth.Resurrected - growth.Churned
+	if growth.Churned > 0 {
+		growth.QuickRatio = float64(growth.New+growth.Resurrected) / float64(growth.Churned)
+	}
+	return growth
+}
+
+// lifecycleOf classifies a user created before the end of a period from
+// whether it was active in the period and in the previous one.
+func lifecycleOf(created, start time.Time, active, wasActive bool) string {
+	switch {
+	case !created.Before(start):
+		return models.LifecycleOfNew
+	case active && wasActive:
+		return models.LifecycleOfRetained
+	case active:
+		return models.LifecycleOfResurrected
+	case wasActive:
+		return models.LifecycleOfChurned
+	}
+	return models.LifecycleOfDormant
+}
+
+// getActivity loads the users and the days they were active since the given
+// day, along with the day of their first usage of all time.
+func (gs *GrowthService) getActivity(ctx context.Context, loc *time.Location, since time.Time) (*growthActivity, error) {
+	activity := newGrowthActivity()
+	erased, err := erasedUsers(ctx, gs.dataSubjectColl)
+	if err != nil {
+		return nil, err
+	}
+	opt := options.FindOptions{
+		Projection: bson.M{
+			"oidc_id":    1,
+			"created_at": 1,
+		},
+	}
+	cursor, err := gs.userColl.Find(ctx, bson.M{}, &opt)
+	if err != nil {
+		return nil, db.HandleDBError(err)
+	}
+	defer func() {
+		_ = cursor.Close(ctx)
+	}()
+	for cursor.Next(ctx) {
+		var user struct {
+			OID       string    `bson:"oidc_id"`
+			CreatedAt time.Time `bson:"created_at"`
+		}
+		if err = cursor.Decode(&user); err != nil {
+			return nil, db.HandleDBError(err)
+		}
+		if _, ok := erased[user.OID]; !ok {
+			activity.created[user.OID] = user.CreatedAt
+		}
+	}
+	if err = cursor.Err(); err != nil {
+		return nil, db.HandleDBError(err)
+	}
+
+	aiUsed := bson.M{"$or": bson.A{
+		bson.M{"usage.chatgpt_3_5": bson.M{"$gt": 0}},
+		bson.M{"usage.chatgpt_4": bson.M{"$gt": 0}},
+	}}
+	if err = gs.addFirstUsages(ctx, activity, gs.aiBillColl, aiUsed, "$collected_at", loc); err != nil {
+		return nil, err
+	}
+	if err = gs.addActiveDays(ctx, activity, gs.aiBillColl, collectedSince(aiUsed, since), "$user_id", "$collected_at", loc, true); err != nil {
+		return nil, err
+	}
+	// the Connect bills are collected the day after the usage
+	connectUsed := bson.M{"delivered_num": bson.M{"$gt": 0}}
+	usedAt := bson.M{"$subtract": bson.A{"$collected_at", int64(24 * time.Hour / time.Millisecond)}}
+	if err = gs.addFirstUsages(ctx, activity, gs.billColl, connectUsed, usedAt, loc); err != nil {
+		return nil, err
+	}
+	if err = gs.addActiveDays(ctx, activity, gs.billColl, collectedSince(connectUsed, since), "$user_id", usedAt, loc, true); err != nil {
+		return nil, err
+	}
+	// the time of the actions is stored as an RFC 3339 string
+	loggedIn := bson.M{
+		"usersub": bson.M{"$nin": bson.A{"", nil}},
+		"time":    bson.M{"$gte": since.UTC().Format(time.RFC3339)},
+	}
+	if err = gs.addActiveDays(ctx, activity, gs.actionColl, loggedIn, "$usersub", actionTime, loc, false); err != nil {
+		return nil, err
+	}
+	return activity, nil
+}
+
+// collectedSince narrows the query of the bills to the ones collected since
+// the given time.
+func collectedSince(query bson.M, since time.Time) bson.M {
+	narrowed := bson.M{"collected_at": bson.M{"$gte": since}}
+	for k, v := range query {
+		narrowed[k] = v
+	}
+	return narrowed
+}
+
+// addFirstUsages adds the day each user used AI or Connect for the first
+// time, which is before the days loaded for the users activated long ago.
+func (gs *GrowthService) addFirstUsages(ctx context.Context, activity *growthActivity, coll *mongo.Collection,
+	query bson.M, at interface{}, loc *time.Location) error {
+	pipeline := mongo.Pipeline{
+		{
+			{"$match", query},
+		},
+		{
+			{"$group", bson.D{
+				{"_id", "$user_id"},
+				{"first", bson.M{"$min": at}},
+			}},
+		},
+	}
+	cursor, err := coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return db.HandleDBError(err)
+	}
+	defer func() {
+		_ = cursor.Close(ctx)
+	}()
+	for cursor.Next(ctx) {
+		var group struct {
+			User  string    `bson:"_id"`
+			First time.Time `bson:"first"`
+		}
+		if err = cursor.Decode(&group); err != nil {
+			return db.HandleDBError(err)
+		}
+		activity.add(group.User, utils.ToBillTimeForAI(group.First, loc), true)
+	}
+	return db.HandleDBError(cursor.Err())
+}
+
+// addActiveDays adds the distinct users and days of the documents matching
+// the query, usage tells whether they are an usage of AI or Connect.
+func (gs *GrowthService) addActiveDays(ctx context.Context, activity *growthActivity, coll *mongo.Collection,
+	query bson.M, user string, at interface{}, loc *time.Location, usage bool) error {
+	pipeline := mongo.Pipeline{
+		{
+			{"$match", query},
+		},
+		{
+			{"$group", bson.D{
+				{"_id", bson.M{
+					"user": user,
+					"date": bson.M{
+						"$dateToString": bson.M{
+							"format":   "%Y-%m-%d",
+							"date":     at,
+							"timezone": loc.String(),
+						},
+					},
+				}},
+			}},
+		},
+	}
+	cursor, err := coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return db.HandleDBError(err)
+	}
+	defer func() {
+		_ = cursor.Close(ctx)
+	}()
+	for cursor.Next(ctx) {
+		var group struct {
+			ID struct {
+				User string `bson:"user"`
+				Date string `bson:"date"`
+			} `bson:"_id"`
+		}
+		if err = cursor.Decode(&group); err != nil {
+			return db.HandleDBError(err)
+		}
+		day, err := time.ParseInLocation(growthDateLayout, group.ID.Date, loc)
+		if err != nil {
+			continue
+		}
+		activity.add(group.ID.User, day, usage)
+	}
+	return db.HandleDBError(cursor.Err())
+}
@@ -0,0 +1,72 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jyjiangkai/stat/models"
+)
+
+func TestGrowthAccount(t *testing.T) {
+	day := func(n int) time.Time {
+		return time.Date(2024, 5, 1+n, 0, 0, 0, 0, time.UTC)
+	}
+	activity := newGrowthActivity()
+	for oid, created := range map[string]time.Time{
+		"retained":    day(0),
+		"churned":     day(0).Add(time.Hour),
+		"signed_up":   day(1).Add(time.Hour),
+		"new":         day(2).Add(time.Hour),
+		"resurrected": day(0),
+		"dormant":     day(0),
+		"later":       day(3),
+	} {
+		activity.created[oid] = created
+	}
+	activity.add("retained", day(1), false)
+	activity.add("retained", day(2), true)
+	activity.add("churned", day(1), true)
+	activity.add("resurrected", day(0), false)
+	activity.add("resurrected", day(2), true)
+	activity.add("later", day(3), true)
+	// unknown users are left out
+	activity.add("deleted", day(2), true)
+
+	growth := activity.account(day(2), day(3), day(1))
+	want := models.DailyStatsOfGrowth{
+		Date:        day(2),
+		Tag:         growthTag,
+		Timezone:    "UTC",
+		New:         1,
+		Retained:    1,
+		Resurrected: 1,
+		// the sign up counts as an activity of the previous day
+		Churned: 2,
+		Dormant: 1,
+		// the first usage of retained and resurrected
+		Activated:  2,
+		Active:     3,
+		Growth:     0,
+		QuickRatio: 1,
+	}
+	if *growth != want {
+		t.Errorf("account() = %+v, want %+v", *growth, want)
+	}
+
+	cases := []struct {
+		created           time.Time
+		active, wasActive bool
+		want              string
+	}{
+		{day(2), false, false, models.LifecycleOfNew},
+		{day(0), true, true, models.LifecycleOfRetained},
+		{day(0), true, false, models.LifecycleOfResurrected},
+		{day(0), false, true, models.LifecycleOfChurned},
+		{day(0), false, false, models.LifecycleOfDormant},
+	}
+	for _, c := range cases {
+		if got := lifecycleOf(c.created, day(2), c.active, c.wasActive); got != c.want {
+			t.Errorf("lifecycleOf(%v, %v, %v) = %s, want %s", c.created, c.active, c.wasActive, got, c.want)
+		}
+	}
+}
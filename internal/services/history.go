@@ -0,0 +1,212 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/jyjiangkai/stat/api"
+	"github.com/jyjiangkai/stat/db"
+	"github.com/jyjiangkai/stat/log"
+	"github.com/jyjiangkai/stat/models"
+	"github.com/jyjiangkai/stat/timezone"
+	"github.com/jyjiangkai/stat/utils"
+)
+
+// HistoryService keeps the versions of the stat users, a version is added
+// only when the class, usages, bill totals or cohort of the user change and
+// is valid from the day it was seen until the day the next one was, so the
+// stat users of any day since can be listed.
+type HistoryService struct {
+	cli          *mongo.Client
+	userStatColl *mongo.Collection
+	historyColl  *mongo.Collection
+}
+
+func NewHistoryService(cli *mongo.Client) *HistoryService {
+	return &HistoryService{
+		cli:          cli,
+		userStatColl: cli.Database(DatabaseOfUserStatistics).Collection("user_stats"),
+		historyColl:  cli.Database(DatabaseOfUserStatistics).Collection("user_stat_history"),
+	}
+}
+
+// currentVersion is the part of the current version of a user Snapshot needs.
+type currentVersion struct {
+	ID        primitive.ObjectID `bson:"_id"`
+	OID       string             `bson:"oidc_id"`
+	ValidFrom time.Time          `bson:"valid_from"`
+	Digest    string             `bson:"digest"`
+}
+
+// Snapshot compares every stat user with its current version, the changed
+// ones get a new version from the day of now and the ones which aren't in
+// user_stats anymore have theirs closed. It runs after the user stat.
+func (hs *HistoryService) Snapshot(ctx context.Context, now time.Time) error {
+	date := utils.ToBillTimeForAI(now, timezone.Reporting())
+	current, err := hs.getCurrentVersions(ctx)
+	if err != nil {
+		return err
+	}
+	// the daily bills and the forecasts aren't kept
+	opt := options.FindOptions{
+		Projection: bson.M{
+			"bills.ai.items":      0,
+			"bills.connect.items": 0,
+			"forecasts":           0,
+		},
+	}
+	cursor, err := hs.userStatColl.Find(ctx, bson.M{}, &opt)
+	if err != nil {
+		return db.HandleDBError(err)
+	}
+	defer func() {
+		_ = cursor.Close(ctx)
+	}()
+
+	writes := make([]mongo.WriteModel, 0, BatchSize)
+	changed := 0
+	for cursor.Next(ctx) {
+		user := models.User{}
+		if err = cursor.Decode(&user); err != nil {
+			return db.HandleDBError(err)
+		}
+		digest, err := digestOf(&user)
+		if err != nil {
+			return err
+		}
+		version := &models.UserStatVersion{
+			User:      user,
+			ValidFrom: date,
+			Digest:    digest,
+		}
+		previous, ok := current[user.OID]
+		delete(current, user.OID)
+		switch {
+		case ok && previous.Digest == digest:
+			continue
+		case ok && !previous.ValidFrom.Before(date):
+			// changed again on the same day
+			version.ID = previous.ID
+			writes = append(writes, mongo.NewReplaceOneModel().
+				SetFilter(bson.M{"_id": previous.ID}).
+				SetReplacement(version))
+		default:
+			if ok {
+				writes = append(writes, closeVersion(previous.ID, date))
+			}
+			version.ID = primitive.NewObjectID()
+			writes = append(writes, mongo.NewInsertOneModel().SetDocument(version))
+		}
+		changed += 1
+		if len(writes) >= BatchSize {
+			if err = bulkWrite(ctx, hs.historyColl, writes); err != nil {
+				return err
+			}
+			writes = writes[:0]
+		}
+	}
+	if err = cursor.Err(); err != nil {
+		return db.HandleDBError(err)
+	}
+	// the users deleted from user_stats, by an erasure or a reconciliation
+	for _, previous := range current {
+		writes = append(writes, closeVersion(previous.ID, date))
+	}
+	if err = bulkWrite(ctx, hs.historyColl, writes); err != nil {
+		return err
+	}
+	log.Info(ctx).Int("changed", changed).Int("closed", len(current)).Msgf("finish user stat snapshot at: %+v\n", time.Now())
+	return nil
+}
+
+func (hs *HistoryService) getCurrentVersions(ctx context.Context) (map[string]*currentVersion, error) {
+	opt := options.FindOptions{
+		Projection: bson.M{
+			"oidc_id":    1,
+			"valid_from": 1,
+			"digest":     1,
+		},
+	}
+	cursor, err := hs.historyColl.Find(ctx, bson.M{"valid_to": nil}, &opt)
+	if err != nil {
+		return nil, db.HandleDBError(err)
+	}
+	defer func() {
+		_ = cursor.Close(ctx)
+	}()
+	versions := make(map[string]*currentVersion)
+	for cursor.Next(ctx) {
+		version := &currentVersion{}
+		if err = cursor.Decode(version); err != nil {
+			return nil, db.HandleDBError(err)
+		}
+		versions[version.OID] = version
+	}
+	return versions, db.HandleDBError(cursor.Err())
+}
+
+func closeVersion(id primitive.ObjectID, date time.Time) mongo.WriteModel {
+	return mongo.NewUpdateOneModel().
+		SetFilter(bson.M{"_id": id}).
+		SetUpdate(bson.M{"$set": bson.M{"valid_to": date}})
+}
+
+// digestOf hashes the fields of the stat user a new version is kept for,
+// json is used as it sorts the keys of the cohort maps.
+func digestOf(user *models.User) (string, error) {
+	key := struct {
+		Class   *models.Class  `json:"class"`
+		Usages  *models.Usages `json:"usages"`
+		AI      uint64         `json:"ai"`
+		Connect *models.Events `json:"connect"`
+		Cohort  *models.Cohort `json:"cohort"`
+	}{
+		Class:  user.Class,
+		Usages: user.Usages,
+		Cohort: user.Cohort,
+	}
+	if user.Bills != nil {
+		if user.Bills.AI != nil {
+			key.AI = user.Bills.AI.Total
+		}
+		if user.Bills.Connect != nil {
+			key.Connect = user.Bills.Connect.Total
+		}
+	}
+	data, err := json.Marshal(key)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// ParseAsOf parses the as_of of a list, a range expression whose last day
+// in the reporting timezone is the day the stat users are listed as of.
+func ParseAsOf(expr string) (time.Time, error) {
+	loc := timezone.Reporting()
+	interval, err := api.ParseRange(expr, time.Now().In(loc))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return utils.ToBillTimeForAI(interval.End.Add(-time.Nanosecond), loc), nil
+}
+
+// asOfQuery selects the versions valid on the day.
+func asOfQuery(date time.Time) bson.M {
+	return bson.M{
+		"valid_from": bson.M{"$lte": date},
+		"$or": bson.A{
+			bson.M{"valid_to": nil},
+			bson.M{"valid_to": bson.M{"$gt": date}},
+		},
+	}
+}
@@ -0,0 +1,51 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/jyjiangkai/stat/models"
+)
+
+func TestDigestOf(t *testing.T) {
+	newUser := func(premium bool, total uint64) *models.User {
+		return &models.User{
+			OID:   "oid",
+			Email: "user@example.com",
+			Class: &models.Class{AI: &models.Level{Premium: premium}},
+			Bills: &models.Bills{
+				AI:      &models.AIBills{Total: total, Yesterday: total},
+				Connect: models.NewConnectBill(),
+			},
+			Cohort: &models.Cohort{
+				AI: map[string]*models.Retention{"0": {}, "1": {}, "2": {}},
+			},
+		}
+	}
+	digest := func(user *models.User) string {
+		d, err := digestOf(user)
+		if err != nil {
+			t.Fatalf("digestOf() error = %v", err)
+		}
+		return d
+	}
+
+	base := digest(newUser(false, 10))
+	for i := 0; i < 10; i++ {
+		if d := digest(newUser(false, 10)); d != base {
+			t.Fatalf("digestOf() isn't stable over the cohort maps, %s != %s", d, base)
+		}
+	}
+	// the fields which aren't kept don't make a new version
+	user := newUser(false, 10)
+	user.Email = "another@example.com"
+	user.Bills.AI.Yesterday = 3
+	if d := digest(user); d != base {
+		t.Errorf("digestOf() changed with the email and yesterday's bill")
+	}
+	if d := digest(newUser(true, 10)); d == base {
+		t.Errorf("digestOf() didn't change with the class")
+	}
+	if d := digest(newUser(false, 11)); d == base {
+		t.Errorf("digestOf() didn't change with the AI total")
+	}
+}
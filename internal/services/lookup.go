@@ -0,0 +1,49 @@
+package services
+
+import (
+	"time"
+
+	"github.com/jyjiangkai/stat/cache"
+)
+
+const (
+	LookupCacheSize = 4096
+	LookupCacheTTL  = 10 * time.Minute
+)
+
+// lookupCache keeps the documents looked up while listing in an LRU, an
+// entry expires after ttl so the renamed or deleted documents are refreshed
+// even when nobody invalidates them.
+type lookupCache struct {
+	lru *cache.LRU
+	ttl time.Duration
+}
+
+func newLookupCache(size int, ttl time.Duration) *lookupCache {
+	return &lookupCache{
+		lru: cache.NewLRU(size),
+		ttl: ttl,
+	}
+}
+
+func (c *lookupCache) Get(key string) (interface{}, bool) {
+	entry, ok := c.lru.Get(key, time.Now())
+	if !ok {
+		return nil, false
+	}
+	return entry.Value, true
+}
+
+func (c *lookupCache) Add(key string, value interface{}) {
+	now := time.Now()
+	c.lru.Add(&cache.Entry{
+		Key:       key,
+		Value:     value,
+		CreatedAt: now,
+		ExpiresAt: now.Add(c.ttl),
+	})
+}
+
+func (c *lookupCache) Remove(keys ...string) {
+	c.lru.Remove(keys...)
+}
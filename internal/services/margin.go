@@ -0,0 +1,406 @@
+package services
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/jyjiangkai/stat/api"
+	"github.com/jyjiangkai/stat/cost"
+	"github.com/jyjiangkai/stat/currency"
+	"github.com/jyjiangkai/stat/db"
+	"github.com/jyjiangkai/stat/log"
+	"github.com/jyjiangkai/stat/models"
+	"github.com/jyjiangkai/stat/timezone"
+	"github.com/jyjiangkai/stat/utils"
+)
+
+const (
+	MarginTypeOfUnprofitable = "unprofitable"
+)
+
+type MarginService struct {
+	cli          *mongo.Client
+	aiBillColl   *mongo.Collection
+	userStatColl *mongo.Collection
+	revenue      *RevenueService
+	closeC       chan struct{}
+}
+
+func NewMarginService(cli *mongo.Client) *MarginService {
+	return &MarginService{
+		cli:          cli,
+		aiBillColl:   cli.Database(db.GetDatabaseName()).Collection("ai_bills"),
+		userStatColl: cli.Database(DatabaseOfUserStatistics).Collection("user_stats"),
+		revenue:      NewRevenueService(cli),
+		closeC:       make(chan struct{}),
+	}
+}
+
+func (ms *MarginService) Start() error {
+	return nil
+}
+
+func (ms *MarginService) Stop() error {
+	return nil
+}
+
+// getAppCosts sums the tokens of every app per day in the range and prices
+// them with the unit prices effective on that day, the costs are converted
+// to the given currency.
+func (ms *MarginService) getAppCosts(ctx context.Context, start, end time.Time, to string) ([]*models.AppCost, error) {
+	loc := timezone.Of(ctx)
+	pipeline := mongo.Pipeline{
+		{
+			{"$match", bson.D{
+				{"collected_at", bson.D{
+					{"$gte", start},
+					{"$lt", end},
+				}},
+			}},
+		},
+		{
+			{"$group", bson.D{
+				{"_id", bson.D{
+					{"user_id", "$user_id"},
+					{"app_id", "$app_id"},
+					{"app_type", "$app_type"},
+					{"date", bson.M{"$dateToString": bson.M{"format": "%Y-%m-%d", "date": "$collected_at", "timezone": loc.String()}}},
+				}},
+				{"chatgpt_3_5", bson.M{"$sum": "$usage.chatgpt_3_5"}},
+				{"chatgpt_4", bson.M{"$sum": "$usage.chatgpt_4"}},
+			}},
+		},
+	}
+	cursor, err := ms.aiBillColl.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, db.HandleDBError(err)
+	}
+	defer func() {
+		_ = cursor.Close(ctx)
+	}()
+
+	type group struct {
+		ID struct {
+			UserID  string             `bson:"user_id"`
+			AppID   primitive.ObjectID `bson:"app_id"`
+			AppType string             `bson:"app_type"`
+			Date    string             `bson:"date"`
+		} `bson:"_id"`
+		ChatGPT35 uint64 `bson:"chatgpt_3_5"`
+		ChatGPT4  uint64 `bson:"chatgpt_4"`
+	}
+	apps := make(map[string]*models.AppCost)
+	list := make([]*models.AppCost, 0)
+	for cursor.Next(ctx) {
+		var g group
+		if err = cursor.Decode(&g); err != nil {
+			return nil, db.HandleDBError(err)
+		}
+		day, err := time.ParseInLocation("2006-01-02", g.ID.Date, loc)
+		if err != nil {
+			return nil, err
+		}
+		mc, err := priceOf(g.ChatGPT35, g.ChatGPT4, day, to)
+		if err != nil {
+			log.Error(ctx).Err(err).Str("user_id", g.ID.UserID).Msg("failed to price ai usage")
+			return nil, api.ErrInternal.WithError(err)
+		}
+		appID := g.ID.AppID.Hex()
+		key := g.ID.UserID + "/" + appID
+		app, ok := apps[key]
+		if !ok {
+			app = &models.AppCost{
+				AppID:     appID,
+				AppType:   g.ID.AppType,
+				OID:       g.ID.UserID,
+				ModelCost: &models.ModelCost{},
+				Currency:  to,
+			}
+			apps[key] = app
+			list = append(list, app)
+		}
+		app.Add(mc)
+	}
+	for _, app := range list {
+		roundModelCost(app.ModelCost)
+	}
+	return list, nil
+}
+
+func priceOf(chatgpt35, chatgpt4 uint64, at time.Time, to string) (*models.ModelCost, error) {
+	mc := &models.ModelCost{
+		ChatGPT35: chatgpt35,
+		ChatGPT4:  chatgpt4,
+	}
+	var err error
+	if mc.ChatGPT35Cost, err = cost.Of(cost.ModelOfChatGPT35, chatgpt35, at); err != nil {
+		return nil, err
+	}
+	if mc.ChatGPT4Cost, err = cost.Of(cost.ModelOfChatGPT4, chatgpt4, at); err != nil {
+		return nil, err
+	}
+	if mc.ChatGPT35Cost, err = currency.Convert(mc.ChatGPT35Cost, cost.Currency(), to, at); err != nil {
+		return nil, err
+	}
+	if mc.ChatGPT4Cost, err = currency.Convert(mc.ChatGPT4Cost, cost.Currency(), to, at); err != nil {
+		return nil, err
+	}
+	mc.Cost = mc.ChatGPT35Cost + mc.ChatGPT4Cost
+	return mc, nil
+}
+
+func roundModelCost(mc *models.ModelCost) {
+	mc.ChatGPT35Cost = utils.KeepTwoDecimalPlaces(mc.ChatGPT35Cost)
+	mc.ChatGPT4Cost = utils.KeepTwoDecimalPlaces(mc.ChatGPT4Cost)
+	mc.Cost = utils.KeepTwoDecimalPlaces(mc.Cost)
+}
+
+// getRevenues returns the AI revenue of every user recognized in the range,
+// the monthly amount of a subscription is spread over the days it overlaps
+// with the range.
+func (ms *MarginService) getRevenues(ctx context.Context, start, end time.Time, to string) (map[string]float64, error) {
+	subs, err := ms.revenue.getSubscriptions(ctx, "ai", to, start, end)
+	if err != nil {
+		return nil, err
+	}
+	revenues := make(map[string]float64)
+	for _, sub := range subs {
+		from, until := sub.start, sub.end
+		if from.Before(start) {
+			from = start
+		}
+		if until.After(end) {
+			until = end
+		}
+		if !until.After(from) {
+			continue
+		}
+		revenues[sub.user] += sub.monthly * until.Sub(from).Hours() / 24 / 30
+	}
+	return revenues, nil
+}
+
+func (ms *MarginService) getUsers(ctx context.Context, oids []string) (map[string]*models.User, error) {
+	opt := options.FindOptions{
+		Projection: bson.M{
+			"oidc_id":      1,
+			"email":        1,
+			"company_name": 1,
+			"class":        1,
+		},
+	}
+	cursor, err := ms.userStatColl.Find(ctx, bson.M{"oidc_id": bson.M{"$in": oids}}, &opt)
+	if err != nil {
+		return nil, db.HandleDBError(err)
+	}
+	defer func() {
+		_ = cursor.Close(ctx)
+	}()
+	users := make(map[string]*models.User)
+	for cursor.Next(ctx) {
+		user := &models.User{}
+		if err = cursor.Decode(user); err != nil {
+			return nil, db.HandleDBError(err)
+		}
+		users[user.OID] = user
+	}
+	return users, nil
+}
+
+func marginCurrency(opts *api.ListOptions) string {
+	if opts.Currency != "" {
+		return opts.Currency
+	}
+	return currency.ReportingCurrency()
+}
+
+// getUserMargins combines the costs and revenues of the range per user, a
+// user who has either of them is included.
+func (ms *MarginService) getUserMargins(ctx context.Context, pg api.Page, opts *api.ListOptions) ([]*models.UserMargin, error) {
+	rg, err := GetRange(ctx, pg.Range)
+	if err != nil {
+		return nil, err
+	}
+	start, end := rg.Start, rg.End
+	to := marginCurrency(opts)
+	apps, err := ms.getAppCosts(ctx, start, end, to)
+	if err != nil {
+		return nil, err
+	}
+	revenues, err := ms.getRevenues(ctx, start, end, to)
+	if err != nil {
+		return nil, err
+	}
+	margins := make(map[string]*models.UserMargin)
+	oids := make([]string, 0)
+	marginOf := func(oid string) *models.UserMargin {
+		if margin, ok := margins[oid]; ok {
+			return margin
+		}
+		margin := &models.UserMargin{
+			OID:       oid,
+			ModelCost: &models.ModelCost{},
+			Currency:  to,
+			Start:     start,
+			End:       end,
+		}
+		margins[oid] = margin
+		oids = append(oids, oid)
+		return margin
+	}
+	for _, app := range apps {
+		marginOf(app.OID).Add(app.ModelCost)
+	}
+	for oid, revenue := range revenues {
+		marginOf(oid).Revenue = revenue
+	}
+	users, err := ms.getUsers(ctx, oids)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*models.UserMargin, 0, len(oids))
+	for _, oid := range oids {
+		margin := margins[oid]
+		plan := models.NewPlanOfLevel(nil)
+		if user, ok := users[oid]; ok {
+			margin.Email = user.Email
+			margin.CompanyName = user.CompanyName
+			if user.Class != nil {
+				plan = models.NewPlanOfLevel(user.Class.AI)
+			}
+		}
+		margin.Plan = planLabel(plan)
+		roundModelCost(margin.ModelCost)
+		margin.Revenue = utils.KeepTwoDecimalPlaces(margin.Revenue)
+		margin.GrossMargin = utils.KeepTwoDecimalPlaces(margin.Revenue - margin.Cost)
+		if margin.Revenue > 0 {
+			margin.MarginRate = utils.KeepTwoDecimalPlaces(margin.GrossMargin / margin.Revenue * 100)
+		}
+		list = append(list, margin)
+	}
+	return list, nil
+}
+
+// Users returns the gross margin of every user sorted by the margin, the
+// unprofitable type keeps the users whose cost exceeds their revenue only.
+func (ms *MarginService) Users(ctx context.Context, pg api.Page, opts *api.ListOptions) (*api.ListResult, error) {
+	if opts.TypeSelector != "" && opts.TypeSelector != MarginTypeOfUnprofitable {
+		return nil, api.ErrInvalidParameter.WithMessage("unsupported type " + opts.TypeSelector)
+	}
+	margins, err := ms.getUserMargins(ctx, pg, opts)
+	if err != nil {
+		return nil, err
+	}
+	// the most unprofitable accounts come first unless asked otherwise
+	asc := pg.Direction == "asc" || opts.TypeSelector == MarginTypeOfUnprofitable
+	sort.Slice(margins, func(i, j int) bool {
+		if asc {
+			return margins[i].GrossMargin < margins[j].GrossMargin
+		}
+		return margins[i].GrossMargin > margins[j].GrossMargin
+	})
+	list := make([]interface{}, 0, len(margins))
+	for _, margin := range margins {
+		if opts.TypeSelector == MarginTypeOfUnprofitable && margin.GrossMargin >= 0 {
+			continue
+		}
+		list = append(list, margin)
+	}
+	return paginate(list, pg)
+}
+
+// Apps returns the cost of every app sorted by the cost.
+func (ms *MarginService) Apps(ctx context.Context, pg api.Page, opts *api.ListOptions) (*api.ListResult, error) {
+	rg, err := GetRange(ctx, pg.Range)
+	if err != nil {
+		return nil, err
+	}
+	apps, err := ms.getAppCosts(ctx, rg.Start, rg.End, marginCurrency(opts))
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(apps, func(i, j int) bool {
+		if pg.Direction == "asc" {
+			return apps[i].Cost < apps[j].Cost
+		}
+		return apps[i].Cost > apps[j].Cost
+	})
+	list := make([]interface{}, 0, len(apps))
+	for _, app := range apps {
+		list = append(list, app)
+	}
+	return paginate(list, pg)
+}
+
+// Plans returns the cost, revenue and gross margin of every AI plan.
+func (ms *MarginService) Plans(ctx context.Context, pg api.Page, opts *api.ListOptions) ([]*models.PlanMargin, error) {
+	margins, err := ms.getUserMargins(ctx, pg, opts)
+	if err != nil {
+		return nil, err
+	}
+	plans := make(map[string]*models.PlanMargin)
+	list := make([]*models.PlanMargin, 0)
+	for _, margin := range margins {
+		plan, ok := plans[margin.Plan]
+		if !ok {
+			plan = &models.PlanMargin{
+				Plan:     margin.Plan,
+				Currency: margin.Currency,
+			}
+			plans[margin.Plan] = plan
+			list = append(list, plan)
+		}
+		plan.Users += 1
+		plan.Cost += margin.Cost
+		plan.Revenue += margin.Revenue
+		if margin.GrossMargin < 0 {
+			plan.Unprofitable += 1
+		}
+	}
+	for _, plan := range list {
+		plan.Cost = utils.KeepTwoDecimalPlaces(plan.Cost)
+		plan.Revenue = utils.KeepTwoDecimalPlaces(plan.Revenue)
+		plan.GrossMargin = utils.KeepTwoDecimalPlaces(plan.Revenue - plan.Cost)
+		if plan.Revenue > 0 {
+			plan.MarginRate = utils.KeepTwoDecimalPlaces(plan.GrossMargin / plan.Revenue * 100)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Plan < list[j].Plan
+	})
+	return list, nil
+}
+
+// paginate returns one page of a list computed in memory.
+func paginate(list []interface{}, pg api.Page) (*api.ListResult, error) {
+	skip := pg.PageNumber * pg.PageSize
+	if skip < 0 {
+		skip = 0
+	}
+	cnt := int64(len(list))
+	if cnt == 0 {
+		return &api.ListResult{
+			List: []interface{}{},
+			P:    pg,
+		}, nil
+	}
+	if cnt <= skip {
+		return nil, api.ErrPageArgumentsTooLarge
+	}
+	pg.Total = cnt
+	end := skip + pg.PageSize
+	if end > cnt || pg.PageSize <= 0 {
+		end = cnt
+	}
+	return &api.ListResult{
+		List: list[skip:end],
+		P:    pg,
+	}, nil
+}
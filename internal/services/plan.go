@@ -0,0 +1,404 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/jyjiangkai/stat/api"
+	"github.com/jyjiangkai/stat/db"
+	"github.com/jyjiangkai/stat/log"
+	"github.com/jyjiangkai/stat/models"
+	"github.com/jyjiangkai/stat/models/cloud"
+	"github.com/jyjiangkai/stat/timezone"
+	"github.com/jyjiangkai/stat/utils"
+)
+
+type PlanService struct {
+	cli            *mongo.Client
+	userStatColl   *mongo.Collection
+	snapshotColl   *mongo.Collection
+	transitionColl *mongo.Collection
+	closeC         chan struct{}
+}
+
+func NewPlanService(cli *mongo.Client) *PlanService {
+	return &PlanService{
+		cli:            cli,
+		userStatColl:   cli.Database(DatabaseOfUserStatistics).Collection("user_stats"),
+		snapshotColl:   cli.Database(DatabaseOfUserStatistics).Collection("plan_snapshots"),
+		transitionColl: cli.Database(DatabaseOfUserStatistics).Collection("plan_transitions"),
+		closeC:         make(chan struct{}),
+	}
+}
+
+func (ps *PlanService) Start() error {
+	return nil
+}
+
+func (ps *PlanService) Stop() error {
+	return nil
+}
+
+// Snapshot records the plans of every user in user_stats for the day of now
+// and derives the transitions from the previous snapshot of each user, it
+// is run after the user stat has been refreshed.
+func (ps *PlanService) Snapshot(ctx context.Context, now time.Time) error {
+	date := utils.ToBillTimeForAI(now, timezone.Reporting())
+	previous, err := ps.getPreviousSnapshots(ctx, date)
+	if err != nil {
+		return err
+	}
+	opt := options.FindOptions{
+		Projection: bson.M{
+			"oidc_id": 1,
+			"class":   1,
+		},
+	}
+	cursor, err := ps.userStatColl.Find(ctx, bson.M{}, &opt)
+	if err != nil {
+		return db.HandleDBError(err)
+	}
+	defer func() {
+		_ = cursor.Close(ctx)
+	}()
+
+	snapshots := make([]mongo.WriteModel, 0, BatchSize)
+	transitions := make([]mongo.WriteModel, 0)
+	cnt := 0
+	for cursor.Next(ctx) {
+		user := &models.User{}
+		if err = cursor.Decode(user); err != nil {
+			return db.HandleDBError(err)
+		}
+		snapshot := &models.PlanSnapshot{
+			Date:     date,
+			OID:      user.OID,
+			Timezone: date.Location().String(),
+		}
+		if user.Class != nil {
+			snapshot.AI = models.NewPlanOfLevel(user.Class.AI)
+			snapshot.Connect = models.NewPlanOfLevel(user.Class.Connect)
+		} else {
+			snapshot.AI = models.NewPlanOfLevel(nil)
+			snapshot.Connect = models.NewPlanOfLevel(nil)
+		}
+		snapshots = append(snapshots, mongo.NewReplaceOneModel().
+			SetFilter(bson.M{"date": date, "oidc_id": user.OID}).
+			SetReplacement(snapshot).
+			SetUpsert(true))
+		if before, ok := previous[user.OID]; ok {
+			for _, transition := range diffPlans(ctx, before, snapshot) {
+				transitions = append(transitions, mongo.NewReplaceOneModel().
+					SetFilter(bson.M{"date": date, "oidc_id": user.OID, "kind": transition.Kind}).
+					SetReplacement(transition).
+					SetUpsert(true))
+			}
+		}
+		if len(snapshots) == BatchSize {
+			if err = bulkWrite(ctx, ps.snapshotColl, snapshots); err != nil {
+				return err
+			}
+			snapshots = snapshots[:0]
+		}
+		cnt += 1
+	}
+	if err = bulkWrite(ctx, ps.snapshotColl, snapshots); err != nil {
+		return err
+	}
+	if err = bulkWrite(ctx, ps.transitionColl, transitions); err != nil {
+		return err
+	}
+	log.Info(ctx).Int("users", cnt).Int("transitions", len(transitions)).Msgf("finish plan snapshot at: %+v\n", time.Now())
+	return nil
+}
+
+// bulkWrite writes unordered, nothing is written when writes is empty.
+func bulkWrite(ctx context.Context, coll *mongo.Collection, writes []mongo.WriteModel) error {
+	if len(writes) == 0 {
+		return nil
+	}
+	_, err := coll.BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		log.Error(ctx).Err(err).Str("collection", coll.Name()).Msg("failed to bulk write")
+		return db.HandleDBError(err)
+	}
+	return nil
+}
+
+// getPreviousSnapshots returns the latest snapshots taken before the date,
+// so a day missed by the job does not hide the transitions of that day.
+func (ps *PlanService) getPreviousSnapshots(ctx context.Context, date time.Time) (map[string]*models.PlanSnapshot, error) {
+	latest := &models.PlanSnapshot{}
+	opt := options.FindOneOptions{
+		Sort: bson.M{"date": -1},
+	}
+	err := ps.snapshotColl.FindOne(ctx, bson.M{"date": bson.M{"$lt": date}}, &opt).Decode(latest)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return map[string]*models.PlanSnapshot{}, nil
+		}
+		return nil, db.HandleDBError(err)
+	}
+	cursor, err := ps.snapshotColl.Find(ctx, bson.M{"date": latest.Date})
+	if err != nil {
+		return nil, db.HandleDBError(err)
+	}
+	defer func() {
+		_ = cursor.Close(ctx)
+	}()
+	snapshots := make(map[string]*models.PlanSnapshot)
+	for cursor.Next(ctx) {
+		snapshot := &models.PlanSnapshot{}
+		if err = cursor.Decode(snapshot); err != nil {
+			return nil, db.HandleDBError(err)
+		}
+		snapshots[snapshot.OID] = snapshot
+	}
+	return snapshots, nil
+}
+
+func diffPlans(ctx context.Context, before, after *models.PlanSnapshot) []*models.PlanTransition {
+	transitions := make([]*models.PlanTransition, 0)
+	pairs := []struct {
+		kind     string
+		from, to *models.PlanOfLevel
+	}{
+		{"ai", before.AI, after.AI},
+		{"connect", before.Connect, after.Connect},
+	}
+	for _, pair := range pairs {
+		if pair.from == nil || pair.to == nil || pair.from.Equal(pair.to) {
+			continue
+		}
+		transitions = append(transitions, &models.PlanTransition{
+			Base: cloud.NewBase(ctx),
+			Date: after.Date,
+			OID:  after.OID,
+			Kind: pair.kind,
+			Type: transitionType(pair.from, pair.to),
+			From: pair.from,
+			To:   pair.to,
+		})
+	}
+	return transitions
+}
+
+func transitionType(from, to *models.PlanOfLevel) string {
+	switch {
+	case !from.Premium && to.Premium:
+		return models.PlanTransitionOfFreeToPaid
+	case from.Premium && !to.Premium:
+		return models.PlanTransitionOfCancellation
+	case to.Level > from.Level:
+		return models.PlanTransitionOfUpgrade
+	case to.Level < from.Level:
+		return models.PlanTransitionOfDowngrade
+	}
+	return models.PlanTransitionOfChange
+}
+
+func planLabel(plan *models.PlanOfLevel) string {
+	if !plan.Premium {
+		return "Free"
+	}
+	return fmt.Sprintf("%s/%d", plan.Type, plan.Level)
+}
+
+func (ps *PlanService) getTransitions(ctx context.Context, start, end time.Time, kind string) ([]*models.PlanTransition, error) {
+	query := bson.M{
+		"date": bson.M{
+			"$gte": start,
+			"$lt":  end,
+		},
+	}
+	if kind != "" {
+		query["kind"] = kind
+	}
+	opt := options.FindOptions{
+		Sort: bson.M{"date": 1},
+	}
+	cursor, err := ps.transitionColl.Find(ctx, query, &opt)
+	if err != nil {
+		return nil, db.HandleDBError(err)
+	}
+	defer func() {
+		_ = cursor.Close(ctx)
+	}()
+	transitions := make([]*models.PlanTransition, 0)
+	for cursor.Next(ctx) {
+		transition := &models.PlanTransition{}
+		if err = cursor.Decode(transition); err != nil {
+			return nil, db.HandleDBError(err)
+		}
+		transitions = append(transitions, transition)
+	}
+	return transitions, nil
+}
+
+// Matrix counts the transitions between every pair of plans in the range.
+func (ps *PlanService) Matrix(ctx context.Context, pg api.Page, opts *api.ListOptions) (*models.PlanTransitionMatrix, error) {
+	if opts.KindSelector != "ai" && opts.KindSelector != "connect" {
+		return nil, api.ErrUnsupportedKind.WithMessage(fmt.Sprintf("unsupported kind: %s", opts.KindSelector))
+	}
+	rg, err := GetRange(ctx, pg.Range)
+	if err != nil {
+		return nil, err
+	}
+	start, end := rg.Start, rg.End
+	transitions, err := ps.getTransitions(ctx, start, end, opts.KindSelector)
+	if err != nil {
+		return nil, err
+	}
+	matrix := &models.PlanTransitionMatrix{
+		Kind:   opts.KindSelector,
+		Start:  start,
+		End:    end,
+		Plans:  make([]string, 0),
+		Counts: make(map[string]map[string]int64),
+	}
+	plans := make(map[string]struct{})
+	for _, transition := range transitions {
+		from, to := planLabel(transition.From), planLabel(transition.To)
+		if _, ok := matrix.Counts[from]; !ok {
+			matrix.Counts[from] = make(map[string]int64)
+		}
+		matrix.Counts[from][to] += 1
+		plans[from] = struct{}{}
+		plans[to] = struct{}{}
+	}
+	for plan := range plans {
+		matrix.Plans = append(matrix.Plans, plan)
+	}
+	sort.Strings(matrix.Plans)
+	return matrix, nil
+}
+
+// Counts returns the number of every type of transitions per day or month.
+func (ps *PlanService) Counts(ctx context.Context, pg api.Page, opts *api.ListOptions) ([]*models.PlanTransitionCount, error) {
+	rg, err := GetRange(ctx, pg.Range)
+	if err != nil {
+		return nil, err
+	}
+	start, end := rg.Start, rg.End
+	transitions, err := ps.getTransitions(ctx, start, end, opts.KindSelector)
+	if err != nil {
+		return nil, err
+	}
+	loc := start.Location()
+	bucketOf := func(t time.Time) time.Time {
+		return utils.ToBillTimeForAI(t, loc)
+	}
+	switch opts.Granularity {
+	case "", GranularityOfDay:
+	case GranularityOfMonth:
+		bucketOf = func(t time.Time) time.Time {
+			return utils.GetMonthBeginTime(t.In(loc))
+		}
+	default:
+		return nil, api.ErrInvalidParameter.WithMessage("unsupported granularity " + opts.Granularity)
+	}
+	counts := make([]*models.PlanTransitionCount, 0)
+	var current *models.PlanTransitionCount
+	for _, transition := range transitions {
+		bucket := bucketOf(transition.Date)
+		if current == nil || !current.Date.Equal(bucket) {
+			current = &models.PlanTransitionCount{
+				Date: bucket,
+			}
+			counts = append(counts, current)
+		}
+		switch transition.Type {
+		case models.PlanTransitionOfFreeToPaid:
+			current.FreeToPaid += 1
+		case models.PlanTransitionOfUpgrade:
+			current.Upgrade += 1
+		case models.PlanTransitionOfDowngrade:
+			current.Downgrade += 1
+		case models.PlanTransitionOfCancellation:
+			current.Cancellation += 1
+		case models.PlanTransitionOfChange:
+			current.Change += 1
+		}
+	}
+	return counts, nil
+}
+
+// List returns the transitions of the range, TypeSelector filters by the
+// type of transition.
+func (ps *PlanService) List(ctx context.Context, pg api.Page, opts *api.ListOptions) (*api.ListResult, error) {
+	var (
+		skip  = pg.PageNumber * pg.PageSize
+		limit = pg.PageSize
+		sort  = bson.M{"date": -1}
+	)
+
+	if skip < 0 {
+		skip = 0
+	}
+
+	rg, err := GetRange(ctx, pg.Range)
+	if err != nil {
+		return nil, err
+	}
+	query := bson.M{
+		"date": bson.M{
+			"$gte": rg.Start,
+			"$lt":  rg.End,
+		},
+	}
+	if opts.KindSelector != "" {
+		query["kind"] = opts.KindSelector
+	}
+	if opts.TypeSelector != "" {
+		query["type"] = opts.TypeSelector
+	}
+	cnt, err := ps.transitionColl.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if cnt == 0 {
+		return &api.ListResult{
+			List: []interface{}{},
+			P:    pg,
+		}, nil
+	}
+	if cnt <= skip {
+		return nil, api.ErrPageArgumentsTooLarge
+	}
+
+	pg.Total = cnt
+	if pg.Direction == "asc" {
+		sort = bson.M{"date": 1}
+	}
+	opt := options.FindOptions{
+		Limit: &limit,
+		Skip:  &skip,
+		Sort:  sort,
+	}
+	cursor, err := ps.transitionColl.Find(ctx, query, &opt)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = cursor.Close(ctx)
+	}()
+
+	list := make([]interface{}, 0)
+	for cursor.Next(ctx) {
+		transition := &models.PlanTransition{}
+		if err = cursor.Decode(transition); err != nil {
+			return nil, db.HandleDBError(err)
+		}
+		list = append(list, transition)
+	}
+	return &api.ListResult{
+		List: list,
+		P:    pg,
+	}, nil
+}
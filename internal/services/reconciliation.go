@@ -0,0 +1,589 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/jyjiangkai/stat/api"
+	"github.com/jyjiangkai/stat/cache"
+	"github.com/jyjiangkai/stat/db"
+	"github.com/jyjiangkai/stat/internal/repository"
+	"github.com/jyjiangkai/stat/log"
+	"github.com/jyjiangkai/stat/models"
+	"github.com/jyjiangkai/stat/models/cloud"
+)
+
+const (
+	ReconciliationSampleSize    = 200
+	ReconciliationMaxSampleSize = 10000
+	// ReconciliationMaxIssues bounds the issues kept in a report, the
+	// counters still count every one of them
+	ReconciliationMaxIssues = 1000
+	// ReconciliationStaleAfter is how long a stat user may go without being
+	// refreshed, the user stat runs once a day
+	ReconciliationStaleAfter = 48 * time.Hour
+)
+
+// statProjection is the part of a stat user the reconciliation compares.
+var statProjection = bson.M{
+	"oidc_id":             1,
+	"created_at":          1,
+	"updated_at":          1,
+	"bills.ai.total":      1,
+	"bills.connect.total": 1,
+}
+
+// ReconciliationService checks user_stats against the collections it is
+// computed from, a stat user is compared with the bills collected up to its
+// last refresh so the bills of the day don't show up as mismatches.
+type ReconciliationService struct {
+	cli             *mongo.Client
+	userColl        *mongo.Collection
+	billColl        *mongo.Collection
+	userStatColl    *mongo.Collection
+	reportColl      *mongo.Collection
+	dataSubjectColl *mongo.Collection
+	aiBills         repository.AIBillRepository
+	stat            *StatService
+	closeC          chan struct{}
+}
+
+func NewReconciliationService(cli *mongo.Client, stat *StatService) *ReconciliationService {
+	return &ReconciliationService{
+		cli:             cli,
+		userColl:        cli.Database(db.GetDatabaseName()).Collection("users"),
+		billColl:        cli.Database(db.GetDatabaseName()).Collection("bills"),
+		userStatColl:    cli.Database(DatabaseOfUserStatistics).Collection("user_stats"),
+		reportColl:      cli.Database(DatabaseOfUserStatistics).Collection("reconciliation_reports"),
+		dataSubjectColl: cli.Database(DatabaseOfUserStatistics).Collection("data_subject_requests"),
+		aiBills:         repository.NewMongoAIBillRepository(cli.Database(db.GetDatabaseName()).Collection("ai_bills")),
+		stat:            stat,
+		closeC:          make(chan struct{}),
+	}
+}
+
+func (rs *ReconciliationService) Start() error {
+	return nil
+}
+
+// Scheduled runs the daily sample reconciliation, it's called once the user
+// stat of the day finishes so the stat users it checks are all fresh.
+func (rs *ReconciliationService) Scheduled(ctx context.Context, now time.Time) {
+	log.Info(ctx).Msgf("start user stat reconciliation of the user stat at: %+v\n", now)
+	report := rs.newReport(ctx, models.ReconciliationModeOfSample, ReconciliationSampleSize, false)
+	if _, err := rs.reportColl.InsertOne(ctx, report); err != nil {
+		log.Error(ctx).Err(err).Msg("failed to insert reconciliation report")
+		return
+	}
+	rs.reconcile(ctx, report)
+}
+
+func (rs *ReconciliationService) Stop() error {
+	return nil
+}
+
+func (rs *ReconciliationService) newReport(ctx context.Context, mode string, sampleSize int64, repair bool) *models.ReconciliationReport {
+	report := &models.ReconciliationReport{
+		Base:   cloud.NewBase(ctx),
+		Mode:   mode,
+		Repair: repair,
+		Status: models.ReconciliationStatusOfPending,
+		Issues: make([]*models.ReconciliationIssue, 0),
+	}
+	if mode == models.ReconciliationModeOfSample {
+		report.SampleSize = sampleSize
+	}
+	return report
+}
+
+// Run creates a reconciliation report and runs it in the background, the
+// returned report is polled for the result.
+func (rs *ReconciliationService) Run(ctx context.Context, mode string, sampleSize int64, repair bool) (*models.ReconciliationReport, error) {
+	if mode == "" {
+		mode = models.ReconciliationModeOfSample
+	}
+	if mode != models.ReconciliationModeOfSample && mode != models.ReconciliationModeOfFull {
+		return nil, api.ErrInvalidParameter.WithMessage("unsupported reconciliation mode " + mode)
+	}
+	if sampleSize == 0 {
+		sampleSize = ReconciliationSampleSize
+	}
+	if sampleSize < 0 || sampleSize > ReconciliationMaxSampleSize {
+		return nil, api.ErrInvalidParameter.WithMessage(fmt.Sprintf(
+			"the sample size must be within [1, %d]", ReconciliationMaxSampleSize))
+	}
+	report := rs.newReport(ctx, mode, sampleSize, repair)
+	if _, err := rs.reportColl.InsertOne(ctx, report); err != nil {
+		return nil, db.HandleDBError(err)
+	}
+	job := *report
+	go rs.reconcile(context.Background(), &job)
+	return report, nil
+}
+
+func (rs *ReconciliationService) reconcile(ctx context.Context, report *models.ReconciliationReport) {
+	now := time.Now()
+	report.Status = models.ReconciliationStatusOfRunning
+	report.StartedAt = now
+	rs.saveReport(ctx, report)
+
+	err := rs.check(ctx, report, now)
+	finished := time.Now()
+	report.FinishedAt = &finished
+	report.Status = models.ReconciliationStatusOfCompleted
+	if err != nil {
+		report.Status = models.ReconciliationStatusOfFailed
+		report.Error = err.Error()
+	}
+	rs.saveReport(ctx, report)
+	if report.Repaired > 0 {
+		cache.Invalidate(ctx, "user stat reconciled")
+	}
+	log.Info(ctx).Str("id", report.ID.Hex()).Str("status", report.Status).
+		Int64("checked", report.Checked).Int64("mismatches", report.Mismatches).
+		Int64("orphans", report.Orphans).Int64("missing", report.Missing).
+		Int64("stale", report.Stale).Int64("repaired", report.Repaired).
+		Msg("finish user stat reconciliation")
+}
+
+func (rs *ReconciliationService) check(ctx context.Context, report *models.ReconciliationReport, now time.Time) error {
+	erased, err := erasedUsers(ctx, rs.dataSubjectColl)
+	if err != nil {
+		return err
+	}
+	// the full mode looks the users up in a set instead of one by one
+	var users map[string]struct{}
+	if report.Mode == models.ReconciliationModeOfFull {
+		if users, err = distinctOIDs(ctx, rs.userColl); err != nil {
+			return err
+		}
+	}
+	cursor, err := rs.statUsers(ctx, report)
+	if err != nil {
+		return db.HandleDBError(err)
+	}
+	defer func() {
+		_ = cursor.Close(ctx)
+	}()
+	for cursor.Next(ctx) {
+		user := &models.User{}
+		if err = cursor.Decode(user); err != nil {
+			return db.HandleDBError(err)
+		}
+		// the anonymized users are kept on purpose
+		if _, ok := erased[user.OID]; ok || strings.HasPrefix(user.OID, pseudonymPrefix) {
+			continue
+		}
+		report.Checked++
+		if err = rs.checkStatUser(ctx, report, user, users, now); err != nil {
+			return err
+		}
+	}
+	if err = cursor.Err(); err != nil {
+		return db.HandleDBError(err)
+	}
+	return rs.checkMissing(ctx, report, erased, now)
+}
+
+// statUsers returns the stat users to check, all of them or a random sample.
+func (rs *ReconciliationService) statUsers(ctx context.Context, report *models.ReconciliationReport) (*mongo.Cursor, error) {
+	if report.Mode == models.ReconciliationModeOfFull {
+		return rs.userStatColl.Find(ctx, bson.M{}, options.Find().SetProjection(statProjection))
+	}
+	pipeline := mongo.Pipeline{
+		{{"$sample", bson.D{{"size", report.SampleSize}}}},
+		{{"$project", statProjection}},
+	}
+	return rs.userStatColl.Aggregate(ctx, pipeline)
+}
+
+func (rs *ReconciliationService) checkStatUser(ctx context.Context, report *models.ReconciliationReport,
+	user *models.User, users map[string]struct{}, now time.Time) error {
+	exists, err := rs.userExists(ctx, user.OID, users)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		report.Orphans++
+		issue := &models.ReconciliationIssue{
+			OID:       user.OID,
+			Type:      models.ReconciliationIssueOfOrphan,
+			UpdatedAt: user.UpdatedAt,
+		}
+		if report.Repair {
+			rs.repairOrphan(ctx, report, issue, user.ID)
+		}
+		addIssue(report, issue)
+		return nil
+	}
+
+	issues := make([]*models.ReconciliationIssue, 0)
+	if now.Sub(user.UpdatedAt) > ReconciliationStaleAfter {
+		report.Stale++
+		issues = append(issues, &models.ReconciliationIssue{
+			OID:       user.OID,
+			Type:      models.ReconciliationIssueOfStale,
+			UpdatedAt: user.UpdatedAt,
+		})
+	}
+	mismatches, err := rs.compareBills(ctx, user)
+	if err != nil {
+		return err
+	}
+	report.Mismatches += int64(len(mismatches))
+	issues = append(issues, mismatches...)
+	if len(issues) == 0 {
+		return nil
+	}
+	if report.Repair {
+		rs.repairUser(ctx, report, issues, user.OID)
+	}
+	for _, issue := range issues {
+		addIssue(report, issue)
+	}
+	return nil
+}
+
+// compareBills recomputes the bill totals of the stat user from the bills
+// collected up to its last refresh.
+func (rs *ReconciliationService) compareBills(ctx context.Context, user *models.User) ([]*models.ReconciliationIssue, error) {
+	aiTotal, err := rs.aiBills.UserTotal(ctx, user.OID, user.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	connectTotal, err := rs.connectBillTotal(ctx, user.OID, user.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	actualAI := uint64(0)
+	actualConnect := &models.Events{}
+	if user.Bills != nil {
+		if user.Bills.AI != nil {
+			actualAI = user.Bills.AI.Total
+		}
+		if user.Bills.Connect != nil && user.Bills.Connect.Total != nil {
+			actualConnect = user.Bills.Connect.Total
+		}
+	}
+	fields := []struct {
+		name             string
+		expected, actual uint64
+	}{
+		{"bills.ai.total", aiTotal, actualAI},
+		{"bills.connect.total.received", connectTotal.Received, actualConnect.Received},
+		{"bills.connect.total.delivered", connectTotal.Delivered, actualConnect.Delivered},
+		{"bills.connect.total.total", connectTotal.Total, actualConnect.Total},
+	}
+	issues := make([]*models.ReconciliationIssue, 0)
+	for _, field := range fields {
+		if field.expected == field.actual {
+			continue
+		}
+		issues = append(issues, &models.ReconciliationIssue{
+			OID:       user.OID,
+			Type:      models.ReconciliationIssueOfMismatch,
+			Field:     field.name,
+			Expected:  field.expected,
+			Actual:    field.actual,
+			UpdatedAt: user.UpdatedAt,
+		})
+	}
+	return issues, nil
+}
+
+func (rs *ReconciliationService) connectBillTotal(ctx context.Context, oid string, until time.Time) (*models.Events, error) {
+	pipeline := mongo.Pipeline{
+		{
+			{"$match", bson.D{
+				{"user_id", oid},
+				{"collected_at", bson.D{{"$lte", until}}},
+			}},
+		},
+		{
+			{"$group", bson.D{
+				{"_id", nil},
+				{"received", bson.D{{"$sum", "$received_num"}}},
+				{"delivered", bson.D{{"$sum", "$delivered_num"}}},
+				{"total", bson.D{{"$sum", "$usage_num"}}},
+			}},
+		},
+	}
+	events := &models.Events{}
+	if err := aggregateOne(ctx, rs.billColl, pipeline, events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// checkMissing finds the users without a stat user, the users created after
+// the last user stat aren't expected to have one yet.
+func (rs *ReconciliationService) checkMissing(ctx context.Context, report *models.ReconciliationReport,
+	erased map[string]struct{}, now time.Time) error {
+	lastStat, err := rs.stat.getLastStatTime(ctx)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil
+		}
+		return db.HandleDBError(err)
+	}
+	query := bson.M{"created_at": bson.M{"$lt": lastStat}}
+	var (
+		cursor *mongo.Cursor
+		stats  map[string]struct{}
+	)
+	if report.Mode == models.ReconciliationModeOfFull {
+		if stats, err = distinctOIDs(ctx, rs.userStatColl); err != nil {
+			return err
+		}
+		cursor, err = rs.userColl.Find(ctx, query)
+	} else {
+		pipeline := mongo.Pipeline{
+			{{"$match", query}},
+			{{"$sample", bson.D{{"size", report.SampleSize}}}},
+		}
+		cursor, err = rs.userColl.Aggregate(ctx, pipeline)
+	}
+	if err != nil {
+		return db.HandleDBError(err)
+	}
+	defer func() {
+		_ = cursor.Close(ctx)
+	}()
+	for cursor.Next(ctx) {
+		user := &cloud.User{}
+		if err = cursor.Decode(user); err != nil {
+			return db.HandleDBError(err)
+		}
+		if _, ok := erased[user.OID]; ok {
+			continue
+		}
+		exists, err := rs.statUserExists(ctx, user.OID, stats)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		report.Missing++
+		issue := &models.ReconciliationIssue{
+			OID:  user.OID,
+			Type: models.ReconciliationIssueOfMissing,
+		}
+		if report.Repair {
+			if err = rs.stat.refreshUser(ctx, user, now); err != nil {
+				issue.Error = err.Error()
+			} else {
+				issue.Repaired = true
+				report.Repaired++
+			}
+		}
+		addIssue(report, issue)
+	}
+	if err = cursor.Err(); err != nil {
+		return db.HandleDBError(err)
+	}
+	return nil
+}
+
+// repairUser refreshes the stat user, which fixes all of its issues at once.
+func (rs *ReconciliationService) repairUser(ctx context.Context, report *models.ReconciliationReport,
+	issues []*models.ReconciliationIssue, oid string) {
+	err := func() error {
+		user := &cloud.User{}
+		if err := rs.userColl.FindOne(ctx, bson.M{"oidc_id": oid}).Decode(user); err != nil {
+			return db.HandleDBError(err)
+		}
+		return rs.stat.refreshUser(ctx, user, time.Now())
+	}()
+	for _, issue := range issues {
+		if err != nil {
+			issue.Error = err.Error()
+			continue
+		}
+		issue.Repaired = true
+	}
+	if err == nil {
+		report.Repaired++
+	}
+}
+
+func (rs *ReconciliationService) repairOrphan(ctx context.Context, report *models.ReconciliationReport,
+	issue *models.ReconciliationIssue, id primitive.ObjectID) {
+	if _, err := rs.userStatColl.DeleteOne(ctx, bson.M{"_id": id}); err != nil {
+		issue.Error = err.Error()
+		return
+	}
+	issue.Repaired = true
+	report.Repaired++
+}
+
+func (rs *ReconciliationService) userExists(ctx context.Context, oid string, users map[string]struct{}) (bool, error) {
+	if users != nil {
+		_, ok := users[oid]
+		return ok, nil
+	}
+	cnt, err := rs.userColl.CountDocuments(ctx, bson.M{"oidc_id": oid})
+	if err != nil {
+		return false, db.HandleDBError(err)
+	}
+	return cnt > 0, nil
+}
+
+func (rs *ReconciliationService) statUserExists(ctx context.Context, oid string, stats map[string]struct{}) (bool, error) {
+	if stats != nil {
+		_, ok := stats[oid]
+		return ok, nil
+	}
+	cnt, err := rs.userStatColl.CountDocuments(ctx, bson.M{"oidc_id": oid})
+	if err != nil {
+		return false, db.HandleDBError(err)
+	}
+	return cnt > 0, nil
+}
+
+func (rs *ReconciliationService) saveReport(ctx context.Context, report *models.ReconciliationReport) {
+	report.UpdatedAt = time.Now()
+	_, err := rs.reportColl.ReplaceOne(ctx, bson.M{"_id": report.ID}, report)
+	if err != nil {
+		log.Error(ctx).Err(err).Str("id", report.ID.Hex()).Msg("failed to save reconciliation report")
+	}
+}
+
+func (rs *ReconciliationService) Get(ctx context.Context, id string) (*models.ReconciliationReport, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, api.ErrInvalidID.WithError(err)
+	}
+	report := &models.ReconciliationReport{}
+	if err = rs.reportColl.FindOne(ctx, bson.M{"_id": oid}).Decode(report); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, api.ErrResourceNotFound.WithMessage(fmt.Sprintf("reconciliation report %s not found", id))
+		}
+		return nil, db.HandleDBError(err)
+	}
+	return report, nil
+}
+
+// List returns a page of the reports without their issues, which are only
+// returned by Get.
+func (rs *ReconciliationService) List(ctx context.Context, pg api.Page, opts *api.ListOptions) (*api.ListResult, error) {
+	var (
+		skip  = pg.PageNumber * pg.PageSize
+		limit = pg.PageSize
+		sort  = bson.M{"created_at": -1}
+	)
+
+	if skip < 0 {
+		skip = 0
+	}
+
+	query := bson.M{}
+	if opts.TypeSelector != "" {
+		query["mode"] = opts.TypeSelector
+	}
+	cnt, err := rs.reportColl.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if cnt == 0 {
+		return &api.ListResult{
+			List: []interface{}{},
+			P:    pg,
+		}, nil
+	}
+	if cnt <= skip {
+		return nil, api.ErrPageArgumentsTooLarge
+	}
+
+	pg.Total = cnt
+	if pg.Direction == "asc" {
+		sort = bson.M{"created_at": 1}
+	}
+	opt := options.FindOptions{
+		Limit:      &limit,
+		Skip:       &skip,
+		Sort:       sort,
+		Projection: bson.M{"issues": 0},
+	}
+	cursor, err := rs.reportColl.Find(ctx, query, &opt)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = cursor.Close(ctx)
+	}()
+
+	list := make([]interface{}, 0)
+	for cursor.Next(ctx) {
+		report := &models.ReconciliationReport{}
+		if err = cursor.Decode(report); err != nil {
+			return nil, db.HandleDBError(err)
+		}
+		list = append(list, report)
+	}
+	return &api.ListResult{
+		List: list,
+		P:    pg,
+	}, nil
+}
+
+func addIssue(report *models.ReconciliationReport, issue *models.ReconciliationIssue) {
+	if len(report.Issues) >= ReconciliationMaxIssues {
+		report.Truncated = true
+		return
+	}
+	report.Issues = append(report.Issues, issue)
+}
+
+// distinctOIDs returns the OIDs of the users of the collection, they are
+// streamed instead of using distinct, whose result is a single document
+// bounded by 16MB.
+func distinctOIDs(ctx context.Context, coll *mongo.Collection) (map[string]struct{}, error) {
+	opts := options.Find().SetProjection(bson.M{"_id": 0, "oidc_id": 1}).SetBatchSize(BatchSize)
+	cursor, err := coll.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, db.HandleDBError(err)
+	}
+	defer func() {
+		_ = cursor.Close(ctx)
+	}()
+	oids := make(map[string]struct{})
+	for cursor.Next(ctx) {
+		var user struct {
+			OID string `bson:"oidc_id"`
+		}
+		if err = cursor.Decode(&user); err != nil {
+			return nil, db.HandleDBError(err)
+		}
+		oids[user.OID] = struct{}{}
+	}
+	if err = cursor.Err(); err != nil {
+		return nil, db.HandleDBError(err)
+	}
+	return oids, nil
+}
+
+// aggregateOne decodes the single result of the pipeline, v is left as it
+// is when there is none.
+func aggregateOne(ctx context.Context, coll *mongo.Collection, pipeline mongo.Pipeline, v interface{}) error {
+	cursor, err := coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return db.HandleDBError(err)
+	}
+	defer func() {
+		_ = cursor.Close(ctx)
+	}()
+	if cursor.Next(ctx) {
+		if err = cursor.Decode(v); err != nil {
+			return db.HandleDBError(err)
+		}
+	}
+	return db.HandleDBError(cursor.Err())
+}
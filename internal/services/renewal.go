@@ -0,0 +1,483 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/jyjiangkai/stat/api"
+	"github.com/jyjiangkai/stat/db"
+	"github.com/jyjiangkai/stat/internal/repository"
+	"github.com/jyjiangkai/stat/log"
+	"github.com/jyjiangkai/stat/models"
+	"github.com/jyjiangkai/stat/models/cloud"
+	"github.com/jyjiangkai/stat/monitor"
+	"github.com/jyjiangkai/stat/timezone"
+	"github.com/jyjiangkai/stat/utils"
+)
+
+const (
+	RenewalGraceDays    = 7 // a plan renewed within this many days after it expired still counts as renewed
+	RenewalNoticeDays   = 7 // notify the plans which expire within this many days
+	DefaultRenewalDays  = 30
+	RenewalTypeExpiring = "expiring"
+)
+
+type RenewalService struct {
+	cli             *mongo.Client
+	quotas          repository.QuotaRepository
+	payments        repository.PaymentRepository
+	renewalColl     *mongo.Collection
+	dataSubjectColl *mongo.Collection
+	closeC          chan struct{}
+}
+
+func NewRenewalService(cli *mongo.Client) *RenewalService {
+	return &RenewalService{
+		cli:             cli,
+		quotas:          repository.NewMongoQuotaRepository(cli.Database(db.GetDatabaseName()).Collection("quotas")),
+		payments:        repository.NewMongoPaymentRepository(cli.Database(db.GetDatabaseName()).Collection("payments")),
+		renewalColl:     cli.Database(DatabaseOfUserStatistics).Collection("renewals"),
+		dataSubjectColl: cli.Database(DatabaseOfUserStatistics).Collection("data_subject_requests"),
+		closeC:          make(chan struct{}),
+	}
+}
+
+func (rs *RenewalService) Start() error {
+	ctx := context.Background()
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		defer log.Warn(ctx).Err(nil).Msg("renewal routine exit")
+		for {
+			select {
+			case <-rs.closeC:
+				log.Info(ctx).Msg("renewal service stopped.")
+				return
+			case <-ticker.C:
+				now := time.Now()
+				if now.Hour() == 4 {
+					log.Info(ctx).Msgf("start renewal tracking at: %+v\n", now)
+					err := rs.TrackRenewals(ctx, now)
+					if err != nil {
+						log.Error(ctx).Err(err).Msgf("renewal tracking failed at %+v\n", time.Now())
+					}
+					err = rs.NotifyExpiring(ctx, now)
+					if err != nil {
+						log.Error(ctx).Err(err).Msgf("expiring notification failed at %+v\n", time.Now())
+					}
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func (rs *RenewalService) Stop() error {
+	return nil
+}
+
+// TrackRenewals walks the paid quotas which expire before the notice window
+// ends and decides for each one whether it was renewed, lapsed or is still
+// pending by looking for the successive quota or payment of the same user.
+// Only the quotas which could still be pending at the last run are walked,
+// the ones of erased users are skipped so their renewals don't come back.
+func (rs *RenewalService) TrackRenewals(ctx context.Context, now time.Time) error {
+	since, err := rs.getTrackedSince(ctx)
+	if err != nil {
+		return err
+	}
+	erased, err := erasedUsers(ctx, rs.dataSubjectColl)
+	if err != nil {
+		return err
+	}
+	quotas, err := rs.quotas.EndWithin(ctx, since, now.AddDate(0, 0, RenewalNoticeDays))
+	if err != nil {
+		return db.HandleDBError(err)
+	}
+
+	cnt := 0
+	for _, quota := range quotas {
+		if !isPaidQuota(quota) {
+			continue
+		}
+		if _, ok := erased[quota.CreatedBy]; ok {
+			continue
+		}
+		renewal, err := rs.getRenewal(ctx, quota)
+		if err != nil {
+			return err
+		}
+		if renewal.Status != models.RenewalStatusOfPending {
+			continue
+		}
+		if err = rs.judge(ctx, now, quota, renewal); err != nil {
+			return err
+		}
+		cnt += 1
+	}
+	log.Info(ctx).Int("cnt", cnt).Msgf("finish renewal tracking at: %+v\n", time.Now())
+	return nil
+}
+
+// getTrackedSince returns the end after which a quota may be undecided, a
+// quota which expired more than the grace period before the last run was
+// decided by it. The first run walks all quotas.
+func (rs *RenewalService) getTrackedSince(ctx context.Context) (time.Time, error) {
+	opt := options.FindOneOptions{
+		Sort:       bson.M{"updated_at": -1},
+		Projection: bson.M{"updated_at": 1},
+	}
+	last := &models.Renewal{}
+	err := rs.renewalColl.FindOne(ctx, bson.M{}, &opt).Decode(last)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return time.Time{}, nil
+		}
+		return time.Time{}, db.HandleDBError(err)
+	}
+	since := last.UpdatedAt.AddDate(0, 0, -RenewalGraceDays)
+	// the pending ones left behind by an interrupted run
+	opt = options.FindOneOptions{
+		Sort:       bson.M{"expired_at": 1},
+		Projection: bson.M{"expired_at": 1},
+	}
+	pending := &models.Renewal{}
+	err = rs.renewalColl.FindOne(ctx, bson.M{"status": models.RenewalStatusOfPending}, &opt).Decode(pending)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return time.Time{}, db.HandleDBError(err)
+	}
+	if err == nil && pending.ExpiredAt.Before(since) {
+		since = pending.ExpiredAt.Add(-time.Nanosecond)
+	}
+	return since, nil
+}
+
+func isPaidQuota(quota *cloud.UserQuota) bool {
+	return quota.Plan != nil && quota.PeriodOfValidity != nil && !strings.EqualFold(quota.Plan.Type, "free")
+}
+
+func (rs *RenewalService) getRenewal(ctx context.Context, quota *cloud.UserQuota) (*models.Renewal, error) {
+	renewal := &models.Renewal{}
+	err := rs.renewalColl.FindOne(ctx, bson.M{"quota_id": quota.ID}).Decode(renewal)
+	if err == nil {
+		return renewal, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, db.HandleDBError(err)
+	}
+	return &models.Renewal{
+		Base:      cloud.NewBase(ctx),
+		QuotaID:   quota.ID,
+		OID:       quota.CreatedBy,
+		Kind:      quota.Plan.Kind,
+		PlanType:  quota.Plan.Type,
+		PlanLevel: quota.Plan.Level,
+		ExpiredAt: quota.PeriodOfValidity.End,
+		Status:    models.RenewalStatusOfPending,
+	}, nil
+}
+
+func (rs *RenewalService) judge(ctx context.Context, now time.Time, quota *cloud.UserQuota, renewal *models.Renewal) error {
+	expiredAt := quota.PeriodOfValidity.End
+	next, err := rs.getNextQuota(ctx, quota)
+	if err != nil {
+		return err
+	}
+	if next != nil {
+		renewal.Status = models.RenewalStatusOfRenewed
+		renewal.NextQuotaID = &next.ID
+		renewal.NextPlan = &models.Plan{
+			Type:  next.Plan.Type,
+			Level: next.Plan.Level,
+		}
+		renewal.RenewedAt = &next.CreatedAt
+	} else {
+		payment, err := rs.getRenewalPayment(ctx, quota)
+		if err != nil {
+			return err
+		}
+		if payment != nil {
+			renewal.Status = models.RenewalStatusOfRenewed
+			renewal.RenewedAt = &payment.CreatedAt
+		} else if now.After(expiredAt.AddDate(0, 0, RenewalGraceDays)) {
+			renewal.Status = models.RenewalStatusOfLapsed
+		}
+	}
+	renewal.UpdatedAt = now
+	opts := &options.ReplaceOptions{
+		Upsert: utils.PtrBool(true),
+	}
+	_, err = rs.renewalColl.ReplaceOne(ctx, bson.M{"quota_id": quota.ID}, renewal, opts)
+	if err != nil {
+		log.Error(ctx).Err(err).Str("user", renewal.OID).Msg("failed to save renewal")
+		return db.HandleDBError(err)
+	}
+	return nil
+}
+
+// getNextQuota returns the paid quota of the same user and kind which
+// starts after the given one and no later than the grace period.
+func (rs *RenewalService) getNextQuota(ctx context.Context, quota *cloud.UserQuota) (*cloud.UserQuota, error) {
+	period := quota.PeriodOfValidity
+	quotas, err := rs.quotas.StartWithin(ctx, quota.CreatedBy, quota.Plan.Kind, period.Start, period.End.AddDate(0, 0, RenewalGraceDays))
+	if err != nil {
+		return nil, db.HandleDBError(err)
+	}
+	for _, next := range quotas {
+		if next.ID != quota.ID && isPaidQuota(next) {
+			return next, nil
+		}
+	}
+	return nil, nil
+}
+
+// getRenewalPayment returns the payment of the same user and kind made
+// around the end of the given quota, a renewal may be paid before the
+// successive quota is issued.
+func (rs *RenewalService) getRenewalPayment(ctx context.Context, quota *cloud.UserQuota) (*models.Payment, error) {
+	end := quota.PeriodOfValidity.End
+	payment, err := rs.payments.FirstWithin(ctx, quota.CreatedBy, quota.Plan.Kind, end.AddDate(0, 0, -RenewalGraceDays), end.AddDate(0, 0, RenewalGraceDays))
+	if err != nil {
+		return nil, db.HandleDBError(err)
+	}
+	if payment == nil || payment.CreatedAt.Before(quota.PeriodOfValidity.Start) {
+		return nil, nil
+	}
+	return payment, nil
+}
+
+// NotifyExpiring sends one notification for the pending plans which expire
+// within the notice window and have not been notified yet.
+func (rs *RenewalService) NotifyExpiring(ctx context.Context, now time.Time) error {
+	query := bson.M{
+		"status":   models.RenewalStatusOfPending,
+		"notified": false,
+		"expired_at": bson.M{
+			"$gte": now,
+			"$lte": now.AddDate(0, 0, RenewalNoticeDays),
+		},
+	}
+	opt := options.FindOptions{
+		Sort: bson.M{"expired_at": 1},
+	}
+	cursor, err := rs.renewalColl.Find(ctx, query, &opt)
+	if err != nil {
+		return db.HandleDBError(err)
+	}
+	defer func() {
+		_ = cursor.Close(ctx)
+	}()
+	renewals := make([]*models.Renewal, 0)
+	lines := make([]string, 0)
+	for cursor.Next(ctx) {
+		renewal := &models.Renewal{}
+		if err = cursor.Decode(renewal); err != nil {
+			return db.HandleDBError(err)
+		}
+		renewals = append(renewals, renewal)
+		lines = append(lines, fmt.Sprintf("%s: %s plan %s(level %d) expires at %s", renewal.OID, renewal.Kind, renewal.PlanType, renewal.PlanLevel, renewal.ExpiredAt.Format("2006-01-02")))
+	}
+	if len(renewals) == 0 {
+		return nil
+	}
+	message := fmt.Sprintf("%d paid plans will expire in the next %d days:\n%s", len(renewals), RenewalNoticeDays, strings.Join(lines, "\n"))
+	if err = monitor.SendAlarm(ctx, message); err != nil {
+		return err
+	}
+	for _, renewal := range renewals {
+		update := bson.M{"$set": bson.M{"notified": true}}
+		if _, err = rs.renewalColl.UpdateOne(ctx, bson.M{"_id": renewal.ID}, update); err != nil {
+			return db.HandleDBError(err)
+		}
+	}
+	return nil
+}
+
+// List returns the plans expiring within opts.Days days when TypeSelector is
+// empty or expiring, otherwise the renewals of the given status.
+func (rs *RenewalService) List(ctx context.Context, pg api.Page, opts *api.ListOptions) (*api.ListResult, error) {
+	var (
+		skip  = pg.PageNumber * pg.PageSize
+		limit = pg.PageSize
+		sort  = bson.M{"expired_at": -1}
+		days  = DefaultRenewalDays
+	)
+
+	if skip < 0 {
+		skip = 0
+	}
+	if opts.Days > 0 {
+		days = opts.Days
+	}
+
+	query := bson.M{}
+	switch opts.TypeSelector {
+	case "", RenewalTypeExpiring:
+		now := time.Now()
+		query["status"] = models.RenewalStatusOfPending
+		query["expired_at"] = bson.M{
+			"$gte": now,
+			"$lte": now.AddDate(0, 0, days),
+		}
+		sort = bson.M{"expired_at": 1}
+	case models.RenewalStatusOfPending, models.RenewalStatusOfRenewed, models.RenewalStatusOfLapsed:
+		rg, err := GetRange(ctx, pg.Range)
+		if err != nil {
+			return nil, err
+		}
+		query["status"] = opts.TypeSelector
+		query["expired_at"] = bson.M{
+			"$gte": rg.Start,
+			"$lt":  rg.End,
+		}
+	default:
+		return nil, api.ErrInvalidParameter.WithMessage(fmt.Sprintf("unsupported renewal type %s", opts.TypeSelector))
+	}
+	if opts.KindSelector != "" {
+		query["kind"] = toQuotaKind(opts.KindSelector)
+	}
+	cnt, err := rs.renewalColl.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if cnt == 0 {
+		return &api.ListResult{
+			List: []interface{}{},
+			P:    pg,
+		}, nil
+	}
+	if cnt <= skip {
+		return nil, api.ErrPageArgumentsTooLarge
+	}
+
+	pg.Total = cnt
+	opt := options.FindOptions{
+		Limit: &limit,
+		Skip:  &skip,
+		Sort:  sort,
+	}
+	cursor, err := rs.renewalColl.Find(ctx, query, &opt)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = cursor.Close(ctx)
+	}()
+
+	list := make([]interface{}, 0)
+	for cursor.Next(ctx) {
+		renewal := &models.Renewal{}
+		if err = cursor.Decode(renewal); err != nil {
+			return nil, db.HandleDBError(err)
+		}
+		list = append(list, renewal)
+	}
+	return &api.ListResult{
+		List: list,
+		P:    pg,
+	}, nil
+}
+
+// Rates returns the renewal rate of every plan type per month the plans
+// expired in, the pending ones are excluded from the rate.
+func (rs *RenewalService) Rates(ctx context.Context, pg api.Page, opts *api.ListOptions) ([]*models.RenewalRate, error) {
+	rg, err := GetRange(ctx, pg.Range)
+	if err != nil {
+		return nil, err
+	}
+	match := bson.M{
+		"expired_at": bson.M{
+			"$gte": rg.Start,
+			"$lt":  rg.End,
+		},
+	}
+	if opts.KindSelector != "" {
+		match["kind"] = toQuotaKind(opts.KindSelector)
+	}
+	countOf := func(status string) bson.M {
+		return bson.M{"$sum": bson.M{"$cond": []interface{}{bson.M{"$eq": []interface{}{"$status", status}}, 1, 0}}}
+	}
+	pipeline := mongo.Pipeline{
+		{
+			{"$match", match},
+		},
+		{
+			{"$group", bson.D{
+				{"_id", bson.M{
+					"month": bson.M{
+						"$dateToString": bson.M{
+							"format":   "%Y-%m",
+							"date":     "$expired_at",
+							"timezone": timezone.Of(ctx).String(),
+						},
+					},
+					"kind":      "$kind",
+					"plan_type": "$plan_type",
+				}},
+				{"expired", bson.M{"$sum": 1}},
+				{"renewed", countOf(models.RenewalStatusOfRenewed)},
+				{"lapsed", countOf(models.RenewalStatusOfLapsed)},
+				{"pending", countOf(models.RenewalStatusOfPending)},
+			}},
+		},
+		{
+			{"$sort", bson.D{
+				{"_id.month", 1},
+				{"_id.kind", 1},
+				{"_id.plan_type", 1},
+			}},
+		},
+	}
+	type rateGroup struct {
+		ID struct {
+			Month    string `bson:"month"`
+			Kind     string `bson:"kind"`
+			PlanType string `bson:"plan_type"`
+		} `bson:"_id"`
+		Expired int64 `bson:"expired"`
+		Renewed int64 `bson:"renewed"`
+		Lapsed  int64 `bson:"lapsed"`
+		Pending int64 `bson:"pending"`
+	}
+	cursor, err := rs.renewalColl.Aggregate(ctx, pipeline)
+	if err != nil {
+		log.Error(ctx).Err(err).Msg("aggregate error")
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	rates := make([]*models.RenewalRate, 0)
+	for cursor.Next(ctx) {
+		var rg rateGroup
+		if err = cursor.Decode(&rg); err != nil {
+			return nil, err
+		}
+		rate := &models.RenewalRate{
+			Month:    rg.ID.Month,
+			Kind:     rg.ID.Kind,
+			PlanType: rg.ID.PlanType,
+			Expired:  rg.Expired,
+			Renewed:  rg.Renewed,
+			Lapsed:   rg.Lapsed,
+			Pending:  rg.Pending,
+		}
+		if decided := rg.Renewed + rg.Lapsed; decided != 0 {
+			rate.Rate = utils.KeepTwoDecimalPlaces(float64(rg.Renewed) / float64(decided) * 100)
+		}
+		rates = append(rates, rate)
+	}
+	return rates, nil
+}
+
+// toQuotaKind maps the kind used by the api to the plan kind of quotas.
+func toQuotaKind(kind string) string {
+	if kind == "connect" {
+		return "cloud"
+	}
+	return kind
+}
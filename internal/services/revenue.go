@@ -0,0 +1,441 @@
+package services
+
+import (
+	"context"
+	"math"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/jyjiangkai/stat/api"
+	"github.com/jyjiangkai/stat/currency"
+	"github.com/jyjiangkai/stat/db"
+	"github.com/jyjiangkai/stat/internal/repository"
+	"github.com/jyjiangkai/stat/log"
+	"github.com/jyjiangkai/stat/models"
+	"github.com/jyjiangkai/stat/models/cloud"
+	"github.com/jyjiangkai/stat/utils"
+)
+
+const (
+	GranularityOfDay   = "day"
+	GranularityOfWeek  = "week"
+	GranularityOfMonth = "month"
+
+	RevenueMaxPeriodMonths = 12 // the longest plan period, a payment made earlier can't overlap the range
+)
+
+type RevenueService struct {
+	cli      *mongo.Client
+	payments repository.PaymentRepository
+	quotas   repository.QuotaRepository
+	closeC   chan struct{}
+}
+
+func NewRevenueService(cli *mongo.Client) *RevenueService {
+	return &RevenueService{
+		cli:      cli,
+		payments: repository.NewMongoPaymentRepository(cli.Database(db.GetDatabaseName()).Collection("payments")),
+		quotas:   repository.NewMongoQuotaRepository(cli.Database(db.GetDatabaseName()).Collection("quotas")),
+		closeC:   make(chan struct{}),
+	}
+}
+
+func (rs *RevenueService) Start() error {
+	return nil
+}
+
+func (rs *RevenueService) Stop() error {
+	return nil
+}
+
+// subscription is a paid period of a user, Monthly is the payable amount
+// of the payment spread evenly over the months of the plan period.
+type subscription struct {
+	user    string
+	start   time.Time
+	end     time.Time
+	monthly float64
+}
+
+type subscriptions []*subscription
+
+// mrrAt returns the monthly recurring revenue of every user at each of the
+// given times. The times are visited in order and the subscriptions are
+// swept once by their starts and ends.
+func (subs subscriptions) mrrAt(times ...time.Time) []map[string]float64 {
+	order := make([]int, len(times))
+	for idx := range order {
+		order[idx] = idx
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return times[order[i]].Before(times[order[j]])
+	})
+	starts := make(subscriptions, len(subs))
+	copy(starts, subs)
+	sort.Slice(starts, func(i, j int) bool {
+		return starts[i].start.Before(starts[j].start)
+	})
+	ends := make(subscriptions, len(subs))
+	copy(ends, subs)
+	sort.Slice(ends, func(i, j int) bool {
+		return ends[i].end.Before(ends[j].end)
+	})
+
+	mrrs := make([]map[string]float64, len(times))
+	active := make(map[string]float64)
+	cnt := make(map[string]int)
+	next, expired := 0, 0
+	for _, idx := range order {
+		at := times[idx]
+		for ; next < len(starts) && !starts[next].start.After(at); next++ {
+			active[starts[next].user] += starts[next].monthly
+			cnt[starts[next].user] += 1
+		}
+		for ; expired < len(ends) && !ends[expired].end.After(at); expired++ {
+			user := ends[expired].user
+			active[user] -= ends[expired].monthly
+			if cnt[user] -= 1; cnt[user] == 0 {
+				delete(active, user)
+				delete(cnt, user)
+			}
+		}
+		mrr := make(map[string]float64, len(active))
+		for user, monthly := range active {
+			mrr[user] = monthly
+		}
+		mrrs[idx] = mrr
+	}
+	return mrrs
+}
+
+// getFirstPaidAt returns the time of the first payment of every user, the
+// payments before the range are counted too.
+func (rs *RevenueService) getFirstPaidAt(ctx context.Context, kind string) (map[string]time.Time, error) {
+	first, err := rs.payments.FirstPaid(ctx, toQuotaKind(kind))
+	if err != nil {
+		log.Error(ctx).Err(err).Msg("aggregate error")
+		return nil, db.HandleDBError(err)
+	}
+	return first, nil
+}
+
+// getSubscriptions returns the subscriptions which may overlap the range,
+// only the payments made within the longest plan period before it are read.
+func (rs *RevenueService) getSubscriptions(ctx context.Context, kind string, to string, start, end time.Time) (subscriptions, error) {
+	since := start.AddDate(0, -RevenueMaxPeriodMonths, 0)
+	payments, err := rs.payments.Paid(ctx, toQuotaKind(kind), since, end)
+	if err != nil {
+		return nil, db.HandleDBError(err)
+	}
+	if len(payments) == 0 {
+		return subscriptions{}, nil
+	}
+	users := make([]string, 0, len(payments))
+	for _, payment := range payments {
+		users = append(users, payment.CreatedBy)
+	}
+	quotas, err := rs.getQuotas(ctx, users, since)
+	if err != nil {
+		return nil, err
+	}
+	subs := make(subscriptions, 0, len(payments))
+	for _, payment := range payments {
+		start := payment.CreatedAt
+		end := start.AddDate(0, 1, 0)
+		if period := matchPeriod(quotas[payment.CreatedBy], payment); period != nil {
+			start, end = period.Start, period.End
+		}
+		months := math.Round(end.Sub(start).Hours() / 24 / 30)
+		if months < 1 {
+			months = 1
+		}
+		payable, err := payableIn(payment, to)
+		if err != nil {
+			// the requested currency is validated already, it's the currency
+			// of the payment which has no rate
+			log.Error(ctx).Err(err).Str("payment", payment.ID.Hex()).Msg("failed to convert payment")
+			return nil, api.ErrInternal.WithError(err)
+		}
+		subs = append(subs, &subscription{
+			user:    payment.CreatedBy,
+			start:   start,
+			end:     end,
+			monthly: payable / months,
+		})
+	}
+	return subs, nil
+}
+
+// payableIn returns the amount the user actually paid converted to the
+// given currency at the payment date, the reporting currency by default.
+func payableIn(payment *models.Payment, to string) (float64, error) {
+	if to == "" {
+		to = currency.ReportingCurrency()
+	}
+	return currency.Convert(payment.Amount.Payable, payment.Currency, to, payment.CreatedAt)
+}
+
+// convertPayment converts all amounts of the payment to the given currency
+// at the payment date.
+func convertPayment(payment *models.Payment, to string) error {
+	if payment == nil || payment.Amount == nil || payment.Currency == "" {
+		return nil
+	}
+	amount := &models.PaymentAmount{}
+	var err error
+	if amount.Total, err = currency.Convert(payment.Amount.Total, payment.Currency, to, payment.CreatedAt); err != nil {
+		return err
+	}
+	if amount.Discount, err = currency.Convert(payment.Amount.Discount, payment.Currency, to, payment.CreatedAt); err != nil {
+		return err
+	}
+	if amount.Payable, err = currency.Convert(payment.Amount.Payable, payment.Currency, to, payment.CreatedAt); err != nil {
+		return err
+	}
+	amount.Total = utils.KeepTwoDecimalPlaces(amount.Total)
+	amount.Discount = utils.KeepTwoDecimalPlaces(amount.Discount)
+	amount.Payable = utils.KeepTwoDecimalPlaces(amount.Payable)
+	payment.Amount = amount
+	payment.Currency = currency.Normalize(to)
+	return nil
+}
+
+func (rs *RevenueService) getQuotas(ctx context.Context, users []string, since time.Time) (map[string][]*cloud.UserQuota, error) {
+	valid, err := rs.quotas.ValidAfter(ctx, users, since)
+	if err != nil {
+		return nil, db.HandleDBError(err)
+	}
+	quotas := make(map[string][]*cloud.UserQuota)
+	for _, quota := range valid {
+		if quota.Plan == nil || quota.PeriodOfValidity == nil {
+			continue
+		}
+		quotas[quota.CreatedBy] = append(quotas[quota.CreatedBy], quota)
+	}
+	return quotas, nil
+}
+
+// matchPeriod returns the period of the quota the payment paid for, which is
+// the latest quota of the same kind started no later than a day after the
+// payment and still valid at the payment time.
+func matchPeriod(quotas []*cloud.UserQuota, payment *models.Payment) *cloud.PeriodOfValidity {
+	var matched *cloud.UserQuota
+	for _, quota := range quotas {
+		if quota.Plan.Kind != payment.Kind {
+			continue
+		}
+		period := quota.PeriodOfValidity
+		if period.Start.After(payment.CreatedAt.Add(24*time.Hour)) || !period.End.After(payment.CreatedAt) {
+			continue
+		}
+		if matched == nil || period.Start.After(matched.PeriodOfValidity.Start) {
+			matched = quota
+		}
+	}
+	if matched == nil {
+		return nil
+	}
+	return matched.PeriodOfValidity
+}
+
+// getRevenueRange returns the buckets of the time series within the page
+// range, which ends at now at the latest, each bucket is represented by its
+// end time.
+func getRevenueRange(ctx context.Context, pg api.Page, granularity string) ([]time.Time, error) {
+	rg, err := GetRange(ctx, pg.Range)
+	if err != nil {
+		return nil, err
+	}
+	start, end := rg.Start, rg.End
+	if now := time.Now(); end.After(now) {
+		end = now
+	}
+	points := make([]time.Time, 0)
+	switch granularity {
+	case "", GranularityOfDay:
+		for day := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, start.Location()); day.Before(end); day = day.AddDate(0, 0, 1) {
+			points = append(points, day.AddDate(0, 0, 1))
+		}
+	case GranularityOfMonth:
+		for month := utils.GetMonthBeginTime(start); month.Before(end); month = month.AddDate(0, 1, 0) {
+			points = append(points, month.AddDate(0, 1, 0))
+		}
+	default:
+		return nil, api.ErrInvalidParameter.WithMessage("unsupported granularity " + granularity)
+	}
+	// the last bucket is cut at the end, which is still in progress when it
+	// is now, take its value as of the end
+	if len(points) != 0 && points[len(points)-1].After(end) {
+		points[len(points)-1] = end
+	}
+	return points, nil
+}
+
+// MRR returns the MRR, ARR and ARPU time series.
+func (rs *RevenueService) MRR(ctx context.Context, pg api.Page, opts *api.ListOptions) ([]*models.RevenuePoint, error) {
+	points, err := getRevenueRange(ctx, pg, opts.Granularity)
+	if err != nil {
+		return nil, err
+	}
+	if len(points) == 0 {
+		return []*models.RevenuePoint{}, nil
+	}
+	subs, err := rs.getSubscriptions(ctx, opts.KindSelector, opts.Currency, points[0], points[len(points)-1])
+	if err != nil {
+		return nil, err
+	}
+	snapshots := subs.mrrAt(points...)
+	series := make([]*models.RevenuePoint, 0, len(points))
+	for idx, at := range points {
+		point := &models.RevenuePoint{
+			Date: at,
+		}
+		for _, mrr := range snapshots[idx] {
+			point.MRR += mrr
+			point.PayingUsers += 1
+		}
+		if point.PayingUsers != 0 {
+			point.ARPU = utils.KeepTwoDecimalPlaces(point.MRR / float64(point.PayingUsers))
+		}
+		point.MRR = utils.KeepTwoDecimalPlaces(point.MRR)
+		point.ARR = utils.KeepTwoDecimalPlaces(point.MRR * 12)
+		series = append(series, point)
+	}
+	return series, nil
+}
+
+// Movements breaks down the MRR change of every month into new,
+// reactivation, expansion, contraction and churned MRR.
+func (rs *RevenueService) Movements(ctx context.Context, pg api.Page, opts *api.ListOptions) ([]*models.RevenueMovement, error) {
+	points, err := getRevenueRange(ctx, pg, GranularityOfMonth)
+	if err != nil {
+		return nil, err
+	}
+	if len(points) == 0 {
+		return []*models.RevenueMovement{}, nil
+	}
+	// the MRR at the end of every month and of the month before it
+	times := make([]time.Time, 0, len(points)+1)
+	times = append(times, utils.GetMonthBeginTime(points[0].Add(-time.Nanosecond)).Add(-time.Nanosecond))
+	times = append(times, points...)
+	subs, err := rs.getSubscriptions(ctx, opts.KindSelector, opts.Currency, times[0], points[len(points)-1])
+	if err != nil {
+		return nil, err
+	}
+	first, err := rs.getFirstPaidAt(ctx, opts.KindSelector)
+	if err != nil {
+		return nil, err
+	}
+	snapshots := subs.mrrAt(times...)
+	movements := make([]*models.RevenueMovement, 0, len(points))
+	for idx, at := range points {
+		begin := utils.GetMonthBeginTime(at.Add(-time.Nanosecond))
+		previous := snapshots[idx]
+		current := snapshots[idx+1]
+		movement := &models.RevenueMovement{
+			Month: begin.Format("2006-01"),
+		}
+		for user, before := range previous {
+			movement.StartMRR += before
+			after := current[user]
+			switch {
+			case after == 0:
+				movement.Churned += before
+				movement.ChurnedUsers += 1
+			case after > before:
+				movement.Expansion += after - before
+			case after < before:
+				movement.Contraction += before - after
+			}
+		}
+		for user, after := range current {
+			movement.EndMRR += after
+			if _, ok := previous[user]; ok {
+				continue
+			}
+			if first[user].Before(begin) {
+				movement.Reactivation += after
+			} else {
+				movement.New += after
+				movement.NewUsers += 1
+			}
+		}
+		movement.StartMRR = utils.KeepTwoDecimalPlaces(movement.StartMRR)
+		movement.New = utils.KeepTwoDecimalPlaces(movement.New)
+		movement.Reactivation = utils.KeepTwoDecimalPlaces(movement.Reactivation)
+		movement.Expansion = utils.KeepTwoDecimalPlaces(movement.Expansion)
+		movement.Contraction = utils.KeepTwoDecimalPlaces(movement.Contraction)
+		movement.Churned = utils.KeepTwoDecimalPlaces(movement.Churned)
+		movement.EndMRR = utils.KeepTwoDecimalPlaces(movement.EndMRR)
+		movements = append(movements, movement)
+	}
+	return movements, nil
+}
+
+// Retention returns the net revenue retention of every cohort of users who
+// paid for the first time in the same month, the MRR of the cohort at the
+// end of its first month is the baseline.
+func (rs *RevenueService) Retention(ctx context.Context, pg api.Page, opts *api.ListOptions) ([]*models.RevenueRetention, error) {
+	points, err := getRevenueRange(ctx, pg, GranularityOfMonth)
+	if err != nil {
+		return nil, err
+	}
+	if len(points) == 0 {
+		return []*models.RevenueRetention{}, nil
+	}
+	subs, err := rs.getSubscriptions(ctx, opts.KindSelector, opts.Currency, points[0], points[len(points)-1])
+	if err != nil {
+		return nil, err
+	}
+	first, err := rs.getFirstPaidAt(ctx, opts.KindSelector)
+	if err != nil {
+		return nil, err
+	}
+	snapshots := subs.mrrAt(points...)
+	cohorts := make(map[string][]string)
+	for user, at := range first {
+		cohort := at.Format("2006-01")
+		cohorts[cohort] = append(cohorts[cohort], user)
+	}
+
+	retentions := make([]*models.RevenueRetention, 0)
+	for idx, at := range points {
+		cohort := at.Add(-time.Nanosecond).Format("2006-01")
+		users, ok := cohorts[cohort]
+		if !ok {
+			continue
+		}
+		retention := &models.RevenueRetention{
+			Cohort:   cohort,
+			Users:    int64(len(users)),
+			StartMRR: sumOf(snapshots[idx], users),
+			Months:   make([]*models.NetRetention, 0),
+		}
+		for offset := 0; idx+offset < len(points); offset++ {
+			mrr := sumOf(snapshots[idx+offset], users)
+			month := &models.NetRetention{
+				Month:  points[idx+offset].Add(-time.Nanosecond).Format("2006-01"),
+				Offset: offset,
+				MRR:    utils.KeepTwoDecimalPlaces(mrr),
+			}
+			if retention.StartMRR != 0 {
+				month.NRR = utils.KeepTwoDecimalPlaces(mrr / retention.StartMRR * 100)
+			}
+			retention.Months = append(retention.Months, month)
+		}
+		retention.StartMRR = utils.KeepTwoDecimalPlaces(retention.StartMRR)
+		retentions = append(retentions, retention)
+	}
+	log.Info(ctx).Int("cohorts", len(retentions)).Msg("finish revenue retention")
+	return retentions, nil
+}
+
+func sumOf(mrr map[string]float64, users []string) float64 {
+	sum := 0.0
+	for _, user := range users {
+		sum += mrr[user]
+	}
+	return sum
+}
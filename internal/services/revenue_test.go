@@ -0,0 +1,82 @@
+package services
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jyjiangkai/stat/currency"
+	"github.com/jyjiangkai/stat/internal/repository"
+	"github.com/jyjiangkai/stat/models"
+	"github.com/jyjiangkai/stat/models/cloud"
+)
+
+func TestMRRAt(t *testing.T) {
+	day := func(d int) time.Time {
+		return time.Date(2024, 1, d, 0, 0, 0, 0, time.UTC)
+	}
+	subs := subscriptions{
+		{user: "a", start: day(1), end: day(11), monthly: 100},
+		// renewed on the day the previous one ends
+		{user: "a", start: day(11), end: day(21), monthly: 120},
+		{user: "b", start: day(5), end: day(15), monthly: 50},
+		{user: "b", start: day(8), end: day(12), monthly: 10},
+	}
+	times := []time.Time{day(20), day(1), day(9), day(11), day(15), day(21), day(12)}
+	want := []map[string]float64{
+		{"a": 120},
+		{"a": 100},
+		{"a": 100, "b": 60},
+		{"a": 120, "b": 60},
+		{"a": 120},
+		{},
+		{"a": 120, "b": 50},
+	}
+	if got := subs.mrrAt(times...); !reflect.DeepEqual(got, want) {
+		t.Errorf("mrrAt() = %v, want %v", got, want)
+	}
+}
+
+func TestGetSubscriptions(t *testing.T) {
+	day := func(m time.Month, d int) time.Time {
+		return time.Date(2024, m, d, 0, 0, 0, 0, time.UTC)
+	}
+	payment := func(user, kind string, at time.Time, payable float64) *models.Payment {
+		payment := models.NewPayment()
+		payment.CreatedBy = user
+		payment.CreatedAt = at
+		payment.Kind = kind
+		payment.Currency = currency.ReportingCurrency()
+		payment.Amount.Payable = payable
+		return payment
+	}
+	rs := &RevenueService{
+		payments: repository.NewMemoryPaymentRepository(
+			payment("a", "cloud", day(1, 1), 300),
+			payment("b", "cloud", day(1, 5), 50),
+			// free of charge
+			payment("c", "cloud", day(1, 5), 0),
+			payment("d", "ai", day(1, 5), 20),
+			// after the range
+			payment("e", "cloud", day(2, 1), 20),
+		),
+		quotas: repository.NewMemoryQuotaRepository(&cloud.UserQuota{
+			Base:             cloud.Base{CreatedBy: "a"},
+			Plan:             &cloud.QuotaPlan{Kind: "cloud", Type: "pro"},
+			PeriodOfValidity: &cloud.PeriodOfValidity{Start: day(1, 1), End: day(4, 1)},
+		}),
+	}
+	subs, err := rs.getSubscriptions(context.Background(), "connect", "", day(1, 1), day(2, 1))
+	if err != nil {
+		t.Fatalf("getSubscriptions() = %v", err)
+	}
+	want := subscriptions{
+		// spread over the three months of the quota the payment paid for
+		{user: "a", start: day(1, 1), end: day(4, 1), monthly: 100},
+		{user: "b", start: day(1, 5), end: day(2, 5), monthly: 50},
+	}
+	if !reflect.DeepEqual(subs, want) {
+		t.Errorf("getSubscriptions() = %v, want %v", subs, want)
+	}
+}
@@ -9,11 +9,14 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 
+	"github.com/jyjiangkai/stat/cache"
 	"github.com/jyjiangkai/stat/db"
+	"github.com/jyjiangkai/stat/internal/repository"
 	"github.com/jyjiangkai/stat/log"
 	"github.com/jyjiangkai/stat/models"
 	"github.com/jyjiangkai/stat/models/cloud"
 	"github.com/jyjiangkai/stat/plausible"
+	"github.com/jyjiangkai/stat/timezone"
 	"github.com/jyjiangkai/stat/utils"
 )
 
@@ -43,8 +46,10 @@ const (
 type StatService struct {
 	mgoCli              *mongo.Client
 	connectionColl      *mongo.Collection
-	userColl            *mongo.Collection
-	quotaColl           *mongo.Collection
+	users               repository.UserRepository
+	quotas              repository.QuotaRepository
+	payments            repository.PaymentRepository
+	creditColl          *mongo.Collection
 	paymentColl         *mongo.Collection
 	billColl            *mongo.Collection
 	aiBillColl          *mongo.Collection
@@ -54,7 +59,12 @@ type StatService struct {
 	userStatColl        *mongo.Collection
 	dailyStatColl       *mongo.Collection
 	actionColl          *mongo.Collection
+	dataSubjectColl     *mongo.Collection
+	plan                *PlanService
+	history             *HistoryService
 	wg                  sync.WaitGroup
+	mutex               sync.Mutex
+	afterUserStat       []func(ctx context.Context, now time.Time)
 	closeC              chan struct{}
 }
 
@@ -62,8 +72,10 @@ func NewStatService(cli *mongo.Client) *StatService {
 	return &StatService{
 		mgoCli:              cli,
 		connectionColl:      cli.Database(db.GetDatabaseName()).Collection("connections"),
-		userColl:            cli.Database(db.GetDatabaseName()).Collection("users"),
-		quotaColl:           cli.Database(db.GetDatabaseName()).Collection("quotas"),
+		users:               repository.NewMongoUserRepository(cli.Database(db.GetDatabaseName()).Collection("users")),
+		quotas:              repository.NewMongoQuotaRepository(cli.Database(db.GetDatabaseName()).Collection("quotas")),
+		payments:            repository.NewMongoPaymentRepository(cli.Database(db.GetDatabaseName()).Collection("payments")),
+		creditColl:          cli.Database(db.GetDatabaseName()).Collection("credits"),
 		paymentColl:         cli.Database(db.GetDatabaseName()).Collection("payments"),
 		billColl:            cli.Database(db.GetDatabaseName()).Collection("bills"),
 		aiBillColl:          cli.Database(db.GetDatabaseName()).Collection("ai_bills"),
@@ -73,6 +85,9 @@ func NewStatService(cli *mongo.Client) *StatService {
 		userStatColl:        cli.Database(DatabaseOfUserStatistics).Collection("user_stats"),
 		dailyStatColl:       cli.Database(DatabaseOfUserStatistics).Collection("daily_stats"),
 		actionColl:          cli.Database(DatabaseOfUserAnalytics).Collection("user_actions"),
+		dataSubjectColl:     cli.Database(DatabaseOfUserStatistics).Collection("data_subject_requests"),
+		plan:                NewPlanService(cli),
+		history:             NewHistoryService(cli),
 		closeC:              make(chan struct{}),
 	}
 }
@@ -104,6 +119,20 @@ func (ss *StatService) Start() error {
 						log.Error(ctx).Err(err).Msgf("refresh user stat failed at %+v\n", time.Now())
 					} else {
 						log.Info(ctx).Msgf("finish refresh user stat at: %+v\n", time.Now())
+						err = ss.plan.Snapshot(ctx, now)
+						if err != nil {
+							log.Error(ctx).Err(err).Msgf("plan snapshot failed at %+v\n", time.Now())
+						}
+						err = ss.history.Snapshot(ctx, now)
+						if err != nil {
+							log.Error(ctx).Err(err).Msgf("user stat snapshot failed at %+v\n", time.Now())
+						}
+						ss.mutex.Lock()
+						hooks := ss.afterUserStat
+						ss.mutex.Unlock()
+						for _, hook := range hooks {
+							hook(ctx, now)
+						}
 					}
 				}
 			}
@@ -116,13 +145,24 @@ func (ss *StatService) Stop() error {
 	return nil
 }
 
+// AfterUserStat registers fn to be called after every daily user stat which
+// succeeds, with the time the user stat started at.
+func (ss *StatService) AfterUserStat(fn func(ctx context.Context, now time.Time)) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	ss.afterUserStat = append(ss.afterUserStat, fn)
+}
+
 func (ss *StatService) UserStat(ctx context.Context, now time.Time) error {
-	query := bson.M{}
-	cnt, err := ss.userColl.CountDocuments(ctx, query)
+	cnt, err := ss.users.Count(ctx)
 	if err != nil {
 		return err
 	}
 	log.Info(ctx).Msgf("current collection time is %+v, with a total of %d users\n", now, cnt)
+	erased, err := erasedUsers(ctx, ss.dataSubjectColl)
+	if err != nil {
+		return err
+	}
 	step := int64(BatchSize)
 	goroutines := 0
 	for i := int64(0); i < cnt; {
@@ -133,18 +173,21 @@ func (ss *StatService) UserStat(ctx context.Context, now time.Time) error {
 		}
 		ss.wg.Add(1)
 		goroutines += 1
-		go ss.rangeUserStat(ctx, start, end, now)
+		go ss.rangeUserStat(ctx, start, end, now, erased)
 		i += step
 	}
 	log.Info(ctx).Msgf("launch a total of %d goroutines, with each goroutine assigned %d user collection tasks\n", goroutines, step)
 	log.Info(ctx).Msg("starting collection, please wait...")
 	ss.wg.Wait()
 	log.Info(ctx).Msgf("finished user data collection, spent %f seconds, updated %d users\n", time.Since(now).Seconds(), cnt)
+	cache.Invalidate(ctx, "user stat finished")
 	return nil
 }
 
 func (ss *StatService) DailyStat(ctx context.Context, now time.Time) error {
-	monthly := StartAt
+	// the days are bucketed in the reporting timezone
+	loc := timezone.Reporting()
+	monthly := time.Date(StartAt.Year(), StartAt.Month(), StartAt.Day(), 0, 0, 0, 0, loc)
 	goroutines := 0
 	for {
 		ss.wg.Add(1)
@@ -156,7 +199,7 @@ func (ss *StatService) DailyStat(ctx context.Context, now time.Time) error {
 			}
 		}(monthly)
 		nextMonthTime := monthly.AddDate(0, 1, 0)
-		monthly = time.Date(nextMonthTime.Year(), nextMonthTime.Month(), 1, 0, 0, 0, 0, time.UTC)
+		monthly = time.Date(nextMonthTime.Year(), nextMonthTime.Month(), 1, 0, 0, 0, 0, loc)
 		if monthly.After(now) {
 			break
 		}
@@ -165,6 +208,7 @@ func (ss *StatService) DailyStat(ctx context.Context, now time.Time) error {
 	log.Info(ctx).Msg("starting daily data collection, please wait...")
 	ss.wg.Wait()
 	log.Info(ctx).Msgf("finished daily data collection, spent %f seconds, updated %d daily data\n", time.Since(now).Seconds(), int64(time.Since(StartAt).Hours()/24))
+	cache.Invalidate(ctx, "daily stat finished")
 	return nil
 }
 
@@ -189,8 +233,9 @@ func (ss *StatService) rangeDailyStat(ctx context.Context, date time.Time) error
 			return err
 		}
 		daily = daily.AddDate(0, 0, 1)
-		if daily.Month() == time.Now().Month() {
-			if daily.Day() >= time.Now().Day() || daily.Month() > date.Month() {
+		today := time.Now().In(daily.Location())
+		if daily.Month() == today.Month() {
+			if daily.Day() >= today.Day() || daily.Month() > date.Month() {
 				break
 			}
 		} else {
@@ -203,7 +248,7 @@ func (ss *StatService) rangeDailyStat(ctx context.Context, date time.Time) error
 }
 
 func (ss *StatService) dailyStatOfUserNumber(ctx context.Context, date time.Time) error {
-	startAt := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+	startAt := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, date.Location())
 	endAt := startAt.AddDate(0, 0, 1)
 	registerUserNumber, err := ss.GetRegisterUserNumber(ctx, startAt, endAt)
 	if err != nil {
@@ -232,6 +277,7 @@ func (ss *StatService) dailyStatOfUserNumber(ctx context.Context, date time.Time
 	daily := &models.DailyStatsOfUserNumber{
 		Date:                        startAt,
 		Tag:                         "user_number",
+		Timezone:                    startAt.Location().String(),
 		RegisterUserNumber:          registerUserNumber,
 		LoginUserNumber:             loginUserNumber,
 		ConnectionCreatedUserNumber: cnCreatedUserNumber,
@@ -240,8 +286,9 @@ func (ss *StatService) dailyStatOfUserNumber(ctx context.Context, date time.Time
 		AppUsedUserNumber:           appUsedUserNumber,
 	}
 	query := bson.M{
-		"date": startAt,
-		"tag":  "user_number",
+		"date":     startAt,
+		"tag":      "user_number",
+		"timezone": timezone.Query(startAt.Location()),
 	}
 	opts := &options.ReplaceOptions{
 		Upsert: utils.PtrBool(true),
@@ -259,7 +306,7 @@ func (ss *StatService) dailyStatOfShopifyLandingPageActionNumber(ctx context.Con
 	if date.Before(time.Date(2023, 10, 26, 0, 0, 0, 0, time.UTC)) {
 		return nil
 	}
-	startAt := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+	startAt := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, date.Location())
 	endAt := startAt.AddDate(0, 0, 1)
 	visitors, err := plausible.GetVisitors(ctx, "vanus.ai", "/connectors/shopify", startAt.Format("2006-01-02"))
 	if err != nil {
@@ -321,6 +368,7 @@ func (ss *StatService) dailyStatOfShopifyLandingPageActionNumber(ctx context.Con
 	daily := &models.DailyStatsOfShopifyLandingPageActionNumber{
 		Date:                            startAt,
 		Tag:                             UserActionOfShopifyLandingPage,
+		Timezone:                        startAt.Location().String(),
 		UniqueVisitorNumber:             visitors,
 		TryVanusActionNumber:            tryVanusActionNumber,
 		SignInWithGithubActionNumber:    signInWithGithubActionNumber,
@@ -337,8 +385,9 @@ func (ss *StatService) dailyStatOfShopifyLandingPageActionNumber(ctx context.Con
 		ShopifyToSlackWithCancelOrderActionNumber:        num8,
 	}
 	query := bson.M{
-		"date": startAt,
-		"tag":  UserActionOfShopifyLandingPage,
+		"date":     startAt,
+		"tag":      UserActionOfShopifyLandingPage,
+		"timezone": timezone.Query(startAt.Location()),
 	}
 	opts := &options.ReplaceOptions{
 		Upsert: utils.PtrBool(true),
@@ -356,7 +405,7 @@ func (ss *StatService) dailyStatOfGithubLandingPageActionNumber(ctx context.Cont
 	if date.Before(time.Date(2023, 10, 26, 0, 0, 0, 0, time.UTC)) {
 		return nil
 	}
-	startAt := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+	startAt := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, date.Location())
 	endAt := startAt.AddDate(0, 0, 1)
 	visitors, err := plausible.GetVisitors(ctx, "vanus.ai", "/connectors/github", startAt.Format("2006-01-02"))
 	if err != nil {
@@ -413,6 +462,7 @@ func (ss *StatService) dailyStatOfGithubLandingPageActionNumber(ctx context.Cont
 	daily := &models.DailyStatsOfGithubLandingPageActionNumber{
 		Date:                                        startAt,
 		Tag:                                         UserActionOfGithubLandingPage,
+		Timezone:                                    startAt.Location().String(),
 		UniqueVisitorNumber:                         visitors,
 		TryVanusActionNumber:                        tryVanusActionNumber,
 		SignInWithGithubActionNumber:                signInWithGithubActionNumber,
@@ -428,8 +478,9 @@ func (ss *StatService) dailyStatOfGithubLandingPageActionNumber(ctx context.Cont
 		GithubToDiscordWithOpenedPRActionNumber:     num7,
 	}
 	query := bson.M{
-		"date": startAt,
-		"tag":  UserActionOfGithubLandingPage,
+		"date":     startAt,
+		"tag":      UserActionOfGithubLandingPage,
+		"timezone": timezone.Query(startAt.Location()),
 	}
 	opts := &options.ReplaceOptions{
 		Upsert: utils.PtrBool(true),
@@ -447,7 +498,7 @@ func (ss *StatService) dailyStatOfAWSCampaignsPageActionNumber(ctx context.Conte
 	if date.Before(time.Date(2023, 10, 26, 0, 0, 0, 0, time.UTC)) {
 		return nil
 	}
-	startAt := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+	startAt := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, date.Location())
 	// endAt := startAt.AddDate(0, 0, 1)
 	visitors, err := plausible.GetVisitors(ctx, "vanus.cn", "/campaigns/aws-smb-hub-2023-11/", startAt.Format("2006-01-02"))
 	if err != nil {
@@ -456,6 +507,7 @@ func (ss *StatService) dailyStatOfAWSCampaignsPageActionNumber(ctx context.Conte
 	daily := &models.DailyStatsOfAWSCampaignsPageActionNumber{
 		Date:                            startAt,
 		Tag:                             UserActionOfAWSCampaignsPage,
+		Timezone:                        startAt.Location().String(),
 		UniqueVisitorNumber:             visitors,
 		TryVanusActionNumber:            0,
 		SignInWithGithubActionNumber:    0,
@@ -464,8 +516,9 @@ func (ss *StatService) dailyStatOfAWSCampaignsPageActionNumber(ctx context.Conte
 		ContactUsActionNumber:           0,
 	}
 	query := bson.M{
-		"date": startAt,
-		"tag":  UserActionOfAWSCampaignsPage,
+		"date":     startAt,
+		"tag":      UserActionOfAWSCampaignsPage,
+		"timezone": timezone.Query(startAt.Location()),
 	}
 	opts := &options.ReplaceOptions{
 		Upsert: utils.PtrBool(true),
@@ -480,13 +533,7 @@ func (ss *StatService) dailyStatOfAWSCampaignsPageActionNumber(ctx context.Conte
 }
 
 func (ss *StatService) GetRegisterUserNumber(ctx context.Context, start, end time.Time) (int64, error) {
-	query := bson.M{
-		"created_at": bson.M{
-			"$gte": start,
-			"$lte": end,
-		},
-	}
-	cnt, err := ss.userColl.CountDocuments(ctx, query)
+	cnt, err := ss.users.CountCreated(ctx, start, end)
 	if err != nil {
 		return 0, err
 	}
@@ -505,8 +552,8 @@ func (ss *StatService) GetLoginUserNumber(ctx context.Context, start, end time.T
 		{
 			{"$match", bson.D{
 				{"time", bson.M{
-					"$gte": start.Format(time.RFC3339),
-					"$lte": end.Format(time.RFC3339),
+					"$gte": start.UTC().Format(time.RFC3339),
+					"$lte": end.UTC().Format(time.RFC3339),
 				}},
 			}},
 		},
@@ -720,8 +767,8 @@ func (ss *StatService) GetTryVanusActionNumber(ctx context.Context, start, end t
 	}
 	query := bson.M{
 		"time": bson.M{
-			"$gte": start.Format(time.RFC3339),
-			"$lte": end.Format(time.RFC3339),
+			"$gte": start.UTC().Format(time.RFC3339),
+			"$lte": end.UTC().Format(time.RFC3339),
 		},
 		"action": "redirect_login",
 		"source": "www.vanus.ai",
@@ -754,8 +801,8 @@ func (ss *StatService) GetSignInActionNumber(ctx context.Context, start, end tim
 	}
 	query := bson.M{
 		"time": bson.M{
-			"$gte": start.Format(time.RFC3339),
-			"$lte": end.Format(time.RFC3339),
+			"$gte": start.UTC().Format(time.RFC3339),
+			"$lte": end.UTC().Format(time.RFC3339),
 		},
 		"action": "redirect_login",
 		"source": "www.vanus.ai",
@@ -786,8 +833,8 @@ func (ss *StatService) GetContactUsActionNumber(ctx context.Context, start, end
 	}
 	query := bson.M{
 		"time": bson.M{
-			"$gte": start.Format(time.RFC3339),
-			"$lte": end.Format(time.RFC3339),
+			"$gte": start.UTC().Format(time.RFC3339),
+			"$lte": end.UTC().Format(time.RFC3339),
 		},
 		"action": "contact",
 		"payload.from": bson.M{
@@ -817,8 +864,8 @@ func (ss *StatService) GetTemplateTryItActionNumber(ctx context.Context, start,
 	}
 	query := bson.M{
 		"time": bson.M{
-			"$gte": start.Format(time.RFC3339),
-			"$lte": end.Format(time.RFC3339),
+			"$gte": start.UTC().Format(time.RFC3339),
+			"$lte": end.UTC().Format(time.RFC3339),
 		},
 		"action": "create_connection_from_landing",
 		"source": "www.vanus.ai",
@@ -834,13 +881,12 @@ func (ss *StatService) GetTemplateTryItActionNumber(ctx context.Context, start,
 	return cnt, nil
 }
 
-func (ss *StatService) rangeUserStat(ctx context.Context, start int64, end int64, now time.Time) {
+func (ss *StatService) rangeUserStat(ctx context.Context, start int64, end int64, now time.Time, erased map[string]struct{}) {
 	var (
 		reterr error
-		cnt    int    = 0
-		skip   int64  = start
-		limit  int64  = end - start
-		sort   bson.M = bson.M{"created_at": 1}
+		cnt    int   = 0
+		skip   int64 = start
+		limit  int64 = end - start
 	)
 	// log.Info(ctx).Msgf("start goroutine for range refresh, start: %d, end: %d\n", start, end)
 	defer ss.wg.Done()
@@ -850,88 +896,88 @@ func (ss *StatService) rangeUserStat(ctx context.Context, start int64, end int64
 		}
 		log.Info(ctx).Msgf("finish goroutine for range[%d, %d] refresh, %d completed, %d remaining.\n", start, end, cnt, (limit - int64(cnt)))
 	}()
-	query := bson.M{}
-	opt := options.FindOptions{
-		Limit: &limit,
-		Skip:  &skip,
-		Sort:  sort,
-	}
-	cursor, err := ss.userColl.Find(ctx, query, &opt)
-	if err != nil {
-		reterr = err
-		log.Error(ctx).Err(err).Msg("failed to find user")
-		return
-	}
-	defer func() {
-		_ = cursor.Close(ctx)
-	}()
-
-	for cursor.Next(ctx) {
-		user := &cloud.User{}
-		if err = cursor.Decode(user); err != nil {
-			reterr = err
-			log.Error(ctx).Err(err).Msg("failed to decode user")
-			return
-		}
+	reterr = ss.users.Range(ctx, skip, limit, func(user *cloud.User) error {
 		cnt += 1
-		bills, err := ss.getBills(ctx, user.OID, now)
-		if err != nil {
-			reterr = err
-			log.Error(ctx).Err(err).Msg("failed to get bills")
-			return
-		}
-		class, err := ss.getClass(ctx, user.OID, now)
-		if err != nil {
-			reterr = err
-			log.Error(ctx).Err(err).Msg("failed to get class")
-			return
-		}
-		usage, err := ss.getUsages(ctx, user.OID)
-		if err != nil {
-			reterr = err
-			log.Error(ctx).Err(err).Msg("failed to get usages")
-			return
-		}
-		cohort, err := ss.GetCohort(ctx, user)
-		if err != nil {
-			reterr = err
-			log.Error(ctx).Err(err).Msg("failed to get cohort")
-			return
-		}
-		user.Base.UpdatedAt = now
-		statUser := &models.User{
-			Base:         user.Base,
-			OID:          user.OID,
-			Phone:        user.Phone,
-			Email:        user.Email,
-			Country:      user.Country,
-			FamilyName:   user.FamilyName,
-			GivenName:    user.GivenName,
-			NickName:     user.NickName,
-			CompanyName:  user.CompanyName,
-			CompanyEmail: user.CompanyEmail,
-			Industry:     ss.GetUserIndustry(ctx, user),
-			Ref:          user.Ref,
-			RefHost:      user.RefHost,
-			Class:        class,
-			Bills:        bills,
-			Usages:       usage,
-			Cohort:       cohort,
-		}
-		query := bson.M{
-			"_id": user.ID,
-		}
-		opts := &options.ReplaceOptions{
-			Upsert: utils.PtrBool(true),
-		}
-		_, err = ss.userStatColl.ReplaceOne(ctx, query, statUser, opts)
-		if err != nil {
-			reterr = err
-			log.Error(ctx).Err(err).Msg("failed to insert stat user")
-			return
+		if _, ok := erased[user.OID]; ok {
+			return nil
 		}
 		// log.Info(ctx).Msgf("[%d] spent %d ms to refresh user stat: %s\n", cnt, time.Since(start).Milliseconds(), user.OID)
+		return ss.refreshUser(ctx, user, now)
+	})
+}
+
+// refreshUser recomputes the stat user of the user and replaces it.
+func (ss *StatService) refreshUser(ctx context.Context, user *cloud.User, now time.Time) error {
+	bills, err := ss.getBills(ctx, user.OID, now)
+	if err != nil {
+		log.Error(ctx).Err(err).Msg("failed to get bills")
+		return err
+	}
+	class, err := ss.getClass(ctx, user.OID, now)
+	if err != nil {
+		log.Error(ctx).Err(err).Msg("failed to get class")
+		return err
+	}
+	usage, err := ss.getUsages(ctx, user.OID)
+	if err != nil {
+		log.Error(ctx).Err(err).Msg("failed to get usages")
+		return err
+	}
+	cohort, err := ss.GetCohort(ctx, user)
+	if err != nil {
+		log.Error(ctx).Err(err).Msg("failed to get cohort")
+		return err
 	}
+	forecasts, err := ss.getForecasts(ctx, user.OID, bills, now)
+	if err != nil {
+		log.Error(ctx).Err(err).Msg("failed to get forecasts")
+		return err
+	}
+	stored, err := ss.getStoredActivation(ctx, user.OID)
+	if err != nil {
+		log.Error(ctx).Err(err).Msg("failed to get stored activation")
+		return err
+	}
+	activation, err := ss.getActivation(ctx, user.OID, stored)
+	if err != nil {
+		log.Error(ctx).Err(err).Msg("failed to get activation")
+		return err
+	}
+	user.Base.UpdatedAt = now
+	statUser := &models.User{
+		Base:         user.Base,
+		OID:          user.OID,
+		Phone:        user.Phone,
+		Email:        user.Email,
+		Country:      user.Country,
+		FamilyName:   user.FamilyName,
+		GivenName:    user.GivenName,
+		NickName:     user.NickName,
+		CompanyName:  user.CompanyName,
+		CompanyEmail: user.CompanyEmail,
+		Industry:     ss.GetUserIndustry(ctx, user),
+		Ref:          user.Ref,
+		RefHost:      user.RefHost,
+		Class:        class,
+		Bills:        bills,
+		Usages:       usage,
+		Cohort:       cohort,
+		Forecasts:    forecasts,
+		Activation:   activation,
+		Timezone:     timezone.Reporting().String(),
+	}
+	query := bson.M{
+		"_id": user.ID,
+	}
+	opts := &options.ReplaceOptions{
+		Upsert: utils.PtrBool(true),
+	}
+	_, err = ss.userStatColl.ReplaceOne(ctx, query, statUser, opts)
+	if err != nil {
+		log.Error(ctx).Err(err).Msg("failed to insert stat user")
+		return err
+	}
+	return nil
 }
 
 func (ss *StatService) getLastStatTime(ctx context.Context) (time.Time, error) {
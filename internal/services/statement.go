@@ -0,0 +1,307 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/jyjiangkai/stat/api"
+	"github.com/jyjiangkai/stat/db"
+	"github.com/jyjiangkai/stat/models"
+	"github.com/jyjiangkai/stat/models/cloud"
+	"github.com/jyjiangkai/stat/pdf"
+	"github.com/jyjiangkai/stat/timezone"
+)
+
+const (
+	StatementFormatOfHTML = "html"
+	StatementFormatOfPDF  = "pdf"
+
+	statementMonthLayout = "2006-01"
+	statementDateLayout  = "2006-01-02"
+)
+
+// Statement builds the usage statement of the user for the month, which is
+// formatted as 2006-01, from the AI and Connect details of UserService.Get
+// with the bills out of the month left out.
+func (us *UserService) Statement(ctx context.Context, oid string, month string) (*models.Statement, error) {
+	start, err := time.ParseInLocation(statementMonthLayout, month, timezone.Of(ctx))
+	if err != nil {
+		return nil, api.ErrInvalidParameter.WithMessage(fmt.Sprintf("invalid month %s, the format is YYYY-MM", month))
+	}
+	end := start.AddDate(0, 1, 0)
+
+	user, err := us.userStats.Get(ctx, oid)
+	if err != nil {
+		return nil, db.HandleDBError(err)
+	}
+	if user == nil {
+		return nil, api.ErrResourceNotFound.WithMessage(fmt.Sprintf("user %s not found", oid))
+	}
+	detail, err := us.Get(ctx, oid, &api.GetOptions{
+		Start:       start.Format(detailDateLayout),
+		End:         end.AddDate(0, 0, -1).Format(detailDateLayout),
+		Granularity: GranularityOfDay,
+	})
+	if err != nil {
+		return nil, err
+	}
+	payments, err := us.payments.List(ctx, oid, start, end)
+	if err != nil {
+		return nil, db.HandleDBError(err)
+	}
+	credits, err := us.getStatementCredits(ctx, oid, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	statement := &models.Statement{
+		OID:         oid,
+		Email:       user.Email,
+		CompanyName: user.CompanyName,
+		Month:       month,
+		Start:       start,
+		End:         end,
+		Class:       user.Class,
+		Payments:    payments,
+		Credits:     credits,
+		AI: &models.UserAIDetail{
+			Apps: make([]*models.App, 0),
+		},
+		Connect: &models.UserConnectDetail{
+			Connections: make([]*models.Connection, 0),
+		},
+		GeneratedAt: time.Now(),
+	}
+	statement.AI.Bills, statement.AI.TotalUsage = billsInMonth(detail.AI.Bills, start, end)
+	for _, app := range detail.AI.Apps {
+		app.Bills, app.TotalUsage = billsInMonth(app.Bills, start, end)
+		statement.AI.Apps = append(statement.AI.Apps, app)
+	}
+	statement.Connect.Bills, statement.Connect.TotalUsage = billsInMonth(detail.Connect.Bills, start, end)
+	for _, connection := range detail.Connect.Connections {
+		connection.Bills, connection.TotalUsage = billsInMonth(connection.Bills, start, end)
+		statement.Connect.Connections = append(statement.Connect.Connections, connection)
+	}
+	return statement, nil
+}
+
+func billsInMonth(bills []models.Bill, start, end time.Time) ([]models.Bill, uint64) {
+	result := make([]models.Bill, 0)
+	total := uint64(0)
+	for _, bill := range bills {
+		if bill.Date.Before(start) || !bill.Date.Before(end) {
+			continue
+		}
+		result = append(result, bill)
+		total += bill.Usage
+	}
+	return result, total
+}
+
+func (us *UserService) getStatementCredits(ctx context.Context, oid string, start, end time.Time) ([]*models.StatementCredits, error) {
+	query := bson.M{
+		"user_id": oid,
+		"period_of_validity.start": bson.M{
+			"$lt": end,
+		},
+		"period_of_validity.end": bson.M{
+			"$gt": start,
+		},
+	}
+	opt := options.FindOptions{
+		Sort: bson.M{"period_of_validity.start": 1},
+	}
+	cursor, err := us.creditColl.Find(ctx, query, &opt)
+	if err != nil {
+		return nil, db.HandleDBError(err)
+	}
+	defer func() {
+		_ = cursor.Close(ctx)
+	}()
+	credits := make([]*models.StatementCredits, 0)
+	for cursor.Next(ctx) {
+		credit := &cloud.UserCredits{}
+		if err = cursor.Decode(credit); err != nil {
+			return nil, db.HandleDBError(err)
+		}
+		credits = append(credits, &models.StatementCredits{
+			Type:  string(credit.Type),
+			Used:  credit.Used,
+			Total: credit.Total,
+			Start: credit.PeriodOfValidity.Start,
+			End:   credit.PeriodOfValidity.End,
+		})
+	}
+	return credits, nil
+}
+
+// Render encodes the statement in the format, which is html or pdf, and
+// returns the content type along with the content.
+func (us *UserService) Render(statement *models.Statement, format string) (string, []byte, error) {
+	switch format {
+	case "", StatementFormatOfHTML:
+		buf := &bytes.Buffer{}
+		if err := statementTemplate.Execute(buf, statement); err != nil {
+			return "", nil, err
+		}
+		return "text/html; charset=utf-8", buf.Bytes(), nil
+	case StatementFormatOfPDF:
+		data, err := renderStatementPDF(statement)
+		if err != nil {
+			return "", nil, api.ErrInternal.WithError(err)
+		}
+		return "application/pdf", data, nil
+	}
+	return "", nil, api.ErrInvalidParameter.WithMessage("unsupported format " + format)
+}
+
+func planOf(level *models.Level) string {
+	if level == nil || !level.Premium || level.Plan == nil {
+		return "Free"
+	}
+	return fmt.Sprintf("%s (level %d)", level.Plan.Type, level.Plan.Level)
+}
+
+func paymentRow(payment *models.Payment) []string {
+	row := []string{payment.CreatedAt.Format(statementDateLayout), payment.Kind, payment.Desc, payment.Currency, "", "", ""}
+	if payment.Amount != nil {
+		row[4] = fmt.Sprintf("%.2f", payment.Amount.Total)
+		row[5] = fmt.Sprintf("%.2f", payment.Amount.Discount)
+		row[6] = fmt.Sprintf("%.2f", payment.Amount.Payable)
+	}
+	return row
+}
+
+func billRows(bills []models.Bill) [][]string {
+	rows := make([][]string, 0, len(bills))
+	for _, bill := range bills {
+		rows = append(rows, []string{bill.Date.Format(statementDateLayout), fmt.Sprintf("%d", bill.Usage)})
+	}
+	return rows
+}
+
+func renderStatementPDF(statement *models.Statement) ([]byte, error) {
+	doc := pdf.New()
+	doc.Title(fmt.Sprintf("Usage statement %s", statement.Month))
+	doc.Text(fmt.Sprintf("Account: %s  %s  %s", statement.Email, statement.CompanyName, statement.OID))
+	doc.Text(fmt.Sprintf("Period: %s to %s", statement.Start.Format(statementDateLayout), statement.End.AddDate(0, 0, -1).Format(statementDateLayout)))
+	doc.Text(fmt.Sprintf("Generated at: %s", statement.GeneratedAt.UTC().Format(time.RFC3339)))
+
+	doc.Heading("Plan")
+	class := statement.Class
+	if class == nil {
+		class = &models.Class{}
+	}
+	doc.Table([]string{"Product", "Plan"}, [][]string{
+		{"AI", planOf(class.AI)},
+		{"Connect", planOf(class.Connect)},
+	})
+
+	doc.Heading("Payments")
+	payments := make([][]string, 0, len(statement.Payments))
+	for _, payment := range statement.Payments {
+		payments = append(payments, paymentRow(payment))
+	}
+	doc.Table([]string{"Date", "Kind", "Description", "Currency", "Total", "Discount", "Payable"}, payments)
+
+	doc.Heading("Credits")
+	credits := make([][]string, 0, len(statement.Credits))
+	for _, credit := range statement.Credits {
+		credits = append(credits, []string{credit.Type, fmt.Sprintf("%d", credit.Used), fmt.Sprintf("%d", credit.Total),
+			credit.Start.Format(statementDateLayout), credit.End.Format(statementDateLayout)})
+	}
+	doc.Table([]string{"Type", "Used", "Total", "Start", "End"}, credits)
+
+	doc.Heading(fmt.Sprintf("AI usage: %d credits", statement.AI.TotalUsage))
+	apps := make([][]string, 0, len(statement.AI.Apps))
+	for _, app := range statement.AI.Apps {
+		apps = append(apps, []string{app.Name, app.Type, app.Model, app.Status, fmt.Sprintf("%d", app.TotalUsage)})
+	}
+	doc.Table([]string{"App", "Type", "Model", "Status", "Usage"}, apps)
+	doc.Table([]string{"Date", "Credits"}, billRows(statement.AI.Bills))
+
+	doc.Heading(fmt.Sprintf("Connect usage: %d events", statement.Connect.TotalUsage))
+	connections := make([][]string, 0, len(statement.Connect.Connections))
+	for _, connection := range statement.Connect.Connections {
+		connections = append(connections, []string{connection.Name, connection.SourceType, connection.SinkType,
+			connection.Status, fmt.Sprintf("%d", connection.TotalUsage)})
+	}
+	doc.Table([]string{"Connection", "Source", "Sink", "Status", "Usage"}, connections)
+	doc.Table([]string{"Date", "Events"}, billRows(statement.Connect.Bills))
+	return doc.Bytes()
+}
+
+var statementTemplate = template.Must(template.New("statement").Funcs(template.FuncMap{
+	"date": func(t time.Time) string {
+		return t.Format(statementDateLayout)
+	},
+	"last": func(t time.Time) string {
+		return t.AddDate(0, 0, -1).Format(statementDateLayout)
+	},
+	"plan": planOf,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Usage statement {{.Month}}</title>
+<style>
+body { font-family: Helvetica, Arial, sans-serif; font-size: 13px; margin: 32px; }
+table { border-collapse: collapse; margin: 8px 0 16px; }
+th, td { border: 1px solid #ddd; padding: 4px 10px; text-align: left; }
+th { background: #f5f5f5; }
+</style>
+</head>
+<body>
+<h1>Usage statement {{.Month}}</h1>
+<p>Account: {{.Email}} {{.CompanyName}} ({{.OID}})<br>
+Period: {{date .Start}} to {{last .End}}<br>
+Generated at: {{.GeneratedAt.UTC.Format "2006-01-02T15:04:05Z07:00"}}</p>
+
+<h2>Plan</h2>
+<table>
+<tr><th>Product</th><th>Plan</th></tr>
+{{with .Class}}<tr><td>AI</td><td>{{plan .AI}}</td></tr>
+<tr><td>Connect</td><td>{{plan .Connect}}</td></tr>{{else}}<tr><td>AI</td><td>Free</td></tr>
+<tr><td>Connect</td><td>Free</td></tr>{{end}}
+</table>
+
+<h2>Payments</h2>
+<table>
+<tr><th>Date</th><th>Kind</th><th>Description</th><th>Currency</th><th>Total</th><th>Discount</th><th>Payable</th></tr>
+{{range .Payments}}<tr><td>{{date .CreatedAt}}</td><td>{{.Kind}}</td><td>{{.Desc}}</td><td>{{.Currency}}</td>{{with .Amount}}<td>{{printf "%.2f" .Total}}</td><td>{{printf "%.2f" .Discount}}</td><td>{{printf "%.2f" .Payable}}</td>{{else}}<td></td><td></td><td></td>{{end}}</tr>
+{{end}}</table>
+
+<h2>Credits</h2>
+<table>
+<tr><th>Type</th><th>Used</th><th>Total</th><th>Start</th><th>End</th></tr>
+{{range .Credits}}<tr><td>{{.Type}}</td><td>{{.Used}}</td><td>{{.Total}}</td><td>{{date .Start}}</td><td>{{date .End}}</td></tr>
+{{end}}</table>
+
+<h2>AI usage: {{.AI.TotalUsage}} credits</h2>
+<table>
+<tr><th>App</th><th>Type</th><th>Model</th><th>Status</th><th>Usage</th></tr>
+{{range .AI.Apps}}<tr><td>{{.Name}}</td><td>{{.Type}}</td><td>{{.Model}}</td><td>{{.Status}}</td><td>{{.TotalUsage}}</td></tr>
+{{end}}</table>
+<table>
+<tr><th>Date</th><th>Credits</th></tr>
+{{range .AI.Bills}}<tr><td>{{date .Date}}</td><td>{{.Usage}}</td></tr>
+{{end}}</table>
+
+<h2>Connect usage: {{.Connect.TotalUsage}} events</h2>
+<table>
+<tr><th>Connection</th><th>Source</th><th>Sink</th><th>Status</th><th>Usage</th></tr>
+{{range .Connect.Connections}}<tr><td>{{.Name}}</td><td>{{.SourceType}}</td><td>{{.SinkType}}</td><td>{{.Status}}</td><td>{{.TotalUsage}}</td></tr>
+{{end}}</table>
+<table>
+<tr><th>Date</th><th>Events</th></tr>
+{{range .Connect.Bills}}<tr><td>{{date .Date}}</td><td>{{.Usage}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
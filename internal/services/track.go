@@ -9,15 +9,18 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 
 	"github.com/jyjiangkai/stat/db"
+	"github.com/jyjiangkai/stat/internal/repository"
 	"github.com/jyjiangkai/stat/log"
 	"github.com/jyjiangkai/stat/models"
+	"github.com/jyjiangkai/stat/timezone"
 	"github.com/jyjiangkai/stat/utils"
 )
 
 type TrackService struct {
 	cli             *mongo.Client
-	paymentColl     *mongo.Collection
-	statColl        *mongo.Collection
+	payments        repository.PaymentRepository
+	userStats       repository.UserStatRepository
+	actions         repository.ActionRepository
 	weeklyTrackColl *mongo.Collection
 	actionColl      *mongo.Collection
 	userTrackColl   *mongo.Collection
@@ -27,8 +30,9 @@ type TrackService struct {
 func NewTrackService(cli *mongo.Client) *TrackService {
 	return &TrackService{
 		cli:             cli,
-		paymentColl:     cli.Database(db.GetDatabaseName()).Collection("payments"),
-		statColl:        cli.Database(DatabaseOfUserStatistics).Collection("user_stats"),
+		payments:        repository.NewMongoPaymentRepository(cli.Database(db.GetDatabaseName()).Collection("payments")),
+		userStats:       repository.NewMongoUserStatRepository(cli.Database(DatabaseOfUserStatistics).Collection("user_stats")),
+		actions:         repository.NewMongoActionRepository(cli.Database(DatabaseOfUserAnalytics).Collection("user_actions")),
 		weeklyTrackColl: cli.Database(DatabaseOfUserStatistics).Collection("weekly_track"),
 		actionColl:      cli.Database(DatabaseOfUserAnalytics).Collection("user_actions"),
 		userTrackColl:   cli.Database(DatabaseOfUserAnalytics).Collection("user_tracks"),
@@ -62,7 +66,7 @@ func (ts *TrackService) Start() error {
 
 func (ts *TrackService) weeklyNoKnowledgeBaseUserTracking(ctx context.Context, now time.Time) error {
 	log.Info(ctx).Msgf("start stat weekly no knowledge user tracking at: %+v\n", now)
-	week := TimeToWeek(now)
+	week := TimeToWeek(now.In(timezone.Reporting()))
 	query := bson.M{
 		"tag":  UserTypeOfNoKnownledgeBase,
 		"time": week.Start,
@@ -121,10 +125,12 @@ func (ts *TrackService) weeklyNoKnowledgeBaseUserTracking(ctx context.Context, n
 		KnowledgeBaseNum: kbNum,
 		ViewPriceNum:     vpriceNum,
 		PremiumNum:       premiumNum,
+		Timezone:         week.Start.Location().String(),
 	}
 	queryWeeklyUserTrack := bson.M{
 		"week.alias": week.Alias,
 		"tag":        UserTypeOfNoKnownledgeBase,
+		"timezone":   timezone.Query(week.Start.Location()),
 	}
 	opts := &options.ReplaceOptions{
 		Upsert: utils.PtrBool(true),
@@ -140,7 +146,7 @@ func (ts *TrackService) weeklyNoKnowledgeBaseUserTracking(ctx context.Context, n
 
 func (ts *TrackService) weeklyHighKnowledgeBaseUserTracking(ctx context.Context, now time.Time) error {
 	log.Info(ctx).Msgf("start stat weekly high knowledge user tracking at: %+v\n", now)
-	week := TimeToWeek(now)
+	week := TimeToWeek(now.In(timezone.Reporting()))
 	query := bson.M{
 		"tag":  UserTypeOfHighKnownledgeBase,
 		"time": week.Start,
@@ -194,10 +200,12 @@ func (ts *TrackService) weeklyHighKnowledgeBaseUserTracking(ctx context.Context,
 		KnowledgeBaseNum: kbNum,
 		ViewPriceNum:     vpriceNum,
 		PremiumNum:       premiumNum,
+		Timezone:         week.Start.Location().String(),
 	}
 	queryWeeklyUserTrack := bson.M{
 		"week.alias": week.Alias,
 		"tag":        UserTypeOfHighKnownledgeBase,
+		"timezone":   timezone.Query(week.Start.Location()),
 	}
 	opts := &options.ReplaceOptions{
 		Upsert: utils.PtrBool(true),
@@ -213,7 +221,7 @@ func (ts *TrackService) weeklyHighKnowledgeBaseUserTracking(ctx context.Context,
 
 func (ts *TrackService) weeklyViewPriceUserTracking(ctx context.Context, now time.Time) error {
 	log.Info(ctx).Msgf("start stat weekly view price user tracking at: %+v\n", now)
-	week := TimeToWeek(now)
+	week := TimeToWeek(now.In(timezone.Reporting()))
 	query := bson.M{
 		"tag":  ActionTypeOfRedirectChangePlan,
 		"time": week.Start,
@@ -267,10 +275,12 @@ func (ts *TrackService) weeklyViewPriceUserTracking(ctx context.Context, now tim
 		KnowledgeBaseNum: kbNum,
 		ViewPriceNum:     vpriceNum,
 		PremiumNum:       premiumNum,
+		Timezone:         week.Start.Location().String(),
 	}
 	queryWeeklyUserTrack := bson.M{
 		"week.alias": week.Alias,
 		"tag":        ActionTypeOfRedirectChangePlan,
+		"timezone":   timezone.Query(week.Start.Location()),
 	}
 	opts := &options.ReplaceOptions{
 		Upsert: utils.PtrBool(true),
@@ -285,94 +295,42 @@ func (ts *TrackService) weeklyViewPriceUserTracking(ctx context.Context, now tim
 }
 
 func (ts *TrackService) checkLogin(ctx context.Context, oid string, start time.Time) bool {
-	query := bson.M{
-		"usersub": oid,
-		"time": bson.M{
-			"$gte": start.Format(time.RFC3339),
-		},
-	}
-	result := ts.actionColl.FindOne(ctx, query)
-	if result.Err() != nil {
-		if result.Err() == mongo.ErrNoDocuments {
-			return false
-		}
-		log.Error(ctx).Err(result.Err()).Str("user", oid).Msg("failed to check user login")
-		return false
-	}
-	return true
+	return ts.checkAction(ctx, oid, "", start, "failed to check user login")
 }
 
 func (ts *TrackService) checkViewPrice(ctx context.Context, oid string, start time.Time) bool {
-	query := bson.M{
-		"usersub": oid,
-		"action":  ActionTypeOfRedirectChangePlan,
-		"time": bson.M{
-			"$gte": start.Format(time.RFC3339),
-		},
-	}
-	result := ts.actionColl.FindOne(ctx, query)
-	if result.Err() != nil {
-		if result.Err() == mongo.ErrNoDocuments {
-			return false
-		}
-		log.Error(ctx).Err(result.Err()).Str("user", oid).Msg("failed to check user view price")
-		return false
-	}
-	return true
+	return ts.checkAction(ctx, oid, ActionTypeOfRedirectChangePlan, start, "failed to check user view price")
 }
 
 func (ts *TrackService) checkPay(ctx context.Context, oid string, start time.Time) bool {
-	query := bson.M{
-		"created_by": oid,
-		"created_at": bson.M{
-			"$gte": start,
-		},
-	}
-	result := ts.paymentColl.FindOne(ctx, query)
-	if result.Err() != nil {
-		if result.Err() == mongo.ErrNoDocuments {
-			return false
-		}
-		log.Error(ctx).Err(result.Err()).Str("user", oid).Msg("failed to check user pay")
+	paid, err := ts.payments.ExistsSince(ctx, oid, start)
+	if err != nil {
+		log.Error(ctx).Err(err).Str("user", oid).Msg("failed to check user pay")
 		return false
 	}
-	return true
+	return paid
 }
 
 func (ts *TrackService) checkViewKnowledge(ctx context.Context, oid string, start time.Time) bool {
-	query := bson.M{
-		"usersub": oid,
-		"action":  ActionTypeOfSwitchSidebarKnowledge,
-		"time": bson.M{
-			"$gte": start.Format(time.RFC3339),
-		},
-	}
-	result := ts.actionColl.FindOne(ctx, query)
-	if result.Err() != nil {
-		if result.Err() == mongo.ErrNoDocuments {
-			return false
-		}
-		log.Error(ctx).Err(result.Err()).Str("user", oid).Msg("failed to check user view knowledge")
+	return ts.checkAction(ctx, oid, ActionTypeOfSwitchSidebarKnowledge, start, "failed to check user view knowledge")
+}
+
+func (ts *TrackService) checkAction(ctx context.Context, oid, action string, start time.Time, msg string) bool {
+	exist, err := ts.actions.Exists(ctx, oid, action, start)
+	if err != nil {
+		log.Error(ctx).Err(err).Str("user", oid).Msg(msg)
 		return false
 	}
-	return true
+	return exist
 }
 
 func (ts *TrackService) checkKnowledgeBase(ctx context.Context, oid string) bool {
-	query := bson.M{
-		"oidc_id": oid,
-	}
-	result := ts.statColl.FindOne(ctx, query)
-	if result.Err() != nil {
-		if result.Err() == mongo.ErrNoDocuments {
-			return false
-		}
-		log.Error(ctx).Err(result.Err()).Str("user", oid).Msg("failed to check knowledge base")
+	user, err := ts.userStats.Get(ctx, oid)
+	if err != nil {
+		log.Error(ctx).Err(err).Str("user", oid).Msg("failed to check knowledge base")
 		return false
 	}
-	user := &models.User{}
-	if err := result.Decode(user); err != nil {
-		log.Error(ctx).Err(err).Str("user", oid).Msg("failed to decode user")
+	if user == nil || user.Usages == nil || user.Usages.AI == nil {
 		return false
 	}
 	return user.Usages.AI.KnowledgeBase > 0
@@ -12,10 +12,13 @@ import (
 
 	"github.com/jyjiangkai/stat/api"
 	"github.com/jyjiangkai/stat/db"
+	"github.com/jyjiangkai/stat/internal/repository"
 	"github.com/jyjiangkai/stat/log"
 	"github.com/jyjiangkai/stat/mailchimp"
 	"github.com/jyjiangkai/stat/models"
 	"github.com/jyjiangkai/stat/models/cloud"
+	"github.com/jyjiangkai/stat/timezone"
+	"github.com/jyjiangkai/stat/utils"
 )
 
 const (
@@ -32,6 +35,8 @@ const (
 	UserTypeOfHighKnownledgeBase             = "high_knowledge_base"
 	UserTypeOfCohort                         = "cohort"
 	UserTypeOfDailyUserNumber                = "daily_user_number"
+	UserTypeOfChurnRisk                      = "churn_risk"
+	UserTypeOfExhausting                     = "exhausting"
 )
 
 var (
@@ -51,11 +56,21 @@ type UserService struct {
 	connectorColl       *mongo.Collection
 	connectionColl      *mongo.Collection
 	userStatColl        *mongo.Collection
+	historyColl         *mongo.Collection
 	dailyStatColl       *mongo.Collection
 	cohortColl          *mongo.Collection
 	creditColl          *mongo.Collection
 	actionColl          *mongo.Collection
 	trackColl           *mongo.Collection
+	apps                repository.AppRepository
+	connections         repository.ConnectionRepository
+	bills               repository.BillRepository
+	aiBills             repository.AIBillRepository
+	payments            repository.PaymentRepository
+	userStats           repository.UserStatRepository
+	churn               *ChurnService
+	connectors          *lookupCache
+	connectorsCheckedAt time.Time
 	closeC              chan struct{}
 }
 
@@ -73,16 +88,43 @@ func NewUserService(cli *mongo.Client) *UserService {
 		connectionColl:      cli.Database(db.GetDatabaseName()).Collection("connections"),
 		creditColl:          cli.Database(db.GetDatabaseName()).Collection("credits"),
 		userStatColl:        cli.Database(DatabaseOfUserStatistics).Collection("user_stats"),
+		historyColl:         cli.Database(DatabaseOfUserStatistics).Collection("user_stat_history"),
 		dailyStatColl:       cli.Database(DatabaseOfUserStatistics).Collection("daily_stats"),
 		cohortColl:          cli.Database(DatabaseOfUserStatistics).Collection("weekly_cohort"),
 		actionColl:          cli.Database(DatabaseOfUserAnalytics).Collection("user_actions"),
 		trackColl:           cli.Database(DatabaseOfUserAnalytics).Collection("user_tracks"),
+		apps:                repository.NewMongoAppRepository(cli.Database(db.GetDatabaseName()).Collection("ai_app")),
+		connections:         repository.NewMongoConnectionRepository(cli.Database(db.GetDatabaseName()).Collection("connections")),
+		bills:               repository.NewMongoBillRepository(cli.Database(db.GetDatabaseName()).Collection("bills")),
+		aiBills:             repository.NewMongoAIBillRepository(cli.Database(db.GetDatabaseName()).Collection("ai_bills")),
+		payments:            repository.NewMongoPaymentRepository(cli.Database(db.GetDatabaseName()).Collection("payments")),
+		userStats:           repository.NewMongoUserStatRepository(cli.Database(DatabaseOfUserStatistics).Collection("user_stats")),
+		churn:               NewChurnService(cli),
+		connectors:          newLookupCache(LookupCacheSize, LookupCacheTTL),
+		connectorsCheckedAt: time.Now(),
 		closeC:              make(chan struct{}),
 	}
 }
 
 func (us *UserService) Start() error {
 	ctx := context.Background()
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		defer log.Warn(ctx).Err(nil).Msg("connector invalidation routine exit")
+		for {
+			select {
+			case <-us.closeC:
+				log.Info(ctx).Msg("user service stopped.")
+				return
+			case <-ticker.C:
+				err := us.invalidateUpdatedConnectors(ctx)
+				if err != nil {
+					log.Error(ctx).Err(err).Msgf("failed to invalidate updated connectors at %+v", time.Now())
+				}
+			}
+		}
+	}()
 	go func() {
 		ticker := time.NewTicker(time.Hour)
 		defer ticker.Stop()
@@ -124,7 +166,7 @@ func (us *UserService) weeklyNoKnownledgeBaseUserTracking(ctx context.Context, n
 			User:  user.OID,
 			Tag:   UserTypeOfNoKnownledgeBase,
 			Count: 0,
-			Time:  time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC),
+			Time:  utils.ToBillTimeForAI(now, timezone.Reporting()),
 		}
 		_, err := us.trackColl.InsertOne(ctx, track)
 		if err != nil {
@@ -164,7 +206,7 @@ func (us *UserService) weeklyHighKnownledgeBaseUserTracking(ctx context.Context,
 			User:  user.OID,
 			Tag:   UserTypeOfHighKnownledgeBase,
 			Count: 0,
-			Time:  time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC),
+			Time:  utils.ToBillTimeForAI(now, timezone.Reporting()),
 		}
 		_, err := us.trackColl.InsertOne(ctx, track)
 		if err != nil {
@@ -190,6 +232,47 @@ func (us *UserService) Stop() error {
 
 func (us *UserService) List(ctx context.Context, pg api.Page, req api.Request, opts *api.ListOptions) (*api.ListResult, error) {
 	log.Info(ctx).Any("page", pg).Any("request", req).Any("opts", opts).Msg("user service list api")
+	result, err := us.listByType(ctx, pg, req, opts)
+	if err != nil || opts.Currency == "" {
+		return result, err
+	}
+	for _, item := range result.List {
+		var class *models.Class
+		switch user := item.(type) {
+		case *models.User:
+			class = user.Class
+		case *models.ChurnRisk:
+			class = user.Class
+		}
+		// the requested currency is validated by the controller, a failure
+		// is a stored payment in a currency without a rate
+		if err = convertClass(class, opts.Currency); err != nil {
+			log.Error(ctx).Err(err).Str("currency", opts.Currency).Msg("failed to convert the payments of the user")
+			return nil, api.ErrInternal.WithError(err)
+		}
+	}
+	return result, nil
+}
+
+func convertClass(class *models.Class, to string) error {
+	if class == nil {
+		return nil
+	}
+	for _, level := range []*models.Level{class.AI, class.Connect} {
+		if level == nil {
+			continue
+		}
+		if err := convertPayment(level.Payment, to); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (us *UserService) listByType(ctx context.Context, pg api.Page, req api.Request, opts *api.ListOptions) (*api.ListResult, error) {
+	if opts.AsOf != "" && opts.TypeSelector != "" && opts.TypeSelector != UserTypeOfPremium {
+		return nil, api.ErrInvalidParameter.WithMessage("as_of isn't supported by the user type " + opts.TypeSelector)
+	}
 	switch opts.TypeSelector {
 	case UserTypeOfRegister, UserTypeOfRegisterFromShopifyLandingPage, UserTypeOfRegisterFromGithubLandingPage, UserTypeOfRegisterFromAWSCampaignsPage, UserTypeOfLogin, UserTypeOfCreated, UserTypeOfUsed, UserTypeOfConnectionTemplateCreated:
 		return us.listSpecifiedUsers(ctx, pg, req, opts)
@@ -203,6 +286,10 @@ func (us *UserService) List(ctx context.Context, pg api.Page, req api.Request, o
 		return us.listCohortUsers(ctx, pg, opts)
 	case UserTypeOfDailyUserNumber:
 		return us.listDailyUserNumber(ctx, pg, opts)
+	case UserTypeOfChurnRisk:
+		return us.churn.List(ctx, pg, opts)
+	case UserTypeOfExhausting:
+		return us.listExhaustingUsers(ctx, pg, req.FilterStack, opts)
 	default:
 		return us.list(ctx, pg, req.FilterStack, opts)
 	}
@@ -219,14 +306,12 @@ func (us *UserService) list(ctx context.Context, pg api.Page, filters api.Filter
 		skip = 0
 	}
 
-	query := addFilter(ctx, filters)
-	if opts.KindSelector == "ai" {
-		query["usages.ai.app"] = bson.M{"$ne": 0}
-	} else if opts.KindSelector == "connect" {
-		query["usages.connect.connection"] = bson.M{"$ne": 0}
+	coll, query, err := us.statQuery(listQuery(ctx, filters, opts), opts)
+	if err != nil {
+		return nil, err
 	}
 	log.Info(ctx).Any("query", query).Msg("show user list api query criteria")
-	cnt, err := us.userStatColl.CountDocuments(ctx, query)
+	cnt, err := coll.CountDocuments(ctx, query)
 	if err != nil {
 		return nil, err
 	}
@@ -252,7 +337,7 @@ func (us *UserService) list(ctx context.Context, pg api.Page, filters api.Filter
 		Skip:  &skip,
 		Sort:  sort,
 	}
-	cursor, err := us.userStatColl.Find(ctx, query, &opt)
+	cursor, err := coll.Find(ctx, query, &opt)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			return &api.ListResult{
@@ -279,6 +364,69 @@ func (us *UserService) list(ctx context.Context, pg api.Page, filters api.Filter
 	}, nil
 }
 
+// Count counts the users of the types read from user_stats, as of a day
+// when opts.AsOf is given.
+func (us *UserService) Count(ctx context.Context, req api.Request, opts *api.ListOptions) (*api.CountResult, error) {
+	var query bson.M
+	switch opts.TypeSelector {
+	case "":
+		query = listQuery(ctx, req.FilterStack, opts)
+	case UserTypeOfPremium:
+		query = premiumQuery(ctx, req.FilterStack, opts)
+	default:
+		return nil, api.ErrInvalidParameter.WithMessage("unsupported user type to count " + opts.TypeSelector)
+	}
+	coll, query, err := us.statQuery(query, opts)
+	if err != nil {
+		return nil, err
+	}
+	cnt, err := coll.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, db.HandleDBError(err)
+	}
+	result := &api.CountResult{
+		Total: cnt,
+	}
+	if opts.AsOf != "" {
+		date, _ := ParseAsOf(opts.AsOf)
+		result.AsOf = &date
+	}
+	return result, nil
+}
+
+// statQuery returns the collection the stat users are read from along with
+// the query, the versions valid on opts.AsOf are read when it is given.
+func (us *UserService) statQuery(query bson.M, opts *api.ListOptions) (*mongo.Collection, bson.M, error) {
+	if opts.AsOf == "" {
+		return us.userStatColl, query, nil
+	}
+	date, err := ParseAsOf(opts.AsOf)
+	if err != nil {
+		return nil, nil, err
+	}
+	return us.historyColl, bson.M{"$and": bson.A{query, asOfQuery(date)}}, nil
+}
+
+func listQuery(ctx context.Context, filters api.FilterStack, opts *api.ListOptions) bson.M {
+	query := addFilter(ctx, filters)
+	if opts.KindSelector == "ai" {
+		query["usages.ai.app"] = bson.M{"$ne": 0}
+	} else if opts.KindSelector == "connect" {
+		query["usages.connect.connection"] = bson.M{"$ne": 0}
+	}
+	return query
+}
+
+func premiumQuery(ctx context.Context, filters api.FilterStack, opts *api.ListOptions) bson.M {
+	query := addFilter(ctx, filters)
+	if opts.KindSelector == "ai" {
+		query["class.ai.premium"] = true
+	} else if opts.KindSelector == "connect" {
+		query["class.connect.premium"] = true
+	}
+	return query
+}
+
 func (us *UserService) listRegisterUsers(ctx context.Context, pg api.Page, rg api.Range, filters api.FilterStack, opts *api.ListOptions) (*api.ListResult, error) {
 	var (
 		skip  = pg.PageNumber * pg.PageSize
@@ -297,7 +445,7 @@ func (us *UserService) listRegisterUsers(ctx context.Context, pg api.Page, rg ap
 	query := addFilter(ctx, filters)
 	query["created_at"] = bson.M{
 		"$gte": start,
-		"$lte": end,
+		"$lt":  end,
 	}
 	cnt, err := us.userColl.CountDocuments(ctx, query)
 	if err != nil {
@@ -375,7 +523,7 @@ func (us *UserService) listRegisterFromLandingPageUsers(ctx context.Context, pg
 	query["ref"] = ref
 	query["created_at"] = bson.M{
 		"$gte": start,
-		"$lte": end,
+		"$lt":  end,
 	}
 	cnt, err := us.userColl.CountDocuments(ctx, query)
 	if err != nil {
@@ -549,13 +697,11 @@ func (us *UserService) listPremiumUsers(ctx context.Context, pg api.Page, filter
 		skip = 0
 	}
 
-	query := addFilter(ctx, filters)
-	if opts.KindSelector == "ai" {
-		query["class.ai.premium"] = true
-	} else if opts.KindSelector == "connect" {
-		query["class.connect.premium"] = true
+	coll, query, err := us.statQuery(premiumQuery(ctx, filters, opts), opts)
+	if err != nil {
+		return nil, err
 	}
-	cnt, err := us.userStatColl.CountDocuments(ctx, query)
+	cnt, err := coll.CountDocuments(ctx, query)
 	if err != nil {
 		return nil, err
 	}
@@ -581,7 +727,7 @@ func (us *UserService) listPremiumUsers(ctx context.Context, pg api.Page, filter
 		Skip:  &skip,
 		Sort:  sort,
 	}
-	cursor, err := us.userStatColl.Find(ctx, query, &opt)
+	cursor, err := coll.Find(ctx, query, &opt)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			return &api.ListResult{
@@ -606,7 +752,8 @@ func (us *UserService) listPremiumUsers(ctx context.Context, pg api.Page, filter
 		} else if opts.KindSelector == "connect" {
 			ctype = user.Class.Connect.Plan.Type
 		}
-		if opts.KindSelector == "ai" {
+		// the credits are the ones of today
+		if opts.KindSelector == "ai" && opts.AsOf == "" {
 			credits, err := us.getUserCredits(ctx, user.OID, ctype)
 			if err != nil {
 				return nil, err
@@ -621,6 +768,74 @@ func (us *UserService) listPremiumUsers(ctx context.Context, pg api.Page, filter
 	}, nil
 }
 
+// listExhaustingUsers returns the users whose credits or quota are forecasted
+// to run out within the next opts.Days days, the soonest first.
+func (us *UserService) listExhaustingUsers(ctx context.Context, pg api.Page, filters api.FilterStack, opts *api.ListOptions) (*api.ListResult, error) {
+	var (
+		skip  = pg.PageNumber * pg.PageSize
+		limit = pg.PageSize
+		days  = DefaultForecastDays
+	)
+
+	if skip < 0 {
+		skip = 0
+	}
+	if opts.Days > 0 {
+		days = opts.Days
+	}
+
+	match := bson.M{
+		"exhausted_at": bson.M{
+			"$lte": time.Now().AddDate(0, 0, days),
+		},
+	}
+	if opts.KindSelector == "ai" || opts.KindSelector == "connect" {
+		match["kind"] = opts.KindSelector
+	}
+	query := addFilter(ctx, filters)
+	query["forecasts"] = bson.M{"$elemMatch": match}
+	cnt, err := us.userStatColl.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if cnt == 0 {
+		return &api.ListResult{
+			List: []interface{}{},
+			P:    pg,
+		}, nil
+	}
+	if cnt <= skip {
+		return nil, api.ErrPageArgumentsTooLarge
+	}
+
+	pg.Total = cnt
+	opt := options.FindOptions{
+		Limit: &limit,
+		Skip:  &skip,
+		Sort:  bson.M{"forecasts.exhausted_at": 1},
+	}
+	cursor, err := us.userStatColl.Find(ctx, query, &opt)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = cursor.Close(ctx)
+	}()
+
+	list := make([]interface{}, 0)
+	for cursor.Next(ctx) {
+		user := &models.User{}
+		if err = cursor.Decode(user); err != nil {
+			return nil, db.HandleDBError(err)
+		}
+		list = append(list, user)
+	}
+	return &api.ListResult{
+		List: list,
+		P:    pg,
+	}, nil
+}
+
 func (us *UserService) listHighKnownledgeBaseUsers(ctx context.Context, pg api.Page, opts *api.ListOptions) (*api.ListResult, error) {
 	var (
 		skip  int64  = 0
@@ -781,12 +996,34 @@ func (us *UserService) listCohortUsers(ctx context.Context, pg api.Page, opts *a
 }
 
 func (us *UserService) listDailyUserNumber(ctx context.Context, pg api.Page, opts *api.ListOptions) (*api.ListResult, error) {
+	rg, previous, err := GetComparison(ctx, pg.Range)
+	if err != nil {
+		return nil, err
+	}
+	list, err := us.findDailyUserNumber(ctx, rg, pg.Tag)
+	if err != nil {
+		return nil, err
+	}
+	result := &api.ListResult{
+		List: list,
+		P:    pg,
+	}
+	if previous != nil {
+		if result.Previous, err = us.findDailyUserNumber(ctx, *previous, pg.Tag); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func (us *UserService) findDailyUserNumber(ctx context.Context, rg api.Interval, tag string) ([]interface{}, error) {
 	query := bson.M{
 		"date": bson.M{
-			"$gte": GetStartAt(ctx, pg.Range),
-			// "$lte": end,
+			"$gte": rg.Start,
+			"$lt":  rg.End,
 		},
-		"tag": pg.Tag,
+		"timezone": timezone.Query(timezone.Reporting()),
+		"tag":      tag,
 	}
 	opt := options.FindOptions{
 		Sort: bson.M{"date": 1},
@@ -794,10 +1031,7 @@ func (us *UserService) listDailyUserNumber(ctx context.Context, pg api.Page, opt
 	cursor, err := us.dailyStatColl.Find(ctx, query, &opt)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
-			return &api.ListResult{
-				List: []interface{}{},
-				P:    pg,
-			}, nil
+			return []interface{}{}, nil
 		}
 		return nil, err
 	}
@@ -812,44 +1046,40 @@ func (us *UserService) listDailyUserNumber(ctx context.Context, pg api.Page, opt
 		}
 		list = append(list, daily)
 	}
-	return &api.ListResult{
-		List: list,
-		P:    pg,
-	}, nil
+	return list, nil
 }
 
+// Get returns the AI and Connect details of the user, the bills are bucketed
+// by the granularity of the options within their range.
 func (us *UserService) Get(ctx context.Context, oid string, opts *api.GetOptions) (*models.UserDetail, error) {
-	if opts.KindSelector == "" {
-		ai, err := us.getAIDetail(ctx, oid)
-		if err != nil {
-			return nil, err
-		}
-		connect, err := us.getConnectDetail(ctx, oid)
-		if err != nil {
-			return nil, err
-		}
-		return &models.UserDetail{
-			AI:      ai,
-			Connect: connect,
-		}, nil
-	} else if opts.KindSelector == "ai" {
-		ai, err := us.getAIDetail(ctx, oid)
-		if err != nil {
-			return nil, err
-		}
-		return &models.UserDetail{
-			AI: ai,
-		}, nil
-	} else if opts.KindSelector == "connect" {
-		connect, err := us.getConnectDetail(ctx, oid)
-		if err != nil {
-			return nil, err
-		}
-		return &models.UserDetail{
-			Connect: connect,
-		}, nil
+	rg, err := newDetailRange(opts, timezone.Of(ctx))
+	if err != nil {
+		return nil, err
+	}
+	detail := &models.UserDetail{}
+	switch opts.KindSelector {
+	case "":
+		err = runConcurrently(
+			func() (err error) {
+				detail.AI, err = us.getAIDetail(ctx, oid, rg)
+				return err
+			},
+			func() (err error) {
+				detail.Connect, err = us.getConnectDetail(ctx, oid, rg)
+				return err
+			},
+		)
+	case "ai":
+		detail.AI, err = us.getAIDetail(ctx, oid, rg)
+	case "connect":
+		detail.Connect, err = us.getConnectDetail(ctx, oid, rg)
+	default:
+		return nil, api.ErrUnsupportedKind.WithMessage(fmt.Sprintf("unsupported kind: %s", opts.KindSelector))
 	}
-	return nil, api.ErrUnsupportedKind.WithMessage(fmt.Sprintf("unsupported kind: %s", opts.KindSelector))
+	if err != nil {
+		return nil, err
+	}
+	return detail, nil
 }
 
 func addFilter(ctx context.Context, fs api.FilterStack) bson.M {
@@ -1082,18 +1312,17 @@ func (us *UserService) getLastWeekUsageUserList(ctx context.Context) ([]string,
 }
 
 func (us *UserService) getLoginUsers(ctx context.Context, rg api.Range) ([]string, error) {
-	layout := "2006-01-02"
-	now := time.Now()
-	if rg.Start == "" || rg.End == "" {
-		rg.Start = now.AddDate(0, 0, -1).Format(layout)
-		rg.End = now.Format(layout)
+	start, end, err := us.getRangeTime(ctx, rg)
+	if err != nil {
+		return nil, err
 	}
+	// the time of the actions is stored as a string in UTC
 	pipeline := mongo.Pipeline{
 		{
 			{"$match", bson.D{
 				{"time", bson.M{
-					"$gte": rg.Start,
-					"$lte": rg.End,
+					"$gte": start.UTC().Format(time.RFC3339),
+					"$lt":  end.UTC().Format(time.RFC3339),
 				}},
 			}},
 		},
@@ -1138,7 +1367,7 @@ func (us *UserService) getConnectCreatedUsers(ctx context.Context, rg api.Range)
 			{"$match", bson.D{
 				{"created_at", bson.M{
 					"$gte": start,
-					"$lte": end,
+					"$lt":  end,
 				}},
 			}},
 		},
@@ -1188,7 +1417,7 @@ func (us *UserService) getAICreatedUsers(ctx context.Context, rg api.Range) ([]s
 			{"$match", bson.D{
 				{"created_at", bson.M{
 					"$gte": start,
-					"$lte": end,
+					"$lt":  end,
 				}},
 			}},
 		},
@@ -1316,8 +1545,8 @@ func (us *UserService) getAIUsedUsers(ctx context.Context, rg api.Range) ([]stri
 	return users, nil
 }
 
-func (us *UserService) getConnectionTemplateCreatedUsers(ctx context.Context, rg string) ([]string, error) {
-	date, err := time.Parse("2006-01-02", rg)
+func (us *UserService) getConnectionTemplateCreatedUsers(ctx context.Context, expr string) ([]string, error) {
+	rg, err := GetRange(ctx, expr)
 	if err != nil {
 		return nil, err
 	}
@@ -1328,8 +1557,8 @@ func (us *UserService) getConnectionTemplateCreatedUsers(ctx context.Context, rg
 					"$exists": true,
 				}},
 				{"created_at", bson.M{
-					"$gte": date,
-					"$lte": date.AddDate(0, 0, 1),
+					"$gte": rg.Start,
+					"$lt":  rg.End,
 				}},
 			}},
 		},
@@ -1369,64 +1598,48 @@ func (us *UserService) getConnectionTemplateCreatedUsers(ctx context.Context, rg
 	return users, nil
 }
 
-func GetStartAt(ctx context.Context, rg string) time.Time {
-	now := time.Now()
-	switch rg {
-	case "Month":
-		startAt := now.AddDate(0, -1, 0)
-		return time.Date(startAt.Year(), startAt.Month(), startAt.Day(), 0, 0, 0, 0, time.UTC)
-	case "Three Months":
-		startAt := now.AddDate(0, -3, 0)
-		return time.Date(startAt.Year(), startAt.Month(), startAt.Day(), 0, 0, 0, 0, time.UTC)
-	case "Six Months":
-		startAt := now.AddDate(0, -6, 0)
-		return time.Date(startAt.Year(), startAt.Month(), startAt.Day(), 0, 0, 0, 0, time.UTC)
-	case "Year":
-		startAt := now.AddDate(-1, 0, 0)
-		if startAt.Before(StartAt) {
-			return StartAt
-		}
-		return time.Date(startAt.Year(), startAt.Month(), startAt.Day(), 0, 0, 0, 0, time.UTC)
-	default:
-		return StartAt
+// GetRange parses the range expression of the request in its timezone, an
+// empty expression is the whole history, which starts at StartAt.
+func GetRange(ctx context.Context, expr string) (api.Interval, error) {
+	if expr == "" {
+		expr = api.RangeOfAll
 	}
-}
-
-func (us *UserService) getRangeTime(ctx context.Context, rg api.Range) (time.Time, time.Time, error) {
-	now := time.Now()
-	layout := "2006-01-02"
-	parseTimeFromString := func(t string) (time.Time, error) {
-		if strings.Contains(t, "T") {
-			t = strings.Split(t, "T")[0]
-		}
-		return time.Parse(layout, t)
+	rg, err := api.ParseRange(expr, time.Now().In(timezone.Of(ctx)))
+	if err != nil {
+		return api.Interval{}, err
+	}
+	if rg.Start.Before(StartAt) {
+		rg.Start = StartAt
 	}
+	return rg, nil
+}
 
-	if rg.Start == "" && rg.End == "" {
-		return now.AddDate(0, 0, -1), now, nil
-	} else if rg.Start == "" {
-		end, err := parseTimeFromString(rg.End)
-		if err != nil {
-			return now, now, err
-		}
-		return end.AddDate(0, 0, -1), end, nil
-	} else if rg.End == "" {
-		start, err := parseTimeFromString(rg.Start)
-		if err != nil {
-			return now, now, err
-		}
-		return start, start.AddDate(0, 0, 1), nil
+// GetComparison parses the range expression like GetRange, the range it is
+// compared against is returned as well when the expression is a comparison,
+// e.g. "this_month vs previous_period", and nil otherwise.
+func GetComparison(ctx context.Context, expr string) (api.Interval, *api.Interval, error) {
+	if !strings.Contains(strings.ToLower(expr), api.ComparisonSeparator) {
+		rg, err := GetRange(ctx, expr)
+		return rg, nil, err
 	}
-	start, err := parseTimeFromString(rg.Start)
+	cmp, err := api.ParseComparison(expr, time.Now().In(timezone.Of(ctx)))
 	if err != nil {
-		return now, now, err
+		return api.Interval{}, nil, err
 	}
-	if rg.Start == rg.End {
-		return start, start.AddDate(0, 0, 1), nil
+	for _, rg := range []*api.Interval{&cmp.Current, &cmp.Previous} {
+		if rg.Start.Before(StartAt) {
+			rg.Start = StartAt
+		}
 	}
-	end, err := parseTimeFromString(rg.End)
+	return cmp.Current, &cmp.Previous, nil
+}
+
+// getRangeTime parses the start and the end of the range in the timezone of
+// the request.
+func (us *UserService) getRangeTime(ctx context.Context, rg api.Range) (time.Time, time.Time, error) {
+	interval, err := rg.Parse(time.Now().In(timezone.Of(ctx)))
 	if err != nil {
-		return now, now, err
+		return time.Time{}, time.Time{}, err
 	}
-	return start, end, nil
+	return interval.Start, interval.End, nil
 }
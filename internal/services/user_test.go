@@ -0,0 +1,143 @@
+package services
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/jyjiangkai/stat/api"
+	"github.com/jyjiangkai/stat/constant"
+)
+
+func TestAddFilter(t *testing.T) {
+	at := time.Date(2023, 6, 1, 8, 30, 0, 0, time.UTC)
+	cases := []struct {
+		name string
+		fs   api.FilterStack
+		want bson.M
+	}{
+		{
+			name: "nil filters",
+			fs:   api.FilterStack{},
+			want: bson.M{},
+		},
+		{
+			name: "empty filters",
+			fs:   api.FilterStack{Filters: []api.Filter{}},
+			want: bson.M{},
+		},
+		{
+			name: "and of every operator",
+			fs: api.FilterStack{
+				Filters: []api.Filter{
+					{ColumnID: "email", Operator: "includes", Value: "vanus"},
+					{ColumnID: "email", Operator: "doesNotInclude", Value: "test"},
+					{ColumnID: "country", Operator: "is", Value: "US"},
+					{ColumnID: "country", Operator: "isNot", Value: "CN"},
+					{ColumnID: "phone", Operator: "isEmpty"},
+					{ColumnID: "company_name", Operator: "isNotEmpty"},
+					{ColumnID: "created_at", Operator: "isBefore", Value: "2023-06-01T08:30:00.000"},
+					{ColumnID: "created_at", Operator: "isAfter", Value: "2023-06-01T08:30:00.000"},
+				},
+			},
+			want: bson.M{
+				"$and": []bson.M{
+					{"email": bson.M{"$regex": "vanus"}},
+					{"email": bson.M{"$not": bson.M{"$regex": "test"}}},
+					{"country": bson.M{"$eq": "US"}},
+					{"country": bson.M{"$ne": "CN"}},
+					{"phone": bson.M{"$exists": false}},
+					{"company_name": bson.M{"$exists": true}},
+					{"created_at": bson.M{"$lte": at}},
+					{"created_at": bson.M{"$gte": at}},
+				},
+			},
+		},
+		{
+			name: "or with an invalid time and an unknown operator",
+			fs: api.FilterStack{
+				Operator: "or",
+				Filters: []api.Filter{
+					{ColumnID: "created_at", Operator: "isBefore", Value: "2023-06-01"},
+					{ColumnID: "country", Operator: "startsWith", Value: "U"},
+					{ColumnID: "country", Operator: "is", Value: "US"},
+				},
+			},
+			want: bson.M{
+				"$or": []bson.M{
+					{"country": bson.M{"$eq": "US"}},
+				},
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := addFilter(context.Background(), c.fs)
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("addFilter() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+// TestGetRange covers the legacy ranges GetStartAt used to parse as well,
+// GetRange took its place.
+func TestGetRange(t *testing.T) {
+	ctx := context.Background()
+	midnight := func(t time.Time) time.Time {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	now := time.Now()
+	cases := []struct {
+		rg   string
+		want time.Time
+	}{
+		{rg: "Month", want: midnight(now.AddDate(0, -1, 0))},
+		{rg: "Three Months", want: midnight(now.AddDate(0, -3, 0))},
+		{rg: "Six Months", want: midnight(now.AddDate(0, -6, 0))},
+		{rg: "last_7d", want: midnight(now.AddDate(0, 0, -7))},
+		{rg: "", want: StartAt},
+		{rg: "All", want: StartAt},
+		{rg: "2020-01..2023-03-20", want: StartAt},
+	}
+	for _, c := range cases {
+		rg, err := GetRange(ctx, c.rg)
+		if err != nil {
+			t.Fatalf("GetRange(%q) = %v", c.rg, err)
+		}
+		if !rg.Start.Equal(c.want) {
+			t.Errorf("GetRange(%q).Start = %v, want %v", c.rg, rg.Start, c.want)
+		}
+	}
+
+	year, err := GetRange(ctx, "Year")
+	if err != nil {
+		t.Fatalf("GetRange(Year) = %v", err)
+	}
+	if year.Start.Before(StartAt) {
+		t.Errorf("GetRange(Year).Start = %v, which is before %v", year.Start, StartAt)
+	}
+	if want := midnight(now.AddDate(-1, 0, 0)); want.After(StartAt) && !year.Start.Equal(want) {
+		t.Errorf("GetRange(Year).Start = %v, want %v", year.Start, want)
+	}
+
+	// the days start at the midnight of the request timezone
+	loc := time.FixedZone("UTC+8", 8*60*60)
+	month, err := GetRange(context.WithValue(ctx, constant.ContextTimezone, loc), "Month")
+	if err != nil {
+		t.Fatalf("GetRange(Month) = %v", err)
+	}
+	local := time.Now().In(loc).AddDate(0, -1, 0)
+	if want := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc); !month.Start.Equal(want) {
+		t.Errorf("GetRange(Month).Start = %v, want %v", month.Start, want)
+	}
+
+	for _, rg := range []string{"Week", "last_0d", "2023-13", "2023-W54", "2023-03-20..2023-03-01"} {
+		if _, err := GetRange(ctx, rg); !api.ErrParseRange.IsSame(err) {
+			t.Errorf("GetRange(%q) = %v, want %v", rg, err, api.ErrParseRange)
+		}
+	}
+}
@@ -23,9 +23,15 @@ type Config struct {
 	WebhookUrl string `yaml:"webhook_url"`
 }
 
+const (
+	ActionOfDelete = "delete"
+)
+
 type MailChimp struct {
 	Email string   `json:"email" yaml:"email"`
 	Tags  []string `json:"tags" yaml:"tags"`
+	// Action is empty for adding a member
+	Action string `json:"action,omitempty" yaml:"action,omitempty"`
 }
 
 func Init(ctx context.Context, c Config) {
@@ -49,6 +55,26 @@ func AddMember(ctx context.Context, email string, tags []string) error {
 	return handleHTTPResponse(ctx, resp, err)
 }
 
+// RemoveMember asks the webhook to permanently delete the member, which is
+// used for the erasure requests of data subjects.
+func RemoveMember(ctx context.Context, email string) error {
+	if !cfg.Enable {
+		log.Info(ctx).Str("email", email).Msg("mailchimp function is disable, no need remove member")
+		return nil
+	}
+	req := &MailChimp{
+		Email:  email,
+		Tags:   []string{},
+		Action: ActionOfDelete,
+	}
+	resp, err := client.R().SetBody(req).Post(cfg.WebhookUrl)
+	return handleHTTPResponse(ctx, resp, err)
+}
+
+func Enabled() bool {
+	return cfg.Enable
+}
+
 func ValidateEmail(email string) bool {
 	regex := `^[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,4}$`
 	match, _ := regexp.MatchString(regex, email)
@@ -0,0 +1,90 @@
+package models
+
+import (
+	"time"
+)
+
+const (
+	MilestoneOfFirstLogin      = "first_login"
+	MilestoneOfFirstApp        = "first_app"
+	MilestoneOfFirstUpload     = "first_upload"
+	MilestoneOfFirstConnection = "first_connection"
+	MilestoneOfFirstDelivery   = "first_delivery"
+	MilestoneOfFirstPayment    = "first_payment"
+
+	ActivationGroupByCohort = "cohort"
+	ActivationGroupByRef    = "ref"
+)
+
+var (
+	Milestones = []string{
+		MilestoneOfFirstLogin,
+		MilestoneOfFirstApp,
+		MilestoneOfFirstUpload,
+		MilestoneOfFirstConnection,
+		MilestoneOfFirstDelivery,
+		MilestoneOfFirstPayment,
+	}
+)
+
+// 用户第一次达成各个激活里程碑的时间，未达成的为空
+type Activation struct {
+	FirstLogin *time.Time `json:"first_login,omitempty" bson:"first_login,omitempty"`
+	// 第一次创建AI应用，包括已删除的应用
+	FirstApp *time.Time `json:"first_app,omitempty" bson:"first_app,omitempty"`
+	// 第一次向知识库上传文件
+	FirstUpload     *time.Time `json:"first_upload,omitempty" bson:"first_upload,omitempty"`
+	FirstConnection *time.Time `json:"first_connection,omitempty" bson:"first_connection,omitempty"`
+	// 第一次成功投递事件的那一天(UTC)
+	FirstDelivery *time.Time `json:"first_delivery,omitempty" bson:"first_delivery,omitempty"`
+	FirstPayment  *time.Time `json:"first_payment,omitempty" bson:"first_payment,omitempty"`
+}
+
+// Of 返回里程碑达成的时间
+func (a *Activation) Of(milestone string) *time.Time {
+	if a == nil {
+		return nil
+	}
+	switch milestone {
+	case MilestoneOfFirstLogin:
+		return a.FirstLogin
+	case MilestoneOfFirstApp:
+		return a.FirstApp
+	case MilestoneOfFirstUpload:
+		return a.FirstUpload
+	case MilestoneOfFirstConnection:
+		return a.FirstConnection
+	case MilestoneOfFirstDelivery:
+		return a.FirstDelivery
+	case MilestoneOfFirstPayment:
+		return a.FirstPayment
+	}
+	return nil
+}
+
+// 按注册周或来源分组的激活报告
+type ActivationReport struct {
+	GroupBy  string             `json:"group_by"`
+	Timezone string             `json:"timezone"`
+	Groups   []*ActivationGroup `json:"groups"`
+	// 所有用户的汇总
+	Total *ActivationGroup `json:"total"`
+}
+
+type ActivationGroup struct {
+	// 注册周的第一天，例如 2023-03-13，或者来源
+	Key        string                 `json:"key"`
+	Users      int64                  `json:"users"`
+	Milestones []*ActivationMilestone `json:"milestones"`
+}
+
+// 一组用户达成某个里程碑的比例(百分比)，以及从注册到达成所用时间(小时)的分布
+type ActivationMilestone struct {
+	Milestone string  `json:"milestone"`
+	Reached   int64   `json:"reached"`
+	Rate      float64 `json:"rate"`
+	P25       float64 `json:"p25"`
+	P50       float64 `json:"p50"`
+	P75       float64 `json:"p75"`
+	P90       float64 `json:"p90"`
+}
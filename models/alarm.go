@@ -0,0 +1,58 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jyjiangkai/stat/models/cloud"
+)
+
+const (
+	AlarmStateOfFiring       = "firing"
+	AlarmStateOfResolved     = "resolved"
+	AlarmStateOfAcknowledged = "acknowledged"
+	AlarmStateOfSilenced     = "silenced"
+)
+
+// 用于记录一个告警从触发到恢复的完整生命周期
+type Alarm struct {
+	cloud.Base `json:",inline" bson:",inline"`
+	// 告警的唯一标识，例如 anomaly:ai_usage:drop，同一标识在恢复前只会存在一个未恢复的告警
+	Key       string `json:"key" bson:"key"`
+	Metric    string `json:"metric" bson:"metric"`
+	Direction string `json:"direction" bson:"direction"`
+	State     string `json:"state" bson:"state"`
+	// 最近一次触发时的告警内容
+	Message           string        `json:"message" bson:"message"`
+	FirstSeen         time.Time     `json:"first_seen" bson:"first_seen"`
+	LastSeen          time.Time     `json:"last_seen" bson:"last_seen"`
+	NotificationCount int           `json:"notification_count" bson:"notification_count"`
+	AcknowledgedBy    string        `json:"acknowledged_by,omitempty" bson:"acknowledged_by,omitempty"`
+	AcknowledgedAt    *time.Time    `json:"acknowledged_at,omitempty" bson:"acknowledged_at,omitempty"`
+	SilencedBy        string        `json:"silenced_by,omitempty" bson:"silenced_by,omitempty"`
+	SilencedUntil     *time.Time    `json:"silenced_until,omitempty" bson:"silenced_until,omitempty"`
+	ResolvedAt        *time.Time    `json:"resolved_at,omitempty" bson:"resolved_at,omitempty"`
+	History           []*AlarmEvent `json:"history" bson:"history"`
+}
+
+// 告警状态的每一次变化
+type AlarmEvent struct {
+	Time     time.Time `json:"time" bson:"time"`
+	State    string    `json:"state" bson:"state"`
+	Operator string    `json:"operator" bson:"operator"`
+	Message  string    `json:"message,omitempty" bson:"message,omitempty"`
+	Notified bool      `json:"notified" bson:"notified"`
+}
+
+func (a *Alarm) IsSilenced(now time.Time) bool {
+	return a.State == AlarmStateOfSilenced && a.SilencedUntil != nil && now.Before(*a.SilencedUntil)
+}
+
+func (a *Alarm) AddEvent(event *AlarmEvent) {
+	a.State = event.State
+	a.UpdatedAt = event.Time
+	a.UpdatedBy = event.Operator
+	if event.Notified {
+		a.NotificationCount++
+	}
+	a.History = append(a.History, event)
+}
@@ -0,0 +1,32 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jyjiangkai/stat/models/cloud"
+)
+
+// 用于记录某个指标在某一天检测出的异常
+type Anomaly struct {
+	cloud.Base `json:",inline" bson:",inline"`
+	// 异常发生的日期(统计时区的零点)
+	Date time.Time `json:"date" bson:"date"`
+	// 统计所用的时区，例如 Asia/Shanghai
+	Timezone string `json:"timezone" bson:"timezone"`
+	// 指标名称，例如 ai_usage、connect_usage、register_user_number、login_user_number
+	Metric string `json:"metric" bson:"metric"`
+	// 当天的实际值
+	Value float64 `json:"value" bson:"value"`
+	// 根据历史同星期数据和趋势得出的期望值
+	Expected float64 `json:"expected" bson:"expected"`
+	Lower    float64 `json:"lower" bson:"lower"`
+	Upper    float64 `json:"upper" bson:"upper"`
+	// 鲁棒z-score，正数表示高于期望，负数表示低于期望
+	Score float64 `json:"score" bson:"score"`
+	// 置信度，取值范围[0, 1]
+	Confidence float64 `json:"confidence" bson:"confidence"`
+	// spike 或 drop
+	Direction string `json:"direction" bson:"direction"`
+	// 参与计算的历史样本数量
+	Samples int `json:"samples" bson:"samples"`
+}
@@ -0,0 +1,34 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jyjiangkai/stat/models/cloud"
+)
+
+// 访问 stat API 的密钥，只保存密钥的 SHA-256 摘要
+type APIKey struct {
+	cloud.Base `json:",inline" bson:",inline"`
+	Name       string `json:"name" bson:"name"`
+	Role       string `json:"role" bson:"role"`
+	// 密钥的前几位，用于在列表中辨认密钥
+	Prefix     string     `json:"prefix" bson:"prefix"`
+	Hash       string     `json:"-" bson:"hash"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty" bson:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty" bson:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty" bson:"revoked_at,omitempty"`
+	RevokedBy  string     `json:"revoked_by,omitempty" bson:"revoked_by,omitempty"`
+}
+
+// 创建密钥时返回一次明文密钥
+type CreatedAPIKey struct {
+	*APIKey `json:",inline"`
+	Key     string `json:"key"`
+}
+
+func (key *APIKey) Active(now time.Time) bool {
+	if key.RevokedAt != nil {
+		return false
+	}
+	return key.ExpiresAt == nil || now.Before(*key.ExpiresAt)
+}
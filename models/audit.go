@@ -0,0 +1,34 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// 一次经过认证的 API 请求的审计记录，只追加不修改
+type AuditLog struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id"`
+	Time      time.Time          `json:"time" bson:"time"`
+	RequestID string             `json:"request_id" bson:"request_id"`
+	Principal string             `json:"principal" bson:"principal"`
+	Name      string             `json:"name" bson:"name"`
+	Role      string             `json:"role" bson:"role"`
+	Method    string             `json:"method" bson:"method"`
+	// 路由模板，例如 /v1/users/:oid
+	Route string              `json:"route" bson:"route"`
+	Path  string              `json:"path" bson:"path"`
+	Query map[string][]string `json:"query,omitempty" bson:"query,omitempty"`
+	// 请求体中的过滤条件，原样记录
+	Filters  string `json:"filters,omitempty" bson:"filters,omitempty"`
+	Status   int    `json:"status" bson:"status"`
+	ClientIP string `json:"client_ip" bson:"client_ip"`
+	Duration int64  `json:"duration_ms" bson:"duration_ms"`
+	// 返回的结果条数及满足条件的总数
+	ResultCount int   `json:"result_count" bson:"result_count"`
+	Total       int64 `json:"total" bson:"total"`
+	// 导出的行数，用于下载、账单和大批量拉取列表的请求
+	ExportedRows int `json:"exported_rows" bson:"exported_rows"`
+	// 请求查看到的用户
+	ViewedUsers []string `json:"viewed_users,omitempty" bson:"viewed_users,omitempty"`
+}
@@ -27,23 +27,27 @@ type Organization struct {
 
 type User struct {
 	cloud.Base   `json:",inline" bson:",inline"`
-	OID          string   `json:"oidc_id" bson:"oidc_id"`
-	Phone        string   `json:"phone" bson:"phone"`
-	Email        string   `json:"email" bson:"email"`
-	Country      string   `json:"country" bson:"country"`
-	GivenName    string   `json:"given_name" bson:"given_name"`
-	FamilyName   string   `json:"family_name" bson:"family_name"`
-	NickName     string   `json:"nickname" bson:"nickname"`
-	CompanyName  string   `json:"company_name" bson:"company_name"`
-	CompanyEmail string   `json:"company_email" bson:"company_email"`
-	Industry     string   `json:"industry" bson:"industry"`
-	Ref          string   `json:"ref" bson:"ref"`
-	RefHost      string   `json:"ref_host" bson:"ref_host"`
-	Class        *Class   `json:"class" bson:"class"`
-	Bills        *Bills   `json:"bills" bson:"bills"`
-	Usages       *Usages  `json:"usages" bson:"usages"`
-	Cohort       *Cohort  `json:"cohort" bson:"cohort"`
-	Credits      *Credits `json:"credits" bson:"credits"`
+	OID          string      `json:"oidc_id" bson:"oidc_id"`
+	Phone        string      `json:"phone" bson:"phone"`
+	Email        string      `json:"email" bson:"email"`
+	Country      string      `json:"country" bson:"country"`
+	GivenName    string      `json:"given_name" bson:"given_name"`
+	FamilyName   string      `json:"family_name" bson:"family_name"`
+	NickName     string      `json:"nickname" bson:"nickname"`
+	CompanyName  string      `json:"company_name" bson:"company_name"`
+	CompanyEmail string      `json:"company_email" bson:"company_email"`
+	Industry     string      `json:"industry" bson:"industry"`
+	Ref          string      `json:"ref" bson:"ref"`
+	RefHost      string      `json:"ref_host" bson:"ref_host"`
+	Class        *Class      `json:"class" bson:"class"`
+	Bills        *Bills      `json:"bills" bson:"bills"`
+	Usages       *Usages     `json:"usages" bson:"usages"`
+	Cohort       *Cohort     `json:"cohort" bson:"cohort"`
+	Credits      *Credits    `json:"credits" bson:"credits"`
+	Forecasts    []*Forecast `json:"forecasts" bson:"forecasts"`
+	Activation   *Activation `json:"activation" bson:"activation"`
+	// 统计日、周数据所用的时区
+	Timezone string `json:"timezone" bson:"timezone"`
 }
 
 type PremiumUser struct {
@@ -219,6 +223,7 @@ type UserConversion struct {
 type DailyStatsOfUserNumber struct {
 	Date                        time.Time `json:"date" bson:"date"`
 	Tag                         string    `json:"tag" bson:"tag"`
+	Timezone                    string    `json:"timezone" bson:"timezone"`
 	RegisterUserNumber          int64     `json:"register_user_number" bson:"register_user_number"`
 	LoginUserNumber             int64     `json:"login_user_number" bson:"login_user_number"`
 	ConnectionCreatedUserNumber int64     `json:"connection_created_user_number" bson:"connection_created_user_number"`
@@ -230,6 +235,7 @@ type DailyStatsOfUserNumber struct {
 type DailyStatsOfShopifyLandingPageActionNumber struct {
 	Date                                             time.Time `json:"date" bson:"date"`
 	Tag                                              string    `json:"tag" bson:"tag"`
+	Timezone                                         string    `json:"timezone" bson:"timezone"`
 	UniqueVisitorNumber                              int64     `json:"unique_visitor_number" bson:"unique_visitor_number"`
 	TryVanusActionNumber                             int64     `json:"try_vanus_action_number" bson:"try_vanus_action_number"`
 	SignInWithGithubActionNumber                     int64     `json:"sign_in_with_github_action_number" bson:"sign_in_with_github_action_number"`
@@ -249,6 +255,7 @@ type DailyStatsOfShopifyLandingPageActionNumber struct {
 type DailyStatsOfGithubLandingPageActionNumber struct {
 	Date                                        time.Time `json:"date" bson:"date"`
 	Tag                                         string    `json:"tag" bson:"tag"`
+	Timezone                                    string    `json:"timezone" bson:"timezone"`
 	UniqueVisitorNumber                         int64     `json:"unique_visitor_number" bson:"unique_visitor_number"`
 	TryVanusActionNumber                        int64     `json:"try_vanus_action_number" bson:"try_vanus_action_number"`
 	SignInWithGithubActionNumber                int64     `json:"sign_in_with_github_action_number" bson:"sign_in_with_github_action_number"`
@@ -267,6 +274,7 @@ type DailyStatsOfGithubLandingPageActionNumber struct {
 type DailyStatsOfAWSCampaignsPageActionNumber struct {
 	Date                            time.Time `json:"date" bson:"date"`
 	Tag                             string    `json:"tag" bson:"tag"`
+	Timezone                        string    `json:"timezone" bson:"timezone"`
 	UniqueVisitorNumber             int64     `json:"unique_visitor_number" bson:"unique_visitor_number"`
 	TryVanusActionNumber            int64     `json:"try_vanus_action_number" bson:"try_vanus_action_number"`
 	SignInWithGithubActionNumber    int64     `json:"sign_in_with_github_action_number" bson:"sign_in_with_github_action_number"`
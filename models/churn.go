@@ -0,0 +1,34 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jyjiangkai/stat/models/cloud"
+)
+
+// 用于记录某一天检测出的有流失风险的付费用户
+type ChurnRisk struct {
+	cloud.Base  `json:",inline" bson:",inline"`
+	Date        time.Time  `json:"date" bson:"date"`
+	Timezone    string     `json:"timezone" bson:"timezone"`
+	OID         string     `json:"oidc_id" bson:"oidc_id"`
+	Email       string     `json:"email" bson:"email"`
+	CompanyName string     `json:"company_name" bson:"company_name"`
+	Class       *Class     `json:"class" bson:"class"`
+	AI          *UsageDrop `json:"ai,omitempty" bson:"ai,omitempty"`
+	Connect     *UsageDrop `json:"connect,omitempty" bson:"connect,omitempty"`
+	// 被判定为有流失风险的原因
+	Reasons []string `json:"reasons" bson:"reasons"`
+}
+
+// 用户最近一段时间的用量相对于自身基线的下降情况
+type UsageDrop struct {
+	// 基线期内的日均用量
+	Baseline float64 `json:"baseline" bson:"baseline"`
+	// 最近一周的日均用量
+	Recent float64 `json:"recent" bson:"recent"`
+	// 下降百分比
+	Decrease float64 `json:"decrease" bson:"decrease"`
+	// 最近一周内用量低于基线的天数
+	LowDays int `json:"low_days" bson:"low_days"`
+}
@@ -14,6 +14,8 @@ type Cohort struct {
 	AI map[string]*Retention `json:"ai" bson:"ai"`
 	// 指该用户的Connect留存数据
 	Connect map[string]*Retention `json:"connect" bson:"connect"`
+	// 划分周所用的时区
+	Timezone string `json:"timezone" bson:"timezone"`
 }
 
 type Week struct {
@@ -42,4 +44,5 @@ type WeeklyCohortAnalysis struct {
 	TotalUsers  uint64                      `json:"total_users" bson:"total_users"`
 	AIRetention map[string]*WeeklyRetention `json:"ai_retention" bson:"ai_retention"`
 	CTRetention map[string]*WeeklyRetention `json:"ct_retention" bson:"ct_retention"`
+	Timezone    string                      `json:"timezone" bson:"timezone"`
 }
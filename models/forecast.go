@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+// 根据近期用量趋势预测的某项额度的耗尽情况
+type Forecast struct {
+	// ai 或 connect
+	Kind string `json:"kind" bson:"kind"`
+	// 额度类型，例如 credits、notice-events、streaming-events
+	Resource string `json:"resource" bson:"resource"`
+	Used     uint64 `json:"used" bson:"used"`
+	Total    int64  `json:"total" bson:"total"`
+	// 按趋势外推得到的当前日均用量
+	DailyUsage float64 `json:"daily_usage" bson:"daily_usage"`
+	// 预计耗尽时间，在有效期内不会耗尽时为空
+	ExhaustedAt *time.Time `json:"exhausted_at,omitempty" bson:"exhausted_at,omitempty"`
+	// 额度有效期的结束时间
+	PeriodEnd time.Time `json:"period_end" bson:"period_end"`
+}
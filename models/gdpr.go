@@ -0,0 +1,66 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/jyjiangkai/stat/models/cloud"
+)
+
+const (
+	DataSubjectRequestOfExport  = "export"
+	DataSubjectRequestOfErasure = "erasure"
+
+	ErasureModeOfDelete    = "delete"
+	ErasureModeOfAnonymize = "anonymize"
+
+	DataSubjectStatusOfPending   = "pending"
+	DataSubjectStatusOfRunning   = "running"
+	DataSubjectStatusOfCompleted = "completed"
+	DataSubjectStatusOfFailed    = "failed"
+)
+
+// 数据主体请求，即用户要求导出或删除其个人数据的请求
+type DataSubjectRequest struct {
+	cloud.Base `json:",inline" bson:",inline"`
+	Type       string `json:"type" bson:"type"`
+	// 删除请求的方式，直接删除或者假名化
+	Mode  string `json:"mode,omitempty" bson:"mode,omitempty"`
+	OID   string `json:"oidc_id" bson:"oidc_id"`
+	Email string `json:"email,omitempty" bson:"email,omitempty"`
+	// 邮箱的 SHA-256 摘要，请求完成后邮箱会被清除，只保留摘要用于核对
+	EmailDigest string `json:"email_digest,omitempty" bson:"email_digest,omitempty"`
+	Status      string `json:"status" bson:"status"`
+	// 假名化后替代 OID 的标识
+	Pseudonym   string         `json:"pseudonym,omitempty" bson:"pseudonym,omitempty"`
+	Report      *ErasureReport `json:"report,omitempty" bson:"report,omitempty"`
+	Error       string         `json:"error,omitempty" bson:"error,omitempty"`
+	CompletedAt *time.Time     `json:"completed_at,omitempty" bson:"completed_at,omitempty"`
+}
+
+// 删除请求的完成报告
+type ErasureReport struct {
+	Collections []*CollectionErasure `json:"collections" bson:"collections"`
+	// MailChimp 中移除成员的结果
+	MailChimp  string    `json:"mailchimp" bson:"mailchimp"`
+	StartedAt  time.Time `json:"started_at" bson:"started_at"`
+	FinishedAt time.Time `json:"finished_at" bson:"finished_at"`
+}
+
+type CollectionErasure struct {
+	Database   string `json:"database" bson:"database"`
+	Collection string `json:"collection" bson:"collection"`
+	Matched    int64  `json:"matched" bson:"matched"`
+	Deleted    int64  `json:"deleted" bson:"deleted"`
+	Anonymized int64  `json:"anonymized" bson:"anonymized"`
+	Error      string `json:"error,omitempty" bson:"error,omitempty"`
+}
+
+// 导出的用户全部数据，按集合分组
+type DataSubjectExport struct {
+	OID         string              `json:"oidc_id" bson:"oidc_id"`
+	Email       string              `json:"email" bson:"email"`
+	GeneratedAt time.Time           `json:"generated_at" bson:"generated_at"`
+	Collections map[string][]bson.M `json:"collections" bson:"collections"`
+}
@@ -0,0 +1,40 @@
+package models
+
+import (
+	"time"
+)
+
+const (
+	// 当期注册的用户
+	LifecycleOfNew = "new"
+	// 上期和当期都活跃的用户
+	LifecycleOfRetained = "retained"
+	// 上期不活跃、当期重新活跃的用户
+	LifecycleOfResurrected = "resurrected"
+	// 上期活跃、当期不活跃的用户
+	LifecycleOfChurned = "churned"
+	// 上期和当期都不活跃的用户
+	LifecycleOfDormant = "dormant"
+)
+
+// 每天或每周的增长核算，活跃指用户登录过或者使用过AI、Connect，注册当期也算活跃
+type DailyStatsOfGrowth struct {
+	Date     time.Time `json:"date" bson:"date"`
+	Tag      string    `json:"tag" bson:"tag"`
+	Timezone string    `json:"timezone" bson:"timezone"`
+	// day 或 week
+	Granularity string `json:"granularity" bson:"granularity"`
+	New         int64  `json:"new" bson:"new"`
+	Retained    int64  `json:"retained" bson:"retained"`
+	Resurrected int64  `json:"resurrected" bson:"resurrected"`
+	Churned     int64  `json:"churned" bson:"churned"`
+	Dormant     int64  `json:"dormant" bson:"dormant"`
+	// 当期第一次使用AI或Connect的用户，与上面的状态有重叠
+	Activated int64 `json:"activated" bson:"activated"`
+	// 当期活跃的用户，即 new + retained + resurrected
+	Active int64 `json:"active" bson:"active"`
+	// new + resurrected - churned
+	Growth int64 `json:"growth" bson:"growth"`
+	// (new + resurrected) / churned，没有流失用户时为0
+	QuickRatio float64 `json:"quick_ratio" bson:"quick_ratio"`
+}
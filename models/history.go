@@ -0,0 +1,17 @@
+package models
+
+import (
+	"time"
+)
+
+// user_stats 中某个用户的一个历史版本，只有关键字段(套餐、用量、额度、留存)
+// 变化时才产生新版本，即缓慢变化维度的第二类
+type UserStatVersion struct {
+	User `json:",inline" bson:",inline"`
+	// 版本生效的日期(统计时区的零点)
+	ValidFrom time.Time `json:"valid_from" bson:"valid_from"`
+	// 版本失效的日期，当前版本为空
+	ValidTo *time.Time `json:"valid_to,omitempty" bson:"valid_to"`
+	// 关键字段的摘要，用于判断是否发生变化
+	Digest string `json:"-" bson:"digest"`
+}
@@ -0,0 +1,59 @@
+package models
+
+import "time"
+
+// 某个用户在统计区间内 AI 的成本、收入和毛利
+type UserMargin struct {
+	OID         string `json:"oidc_id" bson:"oidc_id"`
+	Email       string `json:"email" bson:"email"`
+	CompanyName string `json:"company_name" bson:"company_name"`
+	Plan        string `json:"plan" bson:"plan"`
+	*ModelCost  `json:",inline" bson:",inline"`
+	// 按套餐周期折算到统计区间内的实付金额
+	Revenue     float64 `json:"revenue" bson:"revenue"`
+	GrossMargin float64 `json:"gross_margin" bson:"gross_margin"`
+	// 毛利率(%)，没有收入时为 0
+	MarginRate float64   `json:"margin_rate" bson:"margin_rate"`
+	Currency   string    `json:"currency" bson:"currency"`
+	Start      time.Time `json:"start" bson:"start"`
+	End        time.Time `json:"end" bson:"end"`
+}
+
+// 某个应用在统计区间内的 AI 成本
+type AppCost struct {
+	AppID      string `json:"app_id" bson:"app_id"`
+	AppType    string `json:"app_type" bson:"app_type"`
+	OID        string `json:"oidc_id" bson:"oidc_id"`
+	*ModelCost `json:",inline" bson:",inline"`
+	Currency   string `json:"currency" bson:"currency"`
+}
+
+// 某个套餐下所有用户在统计区间内的成本、收入和毛利
+type PlanMargin struct {
+	Plan        string  `json:"plan" bson:"plan"`
+	Users       int64   `json:"users" bson:"users"`
+	Cost        float64 `json:"cost" bson:"cost"`
+	Revenue     float64 `json:"revenue" bson:"revenue"`
+	GrossMargin float64 `json:"gross_margin" bson:"gross_margin"`
+	MarginRate  float64 `json:"margin_rate" bson:"margin_rate"`
+	// 毛利为负的用户数
+	Unprofitable int64  `json:"unprofitable" bson:"unprofitable"`
+	Currency     string `json:"currency" bson:"currency"`
+}
+
+// 按模型拆分的 token 用量和成本
+type ModelCost struct {
+	ChatGPT35     uint64  `json:"chatgpt_3_5" bson:"chatgpt_3_5"`
+	ChatGPT4      uint64  `json:"chatgpt_4" bson:"chatgpt_4"`
+	ChatGPT35Cost float64 `json:"chatgpt_3_5_cost" bson:"chatgpt_3_5_cost"`
+	ChatGPT4Cost  float64 `json:"chatgpt_4_cost" bson:"chatgpt_4_cost"`
+	Cost          float64 `json:"cost" bson:"cost"`
+}
+
+func (mc *ModelCost) Add(other *ModelCost) {
+	mc.ChatGPT35 += other.ChatGPT35
+	mc.ChatGPT4 += other.ChatGPT4
+	mc.ChatGPT35Cost += other.ChatGPT35Cost
+	mc.ChatGPT4Cost += other.ChatGPT4Cost
+	mc.Cost += other.Cost
+}
@@ -0,0 +1,81 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jyjiangkai/stat/models/cloud"
+)
+
+const (
+	PlanTransitionOfFreeToPaid   = "free_to_paid"
+	PlanTransitionOfUpgrade      = "upgrade"
+	PlanTransitionOfDowngrade    = "downgrade"
+	PlanTransitionOfCancellation = "cancellation"
+	PlanTransitionOfChange       = "change"
+)
+
+// 用户某一天的AI和Connect套餐快照
+type PlanSnapshot struct {
+	Date    time.Time    `json:"date" bson:"date"`
+	OID     string       `json:"oidc_id" bson:"oidc_id"`
+	AI      *PlanOfLevel `json:"ai" bson:"ai"`
+	Connect *PlanOfLevel `json:"connect" bson:"connect"`
+	// 快照日期所在的时区
+	Timezone string `json:"timezone" bson:"timezone"`
+}
+
+type PlanOfLevel struct {
+	Premium bool   `json:"premium" bson:"premium"`
+	Type    string `json:"type" bson:"type"`
+	Level   int    `json:"level" bson:"level"`
+}
+
+// 用户套餐在相邻两天快照之间的变化
+type PlanTransition struct {
+	cloud.Base `json:",inline" bson:",inline"`
+	Date       time.Time    `json:"date" bson:"date"`
+	OID        string       `json:"oidc_id" bson:"oidc_id"`
+	Kind       string       `json:"kind" bson:"kind"`
+	Type       string       `json:"type" bson:"type"`
+	From       *PlanOfLevel `json:"from" bson:"from"`
+	To         *PlanOfLevel `json:"to" bson:"to"`
+}
+
+// 一段时间内套餐之间的转移矩阵，Counts[from][to]为转移次数
+type PlanTransitionMatrix struct {
+	Kind   string                      `json:"kind" bson:"kind"`
+	Start  time.Time                   `json:"start" bson:"start"`
+	End    time.Time                   `json:"end" bson:"end"`
+	Plans  []string                    `json:"plans" bson:"plans"`
+	Counts map[string]map[string]int64 `json:"counts" bson:"counts"`
+}
+
+// 某个时间段内各类套餐变化的次数
+type PlanTransitionCount struct {
+	Date         time.Time `json:"date" bson:"date"`
+	FreeToPaid   int64     `json:"free_to_paid" bson:"free_to_paid"`
+	Upgrade      int64     `json:"upgrade" bson:"upgrade"`
+	Downgrade    int64     `json:"downgrade" bson:"downgrade"`
+	Cancellation int64     `json:"cancellation" bson:"cancellation"`
+	Change       int64     `json:"change" bson:"change"`
+}
+
+func NewPlanOfLevel(level *Level) *PlanOfLevel {
+	plan := &PlanOfLevel{
+		Type:  "Free",
+		Level: 1,
+	}
+	if level == nil {
+		return plan
+	}
+	plan.Premium = level.Premium
+	if level.Plan != nil {
+		plan.Type = level.Plan.Type
+		plan.Level = level.Plan.Level
+	}
+	return plan
+}
+
+func (p *PlanOfLevel) Equal(other *PlanOfLevel) bool {
+	return p.Premium == other.Premium && p.Type == other.Type && p.Level == other.Level
+}
@@ -0,0 +1,66 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jyjiangkai/stat/models/cloud"
+)
+
+const (
+	ReconciliationModeOfSample = "sample"
+	ReconciliationModeOfFull   = "full"
+
+	ReconciliationStatusOfPending   = "pending"
+	ReconciliationStatusOfRunning   = "running"
+	ReconciliationStatusOfCompleted = "completed"
+	ReconciliationStatusOfFailed    = "failed"
+
+	// 统计值与重新计算的值不一致
+	ReconciliationIssueOfMismatch = "mismatch"
+	// user_stats 中存在但 users 中已不存在的用户
+	ReconciliationIssueOfOrphan = "orphan"
+	// users 中存在但 user_stats 中缺失的用户
+	ReconciliationIssueOfMissing = "missing"
+	// 长时间未被刷新的统计用户
+	ReconciliationIssueOfStale = "stale"
+)
+
+// 用于记录一次 user_stats 与源数据(users、bills、ai_bills)的对账结果
+type ReconciliationReport struct {
+	cloud.Base `json:",inline" bson:",inline"`
+	// sample 为抽样对账，full 为全量对账
+	Mode string `json:"mode" bson:"mode"`
+	// 抽样对账时抽取的用户数量
+	SampleSize int64 `json:"sample_size,omitempty" bson:"sample_size,omitempty"`
+	// 是否修复发现的问题
+	Repair bool   `json:"repair" bson:"repair"`
+	Status string `json:"status" bson:"status"`
+	// 核对过的统计用户数量
+	Checked    int64 `json:"checked" bson:"checked"`
+	Mismatches int64 `json:"mismatches" bson:"mismatches"`
+	Orphans    int64 `json:"orphans" bson:"orphans"`
+	Missing    int64 `json:"missing" bson:"missing"`
+	Stale      int64 `json:"stale" bson:"stale"`
+	Repaired   int64 `json:"repaired" bson:"repaired"`
+	// 问题明细，数量过多时只保留前面的部分
+	Issues     []*ReconciliationIssue `json:"issues" bson:"issues"`
+	Truncated  bool                   `json:"truncated" bson:"truncated"`
+	StartedAt  time.Time              `json:"started_at" bson:"started_at"`
+	FinishedAt *time.Time             `json:"finished_at,omitempty" bson:"finished_at,omitempty"`
+	Error      string                 `json:"error,omitempty" bson:"error,omitempty"`
+}
+
+type ReconciliationIssue struct {
+	OID  string `json:"oidc_id" bson:"oidc_id"`
+	Type string `json:"type" bson:"type"`
+	// 不一致的字段，例如 bills.ai.total
+	Field string `json:"field,omitempty" bson:"field,omitempty"`
+	// 根据源数据重新计算的值
+	Expected uint64 `json:"expected" bson:"expected"`
+	// user_stats 中的值
+	Actual uint64 `json:"actual" bson:"actual"`
+	// 统计用户最后刷新的时间
+	UpdatedAt time.Time `json:"updated_at,omitempty" bson:"updated_at,omitempty"`
+	Repaired  bool      `json:"repaired" bson:"repaired"`
+	Error     string    `json:"error,omitempty" bson:"error,omitempty"`
+}
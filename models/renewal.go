@@ -0,0 +1,46 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/jyjiangkai/stat/models/cloud"
+)
+
+const (
+	RenewalStatusOfPending = "pending"
+	RenewalStatusOfRenewed = "renewed"
+	RenewalStatusOfLapsed  = "lapsed"
+)
+
+// 用于记录一个付费套餐到期后是否续费
+type Renewal struct {
+	cloud.Base `json:",inline" bson:",inline"`
+	// 到期的套餐对应的quota记录
+	QuotaID   primitive.ObjectID `json:"quota_id" bson:"quota_id"`
+	OID       string             `json:"oidc_id" bson:"oidc_id"`
+	Kind      string             `json:"kind" bson:"kind"`
+	PlanType  string             `json:"plan_type" bson:"plan_type"`
+	PlanLevel int                `json:"plan_level" bson:"plan_level"`
+	ExpiredAt time.Time          `json:"expired_at" bson:"expired_at"`
+	Status    string             `json:"status" bson:"status"`
+	// 续费后的套餐，未续费时为空
+	NextQuotaID *primitive.ObjectID `json:"next_quota_id,omitempty" bson:"next_quota_id,omitempty"`
+	NextPlan    *Plan               `json:"next_plan,omitempty" bson:"next_plan,omitempty"`
+	RenewedAt   *time.Time          `json:"renewed_at,omitempty" bson:"renewed_at,omitempty"`
+	// 是否已经发送过即将到期的通知
+	Notified bool `json:"notified" bson:"notified"`
+}
+
+// 某个月到期的某类套餐的续费情况
+type RenewalRate struct {
+	Month    string  `json:"month" bson:"month"`
+	Kind     string  `json:"kind" bson:"kind"`
+	PlanType string  `json:"plan_type" bson:"plan_type"`
+	Expired  int64   `json:"expired" bson:"expired"`
+	Renewed  int64   `json:"renewed" bson:"renewed"`
+	Lapsed   int64   `json:"lapsed" bson:"lapsed"`
+	Pending  int64   `json:"pending" bson:"pending"`
+	Rate     float64 `json:"rate" bson:"rate"`
+}
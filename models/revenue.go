@@ -0,0 +1,48 @@
+package models
+
+import "time"
+
+// 某一时间点的经常性收入
+type RevenuePoint struct {
+	Date time.Time `json:"date" bson:"date"`
+	// 月度经常性收入，按套餐周期把实付金额折算到每个月
+	MRR float64 `json:"mrr" bson:"mrr"`
+	// 年度经常性收入，即 MRR * 12
+	ARR float64 `json:"arr" bson:"arr"`
+	// 每个付费用户的平均收入
+	ARPU        float64 `json:"arpu" bson:"arpu"`
+	PayingUsers int64   `json:"paying_users" bson:"paying_users"`
+}
+
+// 某个月相对于上个月的 MRR 变化构成
+type RevenueMovement struct {
+	Month    string  `json:"month" bson:"month"`
+	StartMRR float64 `json:"start_mrr" bson:"start_mrr"`
+	// 首次付费用户带来的 MRR
+	New float64 `json:"new" bson:"new"`
+	// 曾经流失又重新付费的用户带来的 MRR
+	Reactivation float64 `json:"reactivation" bson:"reactivation"`
+	Expansion    float64 `json:"expansion" bson:"expansion"`
+	Contraction  float64 `json:"contraction" bson:"contraction"`
+	Churned      float64 `json:"churned" bson:"churned"`
+	EndMRR       float64 `json:"end_mrr" bson:"end_mrr"`
+	NewUsers     int64   `json:"new_users" bson:"new_users"`
+	ChurnedUsers int64   `json:"churned_users" bson:"churned_users"`
+}
+
+// 按首次付费月份划分的一组用户的净收入留存
+type RevenueRetention struct {
+	Cohort   string          `json:"cohort" bson:"cohort"`
+	Users    int64           `json:"users" bson:"users"`
+	StartMRR float64         `json:"start_mrr" bson:"start_mrr"`
+	Months   []*NetRetention `json:"months" bson:"months"`
+}
+
+type NetRetention struct {
+	Month string `json:"month" bson:"month"`
+	// 距离首次付费月份的月数
+	Offset int     `json:"offset" bson:"offset"`
+	MRR    float64 `json:"mrr" bson:"mrr"`
+	// 净收入留存率(%)，即当月 MRR / 首月 MRR
+	NRR float64 `json:"nrr" bson:"nrr"`
+}
@@ -0,0 +1,31 @@
+package models
+
+import "time"
+
+// 用户某个月的使用账单，用于支持人员发送给客户
+type Statement struct {
+	OID         string    `json:"oidc_id" bson:"oidc_id"`
+	Email       string    `json:"email" bson:"email"`
+	CompanyName string    `json:"company_name" bson:"company_name"`
+	Month       string    `json:"month" bson:"month"`
+	Start       time.Time `json:"start" bson:"start"`
+	End         time.Time `json:"end" bson:"end"`
+	// 生成账单时用户的套餐
+	Class *Class `json:"class" bson:"class"`
+	// 当月的付款记录
+	Payments []*Payment `json:"payments" bson:"payments"`
+	// 与当月有交集的 credits 周期
+	Credits []*StatementCredits `json:"credits" bson:"credits"`
+	// 只包含当月账单的 AI 和 Connect 使用详情
+	AI          *UserAIDetail      `json:"ai" bson:"ai"`
+	Connect     *UserConnectDetail `json:"connect" bson:"connect"`
+	GeneratedAt time.Time          `json:"generated_at" bson:"generated_at"`
+}
+
+type StatementCredits struct {
+	Type  string    `json:"type" bson:"type"`
+	Used  uint64    `json:"used" bson:"used"`
+	Total int64     `json:"total" bson:"total"`
+	Start time.Time `json:"start" bson:"start"`
+	End   time.Time `json:"end" bson:"end"`
+}
@@ -20,4 +20,5 @@ type WeeklyUserTrack struct {
 	KnowledgeBaseNum int64  `json:"knowledge_base_num" bson:"knowledge_base_num"`
 	ViewPriceNum     int64  `json:"view_price_num" bson:"view_price_num"`
 	PremiumNum       int64  `json:"premium_num" bson:"premium_num"`
+	Timezone         string `json:"timezone" bson:"timezone"`
 }
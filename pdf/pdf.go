@@ -0,0 +1,161 @@
+package pdf
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/go-pdf/fpdf"
+
+	"github.com/jyjiangkai/stat/log"
+)
+
+const (
+	margin = 50.0
+
+	fontFamily   = "statement"
+	fallbackFont = "Helvetica"
+	ellipsis     = "..."
+)
+
+var (
+	cfg     Config
+	regular []byte
+	bold    []byte
+	once    sync.Once
+)
+
+type Config struct {
+	// Font is a TrueType font file which has the glyphs of every language
+	// the names of users, apps and connections are written in, e.g. the
+	// DroidSansFallbackFull.ttf of fonts-droid-fallback for CJK
+	Font string `yaml:"font"`
+	// BoldFont is the bold variant of Font, Font is used when it's empty
+	BoldFont string `yaml:"bold_font"`
+}
+
+// Init loads the fonts embedded in every document, without a font the
+// standard Helvetica is used, which only renders the WinAnsi characters.
+func Init(ctx context.Context, c Config) error {
+	var err error
+	once.Do(func() {
+		cfg = c
+		if cfg.Font == "" {
+			log.Warn(ctx).Msg("no pdf font is configured, the characters out of WinAnsi can't be rendered")
+			return
+		}
+		if regular, err = os.ReadFile(cfg.Font); err != nil {
+			return
+		}
+		bold = regular
+		if cfg.BoldFont != "" {
+			if bold, err = os.ReadFile(cfg.BoldFont); err != nil {
+				return
+			}
+		}
+		log.Info(ctx).Str("font", cfg.Font).Str("bold_font", cfg.BoldFont).Msg("the pdf fonts have been loaded")
+	})
+	return err
+}
+
+// Document is a writer for text reports, it lays out titles, paragraphs and
+// tables on A4 pages with the configured TrueType font embedded.
+type Document struct {
+	f      *fpdf.Fpdf
+	family string
+	tr     func(string) string
+}
+
+func New() *Document {
+	d := &Document{
+		f:      fpdf.New("P", "pt", "A4", ""),
+		family: fontFamily,
+		tr:     func(s string) string { return s },
+	}
+	if len(regular) != 0 {
+		d.f.AddUTF8FontFromBytes(fontFamily, "", regular)
+		d.f.AddUTF8FontFromBytes(fontFamily, "B", bold)
+	} else {
+		d.family = fallbackFont
+		d.tr = d.f.UnicodeTranslatorFromDescriptor("")
+	}
+	d.f.SetMargins(margin, margin, margin)
+	d.f.SetAutoPageBreak(true, margin)
+	d.f.AddPage()
+	return d
+}
+
+func (d *Document) font(style string, size float64) {
+	d.f.SetFont(d.family, style, size)
+}
+
+func (d *Document) Title(text string) {
+	d.font("B", 16)
+	d.f.CellFormat(0, 24, d.tr(text), "", 1, "L", false, 0, "")
+	d.f.Ln(6)
+}
+
+func (d *Document) Heading(text string) {
+	d.font("B", 12)
+	d.f.CellFormat(0, 22, d.tr(text), "", 1, "L", false, 0, "")
+	d.f.Ln(4)
+}
+
+func (d *Document) Text(text string) {
+	d.font("", 10)
+	d.f.MultiCell(0, 14, d.tr(text), "", "L", false)
+}
+
+// Table renders the rows in columns of equal width, the header is repeated
+// on every page the table spans.
+func (d *Document) Table(header []string, rows [][]string) {
+	if len(header) == 0 {
+		return
+	}
+	pageWidth, pageHeight := d.f.GetPageSize()
+	width := (pageWidth - 2*margin) / float64(len(header))
+	line := func(style string, cells []string) {
+		d.font(style, 9)
+		for idx := range header {
+			cell := ""
+			if idx < len(cells) {
+				cell = d.truncate(d.tr(cells[idx]), width-4)
+			}
+			d.f.CellFormat(width, 13, cell, "", 0, "L", false, 0, "")
+		}
+		d.f.Ln(13)
+	}
+	line("B", header)
+	for _, row := range rows {
+		if d.f.GetY()+13 > pageHeight-margin {
+			d.f.AddPage()
+			line("B", header)
+		}
+		line("", row)
+	}
+	d.f.Ln(8)
+}
+
+// truncate cuts the text with an ellipsis to fit in the width with the
+// current font.
+func (d *Document) truncate(text string, width float64) string {
+	if d.f.GetStringWidth(text) <= width {
+		return text
+	}
+	runes := []rune(text)
+	for len(runes) != 0 && d.f.GetStringWidth(string(runes)+ellipsis) > width {
+		runes = runes[:len(runes)-1]
+	}
+	return string(runes) + ellipsis
+}
+
+// Bytes returns the encoded PDF file.
+func (d *Document) Bytes() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := d.f.Output(buf); err != nil {
+		return nil, fmt.Errorf("failed to render pdf: %w", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,223 @@
+package privacy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/jyjiangkai/stat/api"
+	"github.com/jyjiangkai/stat/auth"
+	"github.com/jyjiangkai/stat/log"
+	"github.com/jyjiangkai/stat/models"
+)
+
+type Field string
+
+const (
+	FieldOfEmail        Field = "email"
+	FieldOfPhone        Field = "phone"
+	FieldOfGivenName    Field = "given_name"
+	FieldOfFamilyName   Field = "family_name"
+	FieldOfCompanyEmail Field = "company_email"
+	// FieldOfMessage is the chat message in the payload of an action
+	FieldOfMessage Field = "message"
+)
+
+type Action string
+
+const (
+	ActionOfShow Action = "show"
+	ActionOfMask Action = "mask"
+	ActionOfDrop Action = "drop"
+)
+
+var (
+	cfg  Config
+	once sync.Once
+
+	// defaultPolicies is how the PII is shaped for every role unless the
+	// config says otherwise, a field missing in a policy is shown, a role
+	// missing here gets every field dropped.
+	defaultPolicies = map[auth.Role]Policy{
+		auth.RoleOfAdmin: {},
+		auth.RoleOfAnalyst: {
+			FieldOfEmail:        ActionOfMask,
+			FieldOfPhone:        ActionOfMask,
+			FieldOfGivenName:    ActionOfMask,
+			FieldOfFamilyName:   ActionOfMask,
+			FieldOfCompanyEmail: ActionOfMask,
+			FieldOfMessage:      ActionOfDrop,
+		},
+		auth.RoleOfMarketing: {
+			FieldOfPhone:   ActionOfDrop,
+			FieldOfMessage: ActionOfDrop,
+		},
+		auth.RoleOfSupport: {
+			FieldOfMessage: ActionOfMask,
+		},
+	}
+	dropAll = Policy{
+		FieldOfEmail:        ActionOfDrop,
+		FieldOfPhone:        ActionOfDrop,
+		FieldOfGivenName:    ActionOfDrop,
+		FieldOfFamilyName:   ActionOfDrop,
+		FieldOfCompanyEmail: ActionOfDrop,
+		FieldOfMessage:      ActionOfDrop,
+	}
+	policies = defaultPolicies
+)
+
+// Policy maps the PII fields to what is done to them.
+type Policy map[Field]Action
+
+type Config struct {
+	// Policies overrides the fields of the default policy of each role
+	Policies map[auth.Role]Policy `yaml:"policies"`
+}
+
+func Init(ctx context.Context, c Config) error {
+	var err error
+	once.Do(func() {
+		cfg = c
+		merged := make(map[auth.Role]Policy)
+		for role, policy := range defaultPolicies {
+			merged[role] = copyPolicy(policy)
+		}
+		for role, policy := range c.Policies {
+			if !auth.ValidRole(role) {
+				err = fmt.Errorf("unknown role %s in privacy policies", role)
+				return
+			}
+			if _, ok := merged[role]; !ok {
+				merged[role] = Policy{}
+			}
+			for field, action := range policy {
+				if action != ActionOfShow && action != ActionOfMask && action != ActionOfDrop {
+					err = fmt.Errorf("unknown action %s of field %s", action, field)
+					return
+				}
+				merged[role][field] = action
+			}
+		}
+		policies = merged
+		log.Info(ctx).Int("roles", len(policies)).Msg("the privacy policies have been loaded")
+	})
+	return err
+}
+
+func copyPolicy(policy Policy) Policy {
+	result := make(Policy, len(policy))
+	for field, action := range policy {
+		result[field] = action
+	}
+	return result
+}
+
+// PolicyOf returns the policy applying to the caller of the request, all
+// PII is dropped for an unknown caller.
+func PolicyOf(ctx context.Context) Policy {
+	principal := auth.GetPrincipal(ctx)
+	if principal == nil {
+		return dropAll
+	}
+	if policy, ok := policies[principal.Role]; ok {
+		return policy
+	}
+	return dropAll
+}
+
+// Apply shapes the PII of the response in place according to the policy of
+// the caller, the responses carrying no PII are left untouched.
+func Apply(ctx context.Context, resp any) {
+	policy := PolicyOf(ctx)
+	if len(policy) == 0 {
+		return
+	}
+	apply(policy, resp)
+}
+
+func apply(policy Policy, resp any) {
+	switch v := resp.(type) {
+	case *api.ListResult:
+		for _, item := range v.List {
+			apply(policy, item)
+		}
+	case []interface{}:
+		for _, item := range v {
+			apply(policy, item)
+		}
+	case *models.User:
+		v.Email = policy.shape(FieldOfEmail, v.Email)
+		v.Phone = policy.shape(FieldOfPhone, v.Phone)
+		v.GivenName = policy.shape(FieldOfGivenName, v.GivenName)
+		v.FamilyName = policy.shape(FieldOfFamilyName, v.FamilyName)
+		v.CompanyEmail = policy.shape(FieldOfCompanyEmail, v.CompanyEmail)
+	case *models.PremiumUser:
+		v.Email = policy.shape(FieldOfEmail, v.Email)
+		v.Phone = policy.shape(FieldOfPhone, v.Phone)
+		v.GivenName = policy.shape(FieldOfGivenName, v.GivenName)
+		v.FamilyName = policy.shape(FieldOfFamilyName, v.FamilyName)
+		v.CompanyEmail = policy.shape(FieldOfCompanyEmail, v.CompanyEmail)
+	case *models.ChurnRisk:
+		v.Email = policy.shape(FieldOfEmail, v.Email)
+	case *models.UserMargin:
+		v.Email = policy.shape(FieldOfEmail, v.Email)
+	case *models.Statement:
+		v.Email = policy.shape(FieldOfEmail, v.Email)
+	case *models.Action:
+		v.User = policy.shape(FieldOfEmail, v.User)
+		if v.Payload != nil {
+			v.Payload.Message = policy.shape(FieldOfMessage, v.Payload.Message)
+		}
+	case []*models.Action:
+		for _, item := range v {
+			apply(policy, item)
+		}
+	}
+}
+
+func (p Policy) shape(field Field, val string) string {
+	if val == "" {
+		return val
+	}
+	switch p[field] {
+	case ActionOfDrop:
+		return ""
+	case ActionOfMask:
+		return mask(field, val)
+	}
+	return val
+}
+
+func mask(field Field, val string) string {
+	switch field {
+	case FieldOfEmail, FieldOfCompanyEmail:
+		local, domain, ok := strings.Cut(val, "@")
+		if !ok {
+			return maskRunes(val, 1, 0)
+		}
+		return maskRunes(local, 1, 0) + "@" + domain
+	case FieldOfPhone:
+		return maskRunes(val, 0, 4)
+	case FieldOfMessage:
+		return fmt.Sprintf("[masked %d characters]", len([]rune(val)))
+	}
+	return maskRunes(val, 1, 0)
+}
+
+// maskRunes keeps the head and tail runes of the string and replaces the
+// others by asterisks, at least half of the string is always masked.
+func maskRunes(val string, head, tail int) string {
+	runes := []rune(val)
+	if head+tail > len(runes)/2 {
+		head, tail = 0, 0
+		if len(runes) > 1 {
+			head = 1
+		}
+	}
+	for idx := head; idx < len(runes)-tail; idx++ {
+		runes[idx] = '*'
+	}
+	return string(runes)
+}
@@ -0,0 +1,205 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/jyjiangkai/stat/auth"
+	"github.com/jyjiangkai/stat/log"
+)
+
+const (
+	DefaultRate         = 2.0
+	DefaultBurst        = 60.0
+	DefaultBudget       = 3000.0
+	DefaultBudgetWindow = time.Hour
+
+	// how often the idle states are looked for
+	evictInterval = time.Minute
+)
+
+var (
+	cfg     Config
+	window  = DefaultBudgetWindow
+	limiter = NewLimiter()
+	once    sync.Once
+)
+
+// Limit is the allowance of a caller: the bucket holds Burst cost units and
+// refills Rate units per second, and no more than Budget units may be spent
+// in a budget window.
+type Limit struct {
+	Rate   float64 `yaml:"rate"`
+	Burst  float64 `yaml:"burst"`
+	Budget float64 `yaml:"budget"`
+}
+
+type Config struct {
+	Enable bool  `yaml:"enable"`
+	Limit  Limit `yaml:",inline"`
+	// BudgetWindow is a duration like 1h
+	BudgetWindow string `yaml:"budget_window"`
+	// Roles and Principals override the default limit, the principal is the
+	// id of an API key like apikey:<id> or the subject of a bearer token
+	Roles      map[auth.Role]Limit `yaml:"roles"`
+	Principals map[string]Limit    `yaml:"principals"`
+}
+
+func Init(ctx context.Context, c Config) error {
+	var err error
+	once.Do(func() {
+		cfg = c
+		if c.BudgetWindow != "" {
+			window, err = time.ParseDuration(c.BudgetWindow)
+			if err != nil || window <= 0 {
+				err = fmt.Errorf("invalid budget window %s", c.BudgetWindow)
+				return
+			}
+		}
+		limit := withDefaults(c.Limit)
+		log.Info(ctx).Float64("rate", limit.Rate).Float64("burst", limit.Burst).
+			Float64("budget", limit.Budget).Msgf("the rate limiting has been %s\n", switchStatus(c.Enable))
+	})
+	return err
+}
+
+func Enabled() bool {
+	return cfg.Enable
+}
+
+func withDefaults(l Limit) Limit {
+	if l.Rate <= 0 {
+		l.Rate = DefaultRate
+	}
+	if l.Burst <= 0 {
+		l.Burst = DefaultBurst
+	}
+	if l.Budget <= 0 {
+		l.Budget = DefaultBudget
+	}
+	return l
+}
+
+// LimitOf returns the limit of the caller, a principal override wins over
+// the role one, which wins over the default.
+func LimitOf(principal *auth.Principal) Limit {
+	if l, ok := cfg.Principals[principal.ID]; ok {
+		return withDefaults(l)
+	}
+	if l, ok := cfg.Roles[principal.Role]; ok {
+		return withDefaults(l)
+	}
+	return withDefaults(cfg.Limit)
+}
+
+// Decision is the outcome of taking the cost of a request.
+type Decision struct {
+	Allowed         bool
+	Reason          string
+	RetryAfter      time.Duration
+	Limit           Limit
+	Remaining       float64
+	BudgetRemaining float64
+	BudgetReset     time.Time
+}
+
+type state struct {
+	tokens      float64
+	last        time.Time
+	windowStart time.Time
+	spent       float64
+	// when the bucket is full again
+	full time.Time
+}
+
+// idle reports whether the state is the same as a new one by now, its
+// bucket is full and its budget window has passed.
+func (s *state) idle(now time.Time) bool {
+	return !now.Before(s.full) && now.Sub(s.windowStart) >= window
+}
+
+type Limiter struct {
+	mutex  sync.Mutex
+	states map[string]*state
+	swept  time.Time
+}
+
+func NewLimiter() *Limiter {
+	return &Limiter{
+		states: make(map[string]*state),
+	}
+}
+
+// Take charges the cost to the caller identified by key.
+func Take(key string, limit Limit, cost float64, now time.Time) *Decision {
+	return limiter.Take(key, limit, cost, now)
+}
+
+func (l *Limiter) Take(key string, limit Limit, cost float64, now time.Time) *Decision {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.evict(now)
+	s, ok := l.states[key]
+	if !ok {
+		s = &state{
+			tokens:      limit.Burst,
+			last:        now,
+			windowStart: now,
+		}
+		l.states[key] = s
+	}
+	s.tokens = math.Min(limit.Burst, s.tokens+now.Sub(s.last).Seconds()*limit.Rate)
+	s.last = now
+	if now.Sub(s.windowStart) >= window {
+		s.windowStart = now
+		s.spent = 0
+	}
+
+	decision := &Decision{
+		Limit:       limit,
+		BudgetReset: s.windowStart.Add(window),
+	}
+	// a request costing more than the bucket holds is let through once the
+	// bucket is full, otherwise it could never be served
+	charge := math.Min(cost, limit.Burst)
+	switch {
+	case s.spent+cost > limit.Budget:
+		decision.Reason = fmt.Sprintf("the query budget of %.0f per %s is exhausted", limit.Budget, window)
+		decision.RetryAfter = decision.BudgetReset.Sub(now)
+	case s.tokens < charge:
+		decision.Reason = "too many requests"
+		decision.RetryAfter = time.Duration((charge - s.tokens) / limit.Rate * float64(time.Second))
+	default:
+		decision.Allowed = true
+		s.tokens -= charge
+		s.spent += cost
+	}
+	s.full = now.Add(time.Duration((limit.Burst - s.tokens) / limit.Rate * float64(time.Second)))
+	decision.Remaining = math.Floor(s.tokens)
+	decision.BudgetRemaining = math.Max(0, math.Floor(limit.Budget-s.spent))
+	return decision
+}
+
+// evict drops the idle states, so the states of the callers identified by
+// their addresses don't pile up.
+func (l *Limiter) evict(now time.Time) {
+	if now.Sub(l.swept) < evictInterval {
+		return
+	}
+	l.swept = now
+	for key, s := range l.states {
+		if s.idle(now) {
+			delete(l.states, key)
+		}
+	}
+}
+
+func switchStatus(enable bool) string {
+	if enable {
+		return "enabled"
+	}
+	return "disabled"
+}
@@ -0,0 +1,60 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiterTake(t *testing.T) {
+	l := NewLimiter()
+	limit := Limit{Rate: 1, Burst: 10, Budget: 25}
+	t0 := time.Date(2024, 5, 15, 10, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name            string
+		at              time.Duration
+		cost            float64
+		allowed         bool
+		remaining       float64
+		budgetRemaining float64
+		retryAfter      time.Duration
+	}{
+		{name: "a new caller starts with a full bucket", at: 0, cost: 4, allowed: true, remaining: 6, budgetRemaining: 21},
+		{name: "the bucket is short", at: 0, cost: 8, remaining: 6, budgetRemaining: 21, retryAfter: 2 * time.Second},
+		{name: "the bucket refilled", at: 2 * time.Second, cost: 8, allowed: true, remaining: 0, budgetRemaining: 13},
+		{name: "the budget is short", at: 12 * time.Second, cost: 20, remaining: 10, budgetRemaining: 13, retryAfter: time.Hour - 12*time.Second},
+		{name: "the rest of the budget", at: 12 * time.Second, cost: 10, allowed: true, remaining: 0, budgetRemaining: 3},
+		{name: "the budget is exhausted", at: 30 * time.Second, cost: 5, remaining: 10, budgetRemaining: 3, retryAfter: time.Hour - 30*time.Second},
+		{name: "the budget window passed", at: time.Hour, cost: 5, allowed: true, remaining: 5, budgetRemaining: 20},
+	}
+	for _, c := range cases {
+		d := l.Take("apikey:a", limit, c.cost, t0.Add(c.at))
+		if d.Allowed != c.allowed || d.Remaining != c.remaining || d.BudgetRemaining != c.budgetRemaining || d.RetryAfter != c.retryAfter {
+			t.Errorf("%s: Take() = %+v, want allowed %v, remaining %v, budget remaining %v, retry after %v",
+				c.name, d, c.allowed, c.remaining, c.budgetRemaining, c.retryAfter)
+		}
+	}
+
+	// a request costing more than the bucket holds is served once it is full
+	d := l.Take("apikey:b", Limit{Rate: 1, Burst: 10, Budget: 1000}, 100, t0)
+	if !d.Allowed || d.Remaining != 0 || d.BudgetRemaining != 900 {
+		t.Errorf("Take() of a large cost = %+v", d)
+	}
+}
+
+func TestLimiterEvict(t *testing.T) {
+	l := NewLimiter()
+	limit := Limit{Rate: 1, Burst: 10, Budget: 100}
+	t0 := time.Date(2024, 5, 15, 10, 0, 0, 0, time.UTC)
+	l.Take("ip:a", limit, 1, t0)
+	l.Take("ip:b", limit, 1, t0.Add(30*time.Minute))
+	l.Take("ip:c", limit, 1, t0.Add(window+time.Minute))
+	if _, ok := l.states["ip:a"]; ok {
+		t.Errorf("the idle state of ip:a wasn't evicted")
+	}
+	if _, ok := l.states["ip:b"]; !ok {
+		t.Errorf("the state of ip:b within its budget window was evicted")
+	}
+	if len(l.states) != 2 {
+		t.Errorf("len(states) = %d, want 2", len(l.states))
+	}
+}
@@ -0,0 +1,162 @@
+package router
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/gin-contrib/requestid"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/jyjiangkai/stat/api"
+	"github.com/jyjiangkai/stat/auth"
+	"github.com/jyjiangkai/stat/constant"
+	"github.com/jyjiangkai/stat/controller"
+	"github.com/jyjiangkai/stat/internal/services"
+	"github.com/jyjiangkai/stat/models"
+)
+
+const (
+	// the request body kept as the filters of an audit log
+	auditMaxFiltersSize = 64 * 1024
+)
+
+var (
+	// privateBodyRoutes are the routes whose request body identifies a data
+	// subject, it is left out of the filters
+	privateBodyRoutes = map[string]bool{
+		"POST /v1/gdpr/exports":  true,
+		"POST /v1/gdpr/erasures": true,
+	}
+	// exportRoutes are the routes handing data out of the system
+	exportRoutes = map[string]bool{
+		"GET /v1/download":                     true,
+		"GET /v1/users/:oid/statements/:month": true,
+		"POST /v1/gdpr/exports":                true,
+	}
+)
+
+// Audit records every request, the ones served without authentication as
+// the anonymous caller. It must be used before Authenticate so the requests
+// it rejects are recorded too.
+func Audit(svc *services.AuditService) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		start := time.Now()
+		filters := ""
+		private := privateBodyRoutes[ctx.Request.Method+" "+ctx.FullPath()]
+		if ctx.Request.Body != nil && ctx.Request.Method != http.MethodGet && !private {
+			body, err := io.ReadAll(ctx.Request.Body)
+			if err == nil {
+				ctx.Request.Body = io.NopCloser(bytes.NewReader(body))
+				if len(body) > auditMaxFiltersSize {
+					body = body[:auditMaxFiltersSize]
+				}
+				filters = string(body)
+			}
+		}
+
+		ctx.Next()
+
+		// the requests Authenticate rejects have no principal, they are
+		// recorded as the anonymous caller
+		principal := auth.GetPrincipal(ctx)
+		if principal == nil {
+			principal = auth.Anonymous()
+		}
+		route := ctx.Request.Method + " " + ctx.FullPath()
+		entry := &models.AuditLog{
+			ID:        primitive.NewObjectID(),
+			Time:      start,
+			RequestID: requestid.Get(ctx),
+			Principal: principal.ID,
+			Name:      principal.Name,
+			Role:      string(principal.Role),
+			Method:    ctx.Request.Method,
+			Route:     ctx.FullPath(),
+			Path:      ctx.Request.URL.Path,
+			Query:     ctx.Request.URL.Query(),
+			Filters:   filters,
+			Status:    ctx.Writer.Status(),
+			ClientIP:  ctx.ClientIP(),
+			Duration:  time.Since(start).Milliseconds(),
+		}
+		viewed := make(map[string]struct{})
+		if oid := ctx.Param(controller.ParamOfUserOID); oid != "" {
+			viewed[oid] = struct{}{}
+		}
+		resp, ok := ctx.Get(constant.ContextResponse)
+		if ok && resp != nil {
+			entry.ResultCount, entry.Total = countResult(resp, viewed)
+		}
+		for oid := range viewed {
+			entry.ViewedUsers = append(entry.ViewedUsers, oid)
+		}
+		if entry.Status < http.StatusBadRequest {
+			if exportRoutes[route] {
+				entry.ExportedRows = entry.ResultCount
+				if entry.ExportedRows == 0 {
+					entry.ExportedRows = 1
+				}
+			} else if list, ok := resp.(*api.ListResult); ok && list.P.PageSize >= services.AuditExportPageSize {
+				entry.ExportedRows = entry.ResultCount
+			}
+		}
+		svc.Record(entry)
+	}
+}
+
+// countResult returns the number of items in the response and the total
+// matched, the users appearing in it are collected into viewed.
+func countResult(resp any, viewed map[string]struct{}) (int, int64) {
+	switch v := resp.(type) {
+	case *api.ListResult:
+		for _, item := range v.List {
+			countResult(item, viewed)
+		}
+		return len(v.List), v.P.Total
+	case *models.User:
+		viewed[v.OID] = struct{}{}
+	case *models.PremiumUser:
+		viewed[v.OID] = struct{}{}
+	case *models.ChurnRisk:
+		viewed[v.OID] = struct{}{}
+	case *models.UserMargin:
+		viewed[v.OID] = struct{}{}
+	case *models.Action:
+		viewed[v.OID] = struct{}{}
+	case map[string]interface{}:
+		// the items of a list decoded from the shared response cache
+		if oid, ok := v["oidc_id"].(string); ok && oid != "" {
+			viewed[oid] = struct{}{}
+		}
+	case *models.DataSubjectExport:
+		viewed[v.OID] = struct{}{}
+		rows := 0
+		for _, docs := range v.Collections {
+			rows += len(docs)
+		}
+		return rows, int64(rows)
+	case *models.DataSubjectRequest:
+		// the erased user is found through the request, the audit logs
+		// mentioning it are pseudonymized by the erasure
+		if v.Type != models.DataSubjectRequestOfErasure {
+			viewed[v.OID] = struct{}{}
+		}
+	case *models.Statement:
+		viewed[v.OID] = struct{}{}
+		rows := len(v.AI.Bills) + len(v.Connect.Bills) + len(v.Payments) + len(v.Credits)
+		return rows, int64(rows)
+	default:
+		// the series and breakdowns returned as plain slices
+		if rv := reflect.ValueOf(resp); rv.Kind() == reflect.Slice {
+			for idx := 0; idx < rv.Len(); idx++ {
+				countResult(rv.Index(idx).Interface(), viewed)
+			}
+			return rv.Len(), int64(rv.Len())
+		}
+	}
+	return 1, 1
+}
@@ -0,0 +1,182 @@
+package router
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jyjiangkai/stat/api"
+	"github.com/jyjiangkai/stat/auth"
+	"github.com/jyjiangkai/stat/constant"
+	"github.com/jyjiangkai/stat/controller"
+	"github.com/jyjiangkai/stat/internal/services"
+	"github.com/jyjiangkai/stat/log"
+	"github.com/jyjiangkai/stat/utils"
+)
+
+const (
+	HeaderOfAuthorization = "Authorization"
+	HeaderOfAPIKey        = "X-API-Key"
+)
+
+var (
+	// routePermissions maps the method and full path of every route to the
+	// permission it requires, a route missing here is for admins only.
+	routePermissions = map[string]auth.Permission{
+		"POST /v1/users":                       auth.PermissionOfUsersRead,
+		"POST /v1/users/count":                 auth.PermissionOfUsersRead,
+		"GET /v1/users/:oid":                   auth.PermissionOfUsersRead,
+		"GET /v1/users/:oid/statements/:month": auth.PermissionOfStatementRead,
+		"POST /v1/actions":                     auth.PermissionOfActionsRead,
+		"GET /v1/actions/:oid":                 auth.PermissionOfActionsRead,
+		"GET /v1/download":                     auth.PermissionOfDownload,
+		"GET /v1/anomalies":                    auth.PermissionOfAnalyticsRead,
+		"GET /v1/growth":                       auth.PermissionOfAnalyticsRead,
+		"GET /v1/activation":                   auth.PermissionOfAnalyticsRead,
+		"GET /v1/plans":                        auth.PermissionOfAnalyticsRead,
+		"GET /v1/plans/matrix":                 auth.PermissionOfAnalyticsRead,
+		"GET /v1/plans/counts":                 auth.PermissionOfAnalyticsRead,
+		"GET /v1/renewals":                     auth.PermissionOfRevenueRead,
+		"GET /v1/renewals/rates":               auth.PermissionOfRevenueRead,
+		"GET /v1/revenue/mrr":                  auth.PermissionOfRevenueRead,
+		"GET /v1/revenue/movements":            auth.PermissionOfRevenueRead,
+		"GET /v1/revenue/retention":            auth.PermissionOfRevenueRead,
+		"GET /v1/margins/users":                auth.PermissionOfRevenueRead,
+		"GET /v1/margins/apps":                 auth.PermissionOfRevenueRead,
+		"GET /v1/margins/plans":                auth.PermissionOfRevenueRead,
+		"GET /v1/alarms":                       auth.PermissionOfAlarmsRead,
+		"GET /v1/alarms/:id":                   auth.PermissionOfAlarmsRead,
+		"POST /v1/alarms/:id/acknowledge":      auth.PermissionOfAlarmsWrite,
+		"POST /v1/alarms/:id/silence":          auth.PermissionOfAlarmsWrite,
+		"GET /v1/keys":                         auth.PermissionOfKeysManage,
+		"POST /v1/keys":                        auth.PermissionOfKeysManage,
+		"DELETE /v1/keys/:id":                  auth.PermissionOfKeysManage,
+	}
+
+	// typePermissions limits the user types a role may select on the routes
+	// listing users, a role missing here may select every type.
+	typePermissions = map[auth.Role][]string{
+		auth.RoleOfMarketing: {
+			"",
+			services.UserTypeOfRegister,
+			services.UserTypeOfLogin,
+			services.UserTypeOfCreated,
+			services.UserTypeOfUsed,
+			services.UserTypeOfRegisterFromShopifyLandingPage,
+			services.UserTypeOfRegisterFromGithubLandingPage,
+			services.UserTypeOfRegisterFromAWSCampaignsPage,
+			services.UserTypeOfConnectionTemplateCreated,
+			services.UserTypeOfNoKnownledgeBase,
+			services.UserTypeOfHighKnownledgeBase,
+			services.UserTypeOfCohort,
+			services.UserTypeOfDailyUserNumber,
+		},
+	}
+	typeSelectorRoutes = map[string]bool{
+		"POST /v1/users":       true,
+		"POST /v1/users/count": true,
+	}
+)
+
+// Authenticate identifies the caller by an API key, given in the X-API-Key
+// header or as a bearer token, or by an OIDC bearer token, and checks it is
+// permitted to call the route.
+func Authenticate(keys *services.APIKeyService) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if !auth.Enabled() {
+			setPrincipal(ctx, auth.Anonymous())
+			ctx.Next()
+			return
+		}
+		principal, err := authenticate(ctx, keys)
+		if err != nil {
+			abort(ctx, err)
+			return
+		}
+		// the principal is set ahead so the denied requests are audited too
+		setPrincipal(ctx, principal)
+		if err = authorize(ctx, principal); err != nil {
+			abort(ctx, err)
+			return
+		}
+		ctx.Next()
+	}
+}
+
+func authenticate(ctx *gin.Context, keys *services.APIKeyService) (*auth.Principal, error) {
+	key := ctx.GetHeader(HeaderOfAPIKey)
+	bearer := ""
+	if val := ctx.GetHeader(HeaderOfAuthorization); val != "" {
+		scheme, token, ok := strings.Cut(val, " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") {
+			return nil, api.ErrUnauthorized.WithMessage("unsupported authorization scheme")
+		}
+		bearer = strings.TrimSpace(token)
+	}
+	if key == "" && strings.HasPrefix(bearer, services.APIKeyPrefix) {
+		key, bearer = bearer, ""
+	}
+
+	switch {
+	case key != "":
+		if bootstrap := auth.BootstrapKey(); bootstrap != "" &&
+			subtle.ConstantTimeCompare([]byte(key), []byte(bootstrap)) == 1 {
+			return &auth.Principal{
+				ID:     "bootstrap",
+				Name:   "bootstrap",
+				Role:   auth.RoleOfAdmin,
+				Method: auth.MethodOfBootstrap,
+			}, nil
+		}
+		principal, err := keys.Authenticate(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if principal == nil {
+			return nil, api.ErrUnauthorized.WithMessage("invalid api key")
+		}
+		return principal, nil
+	case bearer != "":
+		principal, err := auth.VerifyBearer(bearer)
+		if err != nil {
+			log.Info(ctx).Err(err).Msg("failed to verify bearer token")
+			return nil, api.ErrUnauthorized.WithError(err)
+		}
+		return principal, nil
+	}
+	return nil, api.ErrUnauthorized.WithMessage("missing credentials")
+}
+
+func authorize(ctx *gin.Context, principal *auth.Principal) error {
+	route := ctx.Request.Method + " " + ctx.FullPath()
+	if principal.Role == auth.RoleOfAdmin {
+		return nil
+	}
+	permission, ok := routePermissions[route]
+	if !ok {
+		log.Warn(ctx).Str("route", route).Msg("no permission is configured for the route")
+		return api.ErrPermissionDenied.WithMessage("the route is for admins only")
+	}
+	if !principal.Can(permission) {
+		return api.ErrPermissionDenied.WithMessage("role " + string(principal.Role) + " has no permission " + string(permission))
+	}
+	if types, ok := typePermissions[principal.Role]; ok && typeSelectorRoutes[route] {
+		typ, _ := ctx.GetQuery(controller.QueryOfUserType)
+		if !utils.Contains(types, typ) {
+			return api.ErrPermissionDenied.WithMessage("role " + string(principal.Role) + " can't select user type " + typ)
+		}
+	}
+	return nil
+}
+
+func setPrincipal(ctx *gin.Context, principal *auth.Principal) {
+	ctx.Set(constant.ContextPrincipal, principal)
+	ctx.Set(constant.ContextUserID, principal.ID)
+}
+
+func abort(ctx *gin.Context, err error) {
+	log.Info(ctx).Err(err).Str("path", ctx.Request.URL.Path).Msg("request is rejected")
+	api.ResponseWithError(ctx, err)
+	ctx.Abort()
+}
@@ -0,0 +1,172 @@
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jyjiangkai/stat/api"
+	"github.com/jyjiangkai/stat/auth"
+	"github.com/jyjiangkai/stat/cache"
+	"github.com/jyjiangkai/stat/constant"
+	"github.com/jyjiangkai/stat/controller"
+	"github.com/jyjiangkai/stat/internal/services"
+)
+
+const (
+	HeaderOfETag        = "ETag"
+	HeaderOfIfNoneMatch = "If-None-Match"
+	HeaderOfCache       = "X-Cache"
+)
+
+var (
+	// cachedSelectors are the aggregating selectors of the routes whose
+	// responses are cached, their data only changes after the nightly jobs.
+	cachedSelectors = map[string]map[string]bool{
+		"POST /v1/users": {
+			services.UserTypeOfDailyUserNumber: true,
+			services.UserTypeOfCohort:          true,
+		},
+		"POST /v1/actions": {
+			services.ConnectionTemplateCreatedNumber: true,
+			services.DailyActionNumber:               true,
+			services.ActionType:                      true,
+		},
+	}
+)
+
+// Cache serves the aggregating requests from the response cache, the
+// responses are cached after the PII has been shaped, so the role of the
+// caller is a part of the key.
+func Cache() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if !cache.Enabled() || !cacheable(ctx) {
+			ctx.Next()
+			return
+		}
+		key, ok := cacheKey(ctx)
+		if !ok {
+			ctx.Next()
+			return
+		}
+		if entry, ok := cache.Get(ctx, key); ok {
+			ctx.Set(constant.ContextResponse, cachedResponse(entry))
+			ctx.Header(HeaderOfCache, "HIT")
+			writeEntry(ctx, entry)
+			ctx.Abort()
+			return
+		}
+
+		w := &bufferedWriter{ResponseWriter: ctx.Writer}
+		ctx.Writer = w
+		ctx.Next()
+		ctx.Writer = w.ResponseWriter
+		if w.Status() != http.StatusOK {
+			_, _ = ctx.Writer.Write(w.body.Bytes())
+			return
+		}
+		body := w.body.Bytes()
+		entry := &cache.Entry{
+			Key:         key,
+			Body:        body,
+			ContentType: w.Header().Get("Content-Type"),
+			ETag:        cache.ETag(body),
+		}
+		entry.Value, _ = ctx.Get(constant.ContextResponse)
+		cache.Set(ctx, entry)
+		ctx.Header(HeaderOfCache, "MISS")
+		writeEntry(ctx, entry)
+	}
+}
+
+func cacheable(ctx *gin.Context) bool {
+	selectors, ok := cachedSelectors[ctx.Request.Method+" "+ctx.FullPath()]
+	if !ok {
+		return false
+	}
+	typ, _ := ctx.GetQuery(controller.QueryOfUserType)
+	return selectors[typ]
+}
+
+// cacheKey normalizes the request into a key, the query is encoded sorted by
+// key and the body is re-encoded so neither the order nor the spacing of its
+// fields matter.
+func cacheKey(ctx *gin.Context) (string, bool) {
+	role := ""
+	if principal := auth.GetPrincipal(ctx); principal != nil {
+		role = string(principal.Role)
+	}
+	body := ""
+	if ctx.Request.Body != nil {
+		data, err := io.ReadAll(ctx.Request.Body)
+		if err != nil {
+			return "", false
+		}
+		ctx.Request.Body = io.NopCloser(bytes.NewReader(data))
+		if len(bytes.TrimSpace(data)) > 0 {
+			var v any
+			if err = json.Unmarshal(data, &v); err != nil {
+				return "", false
+			}
+			normalized, err := json.Marshal(v)
+			if err != nil {
+				return "", false
+			}
+			body = string(normalized)
+		}
+	}
+	return cache.Key(role, ctx.Request.Method, ctx.FullPath(), ctx.Request.URL.Query().Encode(), body), true
+}
+
+// cachedResponse returns the response of the entry for the audit, the
+// entries of the shared cache only keep the body, which is decoded as a list.
+func cachedResponse(entry *cache.Entry) any {
+	if entry.Value != nil {
+		return entry.Value
+	}
+	result := &api.ListResult{}
+	if err := json.Unmarshal(entry.Body, result); err != nil {
+		return nil
+	}
+	return result
+}
+
+func writeEntry(ctx *gin.Context, entry *cache.Entry) {
+	ctx.Header(HeaderOfETag, entry.ETag)
+	ctx.Header("Cache-Control", "private, no-cache")
+	if matchETag(ctx.GetHeader(HeaderOfIfNoneMatch), entry.ETag) {
+		ctx.Status(http.StatusNotModified)
+		ctx.Writer.WriteHeaderNow()
+		return
+	}
+	ctx.Data(http.StatusOK, entry.ContentType, entry.Body)
+}
+
+func matchETag(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// bufferedWriter holds the body back so the entity tag can be set before it
+// is written.
+type bufferedWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *bufferedWriter) Write(data []byte) (int, error) {
+	return w.body.Write(data)
+}
+
+func (w *bufferedWriter) WriteString(s string) (int, error) {
+	return w.body.WriteString(s)
+}
@@ -0,0 +1,183 @@
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jyjiangkai/stat/api"
+	"github.com/jyjiangkai/stat/auth"
+	"github.com/jyjiangkai/stat/controller"
+	"github.com/jyjiangkai/stat/internal/services"
+	"github.com/jyjiangkai/stat/log"
+	"github.com/jyjiangkai/stat/ratelimit"
+	"github.com/jyjiangkai/stat/timezone"
+)
+
+const (
+	HeaderOfRetryAfter           = "Retry-After"
+	HeaderOfRateLimitLimit       = "X-RateLimit-Limit"
+	HeaderOfRateLimitRemaining   = "X-RateLimit-Remaining"
+	HeaderOfRateLimitCost        = "X-RateLimit-Cost"
+	HeaderOfRateLimitBudget      = "X-RateLimit-Budget-Remaining"
+	HeaderOfRateLimitBudgetReset = "X-RateLimit-Budget-Reset"
+
+	// daysOfMonth is the range length a cost unit of range covers
+	daysOfMonth = 30
+)
+
+var (
+	// routeCosts is the base cost of the routes that are heavier than a
+	// plain listing, a route missing here costs 1.
+	routeCosts = map[string]float64{
+		"GET /v1/users/:oid/statements/:month": 5,
+		"GET /v1/download":                     5,
+		"GET /v1/plans/matrix":                 2,
+		"GET /v1/renewals/rates":               2,
+		"GET /v1/revenue/mrr":                  3,
+		"GET /v1/revenue/movements":            3,
+		"GET /v1/revenue/retention":            5,
+		"GET /v1/activation":                   3,
+		"GET /v1/margins/users":                5,
+		"GET /v1/margins/apps":                 5,
+		"GET /v1/margins/plans":                5,
+		"POST /v1/gdpr/exports":                10,
+		"POST /v1/gdpr/erasures":               10,
+		"POST /v1/reconciliations":             10,
+	}
+
+	// selectorCosts weights the user and action type selectors, which
+	// aggregate over the whole range instead of reading a page of it.
+	selectorCosts = map[string]float64{
+		services.UserTypeOfCohort:                    4,
+		services.UserTypeOfDailyUserNumber:           4,
+		services.UserTypeOfConnectionTemplateCreated: 2,
+		services.UserTypeOfChurnRisk:                 2,
+		services.ConnectionTemplateCreatedNumber:     5,
+		services.DailyActionNumber:                   5,
+		services.ActionType:                          3,
+	}
+)
+
+// RateLimit charges the estimated cost of every request to the token bucket
+// and the query budget of the caller, and rejects it with 429 when either is
+// exhausted.
+func RateLimit() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if !ratelimit.Enabled() {
+			ctx.Next()
+			return
+		}
+		principal := auth.GetPrincipal(ctx)
+		if principal == nil {
+			ctx.Next()
+			return
+		}
+		key := principal.ID
+		if principal.Method == auth.MethodOfNone {
+			// the callers aren't identified without authentication
+			key = "ip:" + ctx.ClientIP()
+		}
+		cost := estimateCost(ctx)
+		limit := ratelimit.LimitOf(principal)
+		decision := ratelimit.Take(key, limit, cost, time.Now())
+		ctx.Header(HeaderOfRateLimitLimit, formatUnits(limit.Burst))
+		ctx.Header(HeaderOfRateLimitRemaining, formatUnits(decision.Remaining))
+		ctx.Header(HeaderOfRateLimitCost, formatUnits(cost))
+		ctx.Header(HeaderOfRateLimitBudget, formatUnits(decision.BudgetRemaining))
+		ctx.Header(HeaderOfRateLimitBudgetReset, strconv.FormatInt(decision.BudgetReset.Unix(), 10))
+		if !decision.Allowed {
+			retryAfter := int64(math.Ceil(decision.RetryAfter.Seconds()))
+			if retryAfter < 1 {
+				retryAfter = 1
+			}
+			ctx.Header(HeaderOfRetryAfter, strconv.FormatInt(retryAfter, 10))
+			log.Info(ctx).Str("principal", principal.ID).Float64("cost", cost).
+				Int64("retry_after", retryAfter).Msg("request exceeds the rate limit")
+			abort(ctx, api.ErrTooManyRequests.WithMessage(decision.Reason+", retry after "+strconv.FormatInt(retryAfter, 10)+"s"))
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// estimateCost weights the base cost of the route by the selector and by the
+// number of months the request ranges over.
+func estimateCost(ctx *gin.Context) float64 {
+	cost, ok := routeCosts[ctx.Request.Method+" "+ctx.FullPath()]
+	if !ok {
+		cost = 1
+	}
+	days := requestDays(ctx)
+	if typ, ok := ctx.GetQuery(controller.QueryOfUserType); ok {
+		if weight, ok := selectorCosts[typ]; ok {
+			cost *= weight
+			if days == 0 {
+				// the aggregations without a range run over the whole history
+				days = time.Since(services.StartAt).Hours() / 24
+			}
+		}
+	}
+	if days > daysOfMonth {
+		cost *= days / daysOfMonth
+	}
+	return math.Ceil(cost)
+}
+
+// requestDays returns the length of the range of the request in days, it is
+// given either as a range of the body, by the range query or by the start
+// and end queries, 0 means no range or the whole history is given.
+func requestDays(ctx *gin.Context) float64 {
+	now := time.Now().In(timezone.Of(ctx))
+	if days := bodyRangeDays(ctx, now); days > 0 {
+		return days
+	}
+	start, _ := ctx.GetQuery(controller.QueryOfStart)
+	end, _ := ctx.GetQuery(controller.QueryOfEnd)
+	if start != "" || end != "" {
+		interval, err := api.Range{Start: start, End: end}.Parse(now)
+		if err != nil || interval.Start.IsZero() {
+			return 0
+		}
+		return interval.Duration().Hours() / 24
+	}
+	rg, ok := ctx.GetQuery("range")
+	if !ok {
+		return 0
+	}
+	interval, err := api.ParseRange(rg, now)
+	if err != nil || interval.Start.IsZero() {
+		return 0
+	}
+	return interval.Duration().Hours() / 24
+}
+
+func bodyRangeDays(ctx *gin.Context, now time.Time) float64 {
+	if ctx.Request.Body == nil || ctx.Request.Method == http.MethodGet {
+		return 0
+	}
+	body, err := io.ReadAll(ctx.Request.Body)
+	if err != nil {
+		return 0
+	}
+	ctx.Request.Body = io.NopCloser(bytes.NewReader(body))
+	req := api.NewRequest()
+	if err = json.Unmarshal(body, &req); err != nil {
+		return 0
+	}
+	interval, err := req.Range.Parse(now)
+	if err != nil {
+		return 0
+	}
+	return interval.Duration().Hours() / 24
+}
+
+func formatUnits(v float64) string {
+	return strconv.FormatFloat(v, 'f', 0, 64)
+}
@@ -7,16 +7,20 @@ import (
 	"github.com/gin-gonic/gin"
 
 	"github.com/jyjiangkai/stat/api"
+	"github.com/jyjiangkai/stat/constant"
 	"github.com/jyjiangkai/stat/controller"
 	"github.com/jyjiangkai/stat/log"
+	"github.com/jyjiangkai/stat/privacy"
 )
 
 func RegisterUsersRouter(group *gin.RouterGroup,
 	ctrl *controller.UserController) {
 	wrapRouterGroup(group, http.MethodPost, "", ctrl.List)
+	wrapRouterGroup(group, http.MethodPost, "/count", ctrl.Count)
 
 	pathID := fmt.Sprintf("/:%s", controller.ParamOfUserOID)
 	wrapRouterGroup(group, http.MethodGet, pathID, ctrl.Get)
+	group.GET(fmt.Sprintf("%s/statements/:%s", pathID, controller.ParamOfMonth), ctrl.Statement)
 }
 
 func RegisterActionsRouter(group *gin.RouterGroup,
@@ -27,6 +31,85 @@ func RegisterActionsRouter(group *gin.RouterGroup,
 	wrapRouterGroup(group, http.MethodGet, pathID, ctrl.Get)
 }
 
+func RegisterAnomaliesRouter(group *gin.RouterGroup,
+	ctrl *controller.AnomalyController) {
+	wrapRouterGroup(group, http.MethodGet, "", ctrl.List)
+}
+
+func RegisterAlarmsRouter(group *gin.RouterGroup,
+	ctrl *controller.AlarmController) {
+	wrapRouterGroup(group, http.MethodGet, "", ctrl.List)
+
+	pathID := fmt.Sprintf("/:%s", controller.ParamOfAlarmID)
+	wrapRouterGroup(group, http.MethodGet, pathID, ctrl.Get)
+	wrapRouterGroup(group, http.MethodPost, pathID+"/acknowledge", ctrl.Acknowledge)
+	wrapRouterGroup(group, http.MethodPost, pathID+"/silence", ctrl.Silence)
+}
+
+func RegisterRenewalsRouter(group *gin.RouterGroup,
+	ctrl *controller.RenewalController) {
+	wrapRouterGroup(group, http.MethodGet, "", ctrl.List)
+	wrapRouterGroup(group, http.MethodGet, "/rates", ctrl.Rates)
+}
+
+func RegisterRevenueRouter(group *gin.RouterGroup,
+	ctrl *controller.RevenueController) {
+	wrapRouterGroup(group, http.MethodGet, "/mrr", ctrl.MRR)
+	wrapRouterGroup(group, http.MethodGet, "/movements", ctrl.Movements)
+	wrapRouterGroup(group, http.MethodGet, "/retention", ctrl.Retention)
+}
+
+func RegisterMarginsRouter(group *gin.RouterGroup,
+	ctrl *controller.MarginController) {
+	wrapRouterGroup(group, http.MethodGet, "/users", ctrl.Users)
+	wrapRouterGroup(group, http.MethodGet, "/apps", ctrl.Apps)
+	wrapRouterGroup(group, http.MethodGet, "/plans", ctrl.Plans)
+}
+
+func RegisterPlansRouter(group *gin.RouterGroup,
+	ctrl *controller.PlanController) {
+	wrapRouterGroup(group, http.MethodGet, "", ctrl.List)
+	wrapRouterGroup(group, http.MethodGet, "/matrix", ctrl.Matrix)
+	wrapRouterGroup(group, http.MethodGet, "/counts", ctrl.Counts)
+}
+
+func RegisterKeysRouter(group *gin.RouterGroup,
+	ctrl *controller.APIKeyController) {
+	wrapRouterGroup(group, http.MethodGet, "", ctrl.List)
+	wrapRouterGroup(group, http.MethodPost, "", ctrl.Create)
+	wrapRouterGroup(group, http.MethodDelete, "/:"+controller.ParamOfAPIKeyID, ctrl.Revoke)
+}
+
+func RegisterAuditRouter(group *gin.RouterGroup,
+	ctrl *controller.AuditController) {
+	wrapRouterGroup(group, http.MethodGet, "", ctrl.List)
+}
+
+func RegisterGDPRRouter(group *gin.RouterGroup,
+	ctrl *controller.GDPRController) {
+	wrapRouterGroup(group, http.MethodPost, "/exports", ctrl.Export)
+	wrapRouterGroup(group, http.MethodPost, "/erasures", ctrl.Erase)
+	wrapRouterGroup(group, http.MethodGet, "/requests", ctrl.List)
+	wrapRouterGroup(group, http.MethodGet, "/requests/:"+controller.ParamOfRequestID, ctrl.Get)
+}
+
+func RegisterReconciliationsRouter(group *gin.RouterGroup,
+	ctrl *controller.ReconciliationController) {
+	wrapRouterGroup(group, http.MethodPost, "", ctrl.Run)
+	wrapRouterGroup(group, http.MethodGet, "", ctrl.List)
+	wrapRouterGroup(group, http.MethodGet, "/:"+controller.ParamOfReportID, ctrl.Get)
+}
+
+func RegisterGrowthRouter(group *gin.RouterGroup,
+	ctrl *controller.GrowthController) {
+	wrapRouterGroup(group, http.MethodGet, "", ctrl.List)
+}
+
+func RegisterActivationRouter(group *gin.RouterGroup,
+	ctrl *controller.ActivationController) {
+	wrapRouterGroup(group, http.MethodGet, "", ctrl.Report)
+}
+
 func RegisterDownloadRouter(group *gin.RouterGroup,
 	ctrl *controller.DownloadController) {
 	group.GET("", ctrl.Get)
@@ -42,6 +125,8 @@ func wrapHandlerFunc(f HandlerFunc) gin.HandlerFunc {
 			api.ResponseWithError(ctx, err)
 			return
 		}
+		privacy.Apply(ctx, resp)
+		ctx.Set(constant.ContextResponse, resp)
 		api.ResponseWithSuccess(ctx, resp)
 	}
 }
@@ -0,0 +1,32 @@
+package router
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"github.com/jyjiangkai/stat/api"
+	"github.com/jyjiangkai/stat/constant"
+	"github.com/jyjiangkai/stat/timezone"
+)
+
+const (
+	QueryOfTimezone = "tz"
+)
+
+// Timezone makes the services bucket the days and weeks of the request in
+// the timezone of the tz query, such as tz=Asia/Shanghai.
+func Timezone() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		name, ok := ctx.GetQuery(QueryOfTimezone)
+		if !ok {
+			ctx.Next()
+			return
+		}
+		loc, err := timezone.Parse(name)
+		if err != nil {
+			abort(ctx, api.ErrInvalidParameter.WithError(err))
+			return
+		}
+		ctx.Set(constant.ContextTimezone, loc)
+		ctx.Next()
+	}
+}
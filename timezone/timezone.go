@@ -0,0 +1,85 @@
+package timezone
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/jyjiangkai/stat/constant"
+	"github.com/jyjiangkai/stat/log"
+)
+
+const (
+	DefaultReporting = "UTC"
+)
+
+var (
+	cfg       Config
+	reporting = time.UTC
+	once      sync.Once
+)
+
+type Config struct {
+	// Reporting is the IANA name of the timezone the days and weeks are
+	// bucketed in, such as Asia/Shanghai, when the request does not ask for
+	// a specific one
+	Reporting string `yaml:"reporting"`
+}
+
+func Init(ctx context.Context, c Config) error {
+	var err error
+	once.Do(func() {
+		cfg = c
+		if cfg.Reporting == "" {
+			cfg.Reporting = DefaultReporting
+		}
+		var loc *time.Location
+		loc, err = Parse(cfg.Reporting)
+		if err != nil {
+			return
+		}
+		reporting = loc
+		log.Info(ctx).Str("reporting", reporting.String()).Msg("timezone initialized")
+	})
+	return err
+}
+
+// Reporting returns the timezone the precomputed stats are bucketed in.
+func Reporting() *time.Location {
+	return reporting
+}
+
+// Parse loads the timezone of an IANA name, UTC is accepted in any case.
+func Parse(name string) (*time.Location, error) {
+	name = strings.TrimSpace(name)
+	if strings.EqualFold(name, "UTC") || name == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown timezone %s", name)
+	}
+	return loc, nil
+}
+
+// Of returns the timezone asked for by the request of ctx, or the reporting
+// timezone when there is none.
+func Of(ctx context.Context) *time.Location {
+	if loc, ok := ctx.Value(constant.ContextTimezone).(*time.Location); ok && loc != nil {
+		return loc
+	}
+	return reporting
+}
+
+// Query returns the filter of the timezone field of the stats precomputed in
+// loc, the ones stored before the field was added were computed in UTC.
+func Query(loc *time.Location) interface{} {
+	if loc == time.UTC {
+		return bson.M{"$in": bson.A{time.UTC.String(), nil}}
+	}
+	return loc.String()
+}
@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"sort"
+	"time"
+)
+
+// DatedValue is a value effective since a date until the next one.
+type DatedValue struct {
+	Since time.Time
+	Value float64
+}
+
+// DatedValues is a table of values ordered by the dates they are effective
+// since, such as exchange rates and unit prices.
+type DatedValues []DatedValue
+
+// Set returns the table with the value effective since the date, a value of
+// the same date is replaced.
+func (dvs DatedValues) Set(since time.Time, value float64) DatedValues {
+	for idx := range dvs {
+		if dvs[idx].Since.Equal(since) {
+			dvs[idx].Value = value
+			return dvs
+		}
+	}
+	dvs = append(dvs, DatedValue{Since: since, Value: value})
+	sort.Slice(dvs, func(i, j int) bool {
+		return dvs[i].Since.Before(dvs[j].Since)
+	})
+	return dvs
+}
+
+// Has reports whether there is a value effective since the date.
+func (dvs DatedValues) Has(since time.Time) bool {
+	for _, dv := range dvs {
+		if dv.Since.Equal(since) {
+			return true
+		}
+	}
+	return false
+}
+
+// At returns the value effective at the given time, the earliest value is
+// used for the time before it. It's false when the table is empty.
+func (dvs DatedValues) At(at time.Time) (float64, bool) {
+	if len(dvs) == 0 {
+		return 0, false
+	}
+	idx := sort.Search(len(dvs), func(i int) bool {
+		return dvs[i].Since.After(at)
+	})
+	if idx == 0 {
+		return dvs[0].Value, true
+	}
+	return dvs[idx-1].Value, true
+}
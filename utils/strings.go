@@ -20,3 +20,12 @@ func RandomString(l int) string {
 	}
 	return string(str)
 }
+
+func Contains[T comparable](list []T, v T) bool {
+	for _, item := range list {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
@@ -38,6 +38,8 @@ func ToBillTimeForConnect(t time.Time) time.Time {
 	return t.Add(-24 * time.Hour)
 }
 
-func ToBillTimeForAI(t time.Time) time.Time {
-	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+// ToBillTimeForAI returns the beginning of the day of t in loc.
+func ToBillTimeForAI(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
 }